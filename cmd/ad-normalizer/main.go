@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"syscall"
 	"time"
@@ -16,13 +17,16 @@ import (
 	httppprof "net/http/pprof"
 
 	"github.com/Eyevinn/ad-normalizer/cmd/ad-normalizer/telemetry"
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
 	"github.com/Eyevinn/ad-normalizer/internal/config"
 	"github.com/Eyevinn/ad-normalizer/internal/encore"
+	"github.com/Eyevinn/ad-normalizer/internal/ffmpeg"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
 	"github.com/Eyevinn/ad-normalizer/internal/osaas"
 	"github.com/Eyevinn/ad-normalizer/internal/serve"
 	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	osaasclient "github.com/EyevinnOSC/client-go"
 	"github.com/joho/godotenv"
 	"github.com/klauspost/compress/gzhttp"
@@ -62,25 +66,55 @@ func main() {
 		logger.Error("Failed to read configuration", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
-	api, err := setupApi(&config, reportKpi)
+	api, err := setupApi(ctx, &config, reportKpi)
+	if err != nil {
+		logger.Error("Failed to set up API", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if config.ReaperInterval > 0 {
+		go api.RunStaleJobReaper(ctx, time.Duration(config.ReaperInterval)*time.Second, config.InstanceID)
+	}
+	if config.ReconcileInterval > 0 {
+		go api.RunReconciler(ctx, time.Duration(config.ReconcileInterval)*time.Second, config.ReconcileRate, config.InstanceID)
+	}
+	if config.BlacklistSweepInterval > 0 {
+		go api.RunBlacklistSweep(ctx, time.Duration(config.BlacklistSweepInterval)*time.Second)
+	}
 
 	apiMux := http.NewServeMux()
 	apiMux.HandleFunc("/vmap", api.HandleVmap)
 	apiMux.HandleFunc("/vast", api.HandleVast)
 	apiMux.HandleFunc("/blacklist", api.HandleBlackList)
+	apiMux.HandleFunc("POST /blacklist/import", api.HandleBlackListImport)
+	apiMux.HandleFunc("GET /blacklist/export", api.HandleBlackListExport)
 	apiMux.HandleFunc("/jobs", api.HandleJobList)
+	apiMux.HandleFunc("GET /jobs/{creativeId}", api.HandleGetJob)
+	apiMux.HandleFunc("DELETE /jobs/{creativeId}", api.HandleDeleteJob)
+	apiMux.HandleFunc("POST /jobs/{creativeId}/retry", api.HandleRetryJob)
 	apiMux.HandleFunc("/preingest", api.HandlePreIngestCreatives)
+	apiMux.HandleFunc("/audit", api.HandleAudit)
 
 	packagerMux := http.NewServeMux()
 	packagerMux.HandleFunc("/success", api.HandlePackagingSuccess)
 	packagerMux.HandleFunc("/failure", api.HandlePackagingFailure)
 
-	apiMuxChain := setupMiddleWare(apiMux, "api", otelEnabled)
-	packagerMuxChain := setupMiddleWare(packagerMux, "packager", otelEnabled)
+	cors := corsMiddleware(config.CorsAllowedOrigins)
+	var authenticator *auth.Authenticator
+	if len(config.ApiKeys) > 0 {
+		authenticator = auth.NewAuthenticator(config.ApiKeys, serve.RequiredRole)
+	}
+	apiMuxChain := setupMiddleWare(apiMux, "api", otelEnabled, cors, authenticator)
+	// Callbacks are authenticated with their own tokens, see CALLBACK_SECRET
+	packagerMuxChain := setupMiddleWare(packagerMux, "packager", otelEnabled, cors, nil)
 	mainmux := http.NewServeMux()
 
 	mainmux.HandleFunc("/encoreCallback", api.HandleEncoreCallback)
 	mainmux.HandleFunc("/ping", healthCheck)
+	if config.FfmpegOutputDir != "" {
+		// The playlists written by the ffmpeg transcoder, public like the ads
+		assets := http.StripPrefix("/assets", http.FileServer(ffmpeg.OutputFileSystem(config.FfmpegOutputDir)))
+		mainmux.Handle("/assets/", corsMiddleware(nil)(assets))
+	}
 	mainmux.Handle("/api/v1/", http.StripPrefix("/api/v1", apiMuxChain))
 	mainmux.Handle("/packagerCallback/", http.StripPrefix("/packagerCallback", packagerMuxChain))
 
@@ -143,16 +177,38 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("pong"))
 }
 
-func corsMiddleware(next http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			origin = "*"
+// Allows browsers to call the API from the allowed origins, or from any
+// origin if no origins are configured. Answers preflight requests directly,
+// since they carry no API key.
+func corsMiddleware(allowedOrigins []string) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowed := true
+			if allowedOrigins == nil {
+				w.Header().Add("Access-Control-Allow-Origin", "*")
+			} else if origin != "" && slices.Contains(allowedOrigins, origin) {
+				w.Header().Add("Access-Control-Allow-Credentials", "true")
+				w.Header().Add("Access-Control-Allow-Origin", origin)
+			} else {
+				allowed = false
+			}
+			if allowedOrigins != nil {
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowed {
+				w.Header().Add("Access-Control-Expose-Headers", "Set-Cookie")
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				if allowed {
+					w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+					w.Header().Add("Access-Control-Allow-Headers", "Authorization, Content-Type, "+auth.API_KEY_HEADER)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
 		}
-		w.Header().Add("Access-Control-Allow-Credentials", "true")
-		w.Header().Add("Access-Control-Expose-Headers", "Set-Cookie")
-		w.Header().Add("Access-Control-Allow-Origin", origin)
-		next.ServeHTTP(w, r)
 	}
 }
 
@@ -172,17 +228,29 @@ func recovery(next http.Handler) http.HandlerFunc {
 	}
 }
 
-func setupMiddleWare(mainHandler http.Handler, name string, otelEnabled bool) http.Handler {
+// Wraps the handler in the common middleware. Requests are authenticated
+// if an authenticator is given.
+func setupMiddleWare(
+	mainHandler http.Handler,
+	name string,
+	otelEnabled bool,
+	cors func(http.Handler) http.HandlerFunc,
+	authenticator *auth.Authenticator,
+) http.Handler {
 	compressorMiddleware, err := gzhttp.NewWrapper(gzhttp.MinSize(2000), gzhttp.CompressionLevel(gzip.BestSpeed))
 	if err != nil {
 		panic(err)
 	}
 
-	handlerChain := recovery(corsMiddleware(compressorMiddleware(mainHandler)))
+	handler := compressorMiddleware(mainHandler)
+	if authenticator != nil {
+		handler = authenticator.Middleware(handler)
+	}
+	handlerChain := recovery(cors(handler))
 
 	if otelEnabled {
 		otelMiddleware := otelhttp.NewMiddleware(name, otelhttp.WithPropagators(otel.GetTextMapPropagator()))
-		handlerChain = recovery(otelMiddleware(corsMiddleware(compressorMiddleware(mainHandler))))
+		handlerChain = recovery(otelMiddleware(cors(handler)))
 	}
 
 	return handlerChain
@@ -203,11 +271,16 @@ func setupKpiReporting(config *config.AdNormalizerConfig) (func(normalizerMetric
 }
 
 func setupApi(
+	ctx context.Context,
 	config *config.AdNormalizerConfig,
 	kpiReportFunc func(normalizerMetrics.AdsHandledEventArguments),
 ) (*serve.API, error) {
 
-	valkeyStore, err := store.NewValkeyStore(config.ValkeyUrl)
+	apiStore, err := setupStore(config)
+	if err != nil {
+		logger.Error("Failed to create store", slog.String("error", err.Error()))
+		return nil, err
+	}
 	var oscCtx *osaasclient.Context
 	if config.OscToken != "" {
 		oscCtx, err = osaas.SetupOsc(config)
@@ -217,20 +290,66 @@ func setupApi(
 		}
 	}
 	client := &http.Client{}
+	jobTranscoder := setupTranscoder(ctx, config, oscCtx)
+	if config.StoreCacheSize > 0 {
+		cachedStore := store.NewCachedStore(apiStore, config.StoreCacheSize, time.Duration(config.StoreCacheTtl)*time.Second)
+		go cachedStore.ListenForInvalidations(ctx)
+		apiStore = cachedStore
+	}
+	api := serve.NewAPI(apiStore, *config, jobTranscoder, client, kpiReportFunc)
+	return api, nil
+}
+
+func setupTranscoder(
+	ctx context.Context,
+	conf *config.AdNormalizerConfig,
+	oscCtx *osaasclient.Context,
+) transcoder.Transcoder {
+	if conf.Transcoder == config.TRANSCODER_FFMPEG {
+		logger.Info("Transcoding with the local ffmpeg", slog.String("outputDir", conf.FfmpegOutputDir))
+		return ffmpeg.NewTranscoder(
+			conf.FfmpegPath,
+			conf.FfprobePath,
+			conf.FfmpegOutputDir,
+			conf.FfmpegOutputUrl,
+			conf.FfmpegConcurrency,
+		)
+	}
 	encoreHandler := encore.NewHttpEncoreHandler(
 		http.DefaultClient,
-		config.EncoreUrl,
-		config.EncoreProfile,
+		conf.EncoreUrls,
+		conf.EncoreBalancing,
+		conf.EncoreProfile,
 		oscCtx,
-		config.BucketUrl,
-		config.RootUrl,
+		conf.BucketUrl,
+		conf.RootUrl,
+		encore.RetryPolicy{
+			MaxRetries: conf.EncoreMaxRetries,
+			Backoff:    time.Duration(conf.EncoreRetryBackoff) * time.Millisecond,
+		},
+		serve.NewCallbackSigner(*conf),
 	)
+	if conf.EncoreHealthCheck > 0 {
+		go encoreHandler.RunHealthChecks(ctx, time.Duration(conf.EncoreHealthCheck)*time.Second)
+	}
+	return encoreHandler
+}
 
+func setupStore(config *config.AdNormalizerConfig) (store.Store, error) {
+	if config.ValkeyUrl == store.MEMORY_URL {
+		logger.Warn("Using in-memory store, jobs are not shared between instances or kept across restarts")
+		return store.NewMemoryStore(), nil
+	}
+	valkeyStore, err := store.NewValkeyStore(config.ValkeyUrl, config.ValkeyCluster)
 	if err != nil {
-		logger.Error("Failed to create Valkey store", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err = valkeyStore.CheckKeyLayout(); err != nil {
+		return nil, err
+	}
+	if err = valkeyStore.BuildKeyIndex(); err != nil {
 		return nil, err
 	}
 	logger.Debug("Valkey store created successfully")
-	api := serve.NewAPI(valkeyStore, *config, encoreHandler, client, kpiReportFunc)
-	return api, nil
+	return valkeyStore, nil
 }
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+// Header the API key can be sent in, as an alternative to a bearer token
+const API_KEY_HEADER = "X-API-Key"
+
+// Role decides what an API key may do. Each role includes
+// everything the roles before it may do.
+type Role int
+
+const (
+	// Endpoints that need no API key
+	RolePublic Role = iota
+	RoleReadOnly
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RolePublic:   "public",
+	RoleReadOnly: "read-only",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RolePublic && strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return RolePublic, fmt.Errorf("unknown role %q", name)
+}
+
+// APIKey is a key along with the name of its holder and its role.
+type APIKey struct {
+	Name string
+	Role Role
+	Key  string
+}
+
+// ParseAPIKey parses a key given as name:role:key.
+func ParseAPIKey(entry string) (APIKey, error) {
+	parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return APIKey{}, errors.New("API keys must be given as name:role:key")
+	}
+	role, err := ParseRole(parts[1])
+	if err != nil {
+		return APIKey{}, fmt.Errorf("invalid API key %s: %w", parts[0], err)
+	}
+	return APIKey{Name: parts[0], Role: role, Key: parts[2]}, nil
+}
+
+// ReadAPIKeys parses one key per line. Empty lines and lines
+// starting with # are skipped.
+func ReadAPIKeys(r io.Reader) ([]APIKey, error) {
+	keys := []APIKey{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParseAPIKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// Principal is the holder of the API key a request was made with.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+type principalKey struct{}
+
+// FromContext returns who made the request, if it was made with an API key.
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, found := ctx.Value(principalKey{}).(Principal)
+	return principal, found
+}
+
+// Authenticator checks the API key of each request against the role the
+// request requires.
+type Authenticator struct {
+	// Keyed by the SHA-256 of the key, so that keys are not kept in memory
+	// and are not compared byte by byte
+	keys         map[[sha256.Size]byte]Principal
+	requiredRole func(*http.Request) Role
+}
+
+func NewAuthenticator(keys []APIKey, requiredRole func(*http.Request) Role) *Authenticator {
+	a := &Authenticator{
+		keys:         make(map[[sha256.Size]byte]Principal, len(keys)),
+		requiredRole: requiredRole,
+	}
+	for _, key := range keys {
+		a.keys[sha256.Sum256([]byte(key.Key))] = Principal{Name: key.Name, Role: key.Role}
+	}
+	return a
+}
+
+func (a *Authenticator) Middleware(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		required := a.requiredRole(r)
+		if required == RolePublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := requestKey(r)
+		if key == "" {
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+		principal, found := a.keys[sha256.Sum256([]byte(key))]
+		if !found {
+			logger.Warn("request with unknown API key rejected", slog.String("path", r.URL.Path))
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if principal.Role < required {
+			logger.Warn("request with insufficient role rejected",
+				slog.String("path", r.URL.Path),
+				slog.String("method", r.Method),
+				slog.String("key", principal.Name),
+				slog.String("role", principal.Role.String()),
+				slog.String("requiredRole", required.String()),
+			)
+			http.Error(w, "API key does not have the "+required.String()+" role", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
+
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(API_KEY_HEADER); key != "" {
+		return key
+	}
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseAPIKey(t *testing.T) {
+	is := is.New(t)
+	key, err := ParseAPIKey(" ops:Operator:s3cr3t:with:colons ")
+	is.NoErr(err)
+	is.Equal(key, APIKey{Name: "ops", Role: RoleOperator, Key: "s3cr3t:with:colons"})
+
+	for _, invalid := range []string{"", "ops:admin", "ops:admin:", ":admin:key", "ops:root:key", "ops:public:key"} {
+		_, err = ParseAPIKey(invalid)
+		is.True(err != nil) // invalid key accepted
+	}
+}
+
+func TestReadAPIKeys(t *testing.T) {
+	is := is.New(t)
+	keys, err := ReadAPIKeys(strings.NewReader("# API keys\n\ndashboard:read-only:key1\nadmin:admin:key2\n"))
+	is.NoErr(err)
+	is.Equal(len(keys), 2)
+	is.Equal(keys[1].Role, RoleAdmin)
+
+	_, err = ReadAPIKeys(strings.NewReader("dashboard:read-only:key1\nbroken\n"))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "line 2:"))
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := []APIKey{
+		{Name: "dashboard", Role: RoleReadOnly, Key: "read-key"},
+		{Name: "ops", Role: RoleOperator, Key: "operator-key"},
+	}
+	requiredRole := func(r *http.Request) Role {
+		switch r.URL.Path {
+		case "/public":
+			return RolePublic
+		case "/read":
+			return RoleReadOnly
+		default:
+			return RoleOperator
+		}
+	}
+	cases := []struct {
+		name              string
+		path              string
+		headers           map[string]string
+		expectedCode      int
+		expectedPrincipal string
+	}{
+		{name: "public", path: "/public", expectedCode: http.StatusOK},
+		{name: "missing key", path: "/read", expectedCode: http.StatusUnauthorized},
+		{name: "unknown key", path: "/read", headers: map[string]string{API_KEY_HEADER: "guess"}, expectedCode: http.StatusUnauthorized},
+		{name: "key header", path: "/read", headers: map[string]string{API_KEY_HEADER: "read-key"}, expectedCode: http.StatusOK, expectedPrincipal: "dashboard"},
+		{name: "bearer token", path: "/read", headers: map[string]string{"Authorization": "Bearer operator-key"}, expectedCode: http.StatusOK, expectedPrincipal: "ops"},
+		{name: "insufficient role", path: "/write", headers: map[string]string{API_KEY_HEADER: "read-key"}, expectedCode: http.StatusForbidden},
+		{name: "higher role", path: "/write", headers: map[string]string{API_KEY_HEADER: "operator-key"}, expectedCode: http.StatusOK, expectedPrincipal: "ops"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			principalName := ""
+			handler := NewAuthenticator(keys, requiredRole).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, _ := FromContext(r.Context())
+				principalName = principal.Name
+			}))
+			req := httptest.NewRequest(http.MethodGet, c.path, nil)
+			for name, value := range c.headers {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			is.Equal(rr.Code, c.expectedCode)
+			is.Equal(principalName, c.expectedPrincipal)
+		})
+	}
+}
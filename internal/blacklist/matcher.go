@@ -0,0 +1,155 @@
+package blacklist
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Matcher checks creatives against a set of blacklist rules. Hosts and
+// creative keys are map lookups, and all glob and regex rules are combined
+// into a single regular expression, so that the common case of a creative
+// not matching any rule stays cheap however many rules there are.
+type Matcher struct {
+	hosts        map[string]structure.BlacklistRule
+	creativeKeys map[string]structure.BlacklistRule
+	prefixes     []structure.BlacklistRule
+	patterns     []compiledPattern
+	// Matches if any of the patterns matches
+	combined *regexp.Regexp
+}
+
+type compiledPattern struct {
+	rule   structure.BlacklistRule
+	regexp *regexp.Regexp
+}
+
+// Validate checks that the rule can be compiled.
+func Validate(rule structure.BlacklistRule) error {
+	_, err := Compile([]structure.BlacklistRule{rule})
+	return err
+}
+
+// Compile builds a matcher for the rules. Fails if any of the rules has
+// an unknown type or an invalid pattern.
+func Compile(rules []structure.BlacklistRule) (*Matcher, error) {
+	matcher := &Matcher{
+		hosts:        make(map[string]structure.BlacklistRule),
+		creativeKeys: make(map[string]structure.BlacklistRule),
+	}
+	expressions := []string{}
+	for _, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("blacklist rule of type %s has no pattern", rule.Type)
+		}
+		switch rule.Type {
+		case structure.RuleHost:
+			host := strings.ToLower(strings.TrimSuffix(rule.Pattern, "."))
+			if strings.ContainsAny(host, "/:?#") {
+				return nil, fmt.Errorf("invalid host %q", rule.Pattern)
+			}
+			matcher.hosts[host] = rule
+		case structure.RulePathPrefix:
+			prefix, err := url.Parse(rule.Pattern)
+			if err != nil || prefix.Host == "" {
+				return nil, fmt.Errorf("invalid path prefix %q, expected a URL", rule.Pattern)
+			}
+			matcher.prefixes = append(matcher.prefixes, rule)
+		case structure.RuleGlob, structure.RuleRegex:
+			expression := rule.Pattern
+			if rule.Type == structure.RuleGlob {
+				expression = globToRegexp(rule.Pattern)
+			}
+			compiled, err := regexp.Compile(expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", rule.Type, rule.Pattern, err)
+			}
+			matcher.patterns = append(matcher.patterns, compiledPattern{rule: rule, regexp: compiled})
+			expressions = append(expressions, "(?:"+expression+")")
+		case structure.RuleCreativeKey:
+			matcher.creativeKeys[rule.Pattern] = rule
+		default:
+			return nil, fmt.Errorf("unknown blacklist rule type %q", rule.Type)
+		}
+	}
+	if len(expressions) > 0 {
+		combined, err := regexp.Compile(strings.Join(expressions, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to combine blacklist patterns: %w", err)
+		}
+		matcher.combined = combined
+	}
+	return matcher, nil
+}
+
+// globToRegexp turns a glob into an anchored regular expression, where
+// * matches any characters, including slashes, and ? a single character.
+func globToRegexp(glob string) string {
+	var builder strings.Builder
+	builder.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			builder.WriteString(".*")
+		case '?':
+			builder.WriteString(".")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	builder.WriteString("$")
+	return builder.String()
+}
+
+// Match returns the first rule matching the creative key or media URL.
+// Expired rules never match.
+func (m *Matcher) Match(creativeKey string, mediaUrl string, now time.Time) (structure.BlacklistRule, bool) {
+	if m == nil {
+		return structure.BlacklistRule{}, false
+	}
+	if rule, found := m.creativeKeys[creativeKey]; found && creativeKey != "" && !rule.Expired(now) {
+		return rule, true
+	}
+	if mediaUrl == "" {
+		return structure.BlacklistRule{}, false
+	}
+	if len(m.hosts) > 0 {
+		if parsed, err := url.Parse(mediaUrl); err == nil {
+			// The host itself, then each parent domain
+			host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+			for host != "" {
+				if rule, found := m.hosts[host]; found && !rule.Expired(now) {
+					return rule, true
+				}
+				_, host, _ = strings.Cut(host, ".")
+			}
+		}
+	}
+	if len(m.prefixes) > 0 {
+		withoutQuery, _, _ := strings.Cut(mediaUrl, "#")
+		withoutQuery, _, _ = strings.Cut(withoutQuery, "?")
+		for _, rule := range m.prefixes {
+			if strings.HasPrefix(withoutQuery, rule.Pattern) && !rule.Expired(now) {
+				return rule, true
+			}
+		}
+	}
+	if m.combined != nil && m.combined.MatchString(mediaUrl) {
+		for _, pattern := range m.patterns {
+			if pattern.regexp.MatchString(mediaUrl) && !pattern.rule.Expired(now) {
+				return pattern.rule, true
+			}
+		}
+	}
+	return structure.BlacklistRule{}, false
+}
+
+// Empty is true if the matcher has no rules, and can be skipped.
+func (m *Matcher) Empty() bool {
+	return m == nil ||
+		len(m.hosts) == 0 && len(m.creativeKeys) == 0 && len(m.prefixes) == 0 && len(m.patterns) == 0
+}
@@ -0,0 +1,76 @@
+package blacklist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestMatch(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	matcher, err := Compile([]structure.BlacklistRule{
+		{Type: structure.RuleHost, Pattern: "bad-cdn.example.com"},
+		{Type: structure.RulePathPrefix, Pattern: "https://ads.example.com/broken/"},
+		{Type: structure.RuleGlob, Pattern: "https://*.example.org/*.mov"},
+		{Type: structure.RuleRegex, Pattern: `/creative-[0-9]+\.webm$`},
+		{Type: structure.RuleCreativeKey, Pattern: "badcreative"},
+		{Type: structure.RuleHost, Pattern: "expired.example.com", ExpiresAt: now.Add(-time.Minute).Unix()},
+	})
+	is.NoErr(err)
+
+	tests := []struct {
+		creativeKey string
+		mediaUrl    string
+		rule        string
+	}{
+		{"", "https://bad-cdn.example.com/ad.mp4", "host:bad-cdn.example.com"},
+		{"", "https://eu.BAD-CDN.example.com:8443/ad.mp4", "host:bad-cdn.example.com"},
+		{"", "https://notbad-cdn.example.com/ad.mp4", ""},
+		{"", "https://ads.example.com/broken/ad.mp4?session=1234", "pathPrefix:https://ads.example.com/broken/"},
+		{"", "https://ads.example.com/fine/ad.mp4?path=/broken/", ""},
+		{"", "https://media.example.org/ads/ad.mov", "glob:https://*.example.org/*.mov"},
+		{"", "https://media.example.org/ads/ad.mov.mp4", ""},
+		{"", "https://ads.example.com/creative-42.webm", `regex:/creative-[0-9]+\.webm$`},
+		{"badcreative", "https://ads.example.com/ad.mp4", "creativeKey:badcreative"},
+		{"goodcreative", "https://ads.example.com/ad.mp4", ""},
+		{"", "https://expired.example.com/ad.mp4", ""},
+	}
+	for _, test := range tests {
+		rule, matched := matcher.Match(test.creativeKey, test.mediaUrl, now)
+		is.Equal(matched, test.rule != "") // match for test.mediaUrl
+		if matched {
+			is.Equal(rule.Id(), test.rule)
+		}
+	}
+}
+
+func TestMatchWithoutRules(t *testing.T) {
+	is := is.New(t)
+	var nilMatcher *Matcher
+	_, matched := nilMatcher.Match("creative", "https://ads.example.com/ad.mp4", time.Now())
+	is.True(!matched)
+	is.True(nilMatcher.Empty())
+
+	matcher, err := Compile(nil)
+	is.NoErr(err)
+	is.True(matcher.Empty())
+	_, matched = matcher.Match("creative", "https://ads.example.com/ad.mp4", time.Now())
+	is.True(!matched)
+}
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+	is.NoErr(Validate(structure.BlacklistRule{Type: structure.RuleRegex, Pattern: `^https://ads\.example\.com/`}))
+	for _, rule := range []structure.BlacklistRule{
+		{Type: structure.RuleRegex, Pattern: "(unclosed"},
+		{Type: structure.RuleHost, Pattern: "https://ads.example.com/"},
+		{Type: structure.RulePathPrefix, Pattern: "/ads/"},
+		{Type: structure.RuleGlob, Pattern: ""},
+		{Type: "domain", Pattern: "example.com"},
+	} {
+		is.True(Validate(rule) != nil) // invalid rule
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"cmp"
 	"errors"
 	"log/slog"
 	"net/url"
@@ -9,12 +10,23 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+	"github.com/Eyevinn/ad-normalizer/internal/encore"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/rs/xid"
 )
 
+const TRANSCODER_ENCORE = "encore"
+const TRANSCODER_FFMPEG = "ffmpeg"
+
 type AdNormalizerConfig struct {
-	EncoreUrl          url.URL
+	// The transcoder backend, TRANSCODER_ENCORE or TRANSCODER_FFMPEG
+	Transcoder string
+	// Encore instances the jobs are balanced over
+	EncoreUrls         []url.URL
+	EncoreBalancing    encore.BalancingStrategy
+	EncoreHealthCheck  int
 	Bucket             string
 	AdServerUrl        url.URL
 	ValkeyUrl          string
@@ -35,23 +47,98 @@ type AdNormalizerConfig struct {
 	Port               int
 	KpiPostUrl         string
 	PProfPort          string
+	WrapperMaxDepth    int
+	WrapperTimeout     int
+	ReaperInterval     int
+	EncoreMaxRetries   int
+	EncoreRetryBackoff int
+	DispatchBackoff    int
+	StoreCacheSize     int
+	StoreCacheTtl      int
+	CallbackSecret     string
+	CallbackTokenTtl   int
+	ReconcileInterval  int
+	ReconcileRate      int
+	// Failures after which a source is blacklisted, 0 disables it
+	AutoBlacklistThreshold int
+	AutoBlacklistWindow    int
+	BlacklistSweepInterval int
+	BlacklistRulesRefresh  int
+	AuditLogMaxLength      int
+	ApiKeys                []auth.APIKey
+	// Origins allowed to call the API from a browser, nil allows any origin
+	CorsAllowedOrigins []string
+	FfmpegPath         string
+	FfprobePath        string
+	FfmpegOutputDir    string
+	FfmpegOutputUrl    url.URL
+	FfmpegConcurrency  int
 }
 
 func ReadConfig() (AdNormalizerConfig, error) {
 	conf := AdNormalizerConfig{}
-	encoreUrl, found := os.LookupEnv("ENCORE_URL")
 	var err error
-	if !found {
+	transcoder, found := os.LookupEnv("TRANSCODER")
+	switch {
+	case !found:
+		conf.Transcoder = TRANSCODER_ENCORE
+	case transcoder == TRANSCODER_ENCORE || transcoder == TRANSCODER_FFMPEG:
+		conf.Transcoder = transcoder
+	default:
+		logger.Error("Unknown TRANSCODER", slog.String("value", transcoder))
+		err = errors.Join(err, errors.New("invalid TRANSCODER value"))
+	}
+
+	encoreUrl, found := os.LookupEnv("ENCORE_URL")
+	if !found && conf.Transcoder != TRANSCODER_ENCORE {
+		logger.Debug("No Encore configured, using the ffmpeg transcoder")
+	} else if !found {
 		logger.Error("No environment variable ENCORE_URL was found")
 		err = errors.Join(err, errors.New("missing ENCORE_URL environment variable"))
 	} else {
-		parsed, err := url.Parse(strings.TrimSuffix(encoreUrl, "/"))
-		if err != nil {
-			logger.Error("Failed to parse ENCORE_URL", slog.String("error", err.Error()))
-			//nolint:staticcheck // err is returned, linter is dumb
+		for entry := range strings.SplitSeq(encoreUrl, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			parsed, parseErr := url.Parse(strings.TrimSuffix(entry, "/"))
+			if parseErr != nil {
+				logger.Error("Failed to parse ENCORE_URL", slog.String("error", parseErr.Error()))
+				err = errors.Join(err, errors.New("invalid ENCORE_URL format"))
+				continue
+			}
+			conf.EncoreUrls = append(conf.EncoreUrls, *parsed)
+		}
+		if len(conf.EncoreUrls) == 0 {
 			err = errors.Join(err, errors.New("invalid ENCORE_URL format"))
 		}
-		conf.EncoreUrl = *parsed
+	}
+
+	encoreBalancing, found := os.LookupEnv("ENCORE_BALANCING")
+	if !found {
+		conf.EncoreBalancing = encore.RoundRobin
+	} else {
+		strategy, parseErr := encore.ParseBalancingStrategy(encoreBalancing)
+		if parseErr != nil {
+			logger.Error("Failed to parse ENCORE_BALANCING", slog.String("value", encoreBalancing))
+			err = errors.Join(err, errors.New("invalid ENCORE_BALANCING value"))
+		} else {
+			conf.EncoreBalancing = strategy
+		}
+	}
+
+	encoreHealthCheck, found := os.LookupEnv("ENCORE_HEALTH_CHECK_INTERVAL")
+	if !found {
+		logger.Info("No environment variable ENCORE_HEALTH_CHECK_INTERVAL was found, using default")
+		conf.EncoreHealthCheck = 10
+	} else {
+		encoreHealthCheckInt, parseErr := strconv.Atoi(encoreHealthCheck)
+		if parseErr != nil || encoreHealthCheckInt < 0 {
+			logger.Error("Failed to parse ENCORE_HEALTH_CHECK_INTERVAL", slog.String("value", encoreHealthCheck))
+			err = errors.Join(err, errors.New("invalid ENCORE_HEALTH_CHECK_INTERVAL format"))
+		} else {
+			conf.EncoreHealthCheck = encoreHealthCheckInt
+		}
 	}
 
 	valkeyUrl, found := os.LookupEnv("REDIS_URL")
@@ -163,6 +250,12 @@ func ReadConfig() (AdNormalizerConfig, error) {
 
 	conf.JitPackage = jitPackage == "true"
 	logger.Debug("JIT packaging enabled", slog.Bool("enabled", conf.JitPackage))
+	// The packager reads its queue from Valkey, so it would never see the
+	// jobs queued in memory, and they would wait forever
+	if conf.ValkeyUrl == store.MEMORY_URL && conf.Transcoder == TRANSCODER_ENCORE && !conf.JitPackage {
+		logger.Error("The in-memory store cannot be used with an external packager, set JIT_PACKAGE=true or use Valkey")
+		err = errors.Join(err, errors.New("REDIS_URL=memory:// requires JIT_PACKAGE=true with Encore"))
+	}
 
 	rootUrl, found := os.LookupEnv("ROOT_URL")
 	if !found {
@@ -178,6 +271,43 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		}
 	}
 
+	if conf.Transcoder == TRANSCODER_FFMPEG {
+		conf.FfmpegPath = cmp.Or(os.Getenv("FFMPEG_PATH"), "ffmpeg")
+		conf.FfprobePath = cmp.Or(os.Getenv("FFPROBE_PATH"), "ffprobe")
+		outputDir, found := os.LookupEnv("FFMPEG_OUTPUT_DIR")
+		if !found {
+			logger.Error("No environment variable FFMPEG_OUTPUT_DIR was found")
+			err = errors.Join(err, errors.New("missing FFMPEG_OUTPUT_DIR environment variable"))
+		} else {
+			conf.FfmpegOutputDir = outputDir
+		}
+		outputUrl, found := os.LookupEnv("FFMPEG_OUTPUT_URL")
+		if !found {
+			// Served by the normalizer itself, on /assets/
+			conf.FfmpegOutputUrl = *conf.RootUrl.JoinPath("assets")
+		} else {
+			parsedUrl, parseErr := url.Parse(strings.TrimSuffix(outputUrl, "/"))
+			if parseErr != nil {
+				logger.Error("Failed to parse FFMPEG_OUTPUT_URL", slog.String("error", parseErr.Error()))
+				err = errors.Join(err, errors.New("invalid FFMPEG_OUTPUT_URL format"))
+			} else {
+				conf.FfmpegOutputUrl = *parsedUrl
+			}
+		}
+		concurrency, found := os.LookupEnv("FFMPEG_CONCURRENCY")
+		if !found {
+			conf.FfmpegConcurrency = 2
+		} else {
+			concurrencyInt, parseErr := strconv.Atoi(concurrency)
+			if parseErr != nil || concurrencyInt <= 0 {
+				logger.Error("Failed to parse FFMPEG_CONCURRENCY", slog.String("value", concurrency))
+				err = errors.Join(err, errors.New("invalid FFMPEG_CONCURRENCY format"))
+			} else {
+				conf.FfmpegConcurrency = concurrencyInt
+			}
+		}
+	}
+
 	packagingQueueName, found := os.LookupEnv("PACKAGING_QUEUE")
 	if !found {
 		logger.Info("No environment variable PACKAGING_QUEUE_NAME was found, using default")
@@ -192,14 +322,276 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		conf.InFlightTtl = 60 * 60 // Default to 1 hour
 	} else {
 		inFlightTtlInt, parseErr := strconv.Atoi(inFlightTtl)
-		if parseErr != nil {
-			logger.Error("Failed to parse IN_FLIGHT_TTL", slog.String("error", parseErr.Error()))
+		if parseErr != nil || inFlightTtlInt <= 0 {
+			logger.Error("Failed to parse IN_FLIGHT_TTL", slog.String("value", inFlightTtl))
 			err = errors.Join(err, errors.New("invalid IN_FLIGHT_TTL format"))
 		} else {
 			conf.InFlightTtl = inFlightTtlInt
 		}
 	}
 
+	reconcileInterval, found := os.LookupEnv("RECONCILE_INTERVAL")
+	if !found {
+		logger.Info("No environment variable RECONCILE_INTERVAL was found, using default")
+		conf.ReconcileInterval = 60
+	} else {
+		reconcileIntervalInt, parseErr := strconv.Atoi(reconcileInterval)
+		if parseErr != nil || reconcileIntervalInt < 0 {
+			logger.Error("Failed to parse RECONCILE_INTERVAL", slog.String("value", reconcileInterval))
+			err = errors.Join(err, errors.New("invalid RECONCILE_INTERVAL format"))
+		} else {
+			conf.ReconcileInterval = reconcileIntervalInt
+		}
+	}
+
+	reconcileRate, found := os.LookupEnv("RECONCILE_RATE")
+	if !found {
+		logger.Info("No environment variable RECONCILE_RATE was found, using default")
+		conf.ReconcileRate = 5
+	} else {
+		reconcileRateInt, parseErr := strconv.Atoi(reconcileRate)
+		if parseErr != nil || reconcileRateInt <= 0 {
+			logger.Error("Failed to parse RECONCILE_RATE", slog.String("value", reconcileRate))
+			err = errors.Join(err, errors.New("invalid RECONCILE_RATE format"))
+		} else {
+			conf.ReconcileRate = reconcileRateInt
+		}
+	}
+
+	autoBlacklistThreshold, found := os.LookupEnv("AUTO_BLACKLIST_THRESHOLD")
+	if !found {
+		logger.Info("No environment variable AUTO_BLACKLIST_THRESHOLD was found, sources are not blacklisted automatically")
+	} else {
+		autoBlacklistThresholdInt, parseErr := strconv.Atoi(autoBlacklistThreshold)
+		if parseErr != nil || autoBlacklistThresholdInt < 0 {
+			logger.Error("Failed to parse AUTO_BLACKLIST_THRESHOLD", slog.String("value", autoBlacklistThreshold))
+			err = errors.Join(err, errors.New("invalid AUTO_BLACKLIST_THRESHOLD format"))
+		} else {
+			conf.AutoBlacklistThreshold = autoBlacklistThresholdInt
+		}
+	}
+
+	autoBlacklistWindow, found := os.LookupEnv("AUTO_BLACKLIST_WINDOW")
+	if !found {
+		logger.Info("No environment variable AUTO_BLACKLIST_WINDOW was found, using default")
+		conf.AutoBlacklistWindow = 24 * 60 * 60 // Default to a day
+	} else {
+		autoBlacklistWindowInt, parseErr := strconv.Atoi(autoBlacklistWindow)
+		if parseErr != nil || autoBlacklistWindowInt <= 0 {
+			logger.Error("Failed to parse AUTO_BLACKLIST_WINDOW", slog.String("value", autoBlacklistWindow))
+			err = errors.Join(err, errors.New("invalid AUTO_BLACKLIST_WINDOW format"))
+		} else {
+			conf.AutoBlacklistWindow = autoBlacklistWindowInt
+		}
+	}
+
+	encoreMaxRetries, found := os.LookupEnv("ENCORE_MAX_RETRIES")
+	if !found {
+		logger.Info("No environment variable ENCORE_MAX_RETRIES was found, using default")
+		conf.EncoreMaxRetries = 3
+	} else {
+		encoreMaxRetriesInt, parseErr := strconv.Atoi(encoreMaxRetries)
+		if parseErr != nil || encoreMaxRetriesInt < 0 {
+			logger.Error("Failed to parse ENCORE_MAX_RETRIES", slog.String("value", encoreMaxRetries))
+			err = errors.Join(err, errors.New("invalid ENCORE_MAX_RETRIES format"))
+		} else {
+			conf.EncoreMaxRetries = encoreMaxRetriesInt
+		}
+	}
+
+	encoreRetryBackoff, found := os.LookupEnv("ENCORE_RETRY_BACKOFF")
+	if !found {
+		logger.Info("No environment variable ENCORE_RETRY_BACKOFF was found, using default")
+		conf.EncoreRetryBackoff = 500 // Default to 500 milliseconds before the first retry
+	} else {
+		encoreRetryBackoffInt, parseErr := strconv.Atoi(encoreRetryBackoff)
+		if parseErr != nil || encoreRetryBackoffInt < 0 {
+			logger.Error("Failed to parse ENCORE_RETRY_BACKOFF", slog.String("value", encoreRetryBackoff))
+			err = errors.Join(err, errors.New("invalid ENCORE_RETRY_BACKOFF format"))
+		} else {
+			conf.EncoreRetryBackoff = encoreRetryBackoffInt
+		}
+	}
+
+	dispatchBackoff, found := os.LookupEnv("DISPATCH_RETRY_BACKOFF")
+	if !found {
+		logger.Info("No environment variable DISPATCH_RETRY_BACKOFF was found, using default")
+		conf.DispatchBackoff = 60
+	} else {
+		dispatchBackoffInt, parseErr := strconv.Atoi(dispatchBackoff)
+		if parseErr != nil || dispatchBackoffInt <= 0 {
+			logger.Error("Failed to parse DISPATCH_RETRY_BACKOFF", slog.String("value", dispatchBackoff))
+			err = errors.Join(err, errors.New("invalid DISPATCH_RETRY_BACKOFF format"))
+		} else {
+			conf.DispatchBackoff = dispatchBackoffInt
+		}
+	}
+
+	storeCacheSize, found := os.LookupEnv("STORE_CACHE_SIZE")
+	if !found {
+		logger.Info("No environment variable STORE_CACHE_SIZE was found, store cache is disabled")
+	} else {
+		storeCacheSizeInt, parseErr := strconv.Atoi(storeCacheSize)
+		if parseErr != nil || storeCacheSizeInt < 0 {
+			logger.Error("Failed to parse STORE_CACHE_SIZE", slog.String("value", storeCacheSize))
+			err = errors.Join(err, errors.New("invalid STORE_CACHE_SIZE format"))
+		} else {
+			conf.StoreCacheSize = storeCacheSizeInt
+		}
+	}
+
+	storeCacheTtl, found := os.LookupEnv("STORE_CACHE_TTL")
+	if !found {
+		logger.Info("No environment variable STORE_CACHE_TTL was found, using default")
+		conf.StoreCacheTtl = 5 * 60 // Default to 5 minutes
+	} else {
+		storeCacheTtlInt, parseErr := strconv.Atoi(storeCacheTtl)
+		if parseErr != nil || storeCacheTtlInt <= 0 {
+			logger.Error("Failed to parse STORE_CACHE_TTL", slog.String("value", storeCacheTtl))
+			err = errors.Join(err, errors.New("invalid STORE_CACHE_TTL format"))
+		} else {
+			conf.StoreCacheTtl = storeCacheTtlInt
+		}
+	}
+
+	callbackSecret, found := os.LookupEnv("CALLBACK_SECRET")
+	if !found || callbackSecret == "" {
+		logger.Warn("No environment variable CALLBACK_SECRET was found, callbacks are not authenticated")
+	} else {
+		conf.CallbackSecret = callbackSecret
+	}
+
+	callbackTokenTtl, found := os.LookupEnv("CALLBACK_TOKEN_TTL")
+	if !found {
+		logger.Info("No environment variable CALLBACK_TOKEN_TTL was found, using default")
+		conf.CallbackTokenTtl = 24 * 60 * 60
+	} else {
+		callbackTokenTtlInt, parseErr := strconv.Atoi(callbackTokenTtl)
+		if parseErr != nil || callbackTokenTtlInt <= 0 {
+			logger.Error("Failed to parse CALLBACK_TOKEN_TTL", slog.String("value", callbackTokenTtl))
+			err = errors.Join(err, errors.New("invalid CALLBACK_TOKEN_TTL format"))
+		} else {
+			conf.CallbackTokenTtl = callbackTokenTtlInt
+		}
+	}
+
+	apiKeys, found := os.LookupEnv("API_KEYS")
+	if found && apiKeys != "" {
+		for entry := range strings.SplitSeq(apiKeys, ",") {
+			key, parseErr := auth.ParseAPIKey(entry)
+			if parseErr != nil {
+				logger.Error("Failed to parse API_KEYS", slog.String("error", parseErr.Error()))
+				err = errors.Join(err, errors.New("invalid API_KEYS format"))
+				continue
+			}
+			conf.ApiKeys = append(conf.ApiKeys, key)
+		}
+	}
+	apiKeysFile, found := os.LookupEnv("API_KEYS_FILE")
+	if found && apiKeysFile != "" {
+		fileKeys, readErr := readApiKeysFile(apiKeysFile)
+		if readErr != nil {
+			logger.Error("Failed to read API_KEYS_FILE", slog.String("error", readErr.Error()))
+			err = errors.Join(err, errors.New("invalid API_KEYS_FILE"))
+		} else {
+			conf.ApiKeys = append(conf.ApiKeys, fileKeys...)
+		}
+	}
+	if len(conf.ApiKeys) == 0 {
+		logger.Warn("No API keys configured, the management endpoints are not authenticated")
+	}
+
+	corsAllowedOrigins, found := os.LookupEnv("CORS_ALLOWED_ORIGINS")
+	if found && corsAllowedOrigins != "" && corsAllowedOrigins != "*" {
+		for origin := range strings.SplitSeq(corsAllowedOrigins, ",") {
+			conf.CorsAllowedOrigins = append(conf.CorsAllowedOrigins, strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		}
+	}
+
+	reaperInterval, found := os.LookupEnv("REAPER_INTERVAL")
+	if !found {
+		logger.Info("No environment variable REAPER_INTERVAL was found, using default")
+		conf.ReaperInterval = 60
+	} else {
+		reaperIntervalInt, parseErr := strconv.Atoi(reaperInterval)
+		if parseErr != nil || reaperIntervalInt < 0 {
+			logger.Error("Failed to parse REAPER_INTERVAL", slog.String("value", reaperInterval))
+			err = errors.Join(err, errors.New("invalid REAPER_INTERVAL format"))
+		} else {
+			conf.ReaperInterval = reaperIntervalInt
+		}
+	}
+
+	blacklistSweepInterval, found := os.LookupEnv("BLACKLIST_SWEEP_INTERVAL")
+	if !found {
+		logger.Info("No environment variable BLACKLIST_SWEEP_INTERVAL was found, using default")
+		conf.BlacklistSweepInterval = 60
+	} else {
+		blacklistSweepIntervalInt, parseErr := strconv.Atoi(blacklistSweepInterval)
+		if parseErr != nil || blacklistSweepIntervalInt < 0 {
+			logger.Error("Failed to parse BLACKLIST_SWEEP_INTERVAL", slog.String("value", blacklistSweepInterval))
+			err = errors.Join(err, errors.New("invalid BLACKLIST_SWEEP_INTERVAL format"))
+		} else {
+			conf.BlacklistSweepInterval = blacklistSweepIntervalInt
+		}
+	}
+
+	blacklistRulesRefresh, found := os.LookupEnv("BLACKLIST_RULES_REFRESH")
+	if !found {
+		logger.Info("No environment variable BLACKLIST_RULES_REFRESH was found, using default")
+		conf.BlacklistRulesRefresh = 10
+	} else {
+		blacklistRulesRefreshInt, parseErr := strconv.Atoi(blacklistRulesRefresh)
+		if parseErr != nil || blacklistRulesRefreshInt < 0 {
+			logger.Error("Failed to parse BLACKLIST_RULES_REFRESH", slog.String("value", blacklistRulesRefresh))
+			err = errors.Join(err, errors.New("invalid BLACKLIST_RULES_REFRESH format"))
+		} else {
+			conf.BlacklistRulesRefresh = blacklistRulesRefreshInt
+		}
+	}
+
+	auditLogMaxLength, found := os.LookupEnv("AUDIT_LOG_MAX_LENGTH")
+	if !found {
+		logger.Info("No environment variable AUDIT_LOG_MAX_LENGTH was found, using default")
+		conf.AuditLogMaxLength = 100000
+	} else {
+		auditLogMaxLengthInt, parseErr := strconv.Atoi(auditLogMaxLength)
+		if parseErr != nil || auditLogMaxLengthInt < 0 {
+			logger.Error("Failed to parse AUDIT_LOG_MAX_LENGTH", slog.String("value", auditLogMaxLength))
+			err = errors.Join(err, errors.New("invalid AUDIT_LOG_MAX_LENGTH format"))
+		} else {
+			conf.AuditLogMaxLength = auditLogMaxLengthInt
+		}
+	}
+
+	wrapperMaxDepth, found := os.LookupEnv("WRAPPER_MAX_DEPTH")
+	if !found {
+		logger.Info("No environment variable WRAPPER_MAX_DEPTH was found, using default")
+		conf.WrapperMaxDepth = 5
+	} else {
+		wrapperMaxDepthInt, parseErr := strconv.Atoi(wrapperMaxDepth)
+		if parseErr != nil || wrapperMaxDepthInt < 0 {
+			logger.Error("Failed to parse WRAPPER_MAX_DEPTH", slog.String("value", wrapperMaxDepth))
+			err = errors.Join(err, errors.New("invalid WRAPPER_MAX_DEPTH format"))
+		} else {
+			conf.WrapperMaxDepth = wrapperMaxDepthInt
+		}
+	}
+
+	wrapperTimeout, found := os.LookupEnv("WRAPPER_TIMEOUT")
+	if !found {
+		logger.Info("No environment variable WRAPPER_TIMEOUT was found, using default")
+		conf.WrapperTimeout = 2000 // Default to 2 seconds per hop
+	} else {
+		wrapperTimeoutInt, parseErr := strconv.Atoi(wrapperTimeout)
+		if parseErr != nil || wrapperTimeoutInt <= 0 {
+			logger.Error("Failed to parse WRAPPER_TIMEOUT", slog.String("value", wrapperTimeout))
+			err = errors.Join(err, errors.New("invalid WRAPPER_TIMEOUT format"))
+		} else {
+			conf.WrapperTimeout = wrapperTimeoutInt
+		}
+	}
+
 	postUrl, found := os.LookupEnv("KPI_POST_URL")
 	if !found {
 		logger.Info("No environment variable KPI_POST_URL was found, KPIs will not be posted")
@@ -245,3 +637,12 @@ func ReadConfig() (AdNormalizerConfig, error) {
 
 	return conf, err
 }
+
+func readApiKeysFile(name string) ([]auth.APIKey, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return auth.ReadAPIKeys(file)
+}
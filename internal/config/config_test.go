@@ -1,18 +1,26 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+	"github.com/Eyevinn/ad-normalizer/internal/encore"
 	"github.com/matryer/is"
 )
 
 func TestReadConfig(t *testing.T) {
 	is := is.New(t)
+	apiKeysFile := filepath.Join(t.TempDir(), "api-keys")
+	is.NoErr(os.WriteFile(apiKeysFile, []byte("# Admins\nadmin:admin:key3\n"), 0o600))
 	configVars := []struct {
 		name  string
 		value string
 	}{
-		{"ENCORE_URL", "http://demo-encore.osaas.io"},
+		{"ENCORE_URL", "http://demo-encore.osaas.io, http://demo-encore-2.osaas.io/"},
+		{"ENCORE_BALANCING", "least-queued"},
+		{"ENCORE_HEALTH_CHECK_INTERVAL", "5"},
 		{"REDIS_URL", "redis://demo-valkey.osaas.io"},
 		{"REDIS_CLUSTER", "true"},
 		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
@@ -26,13 +34,38 @@ func TestReadConfig(t *testing.T) {
 		{"PACKAGING_QUEUE", "normalizer-package"},
 		{"IN_FLIGHT_TTL", "10"},
 		{"PPROF_PORT", "6060"},
+		{"WRAPPER_MAX_DEPTH", "3"},
+		{"WRAPPER_TIMEOUT", "500"},
+		{"REAPER_INTERVAL", "30"},
+		{"RECONCILE_INTERVAL", "20"},
+		{"RECONCILE_RATE", "10"},
+		{"AUTO_BLACKLIST_THRESHOLD", "3"},
+		{"AUTO_BLACKLIST_WINDOW", "3600"},
+		{"BLACKLIST_SWEEP_INTERVAL", "0"},
+		{"BLACKLIST_RULES_REFRESH", "30"},
+		{"AUDIT_LOG_MAX_LENGTH", "500"},
+		{"ENCORE_MAX_RETRIES", "2"},
+		{"ENCORE_RETRY_BACKOFF", "100"},
+		{"DISPATCH_RETRY_BACKOFF", "120"},
+		{"STORE_CACHE_SIZE", "1000"},
+		{"STORE_CACHE_TTL", "30"},
+		{"CALLBACK_SECRET", "callback-secret"},
+		{"CALLBACK_TOKEN_TTL", "7200"},
+		{"API_KEYS", "dashboard:read-only:key1, ops:operator:key2"},
+		{"API_KEYS_FILE", apiKeysFile},
+		{"CORS_ALLOWED_ORIGINS", "https://dashboard.example.com/, https://ops.example.com"},
 	}
 	for _, v := range configVars {
 		t.Setenv(v.name, v.value)
 	}
 	config, err := ReadConfig()
 	is.NoErr(err)
-	is.Equal(config.EncoreUrl.String(), "http://demo-encore.osaas.io")
+	is.Equal(config.Transcoder, TRANSCODER_ENCORE)
+	is.Equal(len(config.EncoreUrls), 2)
+	is.Equal(config.EncoreUrls[0].String(), "http://demo-encore.osaas.io")
+	is.Equal(config.EncoreUrls[1].String(), "http://demo-encore-2.osaas.io")
+	is.Equal(config.EncoreBalancing, encore.LeastQueued)
+	is.Equal(config.EncoreHealthCheck, 5)
 	is.Equal(config.ValkeyUrl, "redis://demo-valkey.osaas.io")
 	is.Equal(config.AdServerUrl.String(), "http://test-ad-server.osaas.io")
 	is.Equal(config.BucketUrl.String(), "s3://test-bucket.osaas.io")
@@ -42,6 +75,29 @@ func TestReadConfig(t *testing.T) {
 	is.Equal(config.EncoreProfile, "ad-profile")
 	is.Equal(config.ValkeyCluster, true)
 	is.Equal(config.PProfPort, "6060")
+	is.Equal(config.WrapperMaxDepth, 3)
+	is.Equal(config.WrapperTimeout, 500)
+	is.Equal(config.ReaperInterval, 30)
+	is.Equal(config.EncoreMaxRetries, 2)
+	is.Equal(config.EncoreRetryBackoff, 100)
+	is.Equal(config.DispatchBackoff, 120)
+	is.Equal(config.StoreCacheSize, 1000)
+	is.Equal(config.StoreCacheTtl, 30)
+	is.Equal(config.CallbackSecret, "callback-secret")
+	is.Equal(config.CallbackTokenTtl, 7200)
+	is.Equal(config.ReconcileInterval, 20)
+	is.Equal(config.ReconcileRate, 10)
+	is.Equal(config.AutoBlacklistThreshold, 3)
+	is.Equal(config.AutoBlacklistWindow, 3600)
+	is.Equal(config.BlacklistSweepInterval, 0)
+	is.Equal(config.BlacklistRulesRefresh, 30)
+	is.Equal(config.AuditLogMaxLength, 500)
+	is.Equal(config.ApiKeys, []auth.APIKey{
+		{Name: "dashboard", Role: auth.RoleReadOnly, Key: "key1"},
+		{Name: "ops", Role: auth.RoleOperator, Key: "key2"},
+		{Name: "admin", Role: auth.RoleAdmin, Key: "key3"},
+	})
+	is.Equal(config.CorsAllowedOrigins, []string{"https://dashboard.example.com", "https://ops.example.com"})
 }
 
 func TestPProfPortNotSet(t *testing.T) {
@@ -63,6 +119,10 @@ func TestPProfPortNotSet(t *testing.T) {
 	config, err := ReadConfig()
 	is.NoErr(err)
 	is.Equal(config.PProfPort, "")
+	// Not set either, so automatic blacklisting is off
+	is.Equal(config.AutoBlacklistThreshold, 0)
+	is.Equal(config.AutoBlacklistWindow, 24*60*60)
+	is.Equal(config.CallbackTokenTtl, 24*60*60)
 }
 
 func TestPProfPortInvalid(t *testing.T) {
@@ -108,3 +168,115 @@ func TestPProfPortOutOfRange(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(config.PProfPort, "6060")
 }
+
+func TestEncoreBalancingInvalid(t *testing.T) {
+	is := is.New(t)
+	configVars := []struct {
+		name  string
+		value string
+	}{
+		{"ENCORE_URL", "http://demo-encore.osaas.io"},
+		{"ENCORE_BALANCING", "random"},
+		{"REDIS_URL", "redis://demo-valkey.osaas.io"},
+		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
+		{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+	}
+	for _, v := range configVars {
+		t.Setenv(v.name, v.value)
+	}
+	_, err := ReadConfig()
+	is.True(err != nil)
+}
+
+func TestInFlightTtlInvalid(t *testing.T) {
+	for _, value := range []string{"not-a-number", "0", "-60"} {
+		t.Run(value, func(t *testing.T) {
+			is := is.New(t)
+			configVars := []struct {
+				name  string
+				value string
+			}{
+				{"ENCORE_URL", "http://demo-encore.osaas.io"},
+				{"REDIS_URL", "redis://demo-valkey.osaas.io"},
+				{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+				{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
+				{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+				{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+				{"IN_FLIGHT_TTL", value},
+			}
+			for _, v := range configVars {
+				t.Setenv(v.name, v.value)
+			}
+			_, err := ReadConfig()
+			is.True(err != nil)
+		})
+	}
+}
+
+func TestMemoryStoreNeedsJitPackaging(t *testing.T) {
+	is := is.New(t)
+	configVars := []struct {
+		name  string
+		value string
+	}{
+		{"ENCORE_URL", "http://demo-encore.osaas.io"},
+		{"REDIS_URL", "memory://"},
+		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
+		{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+	}
+	for _, v := range configVars {
+		t.Setenv(v.name, v.value)
+	}
+	// The packager could not read the packaging queue
+	_, err := ReadConfig()
+	is.True(err != nil)
+
+	t.Setenv("JIT_PACKAGE", "true")
+	_, err = ReadConfig()
+	is.NoErr(err)
+
+	// Nothing is packaged with ffmpeg
+	t.Setenv("JIT_PACKAGE", "false")
+	t.Setenv("TRANSCODER", "ffmpeg")
+	t.Setenv("FFMPEG_OUTPUT_DIR", "/var/lib/ad-normalizer")
+	_, err = ReadConfig()
+	is.NoErr(err)
+}
+
+func TestReadConfigFfmpeg(t *testing.T) {
+	is := is.New(t)
+	configVars := []struct {
+		name  string
+		value string
+	}{
+		{"TRANSCODER", "ffmpeg"},
+		{"FFMPEG_OUTPUT_DIR", "/var/lib/ad-normalizer"},
+		{"FFMPEG_CONCURRENCY", "4"},
+		{"REDIS_URL", "redis://demo-valkey.osaas.io"},
+		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
+		{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+	}
+	for _, v := range configVars {
+		t.Setenv(v.name, v.value)
+	}
+	// No Encore is needed
+	config, err := ReadConfig()
+	is.NoErr(err)
+	is.Equal(config.Transcoder, TRANSCODER_FFMPEG)
+	is.Equal(len(config.EncoreUrls), 0)
+	is.Equal(config.FfmpegPath, "ffmpeg")
+	is.Equal(config.FfprobePath, "ffprobe")
+	is.Equal(config.FfmpegOutputDir, "/var/lib/ad-normalizer")
+	is.Equal(config.FfmpegOutputUrl.String(), "http://ad-normalizer.osaas.io/assets")
+	is.Equal(config.FfmpegConcurrency, 4)
+
+	t.Setenv("TRANSCODER", "handbrake")
+	_, err = ReadConfig()
+	is.True(err != nil)
+}
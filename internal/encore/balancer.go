@@ -0,0 +1,107 @@
+package encore
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BalancingStrategy decides which Encore instance a new job is submitted to.
+type BalancingStrategy string
+
+const (
+	// Spreads the jobs evenly over the instances
+	RoundRobin BalancingStrategy = "round-robin"
+	// Picks the instance with the shortest queue, as reported by its queue API
+	LeastQueued BalancingStrategy = "least-queued"
+)
+
+func ParseBalancingStrategy(s string) (BalancingStrategy, error) {
+	switch strategy := BalancingStrategy(strings.ToLower(strings.TrimSpace(s))); strategy {
+	case RoundRobin, LeastQueued:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown balancing strategy %q", s)
+	}
+}
+
+// An Encore instance jobs can be submitted to.
+type instance struct {
+	url url.URL
+	// Instances are healthy until a health check or a submit says otherwise
+	healthy atomic.Bool
+	// The queue length from the last health check, plus the jobs
+	// submitted since, so that bursts don't all go to the same instance
+	queued atomic.Int64
+}
+
+func (i *instance) String() string {
+	return i.url.String()
+}
+
+type balancer struct {
+	strategy  BalancingStrategy
+	instances []*instance
+	mu        sync.Mutex
+	next      int
+}
+
+func newBalancer(urls []url.URL, strategy BalancingStrategy) *balancer {
+	b := &balancer{strategy: cmp.Or(strategy, RoundRobin)}
+	for _, u := range urls {
+		inst := &instance{url: u}
+		inst.healthy.Store(true)
+		b.instances = append(b.instances, inst)
+	}
+	return b
+}
+
+// Returns the instances in the order a new job should be tried on them.
+// Unhealthy instances are kept last instead of being left out, so that
+// jobs can still be submitted if the health checks are wrong or disabled.
+func (b *balancer) candidates() []*instance {
+	b.mu.Lock()
+	start := b.next
+	b.next = (b.next + 1) % len(b.instances)
+	b.mu.Unlock()
+
+	ordered := make([]*instance, 0, len(b.instances))
+	ordered = append(ordered, b.instances[start:]...)
+	ordered = append(ordered, b.instances[:start]...)
+	// Stable, so that ties keep the round-robin order
+	slices.SortStableFunc(ordered, func(a, c *instance) int {
+		if a.healthy.Load() != c.healthy.Load() {
+			if a.healthy.Load() {
+				return -1
+			}
+			return 1
+		}
+		if b.strategy == LeastQueued {
+			return cmp.Compare(a.queued.Load(), c.queued.Load())
+		}
+		return 0
+	})
+	return ordered
+}
+
+// Returns the instance with the given base URL, or nil if it is not one
+// of the configured instances. Scheme and host are compared without regard
+// to case, and paths with or without a trailing slash.
+func (b *balancer) find(rawUrl string) *instance {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+	for _, inst := range b.instances {
+		if strings.EqualFold(inst.url.Scheme, u.Scheme) &&
+			strings.EqualFold(inst.url.Host, u.Host) &&
+			strings.TrimSuffix(inst.url.Path, "/") == strings.TrimSuffix(u.Path, "/") {
+			return inst
+		}
+	}
+	return nil
+}
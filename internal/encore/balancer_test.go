@@ -0,0 +1,239 @@
+package encore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+// A fake Encore instance with a queue of the given length, or a broken
+// queue API if it is negative. Submits are answered with submitStatus,
+// and only the job with the given ID can be fetched or cancelled.
+type fakeInstance struct {
+	server  *httptest.Server
+	submits atomic.Int32
+	cancels atomic.Int32
+}
+
+func setupFakeInstance(queueLength int, submitStatus int, jobId string) *fakeInstance {
+	fake := &fakeInstance{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/queue":
+			if queueLength < 0 {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(make([]struct{}, queueLength))
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+			if r.URL.Path != "/encoreJobs/"+jobId+"/cancel" {
+				http.NotFound(w, r)
+				return
+			}
+			fake.cancels.Add(1)
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost:
+			fake.submits.Add(1)
+			if submitStatus != http.StatusCreated {
+				http.Error(w, "cannot take jobs", submitStatus)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": "job-id", "externalId": "test-creative-id"}`))
+		case strings.TrimPrefix(r.URL.Path, "/encoreJobs/") == jobId:
+			_, _ = w.Write([]byte(`{"id": "` + jobId + `", "externalId": "test-creative-id"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return fake
+}
+
+func (f *fakeInstance) url() url.URL {
+	parsed, _ := url.Parse(f.server.URL)
+	return *parsed
+}
+
+func setupBalancedHandler(strategy BalancingStrategy, instances ...*fakeInstance) *HttpEncoreHandler {
+	urls := []url.URL{}
+	for _, instance := range instances {
+		urls = append(urls, instance.url())
+	}
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
+	return NewHttpEncoreHandler(
+		&http.Client{},
+		urls,
+		strategy,
+		"test-profile",
+		nil,
+		*bucketUrl,
+		*rootUrl,
+		RetryPolicy{},
+		nil,
+	)
+}
+
+// Runs a single round of health checks.
+func checkInstances(handler *HttpEncoreHandler) {
+	for _, inst := range handler.balancer.instances {
+		handler.checkInstance(context.Background(), inst)
+	}
+}
+
+var balancedAsset = &structure.ManifestAsset{
+	CreativeId:        "test-creative-id",
+	MasterPlaylistUrl: "http://example.com/test.mp4",
+}
+
+func TestParseBalancingStrategy(t *testing.T) {
+	is := is.New(t)
+	strategy, err := ParseBalancingStrategy("Least-Queued")
+	is.NoErr(err)
+	is.Equal(strategy, LeastQueued)
+	_, err = ParseBalancingStrategy("random")
+	is.True(err != nil)
+}
+
+func TestRoundRobin(t *testing.T) {
+	is := is.New(t)
+	first := setupFakeInstance(0, http.StatusCreated, "")
+	defer first.server.Close()
+	second := setupFakeInstance(0, http.StatusCreated, "")
+	defer second.server.Close()
+	handler := setupBalancedHandler(RoundRobin, first, second)
+
+	for range 4 {
+		_, err := handler.CreateJob(balancedAsset)
+		is.NoErr(err)
+	}
+	is.Equal(first.submits.Load(), int32(2))
+	is.Equal(second.submits.Load(), int32(2))
+}
+
+func TestLeastQueued(t *testing.T) {
+	is := is.New(t)
+	busy := setupFakeInstance(5, http.StatusCreated, "")
+	defer busy.server.Close()
+	idle := setupFakeInstance(1, http.StatusCreated, "")
+	defer idle.server.Close()
+	handler := setupBalancedHandler(LeastQueued, busy, idle)
+	checkInstances(handler)
+
+	for range 4 {
+		job, err := handler.CreateJob(balancedAsset)
+		is.NoErr(err)
+		is.Equal(job.EncoreUrl, idle.server.URL)
+	}
+	// The queues are even now, so the round-robin order decides
+	job, err := handler.CreateJob(balancedAsset)
+	is.NoErr(err)
+	is.Equal(job.EncoreUrl, busy.server.URL)
+}
+
+func TestFailover(t *testing.T) {
+	is := is.New(t)
+	down := setupFakeInstance(0, http.StatusServiceUnavailable, "")
+	defer down.server.Close()
+	up := setupFakeInstance(0, http.StatusCreated, "")
+	defer up.server.Close()
+	handler := setupBalancedHandler(RoundRobin, down, up)
+
+	job, err := handler.CreateJob(balancedAsset)
+	is.NoErr(err)
+	is.Equal(job.EncoreUrl, up.server.URL)
+	is.Equal(down.submits.Load(), int32(1))
+	// The failed instance is only tried when no other instance is left
+	for range 3 {
+		_, err = handler.CreateJob(balancedAsset)
+		is.NoErr(err)
+	}
+	is.Equal(down.submits.Load(), int32(1))
+	is.Equal(up.submits.Load(), int32(4))
+}
+
+func TestHealthChecks(t *testing.T) {
+	is := is.New(t)
+	broken := setupFakeInstance(-1, http.StatusCreated, "")
+	defer broken.server.Close()
+	healthy := setupFakeInstance(0, http.StatusCreated, "")
+	defer healthy.server.Close()
+	handler := setupBalancedHandler(RoundRobin, broken, healthy)
+	checkInstances(handler)
+
+	for range 2 {
+		job, err := handler.CreateJob(balancedAsset)
+		is.NoErr(err)
+		is.Equal(job.EncoreUrl, healthy.server.URL)
+	}
+	is.Equal(broken.submits.Load(), int32(0))
+}
+
+func TestGetEncoreJobFromOwner(t *testing.T) {
+	is := is.New(t)
+	other := setupFakeInstance(0, http.StatusCreated, "")
+	defer other.server.Close()
+	owner := setupFakeInstance(0, http.StatusCreated, "owned-job")
+	defer owner.server.Close()
+	handler := setupBalancedHandler(RoundRobin, other, owner)
+
+	job, err := handler.GetEncoreJob(owner.server.URL+"/", "owned-job")
+	is.NoErr(err)
+	is.Equal(job.EncoreUrl, owner.server.URL)
+
+	// Without a known owner, all instances are asked
+	job, err = handler.GetEncoreJob("", "owned-job")
+	is.NoErr(err)
+	is.Equal(job.EncoreUrl, owner.server.URL)
+	job, err = handler.GetEncoreJob("http://unknown.example.com", "owned-job")
+	is.NoErr(err)
+	is.Equal(job.EncoreUrl, owner.server.URL)
+
+	_, err = handler.GetEncoreJob("", "missing-job")
+	is.True(err != nil)
+}
+
+func TestCancelJob(t *testing.T) {
+	is := is.New(t)
+	other := setupFakeInstance(0, http.StatusCreated, "")
+	defer other.server.Close()
+	owner := setupFakeInstance(0, http.StatusCreated, "owned-job")
+	defer owner.server.Close()
+	handler := setupBalancedHandler(RoundRobin, other, owner)
+
+	is.NoErr(handler.CancelJob(owner.server.URL, "owned-job"))
+	is.Equal(owner.cancels.Load(), int32(1))
+	// Without a known owner, all instances are tried
+	is.NoErr(handler.CancelJob("", "owned-job"))
+	is.Equal(owner.cancels.Load(), int32(2))
+
+	is.True(handler.CancelJob(owner.server.URL, "missing-job") != nil)
+	is.Equal(other.cancels.Load(), int32(0))
+}
+
+func TestFindInstance(t *testing.T) {
+	is := is.New(t)
+	parse := func(raw string) url.URL {
+		u, err := url.Parse(raw)
+		is.NoErr(err)
+		return *u
+	}
+	b := newBalancer([]url.URL{parse("https://encore-a.example.com/"), parse("https://encore-b.example.com/api")}, RoundRobin)
+
+	is.Equal(b.find("https://encore-a.example.com"), b.instances[0])
+	is.Equal(b.find("https://encore-a.example.com/"), b.instances[0])
+	is.Equal(b.find("HTTPS://Encore-A.example.com"), b.instances[0])
+	is.Equal(b.find("https://encore-b.example.com/api/"), b.instances[1])
+	is.True(b.find("https://encore-b.example.com") == nil)
+	is.True(b.find("http://encore-a.example.com") == nil)
+	is.True(b.find("") == nil)
+	is.True(b.find("://") == nil)
+}
@@ -2,48 +2,74 @@ package encore
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/signing"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/Eyevinn/ad-normalizer/internal/util"
 	osaasclient "github.com/EyevinnOSC/client-go"
+	"github.com/google/uuid"
 )
 
 type EncoreHandler interface {
 	CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error)
-	GetEncoreJob(jobId string) (structure.EncoreJob, error)
+	// Gets the job from the Encore instance with the given base URL. If the
+	// instance is unknown, e.g. for jobs stored before it was recorded, all
+	// instances are asked.
+	GetEncoreJob(encoreUrl string, jobId string) (structure.EncoreJob, error)
+	// Cancels a queued or running job. The instance is found the same way
+	// as for GetEncoreJob.
+	CancelJob(encoreUrl string, jobId string) error
+}
+
+// Controls how submits that fail with a transient error are retried.
+// The wait between attempts doubles for every retry.
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration
 }
 
 type HttpEncoreHandler struct {
 	Client             *http.Client
-	encoreUrl          url.URL
+	balancer           *balancer
 	transcodingProfile string
 	oscContext         *osaasclient.Context
 	outputBucket       url.URL
 	rootUrl            url.URL
+	retryPolicy        RetryPolicy
+	// Signs the callback URLs if set
+	callbackSigner *signing.Signer
 }
 
 func NewHttpEncoreHandler(
 	client *http.Client,
-	encoreUrl url.URL,
+	encoreUrls []url.URL,
+	balancing BalancingStrategy,
 	transcodingProfile string,
 	oscContext *osaasclient.Context,
 	outputBucket url.URL,
 	rootUrl url.URL,
+	retryPolicy RetryPolicy,
+	callbackSigner *signing.Signer,
 ) *HttpEncoreHandler {
 	return &HttpEncoreHandler{
 		Client:             client,
-		encoreUrl:          encoreUrl,
+		balancer:           newBalancer(encoreUrls, balancing),
 		transcodingProfile: transcodingProfile,
 		oscContext:         oscContext,
 		outputBucket:       outputBucket,
 		rootUrl:            rootUrl,
+		retryPolicy:        retryPolicy,
+		callbackSigner:     callbackSigner,
 	}
 }
 
@@ -52,13 +78,11 @@ func (eh *HttpEncoreHandler) CreateJob(creative *structure.ManifestAsset) (struc
 		eh.outputBucket,
 		creative.CreativeId,
 	)
-	callbackUrl := eh.rootUrl.JoinPath("/encoreCallback").String()
 	job := structure.EncoreJob{
-		ExternalId:          creative.CreativeId,
-		Profile:             eh.transcodingProfile,
-		OutputFolder:        outputFolder,
-		BaseName:            creative.CreativeId,
-		ProgressCallbackUri: callbackUrl,
+		ExternalId:   creative.CreativeId,
+		Profile:      eh.transcodingProfile,
+		OutputFolder: outputFolder,
+		BaseName:     creative.CreativeId,
 		Inputs: []structure.EncoreInput{
 			{
 				Uri:       creative.MasterPlaylistUrl,
@@ -68,18 +92,82 @@ func (eh *HttpEncoreHandler) CreateJob(creative *structure.ManifestAsset) (struc
 			},
 		},
 	}
+	callbackUrl := eh.rootUrl.JoinPath("/encoreCallback")
+	if eh.callbackSigner != nil {
+		// The token is bound to the creative and the job, and expires, so it
+		// can't be used to report on any other job. Encore keeps the job ID
+		// it is given, which lets the ID be part of the token.
+		job.Id = uuid.NewString()
+		query := callbackUrl.Query()
+		eh.callbackSigner.SignQuery(query, creative.CreativeId, job.Id)
+		callbackUrl.RawQuery = query.Encode()
+	}
+	job.ProgressCallbackUri = callbackUrl.String()
 
-	submitted, err := eh.submitJob(job)
+	submitted, err := eh.submitToInstances(job)
+	backoff := eh.retryPolicy.Backoff
+	for attempt := 0; err != nil && attempt < eh.retryPolicy.MaxRetries && isTransient(err); attempt++ {
+		logger.Warn("Transient error submitting Encore job, retrying",
+			slog.String("creativeId", creative.CreativeId),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("backoff", backoff),
+			slog.String("error", err.Error()),
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+		submitted, err = eh.submitToInstances(job)
+	}
 	if err != nil {
 		logger.Error("Failed to submit Encore job", slog.String("error", err.Error()))
+		return submitted, err
 	}
 	return submitted, nil
 }
 
-func (eh *HttpEncoreHandler) GetEncoreJob(jobId string) (structure.EncoreJob, error) {
-	logger.Debug("Getting Encore job", slog.String("jobId", jobId))
+// Submits the job to the instances in the order of the balancing strategy,
+// failing over to the next instance on transient errors.
+func (eh *HttpEncoreHandler) submitToInstances(job structure.EncoreJob) (structure.EncoreJob, error) {
+	var submitted structure.EncoreJob
+	var err error
+	for _, inst := range eh.balancer.candidates() {
+		submitted, err = eh.submitJob(inst, job)
+		if err == nil || !isTransient(err) {
+			return submitted, err
+		}
+		if inst.healthy.Swap(false) {
+			logger.Warn("Encore instance failed to take a job, marking as unhealthy",
+				slog.String("encoreUrl", inst.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return submitted, err
+}
+
+func isTransient(err error) bool {
+	var encoreErr structure.EncoreError
+	return errors.As(err, &encoreErr) && encoreErr.Transient()
+}
+
+func (eh *HttpEncoreHandler) GetEncoreJob(encoreUrl string, jobId string) (structure.EncoreJob, error) {
+	if inst := eh.balancer.find(encoreUrl); inst != nil {
+		return eh.getJob(inst, jobId)
+	}
+	var job structure.EncoreJob
+	var err error
+	for _, inst := range eh.balancer.instances {
+		job, err = eh.getJob(inst, jobId)
+		if err == nil {
+			return job, nil
+		}
+	}
+	return job, err
+}
+
+func (eh *HttpEncoreHandler) getJob(inst *instance, jobId string) (structure.EncoreJob, error) {
+	logger.Debug("Getting Encore job", slog.String("jobId", jobId), slog.String("encoreUrl", inst.String()))
 	job := structure.EncoreJob{} // init zero value
-	jobRequest, err := http.NewRequest("GET", eh.encoreUrl.JoinPath("/encoreJobs", jobId).String(), nil)
+	jobRequest, err := http.NewRequest("GET", inst.url.JoinPath("/encoreJobs", jobId).String(), nil)
 	logger.Debug("Created Encore job request", slog.String("url", jobRequest.URL.String()))
 	if err != nil {
 		logger.Error("Failed to create Encore job request", slog.String("error", err.Error()))
@@ -87,13 +175,8 @@ func (eh *HttpEncoreHandler) GetEncoreJob(jobId string) (structure.EncoreJob, er
 	}
 	jobRequest.Header.Set("Accept", "application/hal+json")
 	jobRequest.Header.Set("Content-Type", "application/json")
-	if eh.oscContext != nil && eh.oscContext.PersonalAccessToken != "" {
-		sat, err := eh.oscContext.GetServiceAccessToken("encore")
-		if err != nil {
-			logger.Error("Failed to get Service Access Token for Encore", slog.String("error", err.Error()))
-			return job, fmt.Errorf("failed to get Service Access Token for Encore: %w", err)
-		}
-		jobRequest.Header.Set("x-jwt", "Bearer "+sat)
+	if err := eh.authorize(jobRequest); err != nil {
+		return job, err
 	}
 	res, err := eh.Client.Do(jobRequest)
 	if err != nil {
@@ -111,17 +194,56 @@ func (eh *HttpEncoreHandler) GetEncoreJob(jobId string) (structure.EncoreJob, er
 		logger.Error("Failed to decode Encore job response", slog.String("error", err.Error()))
 		return job, fmt.Errorf("failed to decode Encore job response")
 	}
+	job.EncoreUrl = inst.String()
 	return job, nil
 }
 
-func (eh *HttpEncoreHandler) submitJob(job structure.EncoreJob) (structure.EncoreJob, error) {
+func (eh *HttpEncoreHandler) CancelJob(encoreUrl string, jobId string) error {
+	if inst := eh.balancer.find(encoreUrl); inst != nil {
+		return eh.cancelJob(inst, jobId)
+	}
+	var err error
+	for _, inst := range eh.balancer.instances {
+		err = eh.cancelJob(inst, jobId)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (eh *HttpEncoreHandler) cancelJob(inst *instance, jobId string) error {
+	logger.Debug("Cancelling Encore job", slog.String("jobId", jobId), slog.String("encoreUrl", inst.String()))
+	cancelRequest, err := http.NewRequest("POST", inst.url.JoinPath("/encoreJobs", jobId, "cancel").String(), nil)
+	if err != nil {
+		logger.Error("Failed to create Encore cancel request", slog.String("error", err.Error()))
+		return err
+	}
+	cancelRequest.Header.Set("Accept", "application/hal+json")
+	if err := eh.authorize(cancelRequest); err != nil {
+		return err
+	}
+	res, err := eh.Client.Do(cancelRequest)
+	if err != nil {
+		logger.Error("Failed to cancel Encore job", slog.String("error", err.Error()))
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		logger.Error("Failed to cancel Encore job", slog.Int("statusCode", res.StatusCode))
+		return fmt.Errorf("failed to cancel Encore job, status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (eh *HttpEncoreHandler) submitJob(inst *instance, job structure.EncoreJob) (structure.EncoreJob, error) {
 	serialized, err := json.Marshal(job)
 	if err != nil {
 		logger.Error("Failed to serialize Encore job", slog.String("error", err.Error()))
 		return structure.EncoreJob{}, err
 	}
 	jobRequest, err := http.NewRequest("POST",
-		eh.encoreUrl.JoinPath("/encoreJobs").String(),
+		inst.url.JoinPath("/encoreJobs").String(),
 		bytes.NewBuffer(serialized),
 	)
 
@@ -132,18 +254,14 @@ func (eh *HttpEncoreHandler) submitJob(job structure.EncoreJob) (structure.Encor
 
 	jobRequest.Header.Set("Content-Type", "application/json")
 	jobRequest.Header.Set("Accept", "application/hal+json")
-	if eh.oscContext != nil && eh.oscContext.PersonalAccessToken != "" {
-		sat, err := eh.oscContext.GetServiceAccessToken("encore")
-		if err != nil {
-			logger.Error("Failed to get Service Access Token for Encore", slog.String("error", err.Error()))
-			return job, fmt.Errorf("failed to get Service Access Token for Encore: %w", err)
-		}
-		jobRequest.Header.Set("x-jwt", "Bearer "+sat)
+	if err := eh.authorize(jobRequest); err != nil {
+		return job, err
 	}
 	resp, err := eh.Client.Do(jobRequest)
 	if err != nil {
 		logger.Error("Failed to submit Encore job", slog.String("error", err.Error()))
-		return structure.EncoreJob{}, err
+		// No response at all, f.ex. connection refused
+		return structure.EncoreJob{}, structure.EncoreError{Message: err.Error()}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusCreated {
@@ -152,7 +270,10 @@ func (eh *HttpEncoreHandler) submitJob(job structure.EncoreJob) (structure.Encor
 			slog.Int("statusCode", resp.StatusCode),
 			slog.String("error", string(respStr)),
 		)
-		return structure.EncoreJob{}, fmt.Errorf("failed to submit Encore job, status code: %d", resp.StatusCode)
+		return structure.EncoreJob{}, structure.EncoreError{
+			StatusCode: resp.StatusCode,
+			Message:    "failed to submit Encore job: " + string(respStr),
+		}
 	}
 	newJob := structure.EncoreJob{}
 	jsonDecoder := json.NewDecoder(resp.Body)
@@ -161,6 +282,109 @@ func (eh *HttpEncoreHandler) submitJob(job structure.EncoreJob) (structure.Encor
 		logger.Error("Failed to decode Encore job response", slog.String("error", err.Error()))
 		return structure.EncoreJob{}, fmt.Errorf("failed to decode Encore job response")
 	}
-	logger.Info("Successfully submitted Encore job", slog.String("jobId", newJob.ExternalId))
+	logger.Info("Successfully submitted Encore job",
+		slog.String("jobId", newJob.ExternalId),
+		slog.String("encoreUrl", inst.String()),
+	)
+	newJob.EncoreUrl = inst.String()
+	inst.queued.Add(1)
+	inst.healthy.Store(true)
 	return newJob, nil
 }
+
+// Adds the service access token when running in OSC.
+func (eh *HttpEncoreHandler) authorize(req *http.Request) error {
+	if eh.oscContext == nil || eh.oscContext.PersonalAccessToken == "" {
+		return nil
+	}
+	sat, err := eh.oscContext.GetServiceAccessToken("encore")
+	if err != nil {
+		logger.Error("Failed to get Service Access Token for Encore", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to get Service Access Token for Encore: %w", err)
+	}
+	req.Header.Set("x-jwt", "Bearer "+sat)
+	return nil
+}
+
+// RunHealthChecks polls the queue API of every Encore instance, to take
+// unreachable instances out of the rotation and to keep the queue lengths
+// used for balancing up to date. Blocks until the context is cancelled.
+func (eh *HttpEncoreHandler) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, inst := range eh.balancer.instances {
+			eh.checkInstance(ctx, inst)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (eh *HttpEncoreHandler) checkInstance(ctx context.Context, inst *instance) {
+	queued, err := eh.getQueueLength(ctx, inst)
+	if err != nil {
+		if inst.healthy.Swap(false) {
+			logger.Warn("Encore instance is unhealthy",
+				slog.String("encoreUrl", inst.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+	inst.queued.Store(int64(queued))
+	if !inst.healthy.Swap(true) {
+		logger.Info("Encore instance is healthy again", slog.String("encoreUrl", inst.String()))
+	}
+}
+
+func (eh *HttpEncoreHandler) getQueueLength(ctx context.Context, inst *instance) (int, error) {
+	queueRequest, err := http.NewRequestWithContext(ctx, "GET", inst.url.JoinPath("/queue").String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	queueRequest.Header.Set("Accept", "application/json")
+	if err := eh.authorize(queueRequest); err != nil {
+		return 0, err
+	}
+	res, err := eh.Client.Do(queueRequest)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to get Encore queue, status code: %d", res.StatusCode)
+	}
+	queue := []json.RawMessage{}
+	if err := json.NewDecoder(res.Body).Decode(&queue); err != nil {
+		return 0, fmt.Errorf("failed to decode Encore queue: %w", err)
+	}
+	return len(queue), nil
+}
+
+// Submit implements transcoder.Transcoder.
+func (eh *HttpEncoreHandler) Submit(creative *structure.ManifestAsset) (structure.TranscodeJob, error) {
+	job, err := eh.CreateJob(creative)
+	if err != nil {
+		return structure.TranscodeJob{}, err
+	}
+	return job.TranscodeJob(), nil
+}
+
+// Cancel implements transcoder.Transcoder.
+func (eh *HttpEncoreHandler) Cancel(location string, jobId string) error {
+	return eh.CancelJob(location, jobId)
+}
+
+// GetJob implements transcoder.Transcoder, the location is the base URL of
+// the Encore instance.
+func (eh *HttpEncoreHandler) GetJob(location string, jobId string) (structure.TranscodeJob, error) {
+	job, err := eh.GetEncoreJob(location, jobId)
+	if err != nil {
+		return structure.TranscodeJob{}, err
+	}
+	return job.TranscodeJob(), nil
+}
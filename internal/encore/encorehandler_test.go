@@ -2,6 +2,7 @@ package encore
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Eyevinn/ad-normalizer/internal/signing"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
@@ -28,11 +30,14 @@ func TestMain(m *testing.M) {
 	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
 	encoreHandler = NewHttpEncoreHandler(
 		client,
-		*testUrl,
+		[]url.URL{*testUrl},
+		RoundRobin,
 		"test-profile",
 		nil,
 		*bucketUrl,
 		*rootUrl,
+		RetryPolicy{},
+		nil,
 	)
 
 	exitCode := m.Run()
@@ -55,10 +60,42 @@ func TestCreateJob(t *testing.T) {
 	is.Equal(len(created.Inputs), 1)
 }
 
+func TestCreateJobSignedCallback(t *testing.T) {
+	is := is.New(t)
+	testServer := setupTestServer()
+	defer testServer.Close()
+	testUrl, _ := url.Parse(testServer.URL)
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
+	signer := signing.NewSigner("secret", time.Hour)
+	handler := NewHttpEncoreHandler(
+		&http.Client{},
+		[]url.URL{*testUrl},
+		RoundRobin,
+		"test-profile",
+		nil,
+		*bucketUrl,
+		*rootUrl,
+		RetryPolicy{},
+		signer,
+	)
+	created, err := handler.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "test-creative-id",
+		MasterPlaylistUrl: "http://example.com/test.mp4",
+	})
+	is.NoErr(err)
+	callbackUrl, err := url.Parse(created.ProgressCallbackUri)
+	is.NoErr(err)
+	is.Equal(callbackUrl.Path, "/encoreCallback")
+	is.True(created.Id != "")
+	is.True(signer.VerifyQuery(callbackUrl.Query(), "test-creative-id", created.Id))
+	is.True(!signer.VerifyQuery(callbackUrl.Query(), "test-creative-id", "another-job"))
+}
+
 func TestGetJob(t *testing.T) {
 	is := is.New(t)
 	jobId := uuid.New().String()
-	_, err := encoreHandler.GetEncoreJob(jobId)
+	_, err := encoreHandler.GetEncoreJob("", jobId)
 	is.NoErr(err)
 }
 
@@ -69,7 +106,7 @@ func TestGetJobWithoutOSCContext(t *testing.T) {
 	capturedJWT = ""
 	
 	jobId := uuid.New().String()
-	_, err := encoreHandler.GetEncoreJob(jobId)
+	_, err := encoreHandler.GetEncoreJob("", jobId)
 	is.NoErr(err)
 	
 	// Verify no JWT header is set when OSC context is nil
@@ -118,6 +155,88 @@ func TestJWTBearerTokenFormatting(t *testing.T) {
 	}
 }
 
+func TestCreateJobRetries(t *testing.T) {
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
+	asset := &structure.ManifestAsset{
+		CreativeId:        "test-creative-id",
+		MasterPlaylistUrl: "http://example.com/test.mp4",
+	}
+	cases := []struct {
+		name          string
+		failures      int
+		failureStatus int
+		expectErr     bool
+		expectCalls   int
+	}{
+		{name: "recovers after transient errors", failures: 2, failureStatus: http.StatusServiceUnavailable, expectCalls: 3},
+		{name: "gives up after max retries", failures: 5, failureStatus: http.StatusInternalServerError, expectErr: true, expectCalls: 3},
+		{name: "does not retry client errors", failures: 5, failureStatus: http.StatusBadRequest, expectErr: true, expectCalls: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			calls := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls <= c.failures {
+					http.Error(w, "encore is having a bad day", c.failureStatus)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(`{"id": "job-id", "externalId": "test-creative-id"}`))
+			}))
+			defer ts.Close()
+			testUrl, _ := url.Parse(ts.URL)
+			handler := NewHttpEncoreHandler(
+				&http.Client{},
+				[]url.URL{*testUrl},
+				RoundRobin,
+				"test-profile",
+				nil,
+				*bucketUrl,
+				*rootUrl,
+				RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond},
+				nil,
+			)
+			job, err := handler.CreateJob(asset)
+			is.Equal(calls, c.expectCalls)
+			is.Equal(err != nil, c.expectErr)
+			if !c.expectErr {
+				is.Equal(job.Id, "job-id")
+			}
+		})
+	}
+}
+
+func TestCreateJobConnectionRefused(t *testing.T) {
+	is := is.New(t)
+	ts := httptest.NewServer(http.NotFoundHandler())
+	testUrl, _ := url.Parse(ts.URL)
+	ts.Close() // Nothing is listening anymore
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
+	handler := NewHttpEncoreHandler(
+		&http.Client{},
+		[]url.URL{*testUrl},
+		RoundRobin,
+		"test-profile",
+		nil,
+		*bucketUrl,
+		*rootUrl,
+		RetryPolicy{MaxRetries: 1, Backoff: time.Millisecond},
+		nil,
+	)
+	_, err := handler.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "test-creative-id",
+		MasterPlaylistUrl: "http://example.com/test.mp4",
+	})
+	is.True(err != nil)
+	var encoreErr structure.EncoreError
+	is.True(errors.As(err, &encoreErr))
+	is.True(encoreErr.Transient())
+}
+
 func setupTestServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Capture JWT header for tests that need it
@@ -147,7 +266,10 @@ func setupTestServer() *httptest.Server {
 				return
 			}
 			time.Sleep(time.Millisecond * 10) // Simulate round-trip delay
-			postedJob.Id = uuid.New().String()
+			if postedJob.Id == "" {
+				// Like Encore, keep the ID the job was created with
+				postedJob.Id = uuid.New().String()
+			}
 
 			resbod, err := json.Marshal(postedJob)
 			if err != nil {
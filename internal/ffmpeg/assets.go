@@ -0,0 +1,33 @@
+package ffmpeg
+
+import (
+	"net/http"
+	"os"
+)
+
+// OutputFileSystem serves the files in the output directory. Directories
+// are reported as not existing, so that their contents are not listed.
+func OutputFileSystem(outputDir string) http.FileSystem {
+	return noDirectories{http.Dir(outputDir)}
+}
+
+type noDirectories struct {
+	http.FileSystem
+}
+
+func (fs noDirectories) Open(name string) (http.File, error) {
+	file, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
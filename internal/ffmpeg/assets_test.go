@@ -0,0 +1,32 @@
+package ffmpeg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestOutputFileSystem(t *testing.T) {
+	is := is.New(t)
+	outputDir := t.TempDir()
+	is.NoErr(os.MkdirAll(filepath.Join(outputDir, "creative", "job"), 0o755))
+	is.NoErr(os.WriteFile(filepath.Join(outputDir, "creative", "job", "index.m3u8"), []byte("#EXTM3U\n"), 0o644))
+	server := httptest.NewServer(http.FileServer(OutputFileSystem(outputDir)))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/creative/job/index.m3u8")
+	is.NoErr(err)
+	res.Body.Close()
+	is.Equal(res.StatusCode, http.StatusOK)
+
+	for _, dir := range []string{"/", "/creative/", "/creative/job/", "/creative"} {
+		res, err := http.Get(server.URL + dir)
+		is.NoErr(err)
+		res.Body.Close()
+		is.Equal(res.StatusCode, http.StatusNotFound) // no directory listing
+	}
+}
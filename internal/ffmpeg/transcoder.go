@@ -0,0 +1,362 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/google/uuid"
+)
+
+const PROFILE = "ffmpeg-hls"
+const PLAYLIST_NAME = "index.m3u8"
+
+// How long finished jobs can still be looked up
+const jobRetention = time.Hour
+
+// Progress is only reported in steps of this many percent
+const progressStep = 5
+
+// The protocols ffprobe and ffmpeg may open, so that a source cannot make
+// them read local files. crypto is needed for encrypted HLS sources.
+const protocolWhitelist = "https,http,tls,tcp,crypto"
+
+// Transcoder runs ffmpeg locally, and writes the creatives as HLS into a
+// local directory that is served from outputUrl. Jobs are only kept in
+// memory, so they are lost on restart.
+type Transcoder struct {
+	ffmpegPath  string
+	ffprobePath string
+	outputDir   string
+	outputUrl   url.URL
+	// Limits the number of ffmpeg processes running at the same time
+	slots chan struct{}
+	mu    sync.Mutex
+	jobs  map[string]*structure.TranscodeJob
+	// Stops the jobs that have not finished yet
+	cancels map[string]context.CancelFunc
+	// Runs the jobs that have been submitted but not started yet
+	starts   map[string]func()
+	onUpdate func(structure.TranscodeJob)
+}
+
+func NewTranscoder(
+	ffmpegPath string,
+	ffprobePath string,
+	outputDir string,
+	outputUrl url.URL,
+	concurrency int,
+) *Transcoder {
+	return &Transcoder{
+		ffmpegPath:  ffmpegPath,
+		ffprobePath: ffprobePath,
+		outputDir:   outputDir,
+		outputUrl:   outputUrl,
+		slots:       make(chan struct{}, max(concurrency, 1)),
+		jobs:        make(map[string]*structure.TranscodeJob),
+		cancels:     make(map[string]context.CancelFunc),
+		starts:      make(map[string]func()),
+		onUpdate:    func(structure.TranscodeJob) {},
+	}
+}
+
+// Notify implements transcoder.Notifier.
+func (t *Transcoder) Notify(onUpdate func(structure.TranscodeJob)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onUpdate = onUpdate
+}
+
+// Submit implements transcoder.Transcoder. Only http(s) sources are
+// accepted. The job does not run until it is started with Start.
+func (t *Transcoder) Submit(creative *structure.ManifestAsset) (structure.TranscodeJob, error) {
+	source, err := url.Parse(creative.MasterPlaylistUrl)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") {
+		return structure.TranscodeJob{}, fmt.Errorf("unsupported source %q, only http(s) sources can be transcoded", creative.MasterPlaylistUrl)
+	}
+	id := uuid.NewString()
+	job := &structure.TranscodeJob{
+		Id:           id,
+		CreativeId:   creative.CreativeId,
+		Profile:      PROFILE,
+		Status:       structure.TranscodeQueued,
+		Source:       creative.MasterPlaylistUrl,
+		OutputFolder: path.Join(creative.CreativeId, id),
+		BaseName:     strings.TrimSuffix(PLAYLIST_NAME, ".m3u8"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.mu.Lock()
+	t.jobs[id] = job
+	t.cancels[id] = cancel
+	t.starts[id] = func() { go t.run(ctx, id) }
+	submitted := *job
+	t.mu.Unlock()
+	return submitted, nil
+}
+
+// Start implements transcoder.Starter.
+func (t *Transcoder) Start(jobId string) {
+	t.mu.Lock()
+	start, found := t.starts[jobId]
+	delete(t.starts, jobId)
+	t.mu.Unlock()
+	if found {
+		start()
+	}
+}
+
+// GetJob implements transcoder.Transcoder. All jobs run locally, so the
+// location is not used.
+func (t *Transcoder) GetJob(location string, jobId string) (structure.TranscodeJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, found := t.jobs[jobId]
+	if !found {
+		return structure.TranscodeJob{}, fmt.Errorf("ffmpeg job %s not found", jobId)
+	}
+	return *job, nil
+}
+
+// Cancel implements transcoder.Transcoder. The ffmpeg process is killed,
+// and the job is reported as cancelled once it has stopped.
+func (t *Transcoder) Cancel(location string, jobId string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, found := t.jobs[jobId]
+	if !found {
+		return fmt.Errorf("ffmpeg job %s not found", jobId)
+	}
+	if _, pending := t.starts[jobId]; pending {
+		// Never started, so there is nothing to report either
+		t.cancels[jobId]()
+		delete(t.starts, jobId)
+		delete(t.cancels, jobId)
+		delete(t.jobs, jobId)
+		return nil
+	}
+	switch job.Status {
+	case structure.TranscodeSuccessful, structure.TranscodeFailed, structure.TranscodeCancelled:
+		return fmt.Errorf("ffmpeg job %s has already finished", jobId)
+	}
+	t.cancels[jobId]()
+	return nil
+}
+
+// Updates the job and reports the new state.
+func (t *Transcoder) update(jobId string, change func(job *structure.TranscodeJob)) {
+	t.mu.Lock()
+	job := t.jobs[jobId]
+	change(job)
+	updated := *job
+	onUpdate := t.onUpdate
+	t.mu.Unlock()
+	onUpdate(updated)
+}
+
+func (t *Transcoder) run(ctx context.Context, jobId string) {
+	defer time.AfterFunc(jobRetention, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.jobs, jobId)
+	})
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.cancels[jobId]()
+		delete(t.cancels, jobId)
+	}()
+
+	select {
+	case t.slots <- struct{}{}:
+		defer func() { <-t.slots }()
+	case <-ctx.Done():
+		t.cancelled(jobId)
+		return
+	}
+	t.update(jobId, func(job *structure.TranscodeJob) {
+		job.Status = structure.TranscodeInProgress
+	})
+	job, _ := t.GetJob("", jobId)
+	result, err := t.transcode(ctx, job)
+	if ctx.Err() != nil {
+		t.cancelled(jobId)
+		return
+	}
+	if err != nil {
+		logger.Error("ffmpeg job failed",
+			slog.String("creativeId", job.CreativeId),
+			slog.String("jobId", jobId),
+			slog.String("error", err.Error()),
+		)
+		t.update(jobId, func(job *structure.TranscodeJob) {
+			job.Status = structure.TranscodeFailed
+			job.Message = err.Error()
+		})
+		return
+	}
+	logger.Info("ffmpeg job completed",
+		slog.String("creativeId", job.CreativeId),
+		slog.String("jobId", jobId),
+	)
+	t.update(jobId, func(job *structure.TranscodeJob) {
+		job.Status = structure.TranscodeSuccessful
+		job.Progress = 100
+		job.Video = result.video
+		job.HasAudio = result.hasAudio
+		job.PlaylistUrl = t.outputUrl.JoinPath(job.OutputFolder, PLAYLIST_NAME).String()
+	})
+}
+
+func (t *Transcoder) cancelled(jobId string) {
+	logger.Info("ffmpeg job cancelled", slog.String("jobId", jobId))
+	t.update(jobId, func(job *structure.TranscodeJob) {
+		job.Status = structure.TranscodeCancelled
+	})
+}
+
+// What ffprobe found in the source
+type probeResult struct {
+	video    []structure.VideoRendition
+	hasAudio bool
+	duration time.Duration
+}
+
+type probeOutput struct {
+	Streams []struct {
+		CodecType  string `json:"codec_type"`
+		Width      int    `json:"width"`
+		Height     int    `json:"height"`
+		RFrameRate string `json:"r_frame_rate"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func (t *Transcoder) probe(ctx context.Context, source string) (probeResult, error) {
+	cmd := exec.CommandContext(ctx, t.ffprobePath,
+		"-v", "error",
+		"-protocol_whitelist", protocolWhitelist,
+		"-show_entries", "stream=codec_type,width,height,r_frame_rate:format=duration",
+		"-of", "json",
+		source,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return probeResult{}, fmt.Errorf("ffprobe failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	parsed := probeOutput{}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return probeResult{}, fmt.Errorf("failed to decode ffprobe output: %w", err)
+	}
+	result := probeResult{}
+	for _, stream := range parsed.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Only the first video stream is transcoded
+			if len(result.video) == 0 {
+				result.video = append(result.video, structure.VideoRendition{
+					Width:     stream.Width,
+					Height:    stream.Height,
+					FrameRate: structure.ParseFrameRate(stream.RFrameRate),
+				})
+			}
+		case "audio":
+			result.hasAudio = true
+		}
+	}
+	if len(result.video) == 0 {
+		return probeResult{}, errors.New("source has no video stream")
+	}
+	if seconds, err := strconv.ParseFloat(parsed.Format.Duration, 64); err == nil {
+		result.duration = time.Duration(seconds * float64(time.Second))
+	}
+	return result, nil
+}
+
+func (t *Transcoder) transcode(ctx context.Context, job structure.TranscodeJob) (probeResult, error) {
+	source, err := t.probe(ctx, job.Source)
+	if err != nil {
+		return probeResult{}, err
+	}
+	dir := filepath.Join(t.outputDir, filepath.FromSlash(job.OutputFolder))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return probeResult{}, err
+	}
+	cmd := exec.CommandContext(ctx, t.ffmpegPath,
+		"-hide_banner", "-nostdin", "-nostats", "-y",
+		"-protocol_whitelist", protocolWhitelist,
+		"-i", job.Source,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast",
+		"-c:a", "aac", "-b:a", "128k", "-ac", "2",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment_%05d.ts"),
+		"-master_pl_name", PLAYLIST_NAME,
+		"-progress", "pipe:1",
+		filepath.Join(dir, "media.m3u8"),
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return probeResult{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return probeResult{}, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	t.readProgress(job.Id, stdout, source.duration)
+	if err := cmd.Wait(); err != nil {
+		return probeResult{}, fmt.Errorf("ffmpeg failed: %w: %s", err, lastLine(stderr.String()))
+	}
+	return source, nil
+}
+
+// Reports the progress written by ffmpeg, as key=value lines.
+func (t *Transcoder) readProgress(jobId string, progress io.Reader, duration time.Duration) {
+	reported := 0
+	scanner := bufio.NewScanner(progress)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !found || duration <= 0 {
+			continue
+		}
+		outTime, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue // "N/A" before the first frame
+		}
+		// 100 is reported when the playlist is done
+		percent := min(int(time.Duration(outTime)*time.Microsecond*100/duration), 99)
+		if percent >= reported+progressStep {
+			reported = percent
+			t.update(jobId, func(job *structure.TranscodeJob) {
+				job.Progress = percent
+			})
+		}
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,191 @@
+package ffmpeg
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+const fakeFfprobe = `#!/bin/sh
+case "$*" in
+*broken*) echo "Invalid data found when processing input" >&2; exit 1 ;;
+esac
+cat <<EOF
+{"streams": [
+  {"codec_type": "video", "width": 1280, "height": 720, "r_frame_rate": "25/1"},
+  {"codec_type": "audio"}
+], "format": {"duration": "10.000000"}}
+EOF
+`
+
+// Writes the playlist next to the media playlist given as the last argument,
+// and reports half of the duration as done before finishing. Slow sources
+// never finish.
+const fakeFfmpeg = `#!/bin/sh
+case "$*" in
+*slow*) exec sleep 60 ;;
+esac
+for last; do true; done
+echo "#EXTM3U" > "$(dirname "$last")/index.m3u8"
+echo "out_time_us=N/A"
+echo "out_time_us=5000000"
+echo "progress=end"
+`
+
+func setupTranscoder(t *testing.T) (*Transcoder, string) {
+	bin := t.TempDir()
+	ffprobePath := filepath.Join(bin, "ffprobe")
+	ffmpegPath := filepath.Join(bin, "ffmpeg")
+	if err := os.WriteFile(ffprobePath, []byte(fakeFfprobe), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ffmpegPath, []byte(fakeFfmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	outputUrl, _ := url.Parse("https://normalizer.example.com/assets")
+	return NewTranscoder(ffmpegPath, ffprobePath, outputDir, *outputUrl, 1), outputDir
+}
+
+// Collects the reported updates until the job is done
+func waitForJob(t *testing.T, transcoder *Transcoder) func() []structure.TranscodeJob {
+	var mu sync.Mutex
+	updates := []structure.TranscodeJob{}
+	done := make(chan struct{})
+	transcoder.Notify(func(job structure.TranscodeJob) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, job)
+		switch job.Status {
+		case structure.TranscodeSuccessful, structure.TranscodeFailed, structure.TranscodeCancelled:
+			close(done)
+		}
+	})
+	return func() []structure.TranscodeJob {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("job did not finish")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return updates
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	is := is.New(t)
+	transcoder, outputDir := setupTranscoder(t)
+	wait := waitForJob(t, transcoder)
+
+	submitted, err := transcoder.Submit(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "http://example.com/creative.mp4",
+	})
+	is.NoErr(err)
+	is.Equal(submitted.Status, structure.TranscodeQueued)
+	is.Equal(submitted.Profile, PROFILE)
+	// Nothing runs until the job is started
+	time.Sleep(50 * time.Millisecond)
+	queued, err := transcoder.GetJob("", submitted.Id)
+	is.NoErr(err)
+	is.Equal(queued.Status, structure.TranscodeQueued)
+	transcoder.Start(submitted.Id)
+
+	updates := wait()
+	is.Equal(len(updates), 3)
+	is.Equal(updates[0].Status, structure.TranscodeInProgress)
+	is.Equal(updates[1].Progress, 50)
+	job := updates[2]
+	is.Equal(job.Status, structure.TranscodeSuccessful)
+	is.Equal(job.Progress, 100)
+	is.Equal(job.CreativeId, "creative")
+	is.Equal(job.Video, []structure.VideoRendition{{Width: 1280, Height: 720, FrameRate: 25}})
+	is.True(job.HasAudio)
+	is.Equal(job.PlaylistUrl, "https://normalizer.example.com/assets/creative/"+submitted.Id+"/index.m3u8")
+	_, err = os.Stat(filepath.Join(outputDir, "creative", submitted.Id, "index.m3u8"))
+	is.NoErr(err)
+
+	found, err := transcoder.GetJob("", submitted.Id)
+	is.NoErr(err)
+	is.Equal(found.Status, structure.TranscodeSuccessful)
+	_, err = transcoder.GetJob("", "unknown")
+	is.True(err != nil)
+
+	info, err := structure.TranscodeInfoFromJob(&found, false, url.URL{})
+	is.NoErr(err)
+	// The playlist is ready, there is nothing to package
+	is.Equal(info.Status, structure.StatusCompleted)
+	is.Equal(info.Url, job.PlaylistUrl)
+	is.Equal(info.AspectRatio, "16:9")
+}
+
+func TestTranscodeFailure(t *testing.T) {
+	is := is.New(t)
+	transcoder, _ := setupTranscoder(t)
+	wait := waitForJob(t, transcoder)
+
+	submitted, err := transcoder.Submit(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "http://example.com/broken.mp4",
+	})
+	is.NoErr(err)
+	transcoder.Start(submitted.Id)
+
+	updates := wait()
+	job := updates[len(updates)-1]
+	is.Equal(job.Status, structure.TranscodeFailed)
+	is.Equal(job.Message, "ffprobe failed: exit status 1: Invalid data found when processing input")
+}
+
+func TestTranscodeCancel(t *testing.T) {
+	is := is.New(t)
+	transcoder, _ := setupTranscoder(t)
+	wait := waitForJob(t, transcoder)
+
+	submitted, err := transcoder.Submit(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "http://example.com/slow.mp4",
+	})
+	is.NoErr(err)
+	transcoder.Start(submitted.Id)
+	is.NoErr(transcoder.Cancel("", submitted.Id))
+
+	updates := wait()
+	is.Equal(updates[len(updates)-1].Status, structure.TranscodeCancelled)
+	found, err := transcoder.GetJob("", submitted.Id)
+	is.NoErr(err)
+	is.Equal(found.Status, structure.TranscodeCancelled)
+	// There is nothing left to cancel
+	is.True(transcoder.Cancel("", submitted.Id) != nil)
+	is.True(transcoder.Cancel("", "unknown") != nil)
+
+	// A job that was never started is dropped, and cannot be started anymore
+	pending, err := transcoder.Submit(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "http://example.com/video.mp4",
+	})
+	is.NoErr(err)
+	is.NoErr(transcoder.Cancel("", pending.Id))
+	transcoder.Start(pending.Id)
+	_, err = transcoder.GetJob("", pending.Id)
+	is.True(err != nil)
+}
+
+func TestSubmitLocalSource(t *testing.T) {
+	is := is.New(t)
+	transcoder, _ := setupTranscoder(t)
+	for _, source := range []string{"file:///etc/passwd", "/etc/passwd", "concat:a.mp4|b.mp4"} {
+		_, err := transcoder.Submit(&structure.ManifestAsset{
+			CreativeId:        "creative",
+			MasterPlaylistUrl: source,
+		})
+		is.True(err != nil) // only http(s) sources are transcoded
+	}
+}
@@ -22,13 +22,17 @@ type AdsHandledEventArguments struct {
 	BrokenAds   int
 	IngestedAds int
 	ServedAds   int
+	// Sources blacklisted after failing repeatedly. Not tied to an ad
+	// request, so reported without a subdomain.
+	AutoBlacklisted int
 }
 
 type NormalizerMetrics struct {
-	Service     string `json:"service"`
-	BrokenAds   int    `json:"broken_ads"`
-	IngestedAds int    `json:"ingested_ads"`
-	ServedAds   int    `json:"served_ads"`
+	Service         string `json:"service"`
+	BrokenAds       int    `json:"broken_ads"`
+	IngestedAds     int    `json:"ingested_ads"`
+	ServedAds       int    `json:"served_ads"`
+	AutoBlacklisted int    `json:"auto_blacklisted"`
 }
 
 type NormalizerMetricsRequest = map[string]NormalizerMetrics // Key is same as Service == subdomain
@@ -153,12 +157,16 @@ func (c *normalizerKpiCollector) recordMetrics(args AdsHandledEventArguments) {
 	if args.ServedAds > 0 {
 		metrics.ServedAds += args.ServedAds
 	}
+	if args.AutoBlacklisted > 0 {
+		metrics.AutoBlacklisted += args.AutoBlacklisted
+	}
 	logger.Debug(
 		"added metrics, new state:",
 		slog.String("key", key),
 		slog.Int("broken", metrics.BrokenAds),
 		slog.Int("ingested", metrics.IngestedAds),
 		slog.Int("served", metrics.ServedAds),
+		slog.Int("autoBlacklisted", metrics.AutoBlacklisted),
 	)
 
 }
@@ -63,6 +63,12 @@ func TestKpiCollector(t *testing.T) {
 	is.Equal(metrics.ServedAds, 143)
 	is.Equal(metrics.Service, "test-subdomain")
 
+	c.AdsHandled(AdsHandledEventArguments{AutoBlacklisted: 1})
+	time.Sleep(time.Millisecond * 10)
+	metrics, exists = collector.kpiMap[""]
+	is.True(exists)
+	is.Equal(metrics.AutoBlacklisted, 1)
+
 	// Wait for export interval to trigger
 	time.Sleep(time.Millisecond * 250)
 
@@ -4,6 +4,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"io"
 	"log/slog"
@@ -15,12 +16,14 @@ import (
 	"time"
 
 	"github.com/Eyevinn/VMAP/vmap"
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
 	"github.com/Eyevinn/ad-normalizer/internal/config"
-	"github.com/Eyevinn/ad-normalizer/internal/encore"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/signing"
 	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	"github.com/Eyevinn/ad-normalizer/internal/util"
 	"go.opentelemetry.io/otel"
 )
@@ -36,34 +39,73 @@ type API struct {
 	assetServerUrl url.URL
 	keyField       string
 	keyRegex       string
-	encoreHandler  encore.EncoreHandler
+	transcoder     transcoder.Transcoder
 	client         *http.Client
 	jitPackage     bool
 	packageQueue   string
-	encoreUrl      url.URL
 	reportKpi      func(normalizerMetrics.AdsHandledEventArguments)
+	// Max number of wrapper hops followed before giving up on an ad
+	wrapperMaxDepth int
+	wrapperTimeout  time.Duration
+	inFlightTtl     int
+	dispatchBackoff int
+	// Authenticates callbacks if a callback secret is configured
+	callbackSigner *signing.Signer
+	// Failures after which a source is blacklisted, 0 disables it
+	autoBlacklistThreshold int
+	autoBlacklistWindow    int
+	blacklistRules         *blacklistRules
+	// Events kept in the audit log, 0 disables it
+	auditMaxLength int
+	// Retried jobs being submitted in the background
+	retries sync.WaitGroup
 }
 
 func NewAPI(
 	valkeyStore store.Store,
 	config config.AdNormalizerConfig,
-	encoreHandler encore.EncoreHandler,
+	jobTranscoder transcoder.Transcoder,
 	client *http.Client,
 	kpiReportFunc func(normalizerMetrics.AdsHandledEventArguments),
 ) *API {
-	return &API{
+	api := &API{
 		valkeyStore:    valkeyStore,
 		adServerUrl:    config.AdServerUrl,
 		assetServerUrl: config.AssetServerUrl,
 		keyField:       config.KeyField,
 		keyRegex:       config.KeyRegex,
-		encoreHandler:  encoreHandler,
+		transcoder:     jobTranscoder,
 		client:         client,
 		jitPackage:     config.JitPackage,
 		packageQueue:   config.PackagingQueueName,
-		encoreUrl:      config.EncoreUrl,
 		reportKpi:      kpiReportFunc,
+
+		wrapperMaxDepth: config.WrapperMaxDepth,
+		wrapperTimeout:  time.Duration(config.WrapperTimeout) * time.Millisecond,
+		inFlightTtl:     config.InFlightTtl,
+		dispatchBackoff: config.DispatchBackoff,
+		callbackSigner:  NewCallbackSigner(config),
+
+		autoBlacklistThreshold: config.AutoBlacklistThreshold,
+		autoBlacklistWindow:    config.AutoBlacklistWindow,
+		blacklistRules: &blacklistRules{
+			refresh: time.Duration(config.BlacklistRulesRefresh) * time.Second,
+		},
+		auditMaxLength: config.AuditLogMaxLength,
+	}
+	if notifier, ok := jobTranscoder.(transcoder.Notifier); ok {
+		notifier.Notify(api.handleTranscodeUpdate)
+	}
+	return api
+}
+
+// NewCallbackSigner returns the signer for the callback secret,
+// or nil if callbacks are not authenticated.
+func NewCallbackSigner(config config.AdNormalizerConfig) *signing.Signer {
+	if config.CallbackSecret == "" {
+		return nil
 	}
+	return signing.NewSigner(config.CallbackSecret, time.Duration(config.CallbackTokenTtl)*time.Second)
 }
 
 type statusResponse struct {
@@ -101,12 +143,49 @@ func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	filter, err := readJobFilter(query)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cursor, cursorMode, err := readCursor(query)
+	if err != nil {
+		http.Error(w, "Invalid cursor parameter", http.StatusBadRequest)
+		return
+	}
+	if cursorMode {
+		if query.Has("page") {
+			http.Error(w, "The page and cursor parameters cannot be combined", http.StatusBadRequest)
+			return
+		}
+		jobPage, err := api.valkeyStore.ListPage(filter, cursor, size)
+		if err != nil {
+			logger.Error("failed to list jobs", slog.String("error", err.Error()))
+			http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, statusResponse{
+			Jobs:        jobPage.Items,
+			Size:        len(jobPage.Items),
+			Next:        cursorLink(jobPath, query, jobFilterParams, jobPage.Next, size),
+			Prev:        cursorLink(jobPath, query, jobFilterParams, jobPage.Prev, size),
+			TotalAmount: jobPage.Total,
+		})
+		return
+	}
+
 	var prev, next string
 	if page > 0 {
-		prev = jobPath + "?page=" + strconv.Itoa(page-1) + "&size=" + strconv.Itoa(size)
+		prev = pageLink(jobPath, query, jobFilterParams, page-1, size)
 	}
 
-	results, cardinality, err := api.valkeyStore.List(page, size)
+	var results []structure.TranscodeInfo
+	var cardinality int64
+	if filter == (store.JobFilter{}) {
+		results, cardinality, err = api.valkeyStore.List(page, size)
+	} else {
+		results, cardinality, err = api.valkeyStore.ListFiltered(filter, page, size)
+	}
 	if err != nil {
 		logger.Error("failed to list jobs", slog.String("error", err.Error()))
 		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
@@ -114,7 +193,7 @@ func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(results) == size {
-		next = jobPath + "?page=" + strconv.Itoa(page+1) + "&size=" + strconv.Itoa(size)
+		next = pageLink(jobPath, query, jobFilterParams, page+1, size)
 	}
 	resp := statusResponse{
 		Jobs:        results,
@@ -136,17 +215,125 @@ func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(ret)
 }
 
+// Reads the cursor from the query. A listing is cursor based whenever the
+// cursor parameter is present, and an empty cursor starts from the newest entry.
+func readCursor(query url.Values) (*store.Cursor, bool, error) {
+	if !query.Has("cursor") {
+		return nil, false, nil
+	}
+	encoded := query.Get("cursor")
+	if encoded == "" {
+		return nil, true, nil
+	}
+	cursor, err := store.DecodeCursor(encoded)
+	if err != nil {
+		return nil, true, err
+	}
+	return &cursor, true, nil
+}
+
+// Builds a link to another page of a listing, keeping the given parameters
+// from the current query.
+func listLink(path string, query url.Values, keep []string, params url.Values) string {
+	for _, param := range keep {
+		if value := query.Get(param); value != "" {
+			params.Set(param, value)
+		}
+	}
+	return path + "?" + params.Encode()
+}
+
+func pageLink(path string, query url.Values, keep []string, page int, size int) string {
+	return listLink(path, query, keep, url.Values{
+		"page": {strconv.Itoa(page)},
+		"size": {strconv.Itoa(size)},
+	})
+}
+
+// Returns an empty link if there is no cursor.
+func cursorLink(path string, query url.Values, keep []string, cursor *store.Cursor, size int) string {
+	if cursor == nil {
+		return ""
+	}
+	return listLink(path, query, keep, url.Values{
+		"cursor": {cursor.Encode()},
+		"size":   {strconv.Itoa(size)},
+	})
+}
+
+func writeJson(w http.ResponseWriter, resp any) {
+	ret, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("failed to marshal response", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ret)
+}
+
+var jobFilterParams = []string{"status", "source", "since", "until", "prefix"}
+
+// Reads the job list filters from the query. Times are given either
+// as RFC 3339 timestamps or as unix timestamps in seconds.
+func readJobFilter(query url.Values) (store.JobFilter, error) {
+	filter := store.JobFilter{
+		Status: structure.JobStatus(strings.ToUpper(query.Get("status"))),
+		Source: query.Get("source"),
+		Prefix: query.Get("prefix"),
+	}
+	if filter.Status != "" && !filter.Status.Valid() {
+		return filter, errors.New("invalid status parameter")
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = parseTimeParam(since); err != nil {
+			return filter, errors.New("invalid since parameter")
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = parseTimeParam(until); err != nil {
+			return filter, errors.New("invalid until parameter")
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && filter.Until.Before(filter.Since) {
+		return filter, errors.New("until must not be before since")
+	}
+	return filter, nil
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 type blacklistRequest struct {
 	MediaUrl string `json:"mediaUrl"`
+	// Set to blacklist everything matching the pattern instead of the media URL
+	Type    structure.BlacklistRuleType `json:"type,omitempty"`
+	Pattern string                      `json:"pattern,omitempty"`
+	Reason  string                      `json:"reason,omitempty"`
+	// Only used when the request is not made with an API key, otherwise
+	// the name of the key is recorded
+	Actor string `json:"actor,omitempty"`
+	// Unix timestamp after which the entry is removed, 0 to keep it
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 type blacklistResponse struct {
-	MediaUrls  []string `json:"mediaUrls"`
-	Page       int      `json:"page"`
-	Size       int      `json:"size"`
-	Next       string   `json:"next,omitempty"`
-	Prev       string   `json:"prev,omitempty"`
-	TotalCount int64    `json:"totalCount"`
+	MediaUrls []string `json:"mediaUrls"`
+	// The same URLs, with the details of their entries
+	Entries []structure.BlacklistEntry `json:"entries"`
+	// All blacklist rules, these are not paginated
+	Rules      []structure.BlacklistRule `json:"rules"`
+	Page       int                       `json:"page"`
+	Size       int                       `json:"size"`
+	Next       string                    `json:"next,omitempty"`
+	Prev       string                    `json:"prev,omitempty"`
+	TotalCount int64                     `json:"totalCount"`
 }
 
 func readBlacklistRequest(r *http.Request) (blacklistRequest, error) {
@@ -177,7 +364,32 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
-		err = api.valkeyStore.BlackList(blRequest.MediaUrl)
+		if blRequest.ExpiresAt != 0 && blRequest.ExpiresAt <= time.Now().Unix() {
+			http.Error(w, "The expiresAt timestamp must be in the future", http.StatusBadRequest)
+			return
+		}
+		actor := blRequest.Actor
+		if principal, found := auth.FromContext(r.Context()); found {
+			actor = principal.Name
+		}
+		if blRequest.Type != "" {
+			api.addBlackListRule(w, structure.BlacklistRule{
+				Type:      blRequest.Type,
+				Pattern:   blRequest.Pattern,
+				Reason:    blRequest.Reason,
+				Actor:     actor,
+				CreatedAt: time.Now().Unix(),
+				ExpiresAt: blRequest.ExpiresAt,
+			})
+			return
+		}
+		err = api.valkeyStore.BlackList(structure.BlacklistEntry{
+			MediaUrl:  blRequest.MediaUrl,
+			Reason:    blRequest.Reason,
+			Actor:     actor,
+			CreatedAt: time.Now().Unix(),
+			ExpiresAt: blRequest.ExpiresAt,
+		})
 		if err != nil {
 			logger.Error("failed to blacklist media URL",
 				slog.String("mediaUrl", blRequest.MediaUrl),
@@ -186,7 +398,25 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to blacklist media URL", http.StatusInternalServerError)
 			return
 		}
-		logger.Info("blacklisted media URL", slog.String("mediaUrl", blRequest.MediaUrl))
+		logger.Info("blacklisted media URL",
+			slog.String("mediaUrl", blRequest.MediaUrl),
+			slog.String("reason", blRequest.Reason),
+			slog.String("actor", actor),
+		)
+		api.audit(actor, AUDIT_BLACKLIST_ADD, blRequest.MediaUrl, blacklistAuditDetails(blRequest.Reason, blRequest.ExpiresAt))
+		// Don't spend any more transcoding on it
+		cancelled, err := api.cancelJobsForSource(blRequest.MediaUrl)
+		if err != nil {
+			logger.Error("failed to cancel jobs for blacklisted media URL",
+				slog.String("mediaUrl", blRequest.MediaUrl),
+				slog.String("error", err.Error()),
+			)
+		} else if cancelled > 0 {
+			logger.Info("cancelled jobs for blacklisted media URL",
+				slog.String("mediaUrl", blRequest.MediaUrl),
+				slog.Int("count", cancelled),
+			)
+		}
 		w.WriteHeader(http.StatusNoContent)
 
 	case http.MethodDelete:
@@ -196,6 +426,14 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
+		actor := blRequest.Actor
+		if principal, found := auth.FromContext(r.Context()); found {
+			actor = principal.Name
+		}
+		if blRequest.Type != "" {
+			api.removeBlackListRule(w, structure.BlacklistRule{Type: blRequest.Type, Pattern: blRequest.Pattern}, actor)
+			return
+		}
 		err = api.valkeyStore.RemoveFromBlackList(blRequest.MediaUrl)
 		if err != nil {
 			logger.Error("failed to unblacklist media URL",
@@ -206,28 +444,60 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logger.Info("unblacklisted media URL", slog.String("mediaUrl", blRequest.MediaUrl))
+		api.audit(actor, AUDIT_BLACKLIST_REMOVE, blRequest.MediaUrl, nil)
+		// Give the source a fresh start before it is blacklisted automatically again
+		api.clearSourceFailures(blRequest.MediaUrl)
+		api.releaseCancelledJobsForSource(blRequest.MediaUrl)
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet:
 		query := r.URL.Query()
 		page := 0
 		size := 10
+		var err error
 		if p := query.Get("page"); p != "" {
-			page, err := strconv.Atoi(p)
+			page, err = strconv.Atoi(p)
 			if err != nil || page < 0 {
 				http.Error(w, "Invalid page parameter", http.StatusBadRequest)
 				return
 			}
 		}
 		if s := query.Get("size"); s != "" {
-			size, err := strconv.Atoi(s)
+			size, err = strconv.Atoi(s)
 			if err != nil || size <= 0 || size > 100 {
 				http.Error(w, "Invalid size parameter", http.StatusBadRequest)
 				return
 			}
 		}
+		cursor, cursorMode, err := readCursor(query)
+		if err != nil {
+			http.Error(w, "Invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+		if cursorMode {
+			if query.Has("page") {
+				http.Error(w, "The page and cursor parameters cannot be combined", http.StatusBadRequest)
+				return
+			}
+			blacklistPage, err := api.valkeyStore.GetBlackListPage(cursor, size)
+			if err != nil {
+				logger.Error("failed to list blacklist", slog.String("error", err.Error()))
+				http.Error(w, "Failed to list blacklist", http.StatusInternalServerError)
+				return
+			}
+			writeJson(w, blacklistResponse{
+				MediaUrls:  blacklistPage.Items,
+				Entries:    api.blacklistEntries(blacklistPage.Items),
+				Rules:      api.listBlackListRules(),
+				Size:       len(blacklistPage.Items),
+				Next:       cursorLink(blacklistPath, query, nil, blacklistPage.Next, size),
+				Prev:       cursorLink(blacklistPath, query, nil, blacklistPage.Prev, size),
+				TotalCount: blacklistPage.Total,
+			})
+			return
+		}
 		var prev, next string
 		if page > 0 {
-			prev = blacklistPath + "?page=" + strconv.Itoa(page-1) + "&size=" + strconv.Itoa(size)
+			prev = pageLink(blacklistPath, query, nil, page-1, size)
 		}
 
 		results, cardinality, err := api.valkeyStore.GetBlackList(page, size)
@@ -238,10 +508,12 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if len(results) == size {
-			next = blacklistPath + "?page=" + strconv.Itoa(page+1) + "&size=" + strconv.Itoa(size)
+			next = pageLink(blacklistPath, query, nil, page+1, size)
 		}
 		resp := blacklistResponse{
 			MediaUrls:  results,
+			Entries:    api.blacklistEntries(results),
+			Rules:      api.listBlackListRules(),
 			Page:       page,
 			Size:       len(results),
 			Next:       next,
@@ -290,7 +562,7 @@ func (api *API) HandleVmap(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode VMAP data", http.StatusInternalServerError)
 		return
 	}
-	if err := api.processVmap(&vmapData, subdomain); err != nil {
+	if err := api.processVmap(ctx, r, &vmapData, byteResponse, subdomain); err != nil {
 		logger.Error("failed to process VMAP data", slog.String("error", err.Error()))
 		http.Error(w, "Failed to process VMAP data", http.StatusInternalServerError)
 		return
@@ -316,6 +588,24 @@ func (api *API) HandleVast(w http.ResponseWriter, r *http.Request) {
 	logger.Debug("Handling VAST request", slog.String("path", r.URL.Path))
 	qp := r.URL.Query()
 	fillerUrl := qp.Get("filler")
+	var fillerDuration time.Duration
+	if fillerDur := qp.Get("fillerDur"); fillerDur != "" {
+		durSeconds, err := strconv.ParseFloat(fillerDur, 64)
+		if err != nil || durSeconds <= 0 {
+			logger.Warn("Invalid fillerDur parameter, filler duration is unknown", slog.String("fillerDur", fillerDur))
+		} else {
+			fillerDuration = time.Duration(durSeconds * float64(time.Second))
+		}
+	}
+	var breakDuration time.Duration
+	if dur := qp.Get("dur"); dur != "" {
+		durSeconds, err := strconv.ParseFloat(dur, 64)
+		if err != nil || durSeconds <= 0 {
+			logger.Warn("Invalid dur parameter, break duration will not be enforced", slog.String("dur", dur))
+		} else {
+			breakDuration = time.Duration(durSeconds * float64(time.Second))
+		}
+	}
 	responseBody, subdomain, err := api.makeAdServerRequest(r, ctx)
 	if err != nil {
 		logger.Error("failed to fetch VAST data", slog.String("error", err.Error()))
@@ -333,13 +623,29 @@ func (api *API) HandleVast(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Debug("Decoded VAST data", slog.Int("adCount", len(vastData.Ad)))
+	if hasWrapperAds(&vastData) {
+		var wrappers structure.WrapperVast
+		if err := xml.Unmarshal(responseBody, &wrappers); err != nil {
+			logger.Warn("failed to decode VAST wrappers", slog.String("error", err.Error()))
+		}
+		api.resolveWrappers(ctx, r, &vastData, &wrappers)
+		span.AddEvent("Resolved VAST wrappers")
+	}
 	if fillerUrl != "" {
 		logger.Debug("Adding filler to the end of the VAST",
 			slog.String("fillerUrl", fillerUrl),
 		)
-		vastData.Ad = append(vastData.Ad, util.CreateFillerAd(fillerUrl, len(vastData.Ad)+1))
+		filler := util.CreateFillerAd(fillerUrl, len(vastData.Ad)+1)
+		if fillerDuration > 0 {
+			filler.InLine.Creatives[0].Linear.Duration = vmap.Duration{Duration: fillerDuration}
+		}
+		vastData.Ad = append(vastData.Ad, filler)
 	}
 	api.findMissingAndDispatchJobs(&vastData, subdomain)
+	if breakDuration > 0 {
+		util.FitToBreakDuration(&vastData, breakDuration)
+		span.AddEvent("Fitted VAST data to break duration")
+	}
 	var serializedVast []byte
 	requestedContentType := r.Header.Get("Accept")
 	if requestedContentType == "application/json" {
@@ -439,18 +745,38 @@ func (api *API) makeAdServerRequest(r *http.Request, ctx context.Context) ([]byt
 }
 
 func (api *API) processVmap(
+	ctx context.Context,
+	r *http.Request,
 	vmapData *vmap.VMAP,
+	rawVmap []byte,
 	subdomain string,
 ) error {
-	breakWg := &sync.WaitGroup{}
+	// Wrappers are only decoded if needed, since it means parsing the document twice
+	var wrappers structure.WrapperVmap
 	for _, adBreak := range vmapData.AdBreaks {
+		if adBreak.AdSource.VASTData.VAST != nil && hasWrapperAds(adBreak.AdSource.VASTData.VAST) {
+			if err := xml.Unmarshal(rawVmap, &wrappers); err != nil {
+				logger.Warn("failed to decode VMAP wrappers", slog.String("error", err.Error()))
+			}
+			break
+		}
+	}
+	breakWg := &sync.WaitGroup{}
+	for idx, adBreak := range vmapData.AdBreaks {
 		logger.Debug("Processing ad break", slog.String("breakId", adBreak.Id))
 		if adBreak.AdSource.VASTData.VAST != nil {
+			var breakWrappers *structure.WrapperVast
+			if idx < len(wrappers.AdBreaks) {
+				breakWrappers = wrappers.AdBreaks[idx].Vast
+			}
 			breakWg.Add(1)
-			go func(vastData *vmap.VAST, subdomain string) {
+			go func(vastData *vmap.VAST, wrappers *structure.WrapperVast, subdomain string) {
 				defer breakWg.Done()
+				if hasWrapperAds(vastData) {
+					api.resolveWrappers(ctx, r, vastData, wrappers)
+				}
 				api.findMissingAndDispatchJobs(vastData, subdomain)
-			}(adBreak.AdSource.VASTData.VAST, subdomain)
+			}(adBreak.AdSource.VASTData.VAST, breakWrappers, subdomain)
 		}
 	}
 	breakWg.Wait()
@@ -462,26 +788,95 @@ func (api *API) dispatchJobs(missingCreatives map[string]structure.ManifestAsset
 	// Since the creatives won't be used in this response anyway
 	for _, creative := range missingCreatives {
 		go func(creative *structure.ManifestAsset) {
-			encoreJob, err := api.encoreHandler.CreateJob(creative)
+			// Claim the creative before submitting, so that concurrent requests
+			// on this or other instances don't create duplicate jobs
+			now := time.Now().Unix()
+			claimed, err := api.valkeyStore.Claim(creative.CreativeId, structure.TranscodeInfo{
+				Url:        creative.MasterPlaylistUrl,
+				Status:     structure.StatusQueued,
+				Source:     creative.MasterPlaylistUrl,
+				LastUpdate: now,
+				CreatedAt:  now,
+			}, int64(api.inFlightTtl))
 			if err != nil {
-				logger.Error("failed to create encore job",
+				logger.Error("failed to claim creative",
 					slog.String("error", err.Error()),
 					slog.String("creativeId", creative.CreativeId),
 				)
 				return
 			}
-			logger.Debug("created encore job",
+			if !claimed {
+				logger.Debug("creative already claimed, skipping dispatch",
+					slog.String("creativeId", creative.CreativeId),
+				)
+				return
+			}
+			_, _ = api.submitJob(creative)
+		}(&creative)
+	}
+}
+
+// Creates the transcoding job for a creative that has already been claimed,
+// and records the outcome in the store.
+func (api *API) submitJob(creative *structure.ManifestAsset) (structure.TranscodeInfo, error) {
+	job, err := api.transcoder.Submit(creative)
+	if err != nil {
+		logger.Error("failed to create transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creative.CreativeId),
+		)
+		// Replaces the claim, and expires when it is time to dispatch again
+		info := structure.TranscodeInfo{
+			Url:        creative.MasterPlaylistUrl,
+			Status:     structure.StatusDispatchFailed,
+			Source:     creative.MasterPlaylistUrl,
+			LastUpdate: time.Now().Unix(),
+			Error:      err.Error(),
+		}
+		if setErr := api.valkeyStore.Set(creative.CreativeId, info, int64(api.dispatchBackoff)); setErr != nil {
+			// The claim expires after the in-flight TTL instead
+			logger.Error("failed to store failed dispatch",
+				slog.String("error", setErr.Error()),
 				slog.String("creativeId", creative.CreativeId),
-				slog.String("jobId", encoreJob.Id),
 			)
-			_ = api.valkeyStore.Set(creative.CreativeId, structure.TranscodeInfo{
-				Url:        creative.MasterPlaylistUrl,
-				Status:     "QUEUED",
-				Source:     creative.MasterPlaylistUrl,
-				LastUpdate: time.Now().Unix(),
-			})
-		}(&creative)
+		}
+		return info, err
+	}
+	logger.Debug("created transcoding job",
+		slog.String("creativeId", creative.CreativeId),
+		slog.String("jobId", job.Id),
+	)
+	now := time.Now().Unix()
+	info := structure.TranscodeInfo{
+		Url:         creative.MasterPlaylistUrl,
+		Status:      structure.StatusQueued,
+		Source:      creative.MasterPlaylistUrl,
+		LastUpdate:  now,
+		EncoreJobId: job.Id,
+		EncoreUrl:   job.Location,
+		Profile:     job.Profile,
+		CreatedAt:   now,
+	}
+	if err := api.valkeyStore.Set(creative.CreativeId, info); err != nil {
+		// Callbacks of the job would be ignored, since the claim does not
+		// carry its ID, so the job is stopped and the claim left to expire
+		logger.Error("failed to store transcoding job, cancelling it",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creative.CreativeId),
+			slog.String("jobId", job.Id),
+		)
+		if cancelErr := api.transcoder.Cancel(job.Location, job.Id); cancelErr != nil {
+			logger.Warn("failed to cancel unrecorded transcoding job",
+				slog.String("error", cancelErr.Error()),
+				slog.String("jobId", job.Id),
+			)
+		}
+		return info, err
+	}
+	if starter, ok := api.transcoder.(transcoder.Starter); ok {
+		starter.Start(job.Id)
 	}
+	return info, nil
 }
 
 func (api *API) findMissingAndDispatchJobs(
@@ -532,25 +927,48 @@ func (api *API) partitionCreatives(
 	missing := make(map[string]structure.ManifestAsset, len(creatives))
 	logger.Debug("partioning creatives", slog.Int("totalCreatives", len(creatives)))
 	filteredOut := 0
+	keys := make([]string, 0, len(creatives))
+	urls := make([]string, 0, len(creatives))
 	for _, creative := range creatives {
-		transcodeInfo, urlFound, err := api.valkeyStore.Get(creative.CreativeId)
-		if err != nil {
-			logger.Error("failed to get creative from store",
-				slog.String("error", err.Error()),
+		keys = append(keys, creative.CreativeId)
+		urls = append(urls, creative.MasterPlaylistUrl)
+	}
+	transcodeInfos, err := api.valkeyStore.GetMany(keys)
+	if err != nil {
+		logger.Error("failed to get creatives from store",
+			slog.String("error", err.Error()),
+			slog.Int("creativeCount", len(keys)),
+		)
+		return found, missing, filteredOut
+	}
+	blacklisted, err := api.valkeyStore.InBlackListMany(urls)
+	if err != nil {
+		// Same as before batching: a failed lookup does not block the creative
+		logger.Error("failed to check creatives against blacklist", slog.String("error", err.Error()))
+	}
+	matcher := api.blacklistMatcher()
+	now := time.Now()
+	for _, creative := range creatives {
+		if blacklisted[creative.MasterPlaylistUrl] {
+			logger.Debug("creative is in blacklist, skipping",
 				slog.String("creativeId", creative.CreativeId),
+				slog.String("masterPlaylistUrl", creative.MasterPlaylistUrl),
 			)
+			filteredOut++
 			continue
 		}
-		if blacklisted, _ := api.valkeyStore.InBlackList(creative.MasterPlaylistUrl); blacklisted {
-			logger.Debug("creative is in blacklist, skipping",
+		if rule, matched := matcher.Match(creative.CreativeId, creative.MasterPlaylistUrl, now); matched {
+			logger.Debug("creative matches blacklist rule, skipping",
 				slog.String("creativeId", creative.CreativeId),
 				slog.String("masterPlaylistUrl", creative.MasterPlaylistUrl),
+				slog.String("rule", rule.Id()),
 			)
 			filteredOut++
 			continue
 		}
+		transcodeInfo, urlFound := transcodeInfos[creative.CreativeId]
 		if urlFound {
-			if transcodeInfo.Status == "COMPLETED" {
+			if transcodeInfo.Status == structure.StatusCompleted {
 				found[creative.CreativeId] = structure.ManifestAsset{
 					CreativeId:        creative.CreativeId,
 					MasterPlaylistUrl: transcodeInfo.Url,
@@ -595,6 +1013,10 @@ func (api *API) HandlePreIngestCreatives(w http.ResponseWriter, r *http.Request)
 		NotYetProcessed: amtMissing,
 	}
 	logger.Info("Dispatched transcoding jobs for pre-ingest request", slog.Int("amount", amtMissing))
+	api.audit(requestActor(r), AUDIT_PREINGEST, "", map[string]string{
+		"mediaUrls":       strconv.Itoa(len(piRequest.MediaUrls)),
+		"notYetProcessed": strconv.Itoa(amtMissing),
+	})
 	ret, err := json.Marshal(resp)
 	if err != nil {
 		logger.Error("failed to marshal response", slog.String("error", err.Error()))
@@ -646,7 +1068,8 @@ func setupHeaders(ir *http.Request, or *http.Request) {
 	// Copy query parameters from the incoming request to the outgoing request
 	query := or.URL.Query()
 	for k, v := range ir.URL.Query() {
-		if strings.ToLower(k) == "subdomain" {
+		// Parameters for the normalizer itself
+		if strings.ToLower(k) == "subdomain" || k == "fillerDur" {
 			continue
 		}
 		for _, val := range v {
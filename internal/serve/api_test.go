@@ -2,9 +2,12 @@ package serve
 
 import (
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +16,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,24 +24,42 @@ import (
 	"github.com/Eyevinn/ad-normalizer/internal/config"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/util"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
 )
 
 type StoreStub struct {
-	mockStore map[string]structure.TranscodeInfo
-	sets      int
-	gets      int
-	deletes   int
-	blacklist []string
-	kpis      normalizerMetrics.NormalizerMetrics
+	mockStore  map[string]structure.TranscodeInfo
+	sets       int
+	gets       int
+	deletes    int
+	blacklist  []string
+	kpis       normalizerMetrics.NormalizerMetrics
+	lastFilter store.JobFilter
+	lastCursor *store.Cursor
+	history    map[string][]structure.StatusChange
+	queued     []structure.PackagingQueueMessage
+	failures   map[string]int64
+	// Details of the blacklisted keys, if any were given
+	blacklistEntries map[string]structure.BlacklistEntry
+	rules            map[string]structure.BlacklistRule
+	audit            []structure.AuditEvent
+	lastAuditFilter  store.AuditFilter
+	// Returned by GetBlackListPage if set
+	blacklistPageErr error
+	// Returned by Set if set
+	setErr error
 }
 
 func (s *StoreStub) kpiReport(args normalizerMetrics.AdsHandledEventArguments) {
 	s.kpis.BrokenAds += args.BrokenAds
 	s.kpis.IngestedAds += args.IngestedAds
 	s.kpis.ServedAds += args.ServedAds
+	s.kpis.AutoBlacklisted += args.AutoBlacklisted
 }
 
 // Delete implements store.Store.
@@ -55,12 +77,50 @@ func (s *StoreStub) Get(key string) (structure.TranscodeInfo, bool, error) {
 	return structure.TranscodeInfo{}, false, nil
 }
 
+func (s *StoreStub) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	results := make(map[string]structure.TranscodeInfo, len(keys))
+	for _, key := range keys {
+		if value, found, _ := s.Get(key); found {
+			results[key] = value
+		}
+	}
+	return results, nil
+}
+
+func (s *StoreStub) Ttl(key string) (int64, error) {
+	if _, exists := s.mockStore[key]; !exists {
+		return 0, errors.New("key does not exist")
+	}
+	return -1, nil
+}
+
 func (s *StoreStub) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
 	s.sets++
+	if s.setErr != nil {
+		return s.setErr
+	}
+	previous, found := s.mockStore[key]
+	if found && !previous.Status.CanTransitionTo(value.Status) {
+		return &structure.IllegalTransitionError{From: previous.Status, To: value.Status}
+	}
+	if !found || previous.Status != value.Status {
+		s.history[key] = append(s.history[key], structure.StatusChangeFromInfo(value))
+	}
 	s.mockStore[key] = value
 	return nil
 }
 
+func (s *StoreStub) History(key string) ([]structure.StatusChange, error) {
+	return s.history[key], nil
+}
+
+func (s *StoreStub) Claim(key string, value structure.TranscodeInfo, ttl int64) (bool, error) {
+	if _, exists := s.mockStore[key]; exists {
+		return false, nil
+	}
+	return true, s.Set(key, value)
+}
+
 func (s *StoreStub) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
 	result := make([]structure.TranscodeInfo, 0, size)
 	for i := range size {
@@ -76,31 +136,188 @@ func (s *StoreStub) List(page int, size int) ([]structure.TranscodeInfo, int64,
 	return result, int64(size), nil
 }
 
+func (s *StoreStub) ListFiltered(filter store.JobFilter, page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	s.lastFilter = filter
+	return s.List(page, size)
+}
+
+func (s *StoreStub) ListPage(filter store.JobFilter, cursor *store.Cursor, size int) (store.Page[structure.TranscodeInfo], error) {
+	s.lastFilter = filter
+	s.lastCursor = cursor
+	if filter.Source != "" || isInFlight(filter.Status) || filter.Status == structure.StatusUnknown || filter.Status == structure.StatusCancelled {
+		// Looking for jobs to cancel or release, answered from the stored jobs
+		page := store.Page[structure.TranscodeInfo]{}
+		for _, key := range slices.Sorted(maps.Keys(s.mockStore)) {
+			info := s.mockStore[key]
+			if info.Status == filter.Status && strings.Contains(info.Source, filter.Source) {
+				page.Items = append(page.Items, info)
+				page.Keys = append(page.Keys, key)
+			}
+		}
+		page.Total = int64(len(page.Items))
+		return page, nil
+	}
+	jobs, total, _ := s.List(0, size)
+	return store.Page[structure.TranscodeInfo]{
+		Items: jobs,
+		Next:  &store.Cursor{Score: 1000, Member: "oldest-on-page"},
+		Prev:  cursor,
+		Total: total,
+	}, nil
+}
+
+func (s *StoreStub) RecordSourceFailure(source string, reason string, window int64) (int64, error) {
+	if s.failures == nil {
+		s.failures = make(map[string]int64)
+	}
+	s.failures[source]++
+	return s.failures[source], nil
+}
+
+func (s *StoreStub) ClearSourceFailures(source string) error {
+	delete(s.failures, source)
+	return nil
+}
+
+func (s *StoreStub) GetBlackListPage(cursor *store.Cursor, size int) (store.Page[string], error) {
+	s.lastCursor = cursor
+	if s.blacklistPageErr != nil {
+		return store.Page[string]{}, s.blacklistPageErr
+	}
+	return store.Page[string]{Items: s.blacklist, Total: int64(len(s.blacklist))}, nil
+}
+
 func (s *StoreStub) reset() {
 	s.mockStore = make(map[string]structure.TranscodeInfo)
+	s.history = make(map[string][]structure.StatusChange)
 	s.sets = 0
 	s.gets = 0
 	s.deletes = 0
 	s.kpis = normalizerMetrics.NormalizerMetrics{}
 	s.blacklist = []string{} // Reset the blacklist
+	s.blacklistEntries = nil
+	s.rules = nil
+	s.audit = nil
+	s.blacklistPageErr = nil
+	s.setErr = nil
+	s.queued = nil
+	s.failures = nil
+}
+
+func (s *StoreStub) BlackList(entry structure.BlacklistEntry) error {
+	s.blacklist = append(s.blacklist, entry.MediaUrl)
+	if s.blacklistEntries == nil {
+		s.blacklistEntries = make(map[string]structure.BlacklistEntry)
+	}
+	s.blacklistEntries[entry.MediaUrl] = entry
+	return nil
+}
+
+func (s *StoreStub) BlackListMany(entries []structure.BlacklistEntry) []error {
+	errs := make([]error, len(entries))
+	for idx, entry := range entries {
+		if !slices.Contains(s.blacklist, entry.MediaUrl) {
+			errs[idx] = s.BlackList(entry)
+		} else {
+			s.blacklistEntries[entry.MediaUrl] = entry
+		}
+	}
+	return errs
+}
+
+func (s *StoreStub) RemoveFromBlackListMany(keys []string) []error {
+	errs := make([]error, len(keys))
+	for idx, key := range keys {
+		errs[idx] = s.RemoveFromBlackList(key)
+	}
+	return errs
+}
+
+func (s *StoreStub) AppendAudit(event structure.AuditEvent, maxLength int64) error {
+	event.Id = strconv.Itoa(len(s.audit)) + "-0"
+	event.Timestamp = time.Now().UnixMilli()
+	s.audit = append(s.audit, event)
+	return nil
 }
 
-func (s *StoreStub) BlackList(key string) error {
-	s.blacklist = append(s.blacklist, key)
+func (s *StoreStub) AppendAuditMany(events []structure.AuditEvent, maxLength int64) error {
+	for _, event := range events {
+		_ = s.AppendAudit(event, maxLength)
+	}
 	return nil
 }
 
+func (s *StoreStub) ListAudit(filter store.AuditFilter, size int) ([]structure.AuditEvent, error) {
+	s.lastAuditFilter = filter
+	events := []structure.AuditEvent{}
+	for idx := len(s.audit) - 1; idx >= 0 && len(events) < size; idx-- {
+		events = append(events, s.audit[idx])
+	}
+	return events, nil
+}
+
+func (s *StoreStub) AddBlackListRule(rule structure.BlacklistRule) error {
+	if s.rules == nil {
+		s.rules = make(map[string]structure.BlacklistRule)
+	}
+	s.rules[rule.Id()] = rule
+	return nil
+}
+
+func (s *StoreStub) RemoveBlackListRule(id string) error {
+	delete(s.rules, id)
+	return nil
+}
+
+func (s *StoreStub) GetBlackListRules() ([]structure.BlacklistRule, error) {
+	rules := []structure.BlacklistRule{}
+	for _, id := range slices.Sorted(maps.Keys(s.rules)) {
+		rules = append(rules, s.rules[id])
+	}
+	return rules, nil
+}
+
+func (s *StoreStub) GetBlackListEntries(keys []string) (map[string]structure.BlacklistEntry, error) {
+	entries := make(map[string]structure.BlacklistEntry, len(keys))
+	for _, key := range keys {
+		if entry, found := s.blacklistEntries[key]; found {
+			entries[key] = entry
+		}
+	}
+	return entries, nil
+}
+
+func (s *StoreStub) PruneBlackList() ([]string, error) {
+	pruned := []string{}
+	for key, entry := range s.blacklistEntries {
+		if entry.Expired(time.Now()) {
+			_ = s.RemoveFromBlackList(key)
+			pruned = append(pruned, key)
+		}
+	}
+	return pruned, nil
+}
+
 func (s *StoreStub) InBlackList(key string) (bool, error) {
 	if slices.Contains(s.blacklist, key) {
-		return true, nil
+		return !s.blacklistEntries[key].Expired(time.Now()), nil
 	}
 	return false, nil
 }
 
+func (s *StoreStub) InBlackListMany(keys []string) (map[string]bool, error) {
+	results := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		results[key], _ = s.InBlackList(key)
+	}
+	return results, nil
+}
+
 func (s *StoreStub) RemoveFromBlackList(key string) error {
 	for i, blacklistedKey := range s.blacklist {
 		if blacklistedKey == key {
 			s.blacklist = append(s.blacklist[:i], s.blacklist[i+1:]...)
+			delete(s.blacklistEntries, key)
 			return nil
 		}
 	}
@@ -113,80 +330,117 @@ func (s *StoreStub) GetBlackList(page int, size int) ([]string, int64, error) {
 
 func (s *StoreStub) EnqueuePackagingJob(queueName string, message structure.PackagingQueueMessage) error {
 	// This is a stub, in a real implementation this would enqueue the job to a queue
+	s.queued = append(s.queued, message)
 	return nil
 }
 
-type EncoreHandlerStub struct {
-	calls int
+func (s *StoreStub) ListStale(olderThan time.Time, offset int64, count int64) ([]string, error) {
+	keys := make([]string, 0, len(s.mockStore))
+	for key, value := range s.mockStore {
+		if value.LastUpdate < olderThan.Unix() {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if offset >= int64(len(keys)) {
+		return []string{}, nil
+	}
+	return keys[offset:min(offset+count, int64(len(keys)))], nil
+}
+
+func (s *StoreStub) DeleteIfStale(key string, olderThan time.Time) (bool, error) {
+	if value, exists := s.mockStore[key]; exists && value.LastUpdate < olderThan.Unix() {
+		return true, s.Delete(key)
+	}
+	return false, nil
+}
+
+func (s *StoreStub) TryLock(name string, owner string, ttl int64) (bool, error) {
+	return true, nil
+}
+
+func (s *StoreStub) RenewLock(name string, owner string, ttl int64) (bool, error) {
+	return true, nil
+}
+
+type TranscoderStub struct {
+	mu        sync.Mutex
+	calls     int
+	status    structure.TranscodeStatus // Status returned by GetJob, defaults to COMPLETED
+	createErr error                     // Returned by Submit if set
+	// The location GetJob was last called with
+	lastLocation string
+	// IDs of the jobs Cancel was called for
+	cancelled []string
 }
 
-// GetEncoreJob implements encore.EncoreHandler.
-func (e *EncoreHandlerStub) GetEncoreJob(jobId string) (structure.EncoreJob, error) {
-	return structure.EncoreJob{
-		Id:         uuid.NewString(),
-		ExternalId: jobId,
+// GetJob implements transcoder.Transcoder.
+func (e *TranscoderStub) GetJob(location string, jobId string) (structure.TranscodeJob, error) {
+	e.lastLocation = location
+	id := jobId
+	location = cmp.Or(location, "https://encore.example.com")
+	return structure.TranscodeJob{
+		Id:         id,
+		Location:   location,
+		JobUrl:     location + "/encoreJobs/" + id,
+		CreativeId: jobId,
 		Profile:    "test-profile",
 		BaseName:   jobId,
-		Status:     "COMPLETED",
-		Outputs: []structure.EncoreOutput{
-			{
-				MediaType: "Video",
-				VideoStreams: []structure.EncoreVideoStream{
-					{
-						Codec:     "AVC",
-						Width:     1920,
-						Height:    1080,
-						FrameRate: "25",
-					},
-				},
-			},
-			{
-				MediaType: "Audio",
-				AudioStreams: []structure.EncoreAudioStream{
-					{
-						Codec:    "AAC",
-						Channels: 2,
-					},
-				},
-			},
-		},
-		Inputs: []structure.EncoreInput{
-			{
-				Uri: "http://example.com/source/video.mp4",
-			},
-		},
+		Status:     cmp.Or(e.status, "COMPLETED"),
+		Source:     "http://example.com/source/video.mp4",
+		Video:      []structure.VideoRendition{{Width: 1920, Height: 1080, FrameRate: 25}},
+		HasAudio:   true,
 	}, nil
 }
 
-func (e *EncoreHandlerStub) reset() {
-	logger.Info("Resetting EncoreHandlerStub")
+func (e *TranscoderStub) reset() {
+	logger.Info("Resetting TranscoderStub")
 	e.calls = 0
+	e.status = ""
+	e.createErr = nil
+	e.lastLocation = ""
+	e.cancelled = nil
 }
 
-func (e *EncoreHandlerStub) CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error) {
-	logger.Info("EncoreHandlerStub.createJob called")
-	newJob := structure.EncoreJob{}
+// Cancel implements transcoder.Transcoder.
+func (e *TranscoderStub) Cancel(location string, jobId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cancelled = append(e.cancelled, jobId)
+	return nil
+}
+
+func (e *TranscoderStub) Submit(creative *structure.ManifestAsset) (structure.TranscodeJob, error) {
+	logger.Info("TranscoderStub.Submit called")
+	newJob := structure.TranscodeJob{Id: uuid.NewString(), CreativeId: creative.CreativeId, Location: "https://encore.example.com"}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.calls += 1
+	if e.createErr != nil {
+		return structure.TranscodeJob{}, e.createErr
+	}
 	return newJob, nil
 }
 
-func setupApi() (*API, *httptest.Server, *StoreStub, *EncoreHandlerStub) {
+func setupApi() (*API, *httptest.Server, *StoreStub, *TranscoderStub) {
 	storeStub := &StoreStub{
 		mockStore: make(map[string]structure.TranscodeInfo),
+		history:   make(map[string][]structure.StatusChange),
 		kpis:      normalizerMetrics.NormalizerMetrics{},
 	}
 
 	testServer := setupTestServer()
 
-	encoreHandler := &EncoreHandlerStub{}
+	encoreHandler := &TranscoderStub{}
 	adserverUrl, _ := url.Parse(testServer.URL)
 	assetServerUrl, _ := url.Parse("https://asset-server.example.com")
 	apiConf := config.AdNormalizerConfig{
-		AdServerUrl:    *adserverUrl,
-		AssetServerUrl: *assetServerUrl,
-		KeyField:       "url",
-		KeyRegex:       "[^a-zA-Z0-9]",
-		KpiPostUrl:     "http://kpi-post.example.com/metrics",
+		AdServerUrl:       *adserverUrl,
+		AssetServerUrl:    *assetServerUrl,
+		KeyField:          "url",
+		KeyRegex:          "[^a-zA-Z0-9]",
+		KpiPostUrl:        "http://kpi-post.example.com/metrics",
+		AuditLogMaxLength: 100,
 	}
 	// Initialize the API with the mock store
 	api := NewAPI(
@@ -280,7 +534,7 @@ func TestReplaceVastWithBlacklisted(t *testing.T) {
 		nil,
 	)
 	is.NoErr(err)
-	_ = storeStub.BlackList("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4")
+	_ = storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4"})
 	vastReq.Header.Set("User-Agent", "TestUserAgent")
 	vastReq.Header.Set("X-Forwarded-For", "123.123.123")
 	vastReq.Header.Set("X-Device-User-Agent", "TestDeviceUserAgent")
@@ -424,6 +678,62 @@ func TestGetAssetList(t *testing.T) {
 	storeStub.reset()
 }
 
+func TestSetupHeadersQuery(t *testing.T) {
+	is := is.New(t)
+	incoming := httptest.NewRequest(http.MethodGet, "/api/v1/vast?dur=30&fillerDur=5&subdomain=demo&c=1", nil)
+	outgoing, err := http.NewRequest(http.MethodGet, "https://adserver.example.com/vast?key=value", nil)
+	is.NoErr(err)
+	setupHeaders(incoming, outgoing)
+	// The filler duration and subdomain are not meant for the ad server
+	is.Equal(outgoing.URL.RawQuery, "c=1&dur=30&key=value")
+}
+
+func TestGetAssetListWithBreakDuration(t *testing.T) {
+	is := is.New(t)
+	re := regexp.MustCompile("[^a-zA-Z0-9]")
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	for _, name := range []string{"alvedon-10s", "bromwel-15s"} {
+		adKey := re.ReplaceAllString("https://testcontent.eyevinn.technology/ads/"+name+".mp4", "")
+		_ = storeStub.Set(adKey, structure.TranscodeInfo{
+			Url:    "https://testcontent.eyevinn.technology/ads/" + name + ".m3u8",
+			Status: "COMPLETED",
+		})
+	}
+	fillerKey := re.ReplaceAllString("http://example.com/video.mp4", "")
+	_ = storeStub.Set(fillerKey, structure.TranscodeInfo{
+		Url:    "http://example.com/video.m3u8",
+		Status: "COMPLETED",
+	})
+	vastReq, err := http.NewRequest("GET", ts.URL, nil)
+	is.NoErr(err)
+	vastReq.Header.Set("Accept", "application/json")
+	qps := vastReq.URL.Query()
+	qps.Set("requestType", "vast")
+	qps.Set("dur", "20")
+	qps.Set("filler", "http://example.com/video.mp4")
+	qps.Set("fillerDur", "5")
+	vastReq.URL.RawQuery = qps.Encode()
+	recorder := httptest.NewRecorder()
+	api.HandleVast(recorder, vastReq)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	defer recorder.Result().Body.Close()
+
+	var assetList []structure.AssetDescription
+	err = json.NewDecoder(recorder.Result().Body).Decode(&assetList)
+	is.NoErr(err)
+	// The 15s ad does not fit after the 10.25s one, but the 5s filler does,
+	// with the duration of its media
+	is.Equal(len(assetList), 2)
+	is.Equal(assetList[0].Uri, "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8")
+	is.Equal(assetList[0].Duration, 10.25)
+	is.Equal(assetList[1].Uri, "http://example.com/video.m3u8")
+	is.Equal(assetList[1].Duration, 5.0)
+
+	encoreHandler.reset()
+	storeStub.reset()
+}
+
 func TestEmptyVmap(t *testing.T) {
 	is := is.New(t)
 	api, ts, storeStub, encoreHandler := setupApi()
@@ -594,6 +904,229 @@ func TestBlacklist(t *testing.T) {
 	is.Equal(len(storeStub.blacklist), 0)
 }
 
+func TestBlacklistEntryDetails(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	blacklistUrl := "https://adserver-assets.io/badfile.mp4"
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	serializedBody, err := json.Marshal(blacklistRequest{
+		MediaUrl:  blacklistUrl,
+		Reason:    "corrupt audio",
+		Actor:     "ops",
+		ExpiresAt: expiresAt,
+	})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", ts.URL+"/blacklist/", bytes.NewBuffer(serializedBody))
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusNoContent)
+	is.Equal(storeStub.blacklistEntries[blacklistUrl].Reason, "corrupt audio")
+	is.True(storeStub.blacklistEntries[blacklistUrl].CreatedAt > 0)
+
+	req, err = http.NewRequest("GET", ts.URL+"/blacklist/", nil)
+	is.NoErr(err)
+	recorder = httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	var blResponse blacklistResponse
+	is.NoErr(json.NewDecoder(recorder.Result().Body).Decode(&blResponse))
+	is.Equal(len(blResponse.Entries), 1)
+	is.Equal(blResponse.Entries[0].MediaUrl, blacklistUrl)
+	is.Equal(blResponse.Entries[0].Reason, "corrupt audio")
+	is.Equal(blResponse.Entries[0].Actor, "ops")
+	is.Equal(blResponse.Entries[0].ExpiresAt, expiresAt)
+
+	// An expiry in the past is rejected
+	serializedBody, err = json.Marshal(blacklistRequest{
+		MediaUrl:  blacklistUrl,
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	})
+	is.NoErr(err)
+	req, err = http.NewRequest("POST", ts.URL+"/blacklist/", bytes.NewBuffer(serializedBody))
+	is.NoErr(err)
+	recorder = httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusBadRequest)
+}
+
+func TestBlacklistSweep(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "https://adserver-assets.io/expired.mp4",
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}))
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "https://adserver-assets.io/badfile.mp4"}))
+
+	inBlackList, err := storeStub.InBlackList("https://adserver-assets.io/expired.mp4")
+	is.NoErr(err)
+	is.True(!inBlackList)
+	is.Equal(api.pruneBlackList(), 1)
+	is.Equal(storeStub.blacklist, []string{"https://adserver-assets.io/badfile.mp4"})
+	is.Equal(api.pruneBlackList(), 0)
+}
+
+func TestBlacklistRules(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	storeStub.mockStore["transcoding"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      "https://bad-cdn.example.com/ads/ad.mp4?session=1",
+		EncoreJobId: "transcoding-job",
+	}
+	storeStub.mockStore["other"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      "https://cdn.example.com/ads/ad.mp4",
+		EncoreJobId: "other-job",
+	}
+	postRule := func(method string, rule blacklistRequest) int {
+		serializedBody, err := json.Marshal(rule)
+		is.NoErr(err)
+		req, err := http.NewRequest(method, ts.URL+"/blacklist/", bytes.NewBuffer(serializedBody))
+		is.NoErr(err)
+		recorder := httptest.NewRecorder()
+		api.HandleBlackList(recorder, req)
+		return recorder.Result().StatusCode
+	}
+	hostRule := blacklistRequest{Type: structure.RuleHost, Pattern: "bad-cdn.example.com", Reason: "broken CDN"}
+	is.Equal(postRule(http.MethodPost, hostRule), http.StatusNoContent)
+	is.Equal(postRule(http.MethodPost, blacklistRequest{Type: structure.RuleCreativeKey, Pattern: "badcreative"}), http.StatusNoContent)
+	is.Equal(postRule(http.MethodPost, blacklistRequest{Type: structure.RuleRegex, Pattern: "(unclosed"}), http.StatusBadRequest)
+	is.Equal(postRule(http.MethodPost, blacklistRequest{Type: "domain", Pattern: "example.com"}), http.StatusBadRequest)
+	is.Equal(len(storeStub.rules), 2)
+	is.Equal(len(storeStub.blacklist), 0) // Rules are not URL entries
+
+	// In-flight jobs matching the rule are cancelled
+	is.Equal(encoreHandler.cancelled, []string{"transcoding-job"})
+	is.Equal(storeStub.mockStore["other"].Status, structure.StatusInProgress)
+
+	creatives := map[string]structure.ManifestAsset{
+		"badcdn":      {CreativeId: "badcdn", MasterPlaylistUrl: "https://bad-cdn.example.com/ads/new.mp4?session=2"},
+		"badcreative": {CreativeId: "badcreative", MasterPlaylistUrl: "https://cdn.example.com/ads/bad.mp4"},
+		"fine":        {CreativeId: "fine", MasterPlaylistUrl: "https://cdn.example.com/ads/fine.mp4"},
+	}
+	_, missing, filteredOut := api.partitionCreatives(creatives)
+	is.Equal(filteredOut, 2)
+	is.Equal(len(missing), 1)
+	_, found := missing["fine"]
+	is.True(found)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/blacklist/", nil)
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	var blResponse blacklistResponse
+	is.NoErr(json.NewDecoder(recorder.Result().Body).Decode(&blResponse))
+	is.Equal(len(blResponse.Rules), 2)
+	is.Equal(blResponse.Rules[1].Type, structure.RuleHost)
+	is.Equal(blResponse.Rules[1].Reason, "broken CDN")
+
+	is.Equal(postRule(http.MethodDelete, hostRule), http.StatusNoContent)
+	_, _, filteredOut = api.partitionCreatives(creatives)
+	is.Equal(filteredOut, 1)
+}
+
+func TestBlacklistCancelsJobs(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	blacklistUrl := "https://adserver-assets.io/badfile.mp4"
+	storeStub.mockStore["transcoding"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      blacklistUrl,
+		EncoreJobId: "transcoding-job",
+	}
+	storeStub.mockStore["packaging"] = structure.TranscodeInfo{
+		Status:      structure.StatusPackaging,
+		Source:      blacklistUrl,
+		EncoreJobId: "packaging-job",
+	}
+	storeStub.mockStore["completed"] = structure.TranscodeInfo{
+		Status:      structure.StatusCompleted,
+		Source:      blacklistUrl,
+		EncoreJobId: "completed-job",
+	}
+	storeStub.mockStore["other"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      blacklistUrl + ".bak",
+		EncoreJobId: "other-job",
+	}
+	serializedBody, err := json.Marshal(blacklistRequest{MediaUrl: blacklistUrl})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", ts.URL+"/blacklist/", bytes.NewBuffer(serializedBody))
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusNoContent)
+
+	// Packaging cannot be stopped, so only the transcoding job is cancelled
+	is.Equal(encoreHandler.cancelled, []string{"transcoding-job"})
+	is.Equal(storeStub.mockStore["transcoding"].Status, structure.StatusCancelled)
+	is.Equal(storeStub.mockStore["packaging"].Status, structure.StatusCancelled)
+	is.Equal(storeStub.mockStore["completed"].Status, structure.StatusCompleted)
+	is.Equal(storeStub.mockStore["other"].Status, structure.StatusInProgress)
+}
+
+func TestUnblacklistReleasesCancelledJobs(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	blacklistUrl := "https://adserver-assets.io/badfile.mp4"
+	storeStub.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      blacklistUrl,
+		EncoreJobId: "transcoding-job",
+	}
+	storeStub.mockStore["other"] = structure.TranscodeInfo{
+		Status: structure.StatusCancelled,
+		Source: blacklistUrl + ".bak",
+	}
+	send := func(method string, body blacklistRequest) {
+		serializedBody, err := json.Marshal(body)
+		is.NoErr(err)
+		req, err := http.NewRequest(method, ts.URL+"/blacklist/", bytes.NewBuffer(serializedBody))
+		is.NoErr(err)
+		recorder := httptest.NewRecorder()
+		api.HandleBlackList(recorder, req)
+		is.Equal(recorder.Result().StatusCode, http.StatusNoContent)
+	}
+	creatives := map[string]structure.ManifestAsset{
+		"creative": {CreativeId: "creative", MasterPlaylistUrl: blacklistUrl},
+	}
+
+	send(http.MethodPost, blacklistRequest{MediaUrl: blacklistUrl})
+	is.Equal(storeStub.mockStore["creative"].Status, structure.StatusCancelled)
+	_, missing, filteredOut := api.partitionCreatives(creatives)
+	is.Equal(filteredOut, 1)
+	is.Equal(len(missing), 0)
+
+	send(http.MethodDelete, blacklistRequest{MediaUrl: blacklistUrl})
+	_, found := storeStub.mockStore["creative"]
+	is.True(!found) // The cancellation no longer blocks the creative
+	is.Equal(storeStub.mockStore["other"].Status, structure.StatusCancelled)
+	_, missing, filteredOut = api.partitionCreatives(creatives)
+	is.Equal(filteredOut, 0)
+	_, found = missing["creative"]
+	is.True(found) // Ingested again
+
+	// The same goes for rules
+	storeStub.mockStore["rule"] = structure.TranscodeInfo{
+		Status: structure.StatusInProgress,
+		Source: "https://bad-cdn.example.com/ad.mp4",
+	}
+	hostRule := blacklistRequest{Type: structure.RuleHost, Pattern: "bad-cdn.example.com"}
+	send(http.MethodPost, hostRule)
+	is.Equal(storeStub.mockStore["rule"].Status, structure.StatusCancelled)
+	send(http.MethodDelete, hostRule)
+	_, found = storeStub.mockStore["rule"]
+	is.True(!found)
+}
+
 // TODO: Add test for status endpoint
 
 func TestHandleJobList(t *testing.T) {
@@ -629,12 +1162,84 @@ func TestHandleJobList(t *testing.T) {
 		expectedUrl := "http://example.com/video" + strconv.Itoa(expectedIndex) + "/index.m3u8"
 		expectedSource := "s3://fake-bucket/video" + strconv.Itoa(expectedIndex) + ".mp4"
 		is.Equal(job.Url, expectedUrl)
-		is.Equal(job.Status, "COMPLETED")
+		is.Equal(job.Status, structure.StatusCompleted)
 		is.Equal(job.Source, expectedSource)
 		is.True(job.LastUpdate > 0)
 	}
 }
 
+func TestHandleJobListFilters(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	req, err := http.NewRequest(
+		http.MethodGet,
+		"/status?status=failed&source=example.com&prefix=ad&since=2025-01-01T00:00:00Z&until=1767225600",
+		nil,
+	)
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleJobList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	is.Equal(storeStub.lastFilter, store.JobFilter{
+		Status: "FAILED",
+		Source: "example.com",
+		Prefix: "ad",
+		Since:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:  time.Unix(1767225600, 0),
+	})
+	var response statusResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(
+		response.Next,
+		"/jobs?page=1&prefix=ad&since=2025-01-01T00%3A00%3A00Z&size=10&source=example.com&status=failed&until=1767225600",
+	)
+
+	for _, query := range []string{"status=BROKEN", "since=yesterday", "since=1767225600&until=1735689600"} {
+		req, err = http.NewRequest(http.MethodGet, "/status?"+query, nil)
+		is.NoErr(err)
+		recorder = httptest.NewRecorder()
+		api.HandleJobList(recorder, req)
+		is.Equal(recorder.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestHandleJobListCursor(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "/status?cursor=&status=FAILED&size=5", nil)
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleJobList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	is.True(storeStub.lastCursor == nil)
+	var response statusResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(len(response.Jobs), 5)
+	is.Equal(response.Prev, "")
+	next := &store.Cursor{Score: 1000, Member: "oldest-on-page"}
+	is.Equal(response.Next, "/jobs?cursor="+next.Encode()+"&size=5&status=FAILED")
+
+	// Following the link passes the cursor on to the store
+	req, err = http.NewRequest(http.MethodGet, response.Next, nil)
+	is.NoErr(err)
+	recorder = httptest.NewRecorder()
+	api.HandleJobList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	is.Equal(*storeStub.lastCursor, *next)
+	is.Equal(storeStub.lastFilter.Status, structure.StatusFailed)
+
+	for _, query := range []string{"cursor=garbage", "cursor=&page=1"} {
+		req, err = http.NewRequest(http.MethodGet, "/status?"+query, nil)
+		is.NoErr(err)
+		recorder = httptest.NewRecorder()
+		api.HandleJobList(recorder, req)
+		is.Equal(recorder.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
 func TestHandleJobListInvalidPageParameter(t *testing.T) {
 	is := is.New(t)
 	api, ts, _, _ := setupApi()
@@ -753,6 +1358,129 @@ func TestHandlePreIngestCreatives(t *testing.T) {
 	is.Equal(response.NotYetProcessed, 1) // One creative is unknown and should be processed
 }
 
+func TestConcurrentDispatch(t *testing.T) {
+	is := is.New(t)
+	mr, err := miniredis.Run()
+	is.NoErr(err)
+	defer mr.Close()
+	valkeyStore, err := store.NewValkeyStore("redis://"+mr.Addr(), false)
+	is.NoErr(err)
+	api, ts, _, encoreHandler := setupApi()
+	defer ts.Close()
+	api.valkeyStore = valkeyStore
+	api.inFlightTtl = 60
+
+	serializedBody, err := json.Marshal(preIngestCreativeRequest{
+		MediaUrls: []string{"https://testcontent.eyevinn.technology/ads/new-ad.mp4"},
+	})
+	is.NoErr(err)
+	wg := &sync.WaitGroup{}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, "/preingest", bytes.NewBuffer(serializedBody))
+			recorder := httptest.NewRecorder()
+			api.HandlePreIngestCreatives(recorder, req)
+		}()
+	}
+	wg.Wait()
+
+	// Jobs are dispatched in the background, wait for the winner to store its job ID
+	adKey := regexp.MustCompile("[^a-zA-Z0-9]").ReplaceAllString("https://testcontent.eyevinn.technology/ads/new-ad.mp4", "")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		info, found, err := valkeyStore.Get(adKey)
+		is.NoErr(err)
+		if found && info.EncoreJobId != "" {
+			is.Equal(info.Status, structure.StatusQueued)
+			break
+		}
+		is.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	encoreHandler.mu.Lock()
+	defer encoreHandler.mu.Unlock()
+	is.Equal(encoreHandler.calls, 1)
+}
+
+func TestDispatchFailure(t *testing.T) {
+	is := is.New(t)
+	mr, err := miniredis.Run()
+	is.NoErr(err)
+	defer mr.Close()
+	valkeyStore, err := store.NewValkeyStore("redis://"+mr.Addr(), false)
+	is.NoErr(err)
+	api, ts, _, encoreHandler := setupApi()
+	defer ts.Close()
+	api.valkeyStore = valkeyStore
+	api.inFlightTtl = 60
+	api.dispatchBackoff = 30
+	encoreHandler.createErr = structure.EncoreError{StatusCode: http.StatusBadGateway, Message: "bad gateway"}
+
+	mediaUrl := "https://testcontent.eyevinn.technology/ads/new-ad.mp4"
+	adKey := regexp.MustCompile("[^a-zA-Z0-9]").ReplaceAllString(mediaUrl, "")
+	preIngest := func() preIngestCreativeResponse {
+		serializedBody, _ := json.Marshal(preIngestCreativeRequest{MediaUrls: []string{mediaUrl}})
+		req, _ := http.NewRequest(http.MethodPost, "/preingest", bytes.NewBuffer(serializedBody))
+		recorder := httptest.NewRecorder()
+		api.HandlePreIngestCreatives(recorder, req)
+		var response preIngestCreativeResponse
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return response
+	}
+	waitForStatus := func(status structure.JobStatus) structure.TranscodeInfo {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			info, found, err := valkeyStore.Get(adKey)
+			is.NoErr(err)
+			if found && info.Status == status {
+				return info
+			}
+			is.True(time.Now().Before(deadline))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	is.Equal(preIngest().NotYetProcessed, 1)
+	info := waitForStatus("DISPATCH_FAILED")
+	is.True(strings.Contains(info.Error, "bad gateway"))
+
+	// Not re-dispatched while backing off
+	is.Equal(preIngest().NotYetProcessed, 0)
+
+	mr.FastForward(31 * time.Second)
+	encoreHandler.mu.Lock()
+	encoreHandler.createErr = nil
+	encoreHandler.mu.Unlock()
+	is.Equal(preIngest().NotYetProcessed, 1)
+	info = waitForStatus("QUEUED")
+	for info.EncoreJobId == "" {
+		info = waitForStatus("QUEUED")
+	}
+	encoreHandler.mu.Lock()
+	defer encoreHandler.mu.Unlock()
+	is.Equal(encoreHandler.calls, 2)
+}
+
+func TestSubmitJobNotRecorded(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	storeStub.setErr = errors.New("connection refused")
+
+	info, err := api.submitJob(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "https://testcontent.eyevinn.technology/ads/new-ad.mp4",
+	})
+	is.True(err != nil)
+	// The callbacks of the job would be ignored, so it is stopped
+	is.Equal(encoreHandler.cancelled, []string{info.EncoreJobId})
+}
+
 func TestHandlePreIngestCreativesMethodNotAllowed(t *testing.T) {
 	is := is.New(t)
 	api, ts, _, _ := setupApi()
@@ -812,3 +1540,86 @@ func setupTestServer() *httptest.Server {
 			}
 		}))
 }
+
+// Builds a VMAP with the given number of breaks and ads per break,
+// each ad with its own media file.
+func makeBenchmarkVmap(breaks int, adsPerBreak int) vmap.VMAP {
+	vmapData := vmap.VMAP{AdBreaks: make([]vmap.AdBreak, 0, breaks)}
+	for b := range breaks {
+		vast := &vmap.VAST{Ad: make([]vmap.Ad, 0, adsPerBreak)}
+		for a := range adsPerBreak {
+			mediaUrl := "https://testcontent.eyevinn.technology/ads/bench-" + strconv.Itoa(b) + "-" + strconv.Itoa(a) + ".mp4"
+			vast.Ad = append(vast.Ad, vmap.Ad{
+				Id:       "AD_" + strconv.Itoa(b) + "_" + strconv.Itoa(a),
+				Sequence: a + 1,
+				InLine: &vmap.InLine{
+					Creatives: []vmap.Creative{{
+						Linear: &vmap.Linear{
+							MediaFiles: []vmap.MediaFile{{Text: mediaUrl, Width: 1280, Height: 720, Bitrate: 2000}},
+						},
+					}},
+				},
+			})
+		}
+		vmapData.AdBreaks = append(vmapData.AdBreaks, vmap.AdBreak{
+			AdSource: &vmap.AdSource{VASTData: &vmap.VASTData{VAST: vast}},
+		})
+	}
+	return vmapData
+}
+
+// Compares one store round trip per lookup with the batched lookups in
+// partitionCreatives, for a 30 ad VMAP where a third of the ads are
+// already transcoded and a few are blacklisted.
+func BenchmarkPartitionCreatives(b *testing.B) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mr.Close()
+	valkeyStore, err := store.NewValkeyStore("redis://"+mr.Addr(), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	api, ts, _, _ := setupApi()
+	defer ts.Close()
+	api.valkeyStore = valkeyStore
+
+	vmapData := makeBenchmarkVmap(6, 5)
+	breakCreatives := make([]map[string]structure.ManifestAsset, 0, len(vmapData.AdBreaks))
+	i := 0
+	for _, adBreak := range vmapData.AdBreaks {
+		creatives := util.GetCreatives(adBreak.AdSource.VASTData.VAST, api.keyField, api.keyRegex)
+		for _, creative := range creatives {
+			switch i % 6 {
+			case 0, 3:
+				_ = valkeyStore.Set(creative.CreativeId, structure.TranscodeInfo{
+					Url:    strings.Replace(creative.MasterPlaylistUrl, ".mp4", ".m3u8", 1),
+					Status: "COMPLETED",
+				})
+			case 5:
+				_ = valkeyStore.BlackList(structure.BlacklistEntry{MediaUrl: creative.MasterPlaylistUrl})
+			}
+			i++
+		}
+		breakCreatives = append(breakCreatives, creatives)
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for b.Loop() {
+			for _, creatives := range breakCreatives {
+				for _, creative := range creatives {
+					_, _, _ = valkeyStore.Get(creative.CreativeId)
+					_, _ = valkeyStore.InBlackList(creative.MasterPlaylistUrl)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			for _, creatives := range breakCreatives {
+				_, _, _ = api.partitionCreatives(creatives)
+			}
+		}
+	})
+}
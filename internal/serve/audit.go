@@ -0,0 +1,159 @@
+package serve
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+const auditPath = "/audit"
+
+// Actions recorded in the audit log
+const (
+	AUDIT_BLACKLIST_ADD         = "blacklist.add"
+	AUDIT_BLACKLIST_REMOVE      = "blacklist.remove"
+	AUDIT_BLACKLIST_RULE_ADD    = "blacklist.rule.add"
+	AUDIT_BLACKLIST_RULE_REMOVE = "blacklist.rule.remove"
+	AUDIT_BLACKLIST_IMPORT      = "blacklist.import"
+	AUDIT_PREINGEST             = "preingest"
+	AUDIT_JOB_DELETE            = "job.delete"
+	AUDIT_JOB_RETRY             = "job.retry"
+	AUDIT_TRANSCODE_CALLBACK    = "callback.transcode"
+	AUDIT_PACKAGING_SUCCESS     = "callback.packaging.success"
+	AUDIT_PACKAGING_FAILURE     = "callback.packaging.failure"
+)
+
+// Actors of the changes not made with an API key
+const (
+	AUDIT_ACTOR_ANONYMOUS = "anonymous"
+	AUDIT_ACTOR_ENCORE    = "encore"
+	AUDIT_ACTOR_PACKAGER  = "packager"
+)
+
+var auditFilterParams = []string{"since", "until"}
+
+type auditResponse struct {
+	Events []structure.AuditEvent `json:"events"`
+	Size   int                    `json:"size"`
+	Next   string                 `json:"next,omitempty"`
+}
+
+// Records a change in the audit log. Failing to do so is logged, but does
+// not fail the change, which has already been made.
+func (api *API) audit(actor string, action string, target string, details map[string]string) {
+	if api.auditMaxLength <= 0 {
+		return
+	}
+	if actor == "" {
+		actor = AUDIT_ACTOR_ANONYMOUS
+	}
+	err := api.valkeyStore.AppendAudit(structure.AuditEvent{
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}, int64(api.auditMaxLength))
+	if err != nil {
+		logger.Warn("failed to record audit event",
+			slog.String("action", action),
+			slog.String("target", target),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// Records several changes at once, e.g. those of a bulk import, in a few
+// round trips.
+func (api *API) auditMany(events []structure.AuditEvent) {
+	if api.auditMaxLength <= 0 || len(events) == 0 {
+		return
+	}
+	for idx := range events {
+		if events[idx].Actor == "" {
+			events[idx].Actor = AUDIT_ACTOR_ANONYMOUS
+		}
+	}
+	if err := api.valkeyStore.AppendAuditMany(events, int64(api.auditMaxLength)); err != nil {
+		logger.Warn("failed to record audit events",
+			slog.String("action", events[0].Action),
+			slog.Int("count", len(events)),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// The name of the API key the request was made with, if any.
+func requestActor(r *http.Request) string {
+	if principal, found := auth.FromContext(r.Context()); found {
+		return principal.Name
+	}
+	return ""
+}
+
+// HandleAudit lists the audit log, newest first. The since and until query
+// parameters take unix seconds or RFC 3339 timestamps, and the next link
+// pages on to older events.
+func (api *API) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleAudit")
+	defer span.End()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	size := 50
+	if s := query.Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size <= 0 || size > 1000 {
+			http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	filter := store.AuditFilter{Before: query.Get("before")}
+	if filter.Before != "" && !store.IsAuditId(filter.Before) {
+		http.Error(w, "Invalid before parameter", http.StatusBadRequest)
+		return
+	}
+	for _, param := range auditFilterParams {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseTimeParam(value)
+		if err != nil {
+			http.Error(w, "Invalid "+param+" parameter", http.StatusBadRequest)
+			return
+		}
+		if param == "since" {
+			filter.Since = parsed
+		} else {
+			filter.Until = parsed
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && filter.Until.Before(filter.Since) {
+		http.Error(w, "until must not be before since", http.StatusBadRequest)
+		return
+	}
+	events, err := api.valkeyStore.ListAudit(filter, size)
+	if err != nil {
+		logger.Error("failed to list audit events", slog.String("error", err.Error()))
+		http.Error(w, "Failed to list audit events", http.StatusInternalServerError)
+		return
+	}
+	resp := auditResponse{Events: events, Size: len(events)}
+	if len(events) == size {
+		resp.Next = listLink(auditPath, query, auditFilterParams, url.Values{
+			"before": {events[len(events)-1].Id},
+			"size":   {strconv.Itoa(size)},
+		})
+	}
+	writeJson(w, resp)
+}
@@ -0,0 +1,160 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestAuditManagementActions(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	authenticator := auth.NewAuthenticator(
+		[]auth.APIKey{{Name: "ops", Role: auth.RoleAdmin, Key: "ops-key"}},
+		RequiredRole,
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blacklist", api.HandleBlackList)
+	mux.HandleFunc("/preingest", api.HandlePreIngestCreatives)
+	mux.HandleFunc("DELETE /jobs/{creativeId}", api.HandleDeleteJob)
+	handler := authenticator.Middleware(mux)
+	send := func(method string, path string, body any) int {
+		serializedBody, err := json.Marshal(body)
+		is.NoErr(err)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(serializedBody))
+		req.Header.Set(auth.API_KEY_HEADER, "ops-key")
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder.Result().StatusCode
+	}
+
+	blacklistUrl := "https://adserver-assets.io/badfile.mp4"
+	is.Equal(send(http.MethodPost, "/blacklist", blacklistRequest{MediaUrl: blacklistUrl, Reason: "corrupt audio"}), http.StatusNoContent)
+	is.Equal(send(http.MethodDelete, "/blacklist", blacklistRequest{MediaUrl: blacklistUrl}), http.StatusNoContent)
+	is.Equal(send(http.MethodPost, "/blacklist", blacklistRequest{Type: structure.RuleHost, Pattern: "bad-cdn.example.com"}), http.StatusNoContent)
+	is.Equal(send(http.MethodPost, "/preingest", preIngestCreativeRequest{MediaUrls: []string{"https://cdn.example.com/ad.mp4"}}), http.StatusOK)
+	storeStub.mockStore["creative"] = structure.TranscodeInfo{Status: structure.StatusCompleted}
+	is.Equal(send(http.MethodDelete, "/jobs/creative", nil), http.StatusNoContent)
+	// Rejected changes are not recorded
+	is.Equal(send(http.MethodPost, "/blacklist", blacklistRequest{MediaUrl: blacklistUrl, ExpiresAt: 1}), http.StatusBadRequest)
+
+	is.Equal(len(storeStub.audit), 5)
+	for _, event := range storeStub.audit {
+		is.Equal(event.Actor, "ops")
+	}
+	is.Equal(storeStub.audit[0].Action, AUDIT_BLACKLIST_ADD)
+	is.Equal(storeStub.audit[0].Target, blacklistUrl)
+	is.Equal(storeStub.audit[0].Details["reason"], "corrupt audio")
+	is.Equal(storeStub.audit[1].Action, AUDIT_BLACKLIST_REMOVE)
+	is.Equal(storeStub.audit[2].Action, AUDIT_BLACKLIST_RULE_ADD)
+	is.Equal(storeStub.audit[2].Target, "host:bad-cdn.example.com")
+	is.Equal(storeStub.audit[3].Action, AUDIT_PREINGEST)
+	is.Equal(storeStub.audit[3].Details["notYetProcessed"], "1")
+	is.Equal(storeStub.audit[4].Action, AUDIT_JOB_DELETE)
+	is.Equal(storeStub.audit[4].Target, "creative")
+}
+
+func TestAuditBlacklistImport(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	status, _ := importBlacklist(api, "", "text/csv",
+		"mediaUrl,reason,actor\nhttp://example.com/a.mp4,corrupt audio,ops\nhttp://example.com/b.mp4,,\n,missing url,\n")
+	is.Equal(status, http.StatusOK)
+	status, _ = importBlacklist(api, "?mode=replace", "text/csv", "http://example.com/b.mp4\nhttp://example.com/c.mp4\n")
+	is.Equal(status, http.StatusOK)
+
+	actions := map[string][]string{}
+	for _, event := range storeStub.audit {
+		actions[event.Action] = append(actions[event.Action], event.Target)
+	}
+	// One event per URL added or removed, besides the summary of each import
+	is.Equal(actions[AUDIT_BLACKLIST_ADD], []string{
+		"http://example.com/a.mp4",
+		"http://example.com/b.mp4",
+		"http://example.com/b.mp4",
+		"http://example.com/c.mp4",
+	})
+	is.Equal(actions[AUDIT_BLACKLIST_REMOVE], []string{"http://example.com/a.mp4"})
+	is.Equal(len(actions[AUDIT_BLACKLIST_IMPORT]), 2)
+	is.Equal(storeStub.audit[0].Actor, "ops")
+	is.Equal(storeStub.audit[0].Details["reason"], "corrupt audio")
+	is.Equal(storeStub.audit[1].Actor, AUDIT_ACTOR_ANONYMOUS)
+}
+
+func TestAuditCallbacks(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	storeStub.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		EncoreJobId: "job",
+	}
+	callback := func(status string) {
+		body, err := json.Marshal(structure.EncoreJobProgress{JobId: "job", ExternalId: "creative", Status: status, Progress: 50})
+		is.NoErr(err)
+		recorder := httptest.NewRecorder()
+		api.HandleEncoreCallback(recorder, httptest.NewRequest(http.MethodPost, "/encoreCallback", bytes.NewBuffer(body)))
+		is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	}
+	callback(string(structure.TranscodeInProgress))
+	is.Equal(len(storeStub.audit), 0) // Progress is not audited
+	callback(string(structure.TranscodeFailed))
+	is.Equal(len(storeStub.audit), 1)
+	is.Equal(storeStub.audit[0].Actor, AUDIT_ACTOR_ENCORE)
+	is.Equal(storeStub.audit[0].Action, AUDIT_TRANSCODE_CALLBACK)
+	is.Equal(storeStub.audit[0].Target, "creative")
+	is.Equal(storeStub.audit[0].Details["status"], "FAILED")
+}
+
+func TestAuditDisabled(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	api.auditMaxLength = 0
+	api.audit("ops", AUDIT_BLACKLIST_ADD, "https://adserver-assets.io/badfile.mp4", nil)
+	is.Equal(len(storeStub.audit), 0)
+}
+
+func TestHandleAudit(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	for _, target := range []string{"a", "b", "c"} {
+		api.audit("", AUDIT_BLACKLIST_ADD, target, nil)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.HandleAudit(recorder, httptest.NewRequest(http.MethodGet, "/audit?size=2&since=2025-01-01T00:00:00Z&until=1767225600", nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	var response auditResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(response.Size, 2)
+	is.Equal(response.Events[0].Target, "c") // Newest first
+	is.Equal(response.Events[0].Actor, AUDIT_ACTOR_ANONYMOUS)
+	is.Equal(response.Next, "/audit?before=1-0&since=2025-01-01T00%3A00%3A00Z&size=2&until=1767225600")
+	is.Equal(storeStub.lastAuditFilter.Since, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	is.Equal(storeStub.lastAuditFilter.Until, time.Unix(1767225600, 0))
+
+	recorder = httptest.NewRecorder()
+	api.HandleAudit(recorder, httptest.NewRequest(http.MethodGet, response.Next, nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	is.Equal(storeStub.lastAuditFilter.Before, "1-0")
+
+	for _, query := range []string{"size=0", "before=garbage", "since=yesterday", "since=1767225600&until=1735689600"} {
+		recorder = httptest.NewRecorder()
+		api.HandleAudit(recorder, httptest.NewRequest(http.MethodGet, "/audit?"+query, nil))
+		is.Equal(recorder.Result().StatusCode, http.StatusBadRequest)
+	}
+	recorder = httptest.NewRecorder()
+	api.HandleAudit(recorder, httptest.NewRequest(http.MethodPost, "/audit", nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,90 @@
+package serve
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Recorded as the actor of the blacklist entries added automatically
+const AUTO_BLACKLIST_ACTOR = "auto-blacklist"
+
+// Counts a failed job against its source, and blacklists the source once
+// it has failed as many times as the threshold without completing in
+// between, so that a broken source isn't transcoded over and over again.
+// Must be called before the job is removed from the store, since the
+// source is looked up there if the job doesn't carry it.
+func (api *API) sourceFailed(creativeId string, job *structure.TranscodeJob, reason string) {
+	if api.autoBlacklistThreshold <= 0 {
+		return
+	}
+	source := job.Source
+	if source == "" {
+		info, found, err := api.valkeyStore.Get(creativeId)
+		if err != nil || !found || info.EncoreJobId != job.Id {
+			return
+		}
+		source = info.Source
+	}
+	if source == "" {
+		return
+	}
+	failures, err := api.valkeyStore.RecordSourceFailure(source, reason, int64(api.autoBlacklistWindow))
+	if err != nil {
+		logger.Error("failed to record source failure",
+			slog.String("source", source),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	if failures < int64(api.autoBlacklistThreshold) {
+		return
+	}
+	// Jobs already in flight may keep failing after the source was
+	// blacklisted. Failures past the threshold still blacklist it if
+	// that failed before.
+	if blacklisted, err := api.valkeyStore.InBlackList(source); err == nil && blacklisted {
+		return
+	}
+	err = api.valkeyStore.BlackList(structure.BlacklistEntry{
+		MediaUrl:  source,
+		Reason:    reason,
+		Actor:     AUTO_BLACKLIST_ACTOR,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		logger.Error("failed to blacklist failing source",
+			slog.String("source", source),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	logger.Warn("blacklisted source after repeated failures",
+		slog.String("source", source),
+		slog.Int64("failures", failures),
+		slog.String("reason", reason),
+	)
+	api.reportKpi(normalizerMetrics.AdsHandledEventArguments{AutoBlacklisted: 1})
+	api.audit(AUTO_BLACKLIST_ACTOR, AUDIT_BLACKLIST_ADD, source, map[string]string{
+		"reason":   reason,
+		"failures": strconv.FormatInt(failures, 10),
+	})
+}
+
+// Forgets the failures counted against the source, when a job for it has
+// completed or it has been removed from the blacklist.
+func (api *API) clearSourceFailures(source string) {
+	if api.autoBlacklistThreshold <= 0 || source == "" {
+		return
+	}
+	if err := api.valkeyStore.ClearSourceFailures(source); err != nil {
+		logger.Warn("failed to clear source failures",
+			slog.String("source", source),
+			slog.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,127 @@
+package serve
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestAutoBlacklist(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	api.autoBlacklistThreshold = 2
+	api.autoBlacklistWindow = 60
+	source := "http://example.com/broken.mp4"
+	fail := func(jobId string) {
+		storeStub.mockStore["creative"] = structure.TranscodeInfo{
+			Status:      structure.StatusInProgress,
+			Source:      source,
+			EncoreJobId: jobId,
+		}
+		is.NoErr(api.handleTranscodeFailed(&structure.TranscodeJob{Id: jobId, CreativeId: "creative"}))
+	}
+
+	fail("job-1")
+	is.Equal(len(storeStub.blacklist), 0)
+	fail("job-2")
+	is.Equal(storeStub.blacklist, []string{source})
+	is.Equal(storeStub.kpis.AutoBlacklisted, 1)
+	// Jobs still in flight when it was blacklisted don't blacklist it again
+	fail("job-3")
+	is.Equal(len(storeStub.blacklist), 1)
+	is.Equal(storeStub.kpis.AutoBlacklisted, 1)
+}
+
+func TestAutoBlacklistPastThreshold(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	api.autoBlacklistThreshold = 2
+	api.autoBlacklistWindow = 60
+	source := "http://example.com/broken.mp4"
+	// Blacklisting failed when the threshold was reached
+	storeStub.failures = map[string]int64{source: 2}
+
+	storeStub.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      source,
+		EncoreJobId: "job-3",
+	}
+	is.NoErr(api.handleTranscodeFailed(&structure.TranscodeJob{Id: "job-3", CreativeId: "creative"}))
+	is.Equal(storeStub.blacklist, []string{source})
+	is.Equal(storeStub.kpis.AutoBlacklisted, 1)
+}
+
+func TestStaleFailureNotCounted(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	api.autoBlacklistThreshold = 1
+	api.autoBlacklistWindow = 60
+	// The job was retried, and the failure is of the replaced job
+	storeStub.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      structure.StatusQueued,
+		Source:      "http://example.com/video.mp4",
+		EncoreJobId: "job-2",
+	}
+	is.NoErr(api.handleTranscodeFailed(&structure.TranscodeJob{Id: "job-1", CreativeId: "creative"}))
+	is.Equal(storeStub.mockStore["creative"].Status, structure.StatusQueued)
+	is.Equal(len(storeStub.failures), 0)
+	is.Equal(len(storeStub.blacklist), 0)
+}
+
+func TestAutoBlacklistDisabled(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	for range 5 {
+		storeStub.mockStore["creative"] = structure.TranscodeInfo{
+			Status:      structure.StatusInProgress,
+			Source:      "http://example.com/broken.mp4",
+			EncoreJobId: "job-1",
+		}
+		is.NoErr(api.handleTranscodeFailed(&structure.TranscodeJob{Id: "job-1", CreativeId: "creative"}))
+	}
+	is.Equal(len(storeStub.blacklist), 0)
+	is.Equal(len(storeStub.failures), 0)
+}
+
+func TestPackagingFailuresCount(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	api.autoBlacklistThreshold = 3
+	api.autoBlacklistWindow = 60
+	// The source of the job returned by the transcoder stub
+	source := "http://example.com/source/video.mp4"
+	packaging := structure.TranscodeInfo{Status: structure.StatusPackaging, EncoreJobId: "test-job-id"}
+	storeStub.mockStore["test-job-id"] = packaging
+	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
+	req, err := http.NewRequest("POST", "/failure", bytes.NewBufferString(failureEvent))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandlePackagingFailure(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(storeStub.failures[source], int64(1))
+
+	// A completed job clears the count
+	storeStub.mockStore["test-job-id"] = packaging
+	successEvent := `{"jobId": "test-job-id", "url": "https://encore-instance", "outputPath": "/output-folder/"}`
+	req, err = http.NewRequest("POST", "/success", bytes.NewBufferString(successEvent))
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	api.HandlePackagingSuccess(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	_, counted := storeStub.failures[source]
+	is.True(!counted)
+}
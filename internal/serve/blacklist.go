@@ -0,0 +1,210 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/blacklist"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// RunBlacklistSweep periodically removes expired entries from the blacklist.
+// Expired entries are already ignored when ads are filtered, so this only
+// keeps the blacklist from growing. Pruning is idempotent, so every replica
+// sweeps. Blocks until the context is cancelled.
+func (api *API) RunBlacklistSweep(ctx context.Context, interval time.Duration) {
+	logger.Info("Starting blacklist sweep", slog.Duration("interval", interval))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			api.pruneBlackList()
+		case <-ctx.Done():
+			logger.Info("Stopping blacklist sweep")
+			return
+		}
+	}
+}
+
+func (api *API) pruneBlackList() int {
+	pruned, err := api.valkeyStore.PruneBlackList()
+	if err != nil {
+		logger.Error("failed to prune blacklist", slog.String("error", err.Error()))
+		return 0
+	}
+	for _, mediaUrl := range pruned {
+		logger.Info("removed expired blacklist entry", slog.String("mediaUrl", mediaUrl))
+	}
+	return len(pruned) + api.pruneBlackListRules()
+}
+
+func (api *API) pruneBlackListRules() int {
+	rules, err := api.valkeyStore.GetBlackListRules()
+	if err != nil {
+		logger.Error("failed to get blacklist rules", slog.String("error", err.Error()))
+		return 0
+	}
+	pruned := 0
+	now := time.Now()
+	for _, rule := range rules {
+		if !rule.Expired(now) {
+			continue
+		}
+		if err := api.valkeyStore.RemoveBlackListRule(rule.Id()); err != nil {
+			logger.Error("failed to remove expired blacklist rule",
+				slog.String("rule", rule.Id()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		logger.Info("removed expired blacklist rule", slog.String("rule", rule.Id()))
+		pruned++
+	}
+	if pruned > 0 {
+		api.blacklistRules.invalidate()
+	}
+	return pruned
+}
+
+// blacklistRules caches the blacklist rules, compiled into a matcher, since
+// they are consulted for every creative in every ad response. Rules changed
+// through this replica take effect at once, those changed through other
+// replicas once the cached matcher is refreshed.
+type blacklistRules struct {
+	mu       sync.Mutex
+	matcher  *blacklist.Matcher
+	loadedAt time.Time
+	refresh  time.Duration
+}
+
+func (br *blacklistRules) invalidate() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.loadedAt = time.Time{}
+}
+
+// Returns the matcher for the current blacklist rules. If the rules cannot
+// be loaded the last matcher is kept, which is nil if there never was one.
+// A nil matcher matches nothing.
+func (api *API) blacklistMatcher() *blacklist.Matcher {
+	br := api.blacklistRules
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if !br.loadedAt.IsZero() && time.Since(br.loadedAt) < br.refresh {
+		return br.matcher
+	}
+	rules, err := api.valkeyStore.GetBlackListRules()
+	if err != nil {
+		logger.Error("failed to load blacklist rules", slog.String("error", err.Error()))
+		return br.matcher
+	}
+	matcher, err := blacklist.Compile(rules)
+	if err != nil {
+		// Rules are validated when they are added, so this should not happen
+		logger.Error("failed to compile blacklist rules", slog.String("error", err.Error()))
+		return br.matcher
+	}
+	br.matcher = matcher
+	br.loadedAt = time.Now()
+	return matcher
+}
+
+// Returns the details of the blacklisted URLs, in the same order. URLs
+// blacklisted without details only have their URL set.
+func (api *API) blacklistEntries(mediaUrls []string) []structure.BlacklistEntry {
+	stored, err := api.valkeyStore.GetBlackListEntries(mediaUrls)
+	if err != nil {
+		logger.Warn("failed to get blacklist entries", slog.String("error", err.Error()))
+	}
+	entries := make([]structure.BlacklistEntry, 0, len(mediaUrls))
+	for _, mediaUrl := range mediaUrls {
+		entry, found := stored[mediaUrl]
+		if !found {
+			entry = structure.BlacklistEntry{MediaUrl: mediaUrl}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (api *API) addBlackListRule(w http.ResponseWriter, rule structure.BlacklistRule) {
+	if err := blacklist.Validate(rule); err != nil {
+		http.Error(w, "Invalid blacklist rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := api.valkeyStore.AddBlackListRule(rule); err != nil {
+		logger.Error("failed to add blacklist rule",
+			slog.String("rule", rule.Id()),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to add blacklist rule", http.StatusInternalServerError)
+		return
+	}
+	api.blacklistRules.invalidate()
+	logger.Info("added blacklist rule",
+		slog.String("rule", rule.Id()),
+		slog.String("reason", rule.Reason),
+		slog.String("actor", rule.Actor),
+	)
+	api.audit(rule.Actor, AUDIT_BLACKLIST_RULE_ADD, rule.Id(), blacklistAuditDetails(rule.Reason, rule.ExpiresAt))
+	// Don't spend any more transcoding on what the rule matches
+	matcher, _ := blacklist.Compile([]structure.BlacklistRule{rule})
+	cancelled, err := api.cancelJobsMatching(matcher)
+	if err != nil {
+		logger.Error("failed to cancel jobs matching blacklist rule",
+			slog.String("rule", rule.Id()),
+			slog.String("error", err.Error()),
+		)
+	} else if cancelled > 0 {
+		logger.Info("cancelled jobs matching blacklist rule",
+			slog.String("rule", rule.Id()),
+			slog.Int("count", cancelled),
+		)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *API) removeBlackListRule(w http.ResponseWriter, rule structure.BlacklistRule, actor string) {
+	if err := api.valkeyStore.RemoveBlackListRule(rule.Id()); err != nil {
+		logger.Error("failed to remove blacklist rule",
+			slog.String("rule", rule.Id()),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to remove blacklist rule", http.StatusInternalServerError)
+		return
+	}
+	api.blacklistRules.invalidate()
+	logger.Info("removed blacklist rule", slog.String("rule", rule.Id()))
+	api.audit(actor, AUDIT_BLACKLIST_RULE_REMOVE, rule.Id(), nil)
+	// Let what the rule matched be ingested again
+	matcher, _ := blacklist.Compile([]structure.BlacklistRule{rule})
+	api.releaseCancelledJobsMatching(matcher)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *API) listBlackListRules() []structure.BlacklistRule {
+	rules, err := api.valkeyStore.GetBlackListRules()
+	if err != nil {
+		logger.Warn("failed to get blacklist rules", slog.String("error", err.Error()))
+		return []structure.BlacklistRule{}
+	}
+	return rules
+}
+
+// The details of a blacklist entry or rule worth keeping in the audit log
+func blacklistAuditDetails(reason string, expiresAt int64) map[string]string {
+	details := map[string]string{}
+	if reason != "" {
+		details["reason"] = reason
+	}
+	if expiresAt > 0 {
+		details["expiresAt"] = strconv.FormatInt(expiresAt, 10)
+	}
+	return details
+}
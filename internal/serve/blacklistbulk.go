@@ -0,0 +1,537 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+const csvContentType = "text/csv"
+const ndjsonContentType = "application/x-ndjson"
+
+// Largest blacklist import accepted, in bytes
+const maxBlacklistImportSize = 32 << 20
+
+// Columns of a CSV import without a header row, and of an export
+var defaultImportColumns = []string{"mediaUrl", "reason", "expiresAt"}
+var exportColumns = []string{"mediaUrl", "reason", "actor", "createdAt", "expiresAt"}
+
+const (
+	importModeAdd     = "add"
+	importModeRemove  = "remove"
+	importModeReplace = "replace"
+)
+
+type blacklistImportLine struct {
+	Line     int    `json:"line"`
+	MediaUrl string `json:"mediaUrl,omitempty"`
+	Ok       bool   `json:"ok"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type blacklistImportResponse struct {
+	Mode    string                `json:"mode"`
+	Added   int                   `json:"added"`
+	Removed int                   `json:"removed"`
+	Skipped int                   `json:"skipped"`
+	Failed  int                   `json:"failed"`
+	Lines   []blacklistImportLine `json:"lines"`
+	// Set if the import was only partly applied
+	Error string `json:"error,omitempty"`
+}
+
+// A parsed line of an import, entry is only valid if err is nil. Entries
+// that have already expired are skipped.
+type importedEntry struct {
+	line    int
+	entry   structure.BlacklistEntry
+	err     error
+	expired bool
+}
+
+// HandleBlackListImport adds or removes the URLs of a CSV or NDJSON body,
+// or replaces the whole blacklist with them, depending on the mode query
+// parameter. Every line gets its own result, so that a few bad lines do not
+// hide what happened to the others.
+func (api *API) HandleBlackListImport(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleBlackListImport")
+	defer span.End()
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importModeAdd
+	}
+	if mode != importModeAdd && mode != importModeRemove && mode != importModeReplace {
+		http.Error(w, "Invalid mode parameter, expected add, remove or replace", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = importFormat(r.Header.Get("Content-Type"))
+	}
+	body := http.MaxBytesReader(w, r.Body, maxBlacklistImportSize)
+	var parsed []importedEntry
+	var err error
+	switch format {
+	case "csv":
+		parsed, err = readCsvImport(body)
+	case "ndjson":
+		parsed, err = readNdjsonImport(body)
+	default:
+		http.Error(w, "Unsupported format, expected text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to read blacklist import", slog.String("error", err.Error()))
+		http.Error(w, "Failed to read import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(r)
+	now := time.Now()
+	for idx := range parsed {
+		imported := &parsed[idx]
+		if imported.err != nil {
+			continue
+		}
+		if mode == importModeRemove {
+			continue // Only the URL matters
+		}
+		if imported.entry.ExpiresAt != 0 && imported.entry.ExpiresAt <= now.Unix() {
+			// Would be pruned right away, e.g. a line of an old export
+			imported.expired = true
+			continue
+		}
+		if actor != "" {
+			imported.entry.Actor = actor
+		}
+		imported.entry.CreatedAt = now.Unix()
+	}
+
+	response := blacklistImportResponse{Mode: mode, Lines: make([]blacklistImportLine, len(parsed))}
+	for idx, imported := range parsed {
+		response.Lines[idx] = blacklistImportLine{Line: imported.line, MediaUrl: imported.entry.MediaUrl}
+		if imported.err != nil {
+			response.Lines[idx].Error = imported.err.Error()
+			response.Failed++
+		} else if imported.expired {
+			response.Lines[idx].Ok = true
+			response.Lines[idx].Skipped = true
+			response.Skipped++
+		}
+	}
+	if mode == importModeReplace && response.Failed > 0 {
+		// A truncated or garbled file would otherwise empty the blacklist
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if mode == importModeRemove {
+		api.importRemovals(parsed, &response, actor)
+	} else {
+		api.importAdditions(parsed, &response)
+	}
+	var replaceErr error
+	if mode == importModeReplace {
+		// The lines have already been applied, so a failure here leaves the
+		// blacklist with both the imported and the old entries
+		replaceErr = api.removeUnlisted(parsed, &response, actor)
+		if replaceErr != nil {
+			logger.Error("failed to remove entries missing from blacklist import", slog.String("error", replaceErr.Error()))
+			response.Error = "Failed to remove the entries missing from the import, only the lines of the import were applied"
+		}
+	}
+	logger.Info("imported blacklist",
+		slog.String("mode", mode),
+		slog.String("actor", actor),
+		slog.Int("added", response.Added),
+		slog.Int("removed", response.Removed),
+		slog.Int("skipped", response.Skipped),
+		slog.Int("failed", response.Failed),
+	)
+	details := map[string]string{
+		"format":  format,
+		"added":   strconv.Itoa(response.Added),
+		"removed": strconv.Itoa(response.Removed),
+		"skipped": strconv.Itoa(response.Skipped),
+		"failed":  strconv.Itoa(response.Failed),
+	}
+	if replaceErr != nil {
+		details["error"] = response.Error
+	}
+	api.audit(actor, AUDIT_BLACKLIST_IMPORT, mode, details)
+	if replaceErr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(response)
+		return
+	}
+	writeJson(w, response)
+}
+
+func importFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case csvContentType:
+		return "csv"
+	case ndjsonContentType, "application/ndjson", "application/jsonl":
+		return "ndjson"
+	}
+	return ""
+}
+
+func (api *API) importAdditions(parsed []importedEntry, response *blacklistImportResponse) {
+	entries := make([]structure.BlacklistEntry, 0, len(parsed))
+	lines := make([]int, 0, len(parsed))
+	for idx, imported := range parsed {
+		if imported.err == nil && !imported.expired {
+			entries = append(entries, imported.entry)
+			lines = append(lines, idx)
+		}
+	}
+	added := make(map[string]bool, len(entries))
+	events := make([]structure.AuditEvent, 0, len(entries))
+	for idx, err := range api.valkeyStore.BlackListMany(entries) {
+		line := &response.Lines[lines[idx]]
+		if err != nil {
+			line.Error = err.Error()
+			response.Failed++
+			continue
+		}
+		line.Ok = true
+		response.Added++
+		entry := entries[idx]
+		added[entry.MediaUrl] = true
+		events = append(events, structure.AuditEvent{
+			Actor:   entry.Actor,
+			Action:  AUDIT_BLACKLIST_ADD,
+			Target:  entry.MediaUrl,
+			Details: blacklistAuditDetails(entry.Reason, entry.ExpiresAt),
+		})
+	}
+	api.auditMany(events)
+	if len(added) == 0 {
+		return
+	}
+	// Don't spend any more transcoding on them
+	cancelled, err := api.cancelJobs("", func(_ string, info structure.TranscodeInfo) bool {
+		return added[info.Source]
+	})
+	if err != nil {
+		logger.Error("failed to cancel jobs for imported blacklist entries", slog.String("error", err.Error()))
+	} else if cancelled > 0 {
+		logger.Info("cancelled jobs for imported blacklist entries", slog.Int("count", cancelled))
+	}
+}
+
+func (api *API) importRemovals(parsed []importedEntry, response *blacklistImportResponse, actor string) {
+	values := make([]string, 0, len(parsed))
+	lines := make([]int, 0, len(parsed))
+	for idx, imported := range parsed {
+		if imported.err == nil {
+			values = append(values, imported.entry.MediaUrl)
+			lines = append(lines, idx)
+		}
+	}
+	removed := make(map[string]bool, len(values))
+	for idx, err := range api.valkeyStore.RemoveFromBlackListMany(values) {
+		line := &response.Lines[lines[idx]]
+		if err != nil {
+			line.Error = err.Error()
+			response.Failed++
+			continue
+		}
+		line.Ok = true
+		response.Removed++
+		removed[values[idx]] = true
+		api.clearSourceFailures(values[idx])
+	}
+	api.auditRemovals(actor, removed)
+	api.releaseCancelledJobsForSources(removed)
+}
+
+// Records a blacklist.remove event for each removed URL
+func (api *API) auditRemovals(actor string, removed map[string]bool) {
+	events := make([]structure.AuditEvent, 0, len(removed))
+	for value := range removed {
+		events = append(events, structure.AuditEvent{Actor: actor, Action: AUDIT_BLACKLIST_REMOVE, Target: value})
+	}
+	api.auditMany(events)
+}
+
+// Removes the blacklisted URLs that are not part of the import, or only
+// with an entry that has already expired.
+func (api *API) removeUnlisted(parsed []importedEntry, response *blacklistImportResponse, actor string) error {
+	listed := make(map[string]bool, len(parsed))
+	for _, imported := range parsed {
+		if !imported.expired {
+			listed[imported.entry.MediaUrl] = true
+		}
+	}
+	unlisted := []string{}
+	var cursor *store.Cursor
+	for {
+		page, err := api.valkeyStore.GetBlackListPage(cursor, 100)
+		if err != nil {
+			return err
+		}
+		for _, value := range page.Items {
+			if !listed[value] {
+				unlisted = append(unlisted, value)
+			}
+		}
+		if page.Next == nil {
+			break
+		}
+		cursor = page.Next
+	}
+	removed := make(map[string]bool, len(unlisted))
+	for idx, err := range api.valkeyStore.RemoveFromBlackListMany(unlisted) {
+		if err != nil {
+			// Not a line of the import, but should not go unnoticed
+			logger.Error("failed to remove entry missing from blacklist import",
+				slog.String("mediaUrl", unlisted[idx]),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		response.Removed++
+		removed[unlisted[idx]] = true
+		api.clearSourceFailures(unlisted[idx])
+	}
+	api.auditRemovals(actor, removed)
+	api.releaseCancelledJobsForSources(removed)
+	return nil
+}
+
+// Reads a CSV import. The first row is a header if it has a mediaUrl
+// column, otherwise the columns are mediaUrl, reason and expiresAt.
+// Unknown columns are ignored.
+func readCsvImport(body io.Reader) ([]importedEntry, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	columns := defaultImportColumns
+	parsed := []importedEntry{}
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			parsed = append(parsed, importedEntry{line: parseErr.StartLine, err: parseErr.Err})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if first {
+			first = false
+			if strings.EqualFold(strings.TrimSpace(record[0]), "mediaUrl") {
+				columns = record
+				continue
+			}
+		}
+		entry := structure.BlacklistEntry{}
+		var entryErr error
+		for idx, value := range record {
+			if idx >= len(columns) {
+				break
+			}
+			value = unescapeCsvCell(strings.TrimSpace(value))
+			switch strings.ToLower(strings.TrimSpace(columns[idx])) {
+			case "mediaurl":
+				entry.MediaUrl = value
+			case "reason":
+				entry.Reason = value
+			case "actor":
+				entry.Actor = value
+			case "expiresat":
+				entry.ExpiresAt, entryErr = parseExpiry(value)
+			}
+		}
+		if entryErr == nil && entry.MediaUrl == "" {
+			entryErr = errors.New("missing mediaUrl")
+		}
+		parsed = append(parsed, importedEntry{line: line, entry: entry, err: entryErr})
+	}
+	return parsed, nil
+}
+
+// Reads an NDJSON import, where each line has the same fields as a
+// request to the blacklist endpoint. Blank lines are skipped.
+func readNdjsonImport(body io.Reader) ([]importedEntry, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	parsed := []importedEntry{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var blRequest blacklistRequest
+		var entryErr error
+		if err := json.Unmarshal([]byte(raw), &blRequest); err != nil {
+			entryErr = fmt.Errorf("invalid JSON: %w", err)
+		} else if blRequest.Type != "" {
+			entryErr = errors.New("blacklist rules cannot be imported")
+		} else if blRequest.MediaUrl == "" {
+			entryErr = errors.New("missing mediaUrl")
+		}
+		parsed = append(parsed, importedEntry{
+			line: line,
+			entry: structure.BlacklistEntry{
+				MediaUrl:  blRequest.MediaUrl,
+				Reason:    blRequest.Reason,
+				Actor:     blRequest.Actor,
+				ExpiresAt: blRequest.ExpiresAt,
+			},
+			err: entryErr,
+		})
+	}
+	return parsed, scanner.Err()
+}
+
+// Expiry of a CSV line, as unix seconds or RFC 3339. Empty if it does not expire.
+func parseExpiry(value string) (int64, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	expiresAt, err := parseTimeParam(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiresAt %q", value)
+	}
+	return expiresAt.Unix(), nil
+}
+
+// HandleBlackListExport writes the whole blacklist as CSV, or as NDJSON if
+// asked for with the format query parameter or the Accept header. The
+// export can be imported again as is.
+func (api *API) HandleBlackListExport(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleBlackListExport")
+	defer span.End()
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.Contains(r.Header.Get("Accept"), "ndjson") {
+			format = "ndjson"
+		}
+	}
+	var writeEntry func(structure.BlacklistEntry) error
+	var flush func() error
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", csvContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="blacklist.csv"`)
+		writer := csv.NewWriter(w)
+		_ = writer.Write(exportColumns)
+		writeEntry = func(entry structure.BlacklistEntry) error {
+			return writer.Write([]string{
+				escapeCsvCell(entry.MediaUrl),
+				escapeCsvCell(entry.Reason),
+				escapeCsvCell(entry.Actor),
+				formatTimestamp(entry.CreatedAt),
+				formatTimestamp(entry.ExpiresAt),
+			})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case "ndjson":
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="blacklist.ndjson"`)
+		encoder := json.NewEncoder(w)
+		writeEntry = func(entry structure.BlacklistEntry) error {
+			return encoder.Encode(entry)
+		}
+		flush = func() error { return nil }
+	default:
+		http.Error(w, "Invalid format parameter, expected csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	// Pages are written as they are read, so a failure part way through
+	// can only cut the export short
+	exported := 0
+	var cursor *store.Cursor
+	for {
+		page, err := api.valkeyStore.GetBlackListPage(cursor, 100)
+		if err != nil {
+			logger.Error("failed to export blacklist",
+				slog.Int("exported", exported),
+				slog.String("error", err.Error()),
+			)
+			if exported == 0 {
+				http.Error(w, "Failed to export blacklist", http.StatusInternalServerError)
+			}
+			return
+		}
+		now := time.Now().Unix()
+		for _, entry := range api.blacklistEntries(page.Items) {
+			if entry.ExpiresAt > 0 && entry.ExpiresAt <= now {
+				continue // Expired, but not pruned yet
+			}
+			if err := writeEntry(entry); err != nil {
+				logger.Error("failed to write blacklist export", slog.String("error", err.Error()))
+				return
+			}
+			exported++
+		}
+		if page.Next == nil {
+			break
+		}
+		cursor = page.Next
+	}
+	if err := flush(); err != nil {
+		logger.Error("failed to write blacklist export", slog.String("error", err.Error()))
+	}
+}
+
+// Spreadsheets run cells starting with any of these as formulas
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// Prefixes the cell with a quote if a spreadsheet would run it as a formula.
+// Only the CSV export is escaped, since it is meant to be opened in one.
+func escapeCsvCell(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// Removes the quote added by escapeCsvCell, so that an export can be
+// imported again as is.
+func unescapeCsvCell(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return strconv.FormatInt(timestamp, 10)
+}
@@ -0,0 +1,217 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func importBlacklist(api *API, query string, contentType string, body string) (int, blacklistImportResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/blacklist/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackListImport(recorder, req)
+	var response blacklistImportResponse
+	_ = json.NewDecoder(recorder.Result().Body).Decode(&response)
+	return recorder.Result().StatusCode, response
+}
+
+func TestBlacklistImportCsv(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	storeStub.mockStore["transcoding"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		Source:      "http://example.com/b.mp4",
+		EncoreJobId: "transcoding-job",
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	body := "mediaUrl,reason,expiresAt\n" +
+		"http://example.com/a.mp4,corrupt audio,\n" +
+		"http://example.com/b.mp4,,\"" + strconv.FormatInt(expiresAt, 10) + "\"\n" +
+		",missing url,\n" +
+		"http://example.com/c.mp4,expired,1\n" +
+		"http://example.com/d.mp4,bad expiry,tomorrow\n"
+
+	status, response := importBlacklist(api, "", "text/csv; charset=utf-8", body)
+	is.Equal(status, http.StatusOK)
+	is.Equal(response.Mode, "add")
+	is.Equal(response.Added, 2)
+	is.Equal(response.Skipped, 1)
+	is.Equal(response.Failed, 2)
+	is.Equal(len(response.Lines), 5)
+	is.Equal(response.Lines[0], blacklistImportLine{Line: 2, MediaUrl: "http://example.com/a.mp4", Ok: true})
+	is.True(response.Lines[1].Ok)
+	is.Equal(response.Lines[2].Line, 4)
+	is.Equal(response.Lines[2].Error, "missing mediaUrl")
+	is.True(response.Lines[3].Ok) // Already expired, so there is nothing to add
+	is.True(response.Lines[3].Skipped)
+	is.True(!response.Lines[4].Ok) // Not a timestamp
+
+	is.Equal(storeStub.blacklist, []string{"http://example.com/a.mp4", "http://example.com/b.mp4"})
+	is.Equal(storeStub.blacklistEntries["http://example.com/a.mp4"].Reason, "corrupt audio")
+	is.Equal(storeStub.blacklistEntries["http://example.com/b.mp4"].ExpiresAt, expiresAt)
+	is.Equal(encoreHandler.cancelled, []string{"transcoding-job"})
+
+	// Without a header the columns are mediaUrl, reason and expiresAt
+	status, response = importBlacklist(api, "?mode=remove", "text/csv", "http://example.com/a.mp4\nhttp://example.com/unknown.mp4\n")
+	is.Equal(status, http.StatusOK)
+	is.Equal(response.Removed, 2)
+	is.Equal(response.Failed, 0)
+	is.Equal(storeStub.blacklist, []string{"http://example.com/b.mp4"})
+}
+
+func TestBlacklistImportNdjson(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/old.mp4"}))
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/kept.mp4"}))
+
+	body := `{"mediaUrl":"http://example.com/kept.mp4","reason":"still broken"}
+
+{"mediaUrl":"http://example.com/new.mp4"}
+`
+	status, response := importBlacklist(api, "?mode=replace", "application/x-ndjson", body)
+	is.Equal(status, http.StatusOK)
+	is.Equal(response.Added, 2)
+	is.Equal(response.Removed, 1)
+	is.Equal(response.Lines[1].Line, 3) // Blank lines are skipped but counted
+	is.Equal(storeStub.blacklist, []string{"http://example.com/kept.mp4", "http://example.com/new.mp4"})
+	is.Equal(storeStub.blacklistEntries["http://example.com/kept.mp4"].Reason, "still broken")
+
+	// A replace with invalid lines changes nothing
+	status, response = importBlacklist(api, "?mode=replace", "application/x-ndjson", "{\"mediaUrl\":\"http://example.com/only.mp4\"}\nnot json\n")
+	is.Equal(status, http.StatusBadRequest)
+	is.Equal(response.Failed, 1)
+	is.Equal(response.Lines[1].Line, 2)
+	is.Equal(len(storeStub.blacklist), 2)
+
+	// Expired lines do not fail a replace, and are not kept
+	expired := `{"mediaUrl":"http://example.com/kept.mp4","expiresAt":1}
+{"mediaUrl":"http://example.com/new.mp4"}
+`
+	status, response = importBlacklist(api, "?mode=replace", "application/x-ndjson", expired)
+	is.Equal(status, http.StatusOK)
+	is.Equal(response.Skipped, 1)
+	is.Equal(response.Removed, 1)
+	is.Equal(storeStub.blacklist, []string{"http://example.com/new.mp4"})
+
+	status, _ = importBlacklist(api, "?mode=merge", "application/x-ndjson", body)
+	is.Equal(status, http.StatusBadRequest)
+	status, _ = importBlacklist(api, "", "application/json", body)
+	is.Equal(status, http.StatusUnsupportedMediaType)
+}
+
+func TestBlacklistExport(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "http://example.com/a.mp4",
+		Reason:    "corrupt, audio",
+		Actor:     "ops",
+		CreatedAt: 1700000000,
+	}))
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/b.mp4"}))
+	// Expired but not pruned yet, so left out
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/expired.mp4", ExpiresAt: 1}))
+
+	recorder := httptest.NewRecorder()
+	api.HandleBlackListExport(recorder, httptest.NewRequest(http.MethodGet, "/blacklist/export", nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	is.Equal(recorder.Result().Header.Get("Content-Type"), "text/csv")
+	exported := recorder.Body.String()
+	is.Equal(exported, "mediaUrl,reason,actor,createdAt,expiresAt\n"+
+		"http://example.com/a.mp4,\"corrupt, audio\",ops,1700000000,\n"+
+		"http://example.com/b.mp4,,,,\n")
+
+	// The export can be imported again
+	storeStub.reset()
+	status, response := importBlacklist(api, "", "text/csv", exported)
+	is.Equal(status, http.StatusOK)
+	is.Equal(response.Added, 2)
+	is.Equal(storeStub.blacklistEntries["http://example.com/a.mp4"].Reason, "corrupt, audio")
+
+	req := httptest.NewRequest(http.MethodGet, "/blacklist/export", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	recorder = httptest.NewRecorder()
+	api.HandleBlackListExport(recorder, req)
+	is.Equal(recorder.Result().Header.Get("Content-Type"), "application/x-ndjson")
+	scanner := bufio.NewScanner(recorder.Body)
+	lines := 0
+	for scanner.Scan() {
+		var entry structure.BlacklistEntry
+		is.NoErr(json.Unmarshal(scanner.Bytes(), &entry))
+		lines++
+	}
+	is.Equal(lines, 2)
+
+	recorder = httptest.NewRecorder()
+	api.HandleBlackListExport(recorder, httptest.NewRequest(http.MethodGet, "/blacklist/export?format=xlsx", nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusBadRequest)
+}
+
+func TestBlacklistExportEscapesFormulas(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{
+		MediaUrl: "http://example.com/a.mp4",
+		Reason:   "=HYPERLINK(\"http://evil.example.com\")",
+		Actor:    "@ops",
+	}))
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/b.mp4", Reason: "-1+1"}))
+
+	recorder := httptest.NewRecorder()
+	api.HandleBlackListExport(recorder, httptest.NewRequest(http.MethodGet, "/blacklist/export", nil))
+	exported := recorder.Body.String()
+	is.Equal(exported, "mediaUrl,reason,actor,createdAt,expiresAt\n"+
+		"http://example.com/a.mp4,\"'=HYPERLINK(\"\"http://evil.example.com\"\")\",'@ops,,\n"+
+		"http://example.com/b.mp4,'-1+1,,,\n")
+
+	// The NDJSON export is not meant for spreadsheets
+	req := httptest.NewRequest(http.MethodGet, "/blacklist/export?format=ndjson", nil)
+	recorder = httptest.NewRecorder()
+	api.HandleBlackListExport(recorder, req)
+	is.True(strings.Contains(recorder.Body.String(), `"reason":"=HYPERLINK`))
+
+	// Importing the CSV export again restores the values
+	storeStub.reset()
+	status, _ := importBlacklist(api, "", "text/csv", exported)
+	is.Equal(status, http.StatusOK)
+	is.Equal(storeStub.blacklistEntries["http://example.com/a.mp4"].Reason, "=HYPERLINK(\"http://evil.example.com\")")
+	is.Equal(storeStub.blacklistEntries["http://example.com/b.mp4"].Reason, "-1+1")
+}
+
+func TestBlacklistImportPartialReplace(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	is.NoErr(storeStub.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/old.mp4"}))
+	storeStub.blacklistPageErr = errors.New("connection lost")
+
+	status, response := importBlacklist(api, "?mode=replace", "text/csv", "http://example.com/new.mp4\n")
+	is.Equal(status, http.StatusInternalServerError)
+	// The lines were applied, the old entries were not removed
+	is.Equal(response.Added, 1)
+	is.Equal(response.Removed, 0)
+	is.True(response.Lines[0].Ok)
+	is.True(response.Error != "")
+	is.Equal(storeStub.blacklist, []string{"http://example.com/old.mp4", "http://example.com/new.mp4"})
+
+	summary := storeStub.audit[len(storeStub.audit)-1]
+	is.Equal(summary.Action, AUDIT_BLACKLIST_IMPORT)
+	is.Equal(summary.Details["added"], "1")
+	is.Equal(summary.Details["error"], response.Error)
+}
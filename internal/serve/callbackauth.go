@@ -0,0 +1,46 @@
+package serve
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/signing"
+)
+
+// The packager is configured with a single callback URL rather than one per
+// job, so its token is bound to this subject instead of a creative and job.
+// Its callbacks are only accepted for jobs waiting to be packaged.
+const packagerTokenSubject = "packager"
+
+// Checks the token of a callback, and the signature of its body if one was
+// sent. Responds with 401 and returns false if the callback is not authentic
+// or its token has expired. Always passes when no callback secret is
+// configured.
+func (api *API) authenticateCallback(w http.ResponseWriter, r *http.Request, body []byte, subject ...string) bool {
+	if api.callbackSigner == nil {
+		return true
+	}
+	token := r.URL.Query().Get(signing.TOKEN_PARAM)
+	if token == "" {
+		logger.Warn("callback without token rejected", slog.String("path", r.URL.Path))
+		http.Error(w, "Missing callback token", http.StatusUnauthorized)
+		return false
+	}
+	if !api.callbackSigner.VerifyQuery(r.URL.Query(), subject...) {
+		logger.Warn("callback with invalid or expired token rejected",
+			slog.String("path", r.URL.Path),
+			slog.String("subject", strings.Join(subject, "|")),
+		)
+		http.Error(w, "Invalid or expired callback token", http.StatusUnauthorized)
+		return false
+	}
+	signature := r.Header.Get(signing.SIGNATURE_HEADER)
+	if signature != "" && !api.callbackSigner.VerifySignature(body, signature) {
+		logger.Warn("callback with invalid signature rejected", slog.String("path", r.URL.Path))
+		http.Error(w, "Invalid callback signature", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
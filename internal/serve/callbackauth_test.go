@@ -0,0 +1,147 @@
+package serve
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/signing"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestCallbackAuthentication(t *testing.T) {
+	signer := signing.NewSigner("secret", time.Hour)
+	signed := func(subject ...string) url.Values {
+		query := url.Values{}
+		signer.SignQuery(query, subject...)
+		return query
+	}
+	expiredAt := time.Now().Add(-time.Minute).Unix()
+	expired := url.Values{
+		signing.EXPIRES_PARAM: {strconv.FormatInt(expiredAt, 10)},
+		signing.TOKEN_PARAM:   {signer.Token(expiredAt, "creative", "job-id")},
+	}
+	encoreBody := `{"jobId":"job-id","externalId":"creative","status":"IN_PROGRESS","progress":10}`
+	successBody := `{"jobId":"test-job-id","url":"https://encore-instance","outputPath":"/output-folder/assetId/jobId/"}`
+	failureBody := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
+	cases := []struct {
+		name         string
+		handler      func(*API) http.HandlerFunc
+		body         string
+		query        url.Values
+		signature    string
+		expectedCode int
+	}{
+		{
+			name:         "encore callback without token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "encore callback with token for another creative",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        signed("other-creative", "job-id"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "encore callback with token for another job",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        signed("creative", "other-job-id"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "encore callback with expired token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        expired,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "encore callback with token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        signed("creative", "job-id"),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "encore callback with token and signature",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        signed("creative", "job-id"),
+			signature:    signer.Signature([]byte(encoreBody)),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "encore callback with token and invalid signature",
+			handler:      func(api *API) http.HandlerFunc { return api.HandleEncoreCallback },
+			body:         encoreBody,
+			query:        signed("creative", "job-id"),
+			signature:    signer.Signature([]byte("another body")),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "packaging success without token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandlePackagingSuccess },
+			body:         successBody,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "packaging success with token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandlePackagingSuccess },
+			body:         successBody,
+			query:        signed(packagerTokenSubject),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "packaging failure with token for a creative",
+			handler:      func(api *API) http.HandlerFunc { return api.HandlePackagingFailure },
+			body:         failureBody,
+			query:        signed("test-job-id", "test-job-id"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "packaging failure with token",
+			handler:      func(api *API) http.HandlerFunc { return api.HandlePackagingFailure },
+			body:         failureBody,
+			query:        signed(packagerTokenSubject),
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			api, ts, storeStub, _ := setupApi()
+			defer ts.Close()
+			defer storeStub.reset()
+			api.callbackSigner = signer
+			storeStub.mockStore["test-job-id"] = structure.TranscodeInfo{
+				Status:      structure.StatusPackaging,
+				EncoreJobId: "test-job-id",
+			}
+
+			target := "/callback"
+			if c.query != nil {
+				target += "?" + c.query.Encode()
+			}
+			req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(c.body))
+			if c.signature != "" {
+				req.Header.Set(signing.SIGNATURE_HEADER, c.signature)
+			}
+			rr := httptest.NewRecorder()
+			c.handler(api)(rr, req)
+			is.Equal(rr.Code, c.expectedCode)
+			if c.expectedCode == http.StatusUnauthorized {
+				// Rejected before the store is touched
+				is.Equal(storeStub.gets+storeStub.sets+storeStub.deletes, 0)
+			}
+		})
+	}
+}
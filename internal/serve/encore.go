@@ -2,10 +2,13 @@ package serve
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
@@ -13,25 +16,23 @@ import (
 
 func (api *API) HandleEncoreCallback(w http.ResponseWriter, r *http.Request) {
 	jobProgress := structure.EncoreJobProgress{}
-	var requestBody []byte
-	var err error
 	defer r.Body.Close()
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("failed to read request body", slog.String("error", err.Error()))
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	jsonBody := requestBody
 	if r.Header.Get("Content-Encoding") == "gzip" {
-		requestBody, err = decompressGzip(r.Body)
+		jsonBody, err = decompressGzip(bytes.NewReader(requestBody))
 		if err != nil {
 			logger.Error("failed to decompress gzip request body", slog.String("error", err.Error()))
 			http.Error(w, "Failed to decompress gzip request body", http.StatusInternalServerError)
 			return
 		}
-	} else {
-		requestBody, err = io.ReadAll(r.Body)
-		if err != nil {
-			logger.Error("failed to read request body", slog.String("error", err.Error()))
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-			return
-		}
 	}
-	jsonDecoder := json.NewDecoder(bytes.NewBuffer(requestBody))
+	jsonDecoder := json.NewDecoder(bytes.NewBuffer(jsonBody))
 	err = jsonDecoder.Decode(&jobProgress)
 	logger.Debug("Decoded Encore job progress",
 		slog.String("jobId", jobProgress.JobId),
@@ -43,13 +44,26 @@ func (api *API) HandleEncoreCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode job progress", http.StatusBadRequest)
 		return
 	}
-	switch jobProgress.Status {
-	case "SUCCESSFUL":
-		err = api.handleTranscodeCompleted(&jobProgress)
-	case "FAILED":
-		err = api.handleTranscodeFailed(&jobProgress)
-	case "IN_PROGRESS":
-		err = api.handleTranscodeInProgress(&jobProgress)
+	// The signature covers the body as sent, before decompression
+	if !api.authenticateCallback(w, r, requestBody, jobProgress.ExternalId, jobProgress.JobId) {
+		return
+	}
+	job := structure.TranscodeJob{
+		Id:         jobProgress.JobId,
+		CreativeId: jobProgress.ExternalId,
+		Status:     structure.TranscodeStatus(jobProgress.Status),
+		Progress:   jobProgress.Progress,
+	}
+	switch job.Status {
+	case structure.TranscodeSuccessful:
+		// The callback does not carry the outputs
+		err = api.handleTranscodeCompleted(&job)
+	case structure.TranscodeFailed:
+		err = api.handleTranscodeFailed(&job)
+	case structure.TranscodeCancelled:
+		err = api.handleTranscodeCancelled(&job)
+	case structure.TranscodeInProgress:
+		err = api.handleTranscodeInProgress(&job)
 	default:
 		logger.Info("Job status does not match any known status", slog.String("status", jobProgress.Status))
 		err = nil
@@ -62,62 +76,216 @@ func (api *API) HandleEncoreCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to handle transcode job progress", http.StatusInternalServerError)
 		return
 	}
+	// Progress updates are too frequent to audit, the outcome is what matters
+	if job.Status != structure.TranscodeInProgress {
+		api.audit(AUDIT_ACTOR_ENCORE, AUDIT_TRANSCODE_CALLBACK, job.CreativeId, map[string]string{
+			"jobId":  job.Id,
+			"status": string(job.Status),
+		})
+	}
 	w.WriteHeader(http.StatusOK)
 
 }
 
-func (api *API) handleTranscodeInProgress(progress *structure.EncoreJobProgress) error {
+// Handles a job update reported in-process by the transcoder. The job is
+// complete, so successful jobs carry their outputs.
+func (api *API) handleTranscodeUpdate(job structure.TranscodeJob) {
+	var err error
+	switch job.Status {
+	case structure.TranscodeSuccessful:
+		var previous *structure.TranscodeInfo
+		if info, found, _ := api.valkeyStore.Get(job.CreativeId); found {
+			previous = &info
+		}
+		err = api.transcodeCompleted(&job, job.CreativeId, previous)
+	case structure.TranscodeFailed:
+		err = api.handleTranscodeFailed(&job)
+	case structure.TranscodeCancelled:
+		err = api.handleTranscodeCancelled(&job)
+	case structure.TranscodeInProgress:
+		err = api.handleTranscodeInProgress(&job)
+	}
+	if err != nil {
+		logger.Error("failed to handle transcode job update",
+			slog.String("error", err.Error()),
+			slog.String("jobId", job.Id),
+		)
+	}
+}
+
+func (api *API) handleTranscodeInProgress(job *structure.TranscodeJob) error {
 	logger.Info("Transcoding progress updated",
-		slog.String("creative ID", progress.ExternalId),
-		slog.Int("progress", progress.Progress),
+		slog.String("creative ID", job.CreativeId),
+		slog.Int("progress", job.Progress),
 	)
-	return nil
+	info, found, err := api.valkeyStore.Get(job.CreativeId)
+	if err != nil {
+		return err
+	}
+	if !found || info.EncoreJobId != job.Id {
+		// The job has been removed or replaced, don't bring it back
+		return nil
+	}
+	info.Status = structure.StatusInProgress
+	info.Progress = job.Progress
+	info.LastUpdate = time.Now().Unix()
+	err = api.valkeyStore.Set(job.CreativeId, info)
+	var transitionErr *structure.IllegalTransitionError
+	if errors.As(err, &transitionErr) {
+		// Progress reported after the transcode has completed
+		logger.Debug("ignoring late progress update",
+			slog.String("creativeId", job.CreativeId),
+			slog.String("status", string(transitionErr.From)),
+		)
+		return nil
+	}
+	return err
+}
+
+func (api *API) handleTranscodeFailed(job *structure.TranscodeJob) error {
+	info, found, err := api.valkeyStore.Get(job.CreativeId)
+	if err != nil {
+		return err
+	}
+	if !found || info.EncoreJobId != job.Id {
+		// A late failure of a job that has been removed or replaced,
+		// it doesn't count against the source either
+		return nil
+	}
+	reason := cmp.Or(job.Message, "transcoding failed")
+	api.sourceFailed(job.CreativeId, job, reason)
+	return api.markFailed(job.CreativeId, info, reason)
 }
 
-func (api *API) handleTranscodeFailed(progress *structure.EncoreJobProgress) error {
-	err := api.valkeyStore.Delete(progress.ExternalId)
+// Marks the job of a creative as failed. Like a failed dispatch, the entry
+// expires after the backoff, so that the creative is ingested again.
+func (api *API) markFailed(creativeId string, info structure.TranscodeInfo, reason string) error {
+	info.Status = structure.StatusFailed
+	info.Error = reason
+	info.LastUpdate = time.Now().Unix()
+	err := api.valkeyStore.Set(creativeId, info, int64(api.dispatchBackoff))
+	var transitionErr *structure.IllegalTransitionError
+	if errors.As(err, &transitionErr) {
+		// E.g. a repeated failure callback for a job that has been cancelled
+		logger.Warn("ignoring job failure",
+			slog.String("creativeId", creativeId),
+			slog.String("error", transitionErr.Error()),
+		)
+		return nil
+	}
 	return err
 }
 
-func (api *API) handleTranscodeCompleted(progress *structure.EncoreJobProgress) error {
-	job, err := api.encoreHandler.GetEncoreJob(progress.JobId)
+// Returns the info to store for a job that failed after it was transcoded,
+// with what is known about the earlier stages from previous, if given.
+func failedJobInfo(job *structure.TranscodeJob, previous *structure.TranscodeInfo) structure.TranscodeInfo {
+	info := structure.TranscodeInfo{
+		Url:         job.Source,
+		Source:      job.Source,
+		EncoreJobId: job.Id,
+		EncoreUrl:   job.Location,
+		Profile:     job.Profile,
+	}
+	if previous != nil {
+		info.KeepHistory(*previous)
+	}
+	return info
+}
+
+// Marks the creative as cancelled, so that it is not ingested again until
+// the cancellation expires, like in cancelJob. Usually the job was
+// cancelled by us, and the creative is marked already.
+func (api *API) handleTranscodeCancelled(job *structure.TranscodeJob) error {
+	info, found, err := api.valkeyStore.Get(job.CreativeId)
 	if err != nil {
-		logger.Error("failed to get encore job",
+		return err
+	}
+	if !found || info.EncoreJobId != job.Id || info.Status == structure.StatusCancelled {
+		return nil
+	}
+	info.Status = structure.StatusCancelled
+	info.LastUpdate = time.Now().Unix()
+	err = api.valkeyStore.Set(job.CreativeId, info, int64(api.dispatchBackoff))
+	var transitionErr *structure.IllegalTransitionError
+	if errors.As(err, &transitionErr) {
+		return nil
+	}
+	return err
+}
+
+func (api *API) handleTranscodeCompleted(job *structure.TranscodeJob) error {
+	var previous *structure.TranscodeInfo
+	location := ""
+	if info, found, _ := api.valkeyStore.Get(job.CreativeId); found {
+		previous = &info
+		if info.EncoreJobId == job.Id {
+			location = info.EncoreUrl
+		}
+	}
+	completed, err := api.transcoder.GetJob(location, job.Id)
+	if err != nil {
+		logger.Error("failed to get transcoding job",
 			slog.String("error", err.Error()),
-			slog.String("jobId", progress.JobId),
+			slog.String("jobId", job.Id),
 		)
 		return err
 	}
-	if !job.HasAudioOutput() {
-		logger.Error("encore job has no audio output, skipping",
-			slog.String("jobId", progress.JobId),
-			slog.String("creativeId", progress.ExternalId),
+	return api.transcodeCompleted(&completed, job.CreativeId, previous)
+}
+
+// Stores the result of a successful transcoding job, and queues the
+// packaging if it is needed. previous is the stored info for the creative,
+// or nil if there is none.
+func (api *API) transcodeCompleted(job *structure.TranscodeJob, creativeId string, previous *structure.TranscodeInfo) error {
+	if !job.HasAudio {
+		logger.Error("transcoding job has no audio output, skipping",
+			slog.String("jobId", job.Id),
+			slog.String("creativeId", creativeId),
 		)
-		_ = api.valkeyStore.Delete(progress.ExternalId)
-		return nil
+		reason := "transcoding job has no audio output"
+		api.sourceFailed(creativeId, job, reason)
+		return api.markFailed(creativeId, failedJobInfo(job, previous), reason)
 	}
-	transcodeInfo, err := structure.TranscodeInfoFromEncoreJob(&job, api.jitPackage, api.assetServerUrl)
+	transcodeInfo, err := structure.TranscodeInfoFromJob(job, api.jitPackage, api.assetServerUrl)
 	if err != nil {
-		logger.Error("failed to create transcode info from encore job",
+		logger.Error("failed to create transcode info from transcoding job",
 			slog.String("error", err.Error()),
-			slog.String("jobId", progress.JobId),
+			slog.String("jobId", job.Id),
+		)
+		api.sourceFailed(creativeId, job, err.Error())
+		return api.markFailed(creativeId, failedJobInfo(job, previous), err.Error())
+	}
+	if previous != nil {
+		transcodeInfo.KeepHistory(*previous)
+	}
+	transcodeInfo.Progress = 100
+	transcodeInfo.TranscodedAt = transcodeInfo.LastUpdate
+	err = api.valkeyStore.Set(creativeId, transcodeInfo)
+	var transitionErr *structure.IllegalTransitionError
+	if errors.As(err, &transitionErr) {
+		// E.g. a repeated callback for a job that has already been packaged
+		logger.Warn("ignoring transcode completion",
+			slog.String("creativeId", creativeId),
+			slog.String("error", transitionErr.Error()),
 		)
-		_ = api.valkeyStore.Delete(progress.ExternalId) // Something went wrong, remove the job from the store
 		return nil
 	}
-	err = api.valkeyStore.Set(progress.ExternalId, transcodeInfo)
 	if err != nil {
 		logger.Error("failed to store transcode info",
 			slog.String("error", err.Error()),
-			slog.String("creativeId", progress.ExternalId),
+			slog.String("creativeId", creativeId),
 		)
-		_ = api.valkeyStore.Delete(progress.ExternalId) // Something went wrong, remove the job from the store
+		_ = api.valkeyStore.Delete(creativeId) // Something went wrong, remove the job from the store
+	}
+	if err == nil && transcodeInfo.Status == structure.StatusCompleted {
+		api.clearSourceFailures(transcodeInfo.Source)
 	}
-	if !api.jitPackage {
-		logger.Debug("JIT packaging is disabled, queueing packaing job", slog.String("creativeId", progress.ExternalId))
+	if transcodeInfo.Status == structure.StatusPackaging {
+		logger.Debug("JIT packaging is disabled, queueing packaing job", slog.String("creativeId", creativeId))
+		// The packager fetches the job from the instance that ran it
 		packageInfo := structure.PackagingQueueMessage{
-			JobId: progress.JobId,
-			Url:   api.encoreUrl.JoinPath("encoreJobs", progress.JobId).String(),
+			JobId: job.Id,
+			Url:   job.JobUrl,
 		}
 		err = api.valkeyStore.EnqueuePackagingJob(api.packageQueue, packageInfo)
 	}
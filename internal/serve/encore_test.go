@@ -5,8 +5,17 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Eyevinn/ad-normalizer/internal/config"
+	"github.com/Eyevinn/ad-normalizer/internal/ffmpeg"
+	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/matryer/is"
 )
@@ -27,7 +36,7 @@ func TestEncoreCallback(t *testing.T) {
 			},
 			expectSets:    1,
 			expectDeletes: 0,
-			expectGets:    0,
+			expectGets:    1,
 		},
 		{
 			name: "Failed Transcode",
@@ -35,8 +44,8 @@ func TestEncoreCallback(t *testing.T) {
 				Status: "FAILED",
 			},
 			expectSets:    0,
-			expectDeletes: 1,
-			expectGets:    0,
+			expectDeletes: 0,
+			expectGets:    1,
 		},
 		{
 			name: "In Progress Transcode",
@@ -45,7 +54,7 @@ func TestEncoreCallback(t *testing.T) {
 			},
 			expectSets:    0,
 			expectDeletes: 0,
-			expectGets:    0,
+			expectGets:    1,
 		},
 	}
 	for _, c := range cases {
@@ -67,3 +76,173 @@ func TestEncoreCallback(t *testing.T) {
 		})
 	}
 }
+
+func TestEncoreCallbackRecordsProgress(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	ss.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      "QUEUED",
+		Source:      "http://example.com/creative.mp4",
+		EncoreJobId: "job-1",
+		Profile:     "test-profile",
+		CreatedAt:   1000,
+	}
+	send := func(progress structure.EncoreJobProgress) {
+		reqBody, err := json.Marshal(progress)
+		is.NoErr(err)
+		req, err := http.NewRequest("POST", "/encore/callback", bytes.NewBuffer(reqBody))
+		is.NoErr(err)
+		rr := httptest.NewRecorder()
+		api.HandleEncoreCallback(rr, req)
+		is.Equal(rr.Code, http.StatusOK)
+	}
+
+	send(structure.EncoreJobProgress{Status: "IN_PROGRESS", JobId: "job-1", ExternalId: "creative", Progress: 42})
+	info := ss.mockStore["creative"]
+	is.Equal(info.Status, structure.StatusInProgress)
+	is.Equal(info.Progress, 42)
+	is.Equal(info.CreatedAt, int64(1000))
+
+	// Progress for a job that has since been replaced is ignored
+	send(structure.EncoreJobProgress{Status: "IN_PROGRESS", JobId: "job-0", ExternalId: "creative", Progress: 99})
+	is.Equal(ss.mockStore["creative"].Progress, 42)
+
+	// Progress for an unknown creative doesn't create an entry
+	send(structure.EncoreJobProgress{Status: "IN_PROGRESS", JobId: "job-2", ExternalId: "unknown", Progress: 10})
+	_, found := ss.mockStore["unknown"]
+	is.True(!found)
+
+	ss.mockStore["creative"] = structure.TranscodeInfo{Status: "IN_PROGRESS", Progress: 90, CreatedAt: 1000}
+	send(structure.EncoreJobProgress{Status: "SUCCESSFUL", JobId: "job-1", ExternalId: "creative"})
+	info = ss.mockStore["creative"]
+	is.Equal(info.Progress, 100)
+	is.Equal(info.Profile, "test-profile")
+	is.Equal(info.CreatedAt, int64(1000))
+	is.True(info.TranscodedAt > 0)
+
+	// A late progress update doesn't move a completed job backwards
+	ss.mockStore["creative"] = structure.TranscodeInfo{Status: structure.StatusCompleted, EncoreJobId: "job-1"}
+	send(structure.EncoreJobProgress{Status: "IN_PROGRESS", JobId: "job-1", ExternalId: "creative", Progress: 99})
+	is.Equal(ss.mockStore["creative"].Status, structure.StatusCompleted)
+
+	// A failure of a job that has since been replaced is ignored
+	ss.mockStore["creative"] = structure.TranscodeInfo{Status: structure.StatusInProgress, EncoreJobId: "job-4"}
+	send(structure.EncoreJobProgress{Status: "FAILED", JobId: "job-3", ExternalId: "creative"})
+	is.Equal(ss.mockStore["creative"].Status, structure.StatusInProgress)
+	is.Equal(ss.deletes, 0)
+
+	// A job cancelled in Encore is kept, so that it is not ingested again
+	ss.mockStore["creative"] = structure.TranscodeInfo{Status: structure.StatusInProgress, EncoreJobId: "job-3"}
+	send(structure.EncoreJobProgress{Status: "CANCELLED", JobId: "job-3", ExternalId: "creative"})
+	is.Equal(ss.mockStore["creative"].Status, structure.StatusCancelled)
+}
+
+func TestFailedJobsListed(t *testing.T) {
+	is := is.New(t)
+	jobStore := store.NewMemoryStore()
+	api := NewAPI(jobStore, config.AdNormalizerConfig{DispatchBackoff: 60}, nil, &http.Client{},
+		func(normalizerMetrics.AdsHandledEventArguments) {})
+	is.NoErr(jobStore.Set("failed", structure.TranscodeInfo{Status: structure.StatusInProgress, EncoreJobId: "job-1"}))
+	is.NoErr(jobStore.Set("running", structure.TranscodeInfo{Status: structure.StatusInProgress, EncoreJobId: "job-2"}))
+
+	is.NoErr(api.handleTranscodeFailed(&structure.TranscodeJob{Id: "job-1", CreativeId: "failed", Message: "bad input"}))
+	info, found, err := jobStore.Get("failed")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(info.Status, structure.StatusFailed)
+	is.Equal(info.Error, "bad input")
+	// Expires like a failed dispatch, so that the creative is ingested again
+	ttl, err := jobStore.Ttl("failed")
+	is.NoErr(err)
+	is.True(ttl > 0 && ttl <= 60)
+	history, err := jobStore.History("failed")
+	is.NoErr(err)
+	is.Equal(history[len(history)-1].Status, structure.StatusFailed)
+
+	recorder := httptest.NewRecorder()
+	api.HandleJobList(recorder, httptest.NewRequest(http.MethodGet, "/jobs?status=FAILED", nil))
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	var response statusResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(response.TotalAmount, int64(1))
+	is.Equal(len(response.Jobs), 1)
+	is.Equal(response.Jobs[0].EncoreJobId, "job-1")
+}
+
+func TestEncoreCallbackUsesOwningInstance(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	defer encoreHandler.reset()
+	encoreHandler.status = structure.TranscodeSuccessful
+	ss.mockStore["creative"] = structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		EncoreJobId: "job-1",
+		EncoreUrl:   "https://encore-2.example.com",
+	}
+	reqBody, err := json.Marshal(structure.EncoreJobProgress{Status: "SUCCESSFUL", JobId: "job-1", ExternalId: "creative"})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", "/encore/callback", bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+
+	is.Equal(encoreHandler.lastLocation, "https://encore-2.example.com")
+	is.Equal(ss.mockStore["creative"].EncoreUrl, "https://encore-2.example.com")
+	// The packager fetches the job from the same instance
+	is.Equal(len(ss.queued), 1)
+	is.True(strings.HasPrefix(ss.queued[0].Url, "https://encore-2.example.com/encoreJobs/"))
+}
+
+func TestFfmpegTranscoderUpdates(t *testing.T) {
+	is := is.New(t)
+	bin := t.TempDir()
+	ffprobe := `#!/bin/sh
+echo '{"streams": [{"codec_type": "video", "width": 1920, "height": 1080, "r_frame_rate": "25/1"}, {"codec_type": "audio"}]}'
+`
+	ffmpegScript := `#!/bin/sh
+for last; do true; done
+echo "#EXTM3U" > "$(dirname "$last")/index.m3u8"
+`
+	is.NoErr(os.WriteFile(filepath.Join(bin, "ffprobe"), []byte(ffprobe), 0o755))
+	is.NoErr(os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(ffmpegScript), 0o755))
+	outputUrl, _ := url.Parse("https://normalizer.example.com/assets")
+	jobTranscoder := ffmpeg.NewTranscoder(
+		filepath.Join(bin, "ffmpeg"),
+		filepath.Join(bin, "ffprobe"),
+		t.TempDir(),
+		*outputUrl,
+		1,
+	)
+	jobStore := store.NewMemoryStore()
+	api := NewAPI(jobStore, config.AdNormalizerConfig{}, jobTranscoder, &http.Client{},
+		func(normalizerMetrics.AdsHandledEventArguments) {})
+
+	claimed, err := jobStore.Claim("creative", structure.TranscodeInfo{Status: structure.StatusQueued}, 60)
+	is.NoErr(err)
+	is.True(claimed)
+	submitted, err := api.submitJob(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "http://example.com/creative.mp4",
+	})
+	is.NoErr(err)
+
+	// The transcoder reports the result without any callback
+	var info structure.TranscodeInfo
+	for range 100 {
+		info, _, _ = jobStore.Get("creative")
+		if info.Status == structure.StatusCompleted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(info.Status, structure.StatusCompleted)
+	is.Equal(info.EncoreJobId, submitted.EncoreJobId)
+	is.Equal(info.Url, "https://normalizer.example.com/assets/creative/"+submitted.EncoreJobId+"/index.m3u8")
+	is.Equal(info.Profile, ffmpeg.PROFILE)
+	is.True(info.TranscodedAt > 0)
+}
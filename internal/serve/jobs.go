@@ -0,0 +1,359 @@
+package serve
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/blacklist"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+type jobResponse struct {
+	structure.TranscodeInfo
+	CreativeId string `json:"creativeId"`
+	// Seconds until the entry expires, -1 if it does not expire
+	Ttl int64 `json:"ttl"`
+	// Status changes of the creative, oldest first
+	History []structure.StatusChange `json:"history,omitempty"`
+}
+
+// Jobs in these states are still being worked on and cannot be retried
+func isInFlight(status structure.JobStatus) bool {
+	return status == structure.StatusQueued ||
+		status == structure.StatusInProgress ||
+		status == structure.StatusPackaging
+}
+
+// Stops the transcoding job of a creative that is still in flight, and marks
+// the creative as cancelled. Packaging cannot be stopped, but the packager
+// cannot complete a cancelled job either. The cancellation expires like a
+// failed dispatch, so that the creative is ingested again once it is no
+// longer blacklisted.
+func (api *API) cancelJob(creativeId string, info structure.TranscodeInfo) error {
+	if info.EncoreJobId != "" && info.Status != structure.StatusPackaging {
+		if err := api.transcoder.Cancel(info.EncoreUrl, info.EncoreJobId); err != nil {
+			// E.g. the job finished in the meantime, its result is not stored either way
+			logger.Warn("failed to cancel transcoding job",
+				slog.String("creativeId", creativeId),
+				slog.String("encoreJobId", info.EncoreJobId),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	info.Status = structure.StatusCancelled
+	info.LastUpdate = time.Now().Unix()
+	if err := api.valkeyStore.Set(creativeId, info, int64(api.dispatchBackoff)); err != nil {
+		return err
+	}
+	logger.Info("cancelled job",
+		slog.String("creativeId", creativeId),
+		slog.String("encoreJobId", info.EncoreJobId),
+	)
+	return nil
+}
+
+// Cancels the in-flight jobs transcoding the given source. Returns the
+// number of jobs cancelled.
+func (api *API) cancelJobsForSource(source string) (int, error) {
+	// The source filter matches substrings, so the matches are checked again
+	return api.cancelJobs(source, func(_ string, info structure.TranscodeInfo) bool {
+		return info.Source == source
+	})
+}
+
+// Cancels the in-flight jobs matching a blacklist rule.
+func (api *API) cancelJobsMatching(matcher *blacklist.Matcher) (int, error) {
+	now := time.Now()
+	return api.cancelJobs("", func(creativeId string, info structure.TranscodeInfo) bool {
+		_, matched := matcher.Match(creativeId, info.Source, now)
+		return matched
+	})
+}
+
+// Cancels the in-flight jobs with a source containing the given one,
+// for which match returns true.
+func (api *API) cancelJobs(source string, match func(creativeId string, info structure.TranscodeInfo) bool) (int, error) {
+	cancelled := 0
+	err := api.eachJob([]structure.JobStatus{
+		structure.StatusQueued,
+		structure.StatusInProgress,
+		structure.StatusPackaging,
+		structure.StatusUnknown,
+	}, source, func(creativeId string, info structure.TranscodeInfo) error {
+		if !match(creativeId, info) {
+			return nil
+		}
+		if err := api.cancelJob(creativeId, info); err != nil {
+			return err
+		}
+		cancelled++
+		return nil
+	})
+	return cancelled, err
+}
+
+// Deletes the cancelled jobs of a source that was removed from the
+// blacklist, so that it is ingested again without waiting for the
+// cancellations to expire.
+func (api *API) releaseCancelledJobsForSource(source string) {
+	api.releaseCancelledJobs(source, func(_ string, info structure.TranscodeInfo) bool {
+		return info.Source == source
+	})
+}
+
+// Like releaseCancelledJobsForSource, for many sources at once.
+func (api *API) releaseCancelledJobsForSources(sources map[string]bool) {
+	if len(sources) == 0 {
+		return
+	}
+	api.releaseCancelledJobs("", func(_ string, info structure.TranscodeInfo) bool {
+		return sources[info.Source]
+	})
+}
+
+// Deletes the cancelled jobs matching a blacklist rule that was removed.
+func (api *API) releaseCancelledJobsMatching(matcher *blacklist.Matcher) {
+	now := time.Now()
+	api.releaseCancelledJobs("", func(creativeId string, info structure.TranscodeInfo) bool {
+		_, matched := matcher.Match(creativeId, info.Source, now)
+		return matched
+	})
+}
+
+// Deletes the cancelled jobs with a source containing the given one, for
+// which match returns true.
+func (api *API) releaseCancelledJobs(source string, match func(creativeId string, info structure.TranscodeInfo) bool) {
+	released := 0
+	err := api.eachJob([]structure.JobStatus{structure.StatusCancelled}, source, func(creativeId string, info structure.TranscodeInfo) error {
+		if !match(creativeId, info) {
+			return nil
+		}
+		if err := api.valkeyStore.Delete(creativeId); err != nil {
+			return err
+		}
+		released++
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to release cancelled jobs", slog.String("error", err.Error()))
+	}
+	if released > 0 {
+		logger.Info("released cancelled jobs", slog.Int("count", released))
+	}
+}
+
+// Calls fn for every job in one of the given states with a source
+// containing the given one, stopping at the first error.
+func (api *API) eachJob(statuses []structure.JobStatus, source string, fn func(creativeId string, info structure.TranscodeInfo) error) error {
+	for _, status := range statuses {
+		var cursor *store.Cursor
+		for {
+			page, err := api.valkeyStore.ListPage(store.JobFilter{Status: status, Source: source}, cursor, 100)
+			if err != nil {
+				return err
+			}
+			for idx, info := range page.Items {
+				if err := fn(page.Keys[idx], info); err != nil {
+					return err
+				}
+			}
+			if page.Next == nil {
+				break
+			}
+			cursor = page.Next
+		}
+	}
+	return nil
+}
+
+func writeJob(w http.ResponseWriter, statusCode int, job jobResponse) {
+	ret, err := json.Marshal(job)
+	if err != nil {
+		logger.Error("failed to marshal job", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal job", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(ret)
+}
+
+// HandleGetJob returns a single job, along with the time left until it expires.
+func (api *API) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleGetJob")
+	defer span.End()
+	creativeId := r.PathValue("creativeId")
+	info, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		logger.Error("failed to get job",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	ttl, err := api.valkeyStore.Ttl(creativeId)
+	if err != nil {
+		// The job may have expired since it was fetched, but we still have it
+		logger.Warn("failed to get job TTL",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		ttl = 0
+	}
+	history, err := api.valkeyStore.History(creativeId)
+	if err != nil {
+		logger.Warn("failed to get job history",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+	}
+	writeJob(w, http.StatusOK, jobResponse{
+		TranscodeInfo: info,
+		CreativeId:    creativeId,
+		Ttl:           ttl,
+		History:       history,
+	})
+}
+
+// HandleDeleteJob removes a job, so that the creative is ingested again
+// the next time it shows up in an ad response. A job still in flight is
+// cancelled first.
+func (api *API) HandleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleDeleteJob")
+	defer span.End()
+	creativeId := r.PathValue("creativeId")
+	info, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		logger.Error("failed to get job",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if isInFlight(info.Status) || info.Status == structure.StatusUnknown {
+		// Also records the cancellation in the history
+		if err = api.cancelJob(creativeId, info); err != nil {
+			logger.Warn("failed to cancel job before delete",
+				slog.String("creativeId", creativeId),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	if err = api.valkeyStore.Delete(creativeId); err != nil {
+		logger.Error("failed to delete job",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to delete job", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("deleted job", slog.String("creativeId", creativeId))
+	api.audit(requestActor(r), AUDIT_JOB_DELETE, creativeId, map[string]string{"status": string(info.Status)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRetryJob transcodes the creative again from its original source.
+// Jobs that are still in flight are left alone. Responds with the claimed
+// job once it is queued, and submits it in the background.
+func (api *API) HandleRetryJob(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleRetryJob")
+	defer span.End()
+	creativeId := r.PathValue("creativeId")
+	info, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		logger.Error("failed to get job",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if isInFlight(info.Status) {
+		http.Error(w, "Job is still in progress", http.StatusConflict)
+		return
+	}
+	if info.Source == "" {
+		http.Error(w, "Job has no source to transcode", http.StatusConflict)
+		return
+	}
+	if blacklisted, _ := api.valkeyStore.InBlackList(info.Source); blacklisted {
+		http.Error(w, "Job source is blacklisted", http.StatusConflict)
+		return
+	}
+	if _, matched := api.blacklistMatcher().Match(creativeId, info.Source, time.Now()); matched {
+		http.Error(w, "Job matches a blacklist rule", http.StatusConflict)
+		return
+	}
+
+	// Go through a claim like a regular dispatch, so that a concurrent
+	// retry or ad request doesn't create a second job
+	if err = api.valkeyStore.Delete(creativeId); err != nil {
+		logger.Error("failed to delete job before retry",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to retry job", http.StatusInternalServerError)
+		return
+	}
+	claim := structure.TranscodeInfo{
+		Url:        info.Source,
+		Status:     structure.StatusQueued,
+		Source:     info.Source,
+		LastUpdate: time.Now().Unix(),
+	}
+	claimed, err := api.valkeyStore.Claim(creativeId, claim, int64(api.inFlightTtl))
+	if err != nil {
+		logger.Error("failed to claim job for retry",
+			slog.String("creativeId", creativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to retry job", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		http.Error(w, "Job was dispatched by someone else", http.StatusConflict)
+		return
+	}
+	logger.Info("retrying job",
+		slog.String("creativeId", creativeId),
+		slog.String("previousStatus", string(info.Status)),
+	)
+	api.audit(requestActor(r), AUDIT_JOB_RETRY, creativeId, map[string]string{"previousStatus": string(info.Status)})
+	// Submitting may take a while with the retries and failover across
+	// Encore instances, so it is not tied to the request. The outcome is
+	// recorded in the store like for any other dispatch.
+	creative := &structure.ManifestAsset{
+		CreativeId:        creativeId,
+		MasterPlaylistUrl: info.Source,
+		Source:            info.Source,
+	}
+	api.retries.Add(1)
+	go func() {
+		defer api.retries.Done()
+		_, _ = api.submitJob(creative)
+	}()
+	writeJob(w, http.StatusAccepted, jobResponse{
+		TranscodeInfo: claim,
+		CreativeId:    creativeId,
+		Ttl:           int64(api.inFlightTtl),
+	})
+}
@@ -0,0 +1,170 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func setupJobsMux(api *API) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{creativeId}", api.HandleGetJob)
+	mux.HandleFunc("DELETE /jobs/{creativeId}", api.HandleDeleteJob)
+	mux.HandleFunc("POST /jobs/{creativeId}/retry", api.HandleRetryJob)
+	return mux
+}
+
+func TestGetAndDeleteJob(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	mux := setupJobsMux(api)
+	_ = storeStub.Set("creative", structure.TranscodeInfo{
+		Url:         "https://example.com/creative/index.m3u8",
+		Status:      "COMPLETED",
+		EncoreJobId: "encore-job-id",
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs/creative", nil))
+	is.Equal(recorder.Code, http.StatusOK)
+	var job jobResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&job))
+	is.Equal(job.CreativeId, "creative")
+	is.Equal(job.EncoreJobId, "encore-job-id")
+	is.Equal(job.Ttl, int64(-1))
+	is.Equal(len(job.History), 1)
+	is.Equal(job.History[0].Status, structure.StatusCompleted)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/jobs/creative", nil))
+	is.Equal(recorder.Code, http.StatusNoContent)
+	is.Equal(storeStub.deletes, 1)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs/creative", nil))
+	is.Equal(recorder.Code, http.StatusNotFound)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/jobs/creative", nil))
+	is.Equal(recorder.Code, http.StatusNotFound)
+}
+
+func TestDeleteInFlightJob(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	mux := setupJobsMux(api)
+	_ = storeStub.Set("creative", structure.TranscodeInfo{
+		Status:      structure.StatusInProgress,
+		EncoreJobId: "encore-job-id",
+		EncoreUrl:   "https://encore.example.com",
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/jobs/creative", nil))
+	is.Equal(recorder.Code, http.StatusNoContent)
+	is.Equal(encoreHandler.cancelled, []string{"encore-job-id"})
+	is.Equal(storeStub.deletes, 1)
+	// The cancellation outlives the job in its history
+	history := storeStub.history["creative"]
+	is.Equal(history[len(history)-1].Status, structure.StatusCancelled)
+}
+
+func TestRetryJob(t *testing.T) {
+	cases := []struct {
+		name           string
+		existing       *structure.TranscodeInfo
+		blacklisted    bool
+		createErr      error
+		expectedCode   int
+		expectedStatus structure.JobStatus
+		expectedCalls  int
+	}{
+		{
+			name:           "failed job",
+			existing:       &structure.TranscodeInfo{Status: "FAILED", Source: "https://example.com/creative.mp4"},
+			expectedCode:   http.StatusAccepted,
+			expectedStatus: "QUEUED",
+			expectedCalls:  1,
+		},
+		{
+			name:           "completed job",
+			existing:       &structure.TranscodeInfo{Status: "COMPLETED", Source: "https://example.com/creative.mp4"},
+			expectedCode:   http.StatusAccepted,
+			expectedStatus: "QUEUED",
+			expectedCalls:  1,
+		},
+		{
+			name:           "encore unavailable",
+			existing:       &structure.TranscodeInfo{Status: "FAILED", Source: "https://example.com/creative.mp4"},
+			createErr:      structure.EncoreError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"},
+			expectedCode:   http.StatusAccepted,
+			expectedStatus: "DISPATCH_FAILED",
+			expectedCalls:  1,
+		},
+		{
+			name:           "in progress",
+			existing:       &structure.TranscodeInfo{Status: "IN_PROGRESS", Source: "https://example.com/creative.mp4"},
+			expectedCode:   http.StatusConflict,
+			expectedStatus: "IN_PROGRESS",
+		},
+		{
+			name:           "blacklisted source",
+			existing:       &structure.TranscodeInfo{Status: "FAILED", Source: "https://example.com/creative.mp4"},
+			blacklisted:    true,
+			expectedCode:   http.StatusConflict,
+			expectedStatus: "FAILED",
+		},
+		{
+			name:           "no source",
+			existing:       &structure.TranscodeInfo{Status: "FAILED"},
+			expectedCode:   http.StatusConflict,
+			expectedStatus: "FAILED",
+		},
+		{
+			name:         "missing job",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			api, ts, storeStub, encoreHandler := setupApi()
+			defer ts.Close()
+			defer storeStub.reset()
+			defer encoreHandler.reset()
+			mux := setupJobsMux(api)
+			if c.existing != nil {
+				_ = storeStub.Set("creative", *c.existing)
+			}
+			if c.blacklisted {
+				_ = storeStub.BlackList(structure.BlacklistEntry{MediaUrl: c.existing.Source})
+			}
+			encoreHandler.createErr = c.createErr
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/jobs/creative/retry", nil))
+			is.Equal(recorder.Code, c.expectedCode)
+			if recorder.Code == http.StatusAccepted {
+				// Answered with the claim, before the job is submitted
+				var response jobResponse
+				is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+				is.Equal(response.Status, structure.StatusQueued)
+				is.Equal(response.EncoreJobId, "")
+			}
+			api.retries.Wait()
+			is.Equal(encoreHandler.calls, c.expectedCalls)
+			if c.existing != nil {
+				info, found, _ := storeStub.Get("creative")
+				is.True(found)
+				is.Equal(info.Status, c.expectedStatus)
+			}
+		})
+	}
+}
@@ -2,78 +2,160 @@ package serve
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 )
 
+// Reads the body of a packager callback and authenticates it.
+// Returns false if a response has already been written.
+func (api *API) readPackagerCallback(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !api.authenticateCallback(w, r, requestBody, packagerTokenSubject) {
+		return nil, false
+	}
+	return requestBody, true
+}
+
 func (api *API) HandlePackagingFailure(w http.ResponseWriter, r *http.Request) {
 	body := structure.PackagingFailureBody{}
-	dec := json.NewDecoder(r.Body)
-	defer r.Body.Close()
-	if err := dec.Decode(&body); err != nil {
+	requestBody, ok := api.readPackagerCallback(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(requestBody, &body); err != nil {
 		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 		return
 	}
-	encoreJob, err := api.encoreHandler.GetEncoreJob(body.Message.JobId)
+	encoreJob, err := api.transcoder.GetJob(encoreUrlOf(body.Message.Url, body.Message.JobId), body.Message.JobId)
 	if err != nil {
 		http.Error(w, "Failed to get Encore job", http.StatusNotFound)
 		return
 	}
-	if encoreJob.ExternalId == "" {
+	if encoreJob.CreativeId == "" {
 		http.Error(w, "Encore job does not have an external ID", http.StatusNotFound)
 		return
 	}
-	if err := api.valkeyStore.Delete(encoreJob.ExternalId); err != nil {
-		http.Error(w, "Failed to delete job from Valkey store", http.StatusInternalServerError)
+	info, ok := api.awaitingPackaging(w, &encoreJob)
+	if !ok {
+		return
+	}
+	api.sourceFailed(encoreJob.CreativeId, &encoreJob, "packaging failed")
+	if err := api.markFailed(encoreJob.CreativeId, info, "packaging failed"); err != nil {
+		http.Error(w, "Failed to save job to Valkey store", http.StatusInternalServerError)
 		return
 	}
+	api.audit(AUDIT_ACTOR_PACKAGER, AUDIT_PACKAGING_FAILURE, encoreJob.CreativeId, map[string]string{"jobId": encoreJob.Id})
 	w.WriteHeader(http.StatusOK)
-	logger.Info("Packaging failure handled successfully", slog.String("creativeId", encoreJob.ExternalId))
+	logger.Info("Packaging failure handled successfully", slog.String("creativeId", encoreJob.CreativeId))
 }
 
 func (api *API) HandlePackagingSuccess(w http.ResponseWriter, r *http.Request) {
 	body := structure.PackagingSuccessBody{}
-	dec := json.NewDecoder(r.Body)
-	defer r.Body.Close()
-	if err := dec.Decode(&body); err != nil {
+	requestBody, ok := api.readPackagerCallback(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(requestBody, &body); err != nil {
 		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 		return
 	}
 	logger.Debug("getting Encore job for packaging success", slog.String("jobId", body.JobId))
-	encoreJob, err := api.encoreHandler.GetEncoreJob(body.JobId)
+	encoreJob, err := api.transcoder.GetJob(encoreUrlOf(body.Url, body.JobId), body.JobId)
 	if err != nil {
 		http.Error(w, "Failed to get Encore job", http.StatusNotFound)
 		return
 	}
-	if encoreJob.ExternalId == "" {
+	if encoreJob.CreativeId == "" {
 		http.Error(w, "Encore job does not have an external ID", http.StatusNotFound)
 		return
 	}
-	storeInfo, err := structure.TranscodeInfoFromEncoreJob(&encoreJob, api.jitPackage, api.assetServerUrl)
+	previous, ok := api.awaitingPackaging(w, &encoreJob)
+	if !ok {
+		return
+	}
+	storeInfo, err := structure.TranscodeInfoFromJob(&encoreJob, api.jitPackage, api.assetServerUrl)
 	if err != nil {
 		logger.Error("Failed to create transcode info from Encore job",
 			slog.String("error", err.Error()),
 			slog.String("jobId", encoreJob.Id),
 		)
-		_ = api.valkeyStore.Delete(encoreJob.ExternalId) // Something went wrong, remove the job from the store
+		_ = api.valkeyStore.Delete(encoreJob.CreativeId) // Something went wrong, remove the job from the store
 		http.Error(w, "Failed to create transcode info from Encore job", http.StatusInternalServerError)
 		return
 	}
 	packageUrl := structure.CreatePackageUrl(api.assetServerUrl, body.OutputPath, "index")
 	storeInfo.Url = packageUrl.String()
-	storeInfo.Status = "COMPLETED"
+	storeInfo.Status = structure.StatusCompleted
 	storeInfo.LastUpdate = time.Now().Unix()
-	if err := api.valkeyStore.Set(encoreJob.ExternalId, storeInfo); err != nil {
+	storeInfo.Progress = 100
+	storeInfo.PackagedAt = storeInfo.LastUpdate
+	storeInfo.KeepHistory(previous)
+	err = api.valkeyStore.Set(encoreJob.CreativeId, storeInfo)
+	var transitionErr *structure.IllegalTransitionError
+	if errors.As(err, &transitionErr) {
+		http.Error(w, transitionErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to save job to Valkey store", http.StatusInternalServerError)
 		return
 	}
+	api.clearSourceFailures(storeInfo.Source)
+	api.audit(AUDIT_ACTOR_PACKAGER, AUDIT_PACKAGING_SUCCESS, encoreJob.CreativeId, map[string]string{
+		"jobId":      encoreJob.Id,
+		"packageUrl": storeInfo.Url,
+	})
 	w.WriteHeader(http.StatusOK)
 	logger.Info("Packaging success handled successfully",
-		slog.String("creativeId", encoreJob.ExternalId),
+		slog.String("creativeId", encoreJob.CreativeId),
 		slog.String("packageUrl", packageUrl.String()),
 	)
 }
+
+// Returns the stored job the packager callback is about. The packager's token
+// is not bound to a job, so callbacks are only accepted for a job that is
+// waiting to be packaged. A replayed or forged callback then cannot change
+// any other creative, nor a job that has already been packaged. Responds
+// and returns false otherwise.
+func (api *API) awaitingPackaging(w http.ResponseWriter, encoreJob *structure.TranscodeJob) (structure.TranscodeInfo, bool) {
+	info, found, err := api.valkeyStore.Get(encoreJob.CreativeId)
+	if err != nil {
+		logger.Error("failed to get job for packager callback",
+			slog.String("creativeId", encoreJob.CreativeId),
+			slog.String("error", err.Error()),
+		)
+		http.Error(w, "Failed to get job from Valkey store", http.StatusInternalServerError)
+		return info, false
+	}
+	if !found || info.Status != structure.StatusPackaging || info.EncoreJobId != encoreJob.Id {
+		logger.Warn("packager callback for a job not waiting to be packaged rejected",
+			slog.String("creativeId", encoreJob.CreativeId),
+			slog.String("jobId", encoreJob.Id),
+		)
+		http.Error(w, "Job is not waiting to be packaged", http.StatusConflict)
+		return info, false
+	}
+	return info, true
+}
+
+// Returns the base URL of the Encore instance from the job URL in the
+// packaging queue message, which the packager passes back in its callbacks.
+func encoreUrlOf(jobUrl string, jobId string) string {
+	encoreUrl, found := strings.CutSuffix(jobUrl, "/encoreJobs/"+jobId)
+	if !found {
+		return ""
+	}
+	return encoreUrl
+}
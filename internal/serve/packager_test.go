@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/matryer/is"
 )
 
@@ -15,13 +16,20 @@ func TestPackagingFailure(t *testing.T) {
 
 	api, ts, storeStub, _ := setupApi()
 	defer ts.Close()
+	storeStub.mockStore["test-job-id"] = structure.TranscodeInfo{
+		Status:      structure.StatusPackaging,
+		EncoreJobId: "test-job-id",
+	}
 	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
 	req, err := http.NewRequest("POST", "/failure", bytes.NewBufferString(failureEvent))
 	is.NoErr(err)
 	rr := httptest.NewRecorder()
 	api.HandlePackagingFailure(rr, req)
 	is.Equal(rr.Code, http.StatusOK)
-	is.Equal(storeStub.deletes, 1)
+	is.Equal(storeStub.deletes, 0)
+	failed, _, _ := storeStub.Get("test-job-id")
+	is.Equal(failed.Status, structure.StatusFailed)
+	is.Equal(failed.Error, "packaging failed")
 
 	storeStub.reset()
 }
@@ -35,6 +43,12 @@ func TestPackagingSuccess(t *testing.T) {
 	}`
 	api, ts, storeStub, _ := setupApi()
 	defer ts.Close()
+	storeStub.mockStore["test-job-id"] = structure.TranscodeInfo{
+		Status:       "PACKAGING",
+		EncoreJobId:  "test-job-id",
+		CreatedAt:    1000,
+		TranscodedAt: 1060,
+	}
 	req, err := http.NewRequest("POST", "/success", bytes.NewBufferString(successEvent))
 	is.NoErr(err)
 	rr := httptest.NewRecorder()
@@ -44,7 +58,43 @@ func TestPackagingSuccess(t *testing.T) {
 	tci, ok, err := storeStub.Get("test-job-id")
 	is.NoErr(err)
 	is.True(ok)
-	is.Equal(tci.Status, "COMPLETED")
+	is.Equal(tci.Status, structure.StatusCompleted)
 	is.True(strings.HasSuffix(tci.Url, "index.m3u8"))
+	is.Equal(tci.CreatedAt, int64(1000))
+	is.Equal(tci.TranscodedAt, int64(1060))
+	is.True(tci.PackagedAt >= tci.TranscodedAt)
+	is.Equal(tci.Profile, "test-profile")
 	storeStub.reset()
 }
+
+func TestPackagingCallbackForJobNotWaiting(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	successEvent := `{"jobId": "test-job-id", "url": "https://encore-instance", "outputPath": "/elsewhere/"}`
+	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
+	for _, info := range []*structure.TranscodeInfo{
+		nil,
+		{Status: structure.StatusCompleted, EncoreJobId: "test-job-id", Url: "https://assets.example.com/index.m3u8"},
+		{Status: structure.StatusPackaging, EncoreJobId: "another-job-id"},
+	} {
+		storeStub.reset()
+		if info != nil {
+			storeStub.mockStore["test-job-id"] = *info
+		}
+		rr := httptest.NewRecorder()
+		api.HandlePackagingSuccess(rr, httptest.NewRequest(http.MethodPost, "/success", bytes.NewBufferString(successEvent)))
+		is.Equal(rr.Code, http.StatusConflict)
+		rr = httptest.NewRecorder()
+		api.HandlePackagingFailure(rr, httptest.NewRequest(http.MethodPost, "/failure", bytes.NewBufferString(failureEvent)))
+		is.Equal(rr.Code, http.StatusConflict)
+		is.Equal(storeStub.sets+storeStub.deletes, 0) // e.g. a replayed callback does not change the job
+	}
+}
+
+func TestEncoreUrlOf(t *testing.T) {
+	is := is.New(t)
+	is.Equal(encoreUrlOf("https://encore-2.example.com/encoreJobs/job-1", "job-1"), "https://encore-2.example.com")
+	is.Equal(encoreUrlOf("https://encore-2.example.com/encoreJobs/job-1", "job-2"), "")
+	is.Equal(encoreUrlOf("", "job-1"), "")
+}
@@ -0,0 +1,134 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+const reaperLockKey = "stale_job_reaper_lock"
+const reaperBatchSize = 100
+
+// RunStaleJobReaper periodically removes jobs that have not received an update
+// within the in-flight TTL, so that they are re-ingested on the next ad request.
+// Only one replica reaps per interval, coordinated through a lock in the store.
+// Blocks until the context is cancelled.
+func (api *API) RunStaleJobReaper(ctx context.Context, interval time.Duration, instanceId string) {
+	logger.Info("Starting stale job reaper",
+		slog.Duration("interval", interval),
+		slog.Int("inFlightTtl", api.inFlightTtl),
+	)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			locked, err := api.valkeyStore.TryLock(reaperLockKey, instanceId, int64(interval.Seconds()))
+			if err != nil {
+				logger.Error("failed to acquire reaper lock", slog.String("error", err.Error()))
+				continue
+			}
+			if !locked {
+				logger.Debug("another instance is reaping stale jobs, skipping")
+				continue
+			}
+			reaped := api.reapStaleJobs()
+			logger.Info("Reaped stale jobs", slog.Int("amount", reaped))
+		case <-ctx.Done():
+			logger.Info("Stopping stale job reaper")
+			return
+		}
+	}
+}
+
+// Removes all non-terminal jobs older than the in-flight TTL
+// and returns the number of jobs removed.
+func (api *API) reapStaleJobs() int {
+	cutoff := time.Now().Add(-time.Duration(api.inFlightTtl) * time.Second)
+	// Collect all keys up front, since reaping moves keys out of the stale range
+	// and would make the offsets unreliable
+	staleKeys := make([]string, 0, reaperBatchSize)
+	for offset := int64(0); ; offset += reaperBatchSize {
+		keys, err := api.valkeyStore.ListStale(cutoff, offset, reaperBatchSize)
+		if err != nil {
+			logger.Error("failed to list stale jobs", slog.String("error", err.Error()))
+			return 0
+		}
+		staleKeys = append(staleKeys, keys...)
+		if len(keys) < reaperBatchSize {
+			break
+		}
+	}
+	reaped := 0
+	for _, key := range staleKeys {
+		if api.reapStaleJob(key, cutoff) {
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// Returns true if the job was removed from the store.
+func (api *API) reapStaleJob(key string, cutoff time.Time) bool {
+	info, found, err := api.valkeyStore.Get(key)
+	if err != nil {
+		logger.Error("failed to get stale job", slog.String("key", key), slog.String("error", err.Error()))
+		return false
+	}
+	// Failed dispatches expire on their own when the backoff is over
+	if found && info.Status.Terminal() {
+		return false
+	}
+	if found && info.EncoreJobId != "" && api.reconcileStaleJob(key, &info) {
+		return false
+	}
+	// Also covers keys that expired but are still in the time index
+	deleted, err := api.valkeyStore.DeleteIfStale(key, cutoff)
+	if err != nil {
+		logger.Error("failed to delete stale job", slog.String("key", key), slog.String("error", err.Error()))
+		return false
+	}
+	if deleted {
+		logger.Info("Removed stale job",
+			slog.String("creativeId", key),
+			slog.String("status", string(info.Status)),
+			slog.String("encoreJobId", info.EncoreJobId),
+		)
+	}
+	return deleted
+}
+
+// Checks the transcoding job for a stale entry, in case only the callback was lost.
+// Returns true if the job is still alive and should be kept.
+func (api *API) reconcileStaleJob(key string, info *structure.TranscodeInfo) bool {
+	job, err := api.transcoder.GetJob(info.EncoreUrl, info.EncoreJobId)
+	if err != nil {
+		logger.Warn("could not reconcile stale job with the transcoder",
+			slog.String("creativeId", key),
+			slog.String("encoreJobId", info.EncoreJobId),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+	switch job.Status {
+	case structure.TranscodeQueued, structure.TranscodeInProgress:
+		logger.Debug("stale job is still running in Encore, refreshing",
+			slog.String("creativeId", key),
+			slog.String("encoreStatus", string(job.Status)),
+		)
+		info.LastUpdate = time.Now().Unix()
+		return api.valkeyStore.Set(key, *info) == nil
+	case structure.TranscodeSuccessful:
+		if info.Status == structure.StatusPackaging {
+			// Transcoding is done, so it's the packaging callback that was lost
+			return false
+		}
+		logger.Info("transcode callback was lost, completing stale job", slog.String("creativeId", key))
+		return api.transcodeCompleted(&job, key, info) == nil
+	default:
+		return false
+	}
+}
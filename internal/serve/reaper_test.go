@@ -0,0 +1,53 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestReapStaleJobs(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	api.inFlightTtl = 60
+	encoreHandler.status = "IN_PROGRESS"
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	storeStub.mockStore = map[string]structure.TranscodeInfo{
+		"stale-queued":    {Status: "QUEUED", LastUpdate: old},
+		"stale-packaging": {Status: "PACKAGING", LastUpdate: old},
+		"stale-completed": {Status: "COMPLETED", LastUpdate: old},
+		"stale-running":   {Status: "QUEUED", LastUpdate: old, EncoreJobId: "running-job"},
+		"fresh-queued":    {Status: "QUEUED", LastUpdate: time.Now().Unix()},
+	}
+
+	reaped := api.reapStaleJobs()
+	is.Equal(reaped, 2)
+	_, found, _ := storeStub.Get("stale-queued")
+	is.True(!found)
+	_, found, _ = storeStub.Get("stale-packaging")
+	is.True(!found)
+	_, found, _ = storeStub.Get("stale-completed")
+	is.True(found)
+	_, found, _ = storeStub.Get("fresh-queued")
+	is.True(found)
+	// Still running in Encore, so the entry is refreshed instead of removed
+	running, found, _ := storeStub.Get("stale-running")
+	is.True(found)
+	is.True(running.LastUpdate > old)
+
+	encoreHandler.status = "FAILED"
+	storeStub.mockStore["stale-failed"] = structure.TranscodeInfo{
+		Status:      "IN_PROGRESS",
+		LastUpdate:  old,
+		EncoreJobId: "failed-job",
+	}
+	is.Equal(api.reapStaleJobs(), 1)
+	_, found, _ = storeStub.Get("stale-failed")
+	is.True(!found)
+
+	storeStub.reset()
+	encoreHandler.reset()
+}
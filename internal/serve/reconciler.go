@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+const reconcilerLockKey = "encore_reconciler_leader"
+const reconcilerBatchSize = 100
+
+// Jobs in these statuses are waiting for a callback from Encore. Packaging
+// jobs are left out, since Encore knows nothing about the packaging.
+var reconciledStatuses = []structure.JobStatus{
+	structure.StatusQueued,
+	structure.StatusInProgress,
+	structure.StatusUnknown,
+}
+
+// RunReconciler periodically checks the jobs that are waiting for Encore
+// against the Encore jobs, and handles any callback that was missed.
+// Only jobs without updates during the last interval are checked, and at
+// most rate Encore jobs are fetched per second. The replicas elect a leader
+// through a lock in the store, which is the only one reconciling.
+// Blocks until the context is cancelled.
+func (api *API) RunReconciler(ctx context.Context, interval time.Duration, rate int, instanceId string) {
+	logger.Info("Starting Encore job reconciler",
+		slog.Duration("interval", interval),
+		slog.Int("rate", rate),
+	)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// The lease outlives the interval, so that the leader keeps it
+			// between passes, and another replica takes over if it goes away
+			leader, err := api.valkeyStore.RenewLock(reconcilerLockKey, instanceId, int64(2*max(interval, time.Second).Seconds()))
+			if err != nil {
+				logger.Error("failed to renew reconciler leadership", slog.String("error", err.Error()))
+				continue
+			}
+			if !leader {
+				logger.Debug("another instance is reconciling Encore jobs, skipping")
+				continue
+			}
+			reconciled := api.reconcileJobs(ctx, time.Now().Add(-interval), rate)
+			logger.Info("Reconciled Encore jobs", slog.Int("amount", reconciled))
+		case <-ctx.Done():
+			logger.Info("Stopping Encore job reconciler")
+			return
+		}
+	}
+}
+
+// Checks the jobs waiting for Encore that were last updated before the
+// cutoff, and returns the number of jobs that were updated.
+func (api *API) reconcileJobs(ctx context.Context, cutoff time.Time, rate int) int {
+	throttle := time.NewTicker(time.Second / time.Duration(rate))
+	defer throttle.Stop()
+	reconciled := 0
+	// Jobs moving to a later status during the pass show up again
+	checked := make(map[string]bool)
+	for _, status := range reconciledStatuses {
+		filter := store.JobFilter{Status: status, Until: cutoff}
+		var cursor *store.Cursor
+		for {
+			// Reconciled jobs move out of the filter, which the cursor
+			// is not affected by
+			page, err := api.valkeyStore.ListPage(filter, cursor, reconcilerBatchSize)
+			if err != nil {
+				logger.Error("failed to list jobs to reconcile",
+					slog.String("status", string(status)),
+					slog.String("error", err.Error()),
+				)
+				break
+			}
+			for _, info := range page.Items {
+				if info.EncoreJobId == "" || checked[info.EncoreJobId] {
+					continue // Not submitted yet, or already checked
+				}
+				checked[info.EncoreJobId] = true
+				select {
+				case <-throttle.C:
+				case <-ctx.Done():
+					return reconciled
+				}
+				if api.reconcileJob(&info) {
+					reconciled++
+				}
+			}
+			if page.Next == nil {
+				break
+			}
+			cursor = page.Next
+		}
+	}
+	return reconciled
+}
+
+// Handles the Encore job of a stored job the same way as its callback.
+// Returns true if the Encore job had moved on.
+func (api *API) reconcileJob(info *structure.TranscodeInfo) bool {
+	job, err := api.transcoder.GetJob(info.EncoreUrl, info.EncoreJobId)
+	if err != nil {
+		logger.Warn("could not get transcoding job to reconcile",
+			slog.String("encoreJobId", info.EncoreJobId),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+	if job.CreativeId == "" {
+		return false
+	}
+	switch job.Status {
+	case structure.TranscodeSuccessful:
+		err = api.transcodeCompleted(&job, job.CreativeId, info)
+	case structure.TranscodeFailed:
+		err = api.handleTranscodeFailed(&job)
+	case structure.TranscodeCancelled:
+		err = api.handleTranscodeCancelled(&job)
+	case structure.TranscodeInProgress:
+		if info.Status == structure.StatusInProgress && info.Progress == job.Progress {
+			return false
+		}
+		err = api.handleTranscodeInProgress(&job)
+	default:
+		return false // Still waiting in Encore
+	}
+	if err != nil {
+		logger.Error("failed to reconcile Encore job",
+			slog.String("creativeId", job.CreativeId),
+			slog.String("encoreJobId", job.Id),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+	logger.Info("Reconciled missed Encore callback",
+		slog.String("creativeId", job.CreativeId),
+		slog.String("encoreJobId", job.Id),
+		slog.String("encoreStatus", string(job.Status)),
+	)
+	return true
+}
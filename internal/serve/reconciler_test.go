@@ -0,0 +1,155 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/config"
+	"github.com/Eyevinn/ad-normalizer/internal/encore"
+	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+// Serves the given Encore jobs by ID, and counts the requests for them.
+func setupFakeEncore(jobs map[string]structure.EncoreJob) (*httptest.Server, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		job, found := jobs[strings.TrimPrefix(r.URL.Path, "/encoreJobs/")]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(job)
+	}))
+	return server, requests
+}
+
+func setupReconcilerApi(encoreServer *httptest.Server, jobStore store.Store) *API {
+	encoreUrl, _ := url.Parse(encoreServer.URL)
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.example.com")
+	encoreHandler := encore.NewHttpEncoreHandler(
+		&http.Client{},
+		[]url.URL{*encoreUrl},
+		encore.RoundRobin,
+		"test-profile",
+		nil,
+		*bucketUrl,
+		*rootUrl,
+		encore.RetryPolicy{},
+		nil,
+	)
+	return NewAPI(
+		jobStore,
+		config.AdNormalizerConfig{PackagingQueueName: "package", DispatchBackoff: 60},
+		encoreHandler,
+		&http.Client{},
+		func(normalizerMetrics.AdsHandledEventArguments) {},
+	)
+}
+
+func successfulEncoreJob(id string, creativeId string) structure.EncoreJob {
+	return structure.EncoreJob{
+		Id:         id,
+		ExternalId: creativeId,
+		Profile:    "test-profile",
+		Status:     "SUCCESSFUL",
+		Progress:   100,
+		Inputs:     []structure.EncoreInput{{Uri: "http://example.com/" + creativeId + ".mp4"}},
+		Outputs: []structure.EncoreOutput{
+			{
+				MediaType:    "Video",
+				VideoStreams: []structure.EncoreVideoStream{{Codec: "AVC", Width: 1280, Height: 720, FrameRate: "25"}},
+			},
+			{
+				MediaType:    "Audio",
+				AudioStreams: []structure.EncoreAudioStream{{Codec: "AAC", Channels: 2}},
+			},
+		},
+	}
+}
+
+func TestReconcileJobs(t *testing.T) {
+	is := is.New(t)
+	encoreServer, requests := setupFakeEncore(map[string]structure.EncoreJob{
+		"job-done":    successfulEncoreJob("job-done", "done"),
+		"job-failed":  {Id: "job-failed", ExternalId: "failed", Status: "FAILED"},
+		"job-running": {Id: "job-running", ExternalId: "running", Status: "IN_PROGRESS", Progress: 40},
+		"job-waiting": {Id: "job-waiting", ExternalId: "waiting", Status: "QUEUED"},
+	})
+	defer encoreServer.Close()
+	jobStore := store.NewMemoryStore()
+	api := setupReconcilerApi(encoreServer, jobStore)
+	for creativeId, info := range map[string]structure.TranscodeInfo{
+		"done":        {Status: structure.StatusQueued, EncoreJobId: "job-done", CreatedAt: 1000},
+		"failed":      {Status: structure.StatusInProgress, EncoreJobId: "job-failed"},
+		"running":     {Status: structure.StatusQueued, EncoreJobId: "job-running"},
+		"waiting":     {Status: structure.StatusQueued, EncoreJobId: "job-waiting"},
+		"unsubmitted": {Status: structure.StatusQueued},
+		"packaging":   {Status: structure.StatusPackaging, EncoreJobId: "job-packaging"},
+		"completed":   {Status: structure.StatusCompleted, EncoreJobId: "job-completed"},
+	} {
+		is.NoErr(jobStore.Set(creativeId, info))
+	}
+
+	start := time.Now()
+	reconciled := api.reconcileJobs(context.Background(), time.Now().Add(time.Second), 50)
+	is.Equal(reconciled, 3)
+	// Only the jobs waiting for Encore are looked up, at most 50 per second
+	is.Equal(requests.Load(), int32(4))
+	is.True(time.Since(start) >= 70*time.Millisecond)
+
+	done, _, _ := jobStore.Get("done")
+	is.Equal(done.Status, structure.StatusPackaging)
+	is.Equal(done.CreatedAt, int64(1000))
+	is.True(done.TranscodedAt > 0)
+	failed, _, _ := jobStore.Get("failed")
+	is.Equal(failed.Status, structure.StatusFailed)
+	running, _, _ := jobStore.Get("running")
+	is.Equal(running.Status, structure.StatusInProgress)
+	is.Equal(running.Progress, 40)
+	waiting, _, _ := jobStore.Get("waiting")
+	is.Equal(waiting.Status, structure.StatusQueued)
+
+	// Jobs updated after the cutoff are left alone
+	requests.Store(0)
+	is.Equal(api.reconcileJobs(context.Background(), start.Add(-time.Second), 50), 0)
+	is.Equal(requests.Load(), int32(0))
+}
+
+func TestReconcilerLeaderElection(t *testing.T) {
+	is := is.New(t)
+	encoreServer, requests := setupFakeEncore(map[string]structure.EncoreJob{
+		"job-done": successfulEncoreJob("job-done", "done"),
+	})
+	defer encoreServer.Close()
+	jobStore := store.NewMemoryStore()
+	is.NoErr(jobStore.Set("done", structure.TranscodeInfo{Status: structure.StatusQueued, EncoreJobId: "job-done"}))
+	time.Sleep(20 * time.Millisecond) // Let the job fall behind the cutoff
+
+	leader, err := jobStore.RenewLock(reconcilerLockKey, "instance-a", 60)
+	is.NoErr(err)
+	is.True(leader)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	setupReconcilerApi(encoreServer, jobStore).RunReconciler(ctx, 10*time.Millisecond, 100, "instance-b")
+	is.Equal(requests.Load(), int32(0)) // instance-a is the leader
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	setupReconcilerApi(encoreServer, jobStore).RunReconciler(ctx, 10*time.Millisecond, 100, "instance-a")
+	is.True(requests.Load() > 0)
+	done, _, _ := jobStore.Get("done")
+	is.Equal(done.Status, structure.StatusPackaging)
+}
@@ -0,0 +1,25 @@
+package serve
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+)
+
+// RequiredRole returns the role needed for a request to the API, with the
+// /api/v1 prefix stripped. The ad endpoints are public, reading jobs and the
+// blacklist needs read-only access, managing jobs needs an operator and
+// changing the blacklist needs an admin.
+func RequiredRole(r *http.Request) auth.Role {
+	switch {
+	case r.URL.Path == "/vast" || r.URL.Path == "/vmap":
+		return auth.RolePublic
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return auth.RoleReadOnly
+	case strings.HasPrefix(r.URL.Path, "/blacklist"):
+		return auth.RoleAdmin
+	default:
+		return auth.RoleOperator
+	}
+}
@@ -0,0 +1,35 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/auth"
+	"github.com/matryer/is"
+)
+
+func TestRequiredRole(t *testing.T) {
+	is := is.New(t)
+	cases := []struct {
+		method, path string
+		expected     auth.Role
+	}{
+		{http.MethodGet, "/vast", auth.RolePublic},
+		{http.MethodGet, "/vmap", auth.RolePublic},
+		{http.MethodGet, "/jobs", auth.RoleReadOnly},
+		{http.MethodGet, "/jobs/creative", auth.RoleReadOnly},
+		{http.MethodGet, "/blacklist", auth.RoleReadOnly},
+		{http.MethodGet, "/blacklist/export", auth.RoleReadOnly},
+		{http.MethodGet, "/audit", auth.RoleReadOnly},
+		{http.MethodPost, "/jobs/creative/retry", auth.RoleOperator},
+		{http.MethodDelete, "/jobs/creative", auth.RoleOperator},
+		{http.MethodPost, "/preingest", auth.RoleOperator},
+		{http.MethodPost, "/blacklist", auth.RoleAdmin},
+		{http.MethodDelete, "/blacklist", auth.RoleAdmin},
+		{http.MethodPost, "/blacklist/import", auth.RoleAdmin},
+	}
+	for _, c := range cases {
+		is.Equal(RequiredRole(httptest.NewRequest(c.method, c.path, nil)), c.expected) // c.method c.path
+	}
+}
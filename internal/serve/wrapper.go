@@ -0,0 +1,211 @@
+package serve
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Eyevinn/VMAP/vmap"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+var errWrapperDepthExceeded = errors.New("wrapper chain exceeds max depth")
+var errWrapperLoop = errors.New("wrapper chain contains a loop")
+var errMissingAdTagUri = errors.New("wrapper has no VASTAdTagURI")
+
+// Returns true if any ad in the VAST lacks an InLine element,
+// meaning it is either a wrapper or an ad we cannot use.
+func hasWrapperAds(vast *vmap.VAST) bool {
+	for _, ad := range vast.Ad {
+		if ad.InLine == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveWrappers replaces every wrapper ad in the VAST with the inline ad(s)
+// it eventually points to. Wrapper impressions, errors and tracking are merged
+// into the resolved ads. Ads that cannot be resolved are dropped, since the
+// rest of the pipeline only knows how to handle inline ads.
+// The wrappers argument must be decoded from the same document as the VAST,
+// so that the ads can be matched by index.
+func (api *API) resolveWrappers(
+	ctx context.Context,
+	r *http.Request,
+	vast *vmap.VAST,
+	wrappers *structure.WrapperVast,
+) {
+	ctx, span := otel.Tracer("api").Start(ctx, "resolveWrappers")
+	defer span.End()
+	resolved := make([][]vmap.Ad, len(vast.Ad))
+	wg := &sync.WaitGroup{}
+	for idx, ad := range vast.Ad {
+		if ad.InLine != nil {
+			resolved[idx] = []vmap.Ad{ad}
+			continue
+		}
+		if wrappers == nil || idx >= len(wrappers.Ads) || wrappers.Ads[idx].Wrapper == nil {
+			logger.Debug("dropping ad without InLine or Wrapper", slog.String("adId", ad.Id))
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, ad vmap.Ad, wrapper *structure.Wrapper) {
+			defer wg.Done()
+			ads, err := api.resolveWrapper(ctx, r, wrapper, 0, map[string]struct{}{})
+			if err != nil {
+				logger.Error("failed to resolve wrapper ad",
+					slog.String("adId", ad.Id),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			if len(ads) == 1 {
+				ads[0].Sequence = ad.Sequence
+			}
+			resolved[idx] = ads
+		}(idx, ad, wrappers.Ads[idx].Wrapper)
+	}
+	wg.Wait()
+	newAds := make([]vmap.Ad, 0, len(vast.Ad))
+	for _, ads := range resolved {
+		newAds = append(newAds, ads...)
+	}
+	vast.Ad = newAds
+}
+
+// Follows a single wrapper's VASTAdTagURI, recursing into nested wrappers
+// until inline ads are found. Visited holds the ad tag URIs already
+// followed in this chain and is used to detect loops.
+func (api *API) resolveWrapper(
+	ctx context.Context,
+	r *http.Request,
+	wrapper *structure.Wrapper,
+	depth int,
+	visited map[string]struct{},
+) ([]vmap.Ad, error) {
+	adTagUri := strings.TrimSpace(wrapper.VastAdTagUri)
+	if adTagUri == "" {
+		return nil, errMissingAdTagUri
+	}
+	if depth >= api.wrapperMaxDepth {
+		return nil, errWrapperDepthExceeded
+	}
+	if _, seen := visited[adTagUri]; seen {
+		return nil, fmt.Errorf("%w: %s", errWrapperLoop, adTagUri)
+	}
+	visited[adTagUri] = struct{}{}
+
+	logger.Debug("Following VAST wrapper",
+		slog.String("adTagUri", adTagUri),
+		slog.Int("depth", depth),
+	)
+	body, err := api.fetchWrappedVast(ctx, r, adTagUri)
+	if err != nil {
+		return nil, err
+	}
+	vast, err := vmap.DecodeVastScan(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped VAST from %s: %w", adTagUri, err)
+	}
+	var nested structure.WrapperVast
+	if hasWrapperAds(&vast) {
+		if err := xml.Unmarshal(body, &nested); err != nil {
+			logger.Warn("failed to decode nested wrappers",
+				slog.String("adTagUri", adTagUri),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	resolved := make([]vmap.Ad, 0, len(vast.Ad))
+	for idx, ad := range vast.Ad {
+		if ad.InLine != nil {
+			resolved = append(resolved, ad)
+			continue
+		}
+		if idx >= len(nested.Ads) || nested.Ads[idx].Wrapper == nil {
+			continue
+		}
+		// Siblings in a pod get their own copy, so that two ads pointing
+		// to the same tag are not mistaken for a loop
+		inner, err := api.resolveWrapper(ctx, r, nested.Ads[idx].Wrapper, depth+1, maps.Clone(visited))
+		if err != nil {
+			logger.Error("failed to resolve nested wrapper ad",
+				slog.String("adId", ad.Id),
+				slog.String("adTagUri", adTagUri),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		resolved = append(resolved, inner...)
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("no ads found in wrapped VAST from %s", adTagUri)
+	}
+	for idx := range resolved {
+		mergeWrapper(&resolved[idx], wrapper)
+	}
+	return resolved, nil
+}
+
+// Adds the wrapper's impressions and tracking to the resolved inline ad.
+// Since an InLine only holds a single error URL, the wrapper error is only
+// used if the inline ad has none.
+func mergeWrapper(ad *vmap.Ad, wrapper *structure.Wrapper) {
+	ad.InLine.Impression = append(ad.InLine.Impression, wrapper.Impressions...)
+	if ad.InLine.Error == nil && len(wrapper.Errors) > 0 {
+		ad.InLine.Error = &vmap.Error{Value: strings.TrimSpace(wrapper.Errors[0].Value)}
+	}
+	for idx := range ad.InLine.Creatives {
+		linear := ad.InLine.Creatives[idx].Linear
+		if linear == nil {
+			continue
+		}
+		linear.TrackingEvents = append(linear.TrackingEvents, wrapper.TrackingEvents...)
+		linear.ClickTracking = append(linear.ClickTracking, wrapper.ClickTracking...)
+	}
+}
+
+// Fetches the VAST document a wrapper points to, bounded by the per-hop timeout.
+func (api *API) fetchWrappedVast(ctx context.Context, r *http.Request, adTagUri string) ([]byte, error) {
+	hopCtx, cancel := context.WithTimeout(ctx, api.wrapperTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(hopCtx, http.MethodGet, adTagUri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wrapper request: %w", err)
+	}
+	req.Header.Add("User-Agent", "eyevinn/ad-normalizer")
+	if deviceUserAgent := r.Header.Get(userAgentHeader); deviceUserAgent != "" {
+		req.Header.Add(userAgentHeader, deviceUserAgent)
+	}
+	if forwardedFor := r.Header.Get(forwardedForHeader); forwardedFor != "" {
+		req.Header.Add(forwardedForHeader, forwardedFor)
+	}
+	req.Header.Add("Accept", "application/xml")
+	req.Header.Add("Accept-Encoding", "gzip")
+	response, err := api.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch wrapped VAST from %s: %w", adTagUri, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, structure.AdServerError{
+			StatusCode: response.StatusCode,
+			Message:    "Failed to fetch wrapped VAST from " + adTagUri,
+		}
+	}
+	if response.Header.Get("Content-Encoding") == "gzip" {
+		return decompressGzip(response.Body)
+	}
+	return io.ReadAll(response.Body)
+}
@@ -0,0 +1,182 @@
+package serve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/VMAP/vmap"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func wrapperVast(adTagUri string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<VAST version="4.0">
+  <Ad id="WRAPPER_AD" sequence="3">
+    <Wrapper>
+      <AdSystem>Wrapper Adserver</AdSystem>
+      <VASTAdTagURI><![CDATA[` + adTagUri + `]]></VASTAdTagURI>
+      <Error><![CDATA[https://wrapper.example.com/error]]></Error>
+      <Impression id="wrapper-impression"><![CDATA[https://wrapper.example.com/impression]]></Impression>
+      <Creatives>
+        <Creative>
+          <Linear>
+            <TrackingEvents>
+              <Tracking event="start"><![CDATA[https://wrapper.example.com/start]]></Tracking>
+            </TrackingEvents>
+          </Linear>
+        </Creative>
+      </Creatives>
+    </Wrapper>
+  </Ad>
+</VAST>`
+}
+
+// Serves wrapper chains pointing back to itself. The VAST returned
+// for /inline is the regular test VAST, trimmed down to its first ad.
+func setupWrapperAdServer(t *testing.T) *httptest.Server {
+	vastData, err := os.ReadFile("../test_data/testVast.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inline := regexp.MustCompile(`(?s)<Ad id="POD_AD-ID_002".*</Ad>`).ReplaceAll(vastData, nil)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		switch r.URL.Path {
+		case "/inline":
+			_, _ = w.Write(inline)
+		case "/wrapper":
+			_, _ = w.Write([]byte(wrapperVast(ts.URL + "/inline")))
+		case "/double-wrapper":
+			_, _ = w.Write([]byte(wrapperVast(ts.URL + "/wrapper")))
+		case "/loop-a":
+			_, _ = w.Write([]byte(wrapperVast(ts.URL + "/loop-b")))
+		case "/loop-b":
+			_, _ = w.Write([]byte(wrapperVast(ts.URL + "/loop-a")))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write(inline)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return ts
+}
+
+func TestResolveWrappers(t *testing.T) {
+	adServer := setupWrapperAdServer(t)
+	defer adServer.Close()
+	cases := []struct {
+		name        string
+		path        string
+		maxDepth    int
+		expectedAds int
+	}{
+		{name: "single wrapper", path: "/wrapper", maxDepth: 5, expectedAds: 1},
+		{name: "nested wrappers", path: "/double-wrapper", maxDepth: 5, expectedAds: 1},
+		{name: "max depth exceeded", path: "/double-wrapper", maxDepth: 1, expectedAds: 0},
+		{name: "wrappers disabled", path: "/wrapper", maxDepth: 0, expectedAds: 0},
+		{name: "loop", path: "/loop-a", maxDepth: 10, expectedAds: 0},
+		{name: "hop timeout", path: "/slow", maxDepth: 5, expectedAds: 0},
+		{name: "broken ad tag", path: "/missing", maxDepth: 5, expectedAds: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			api, ts, storeStub, encoreHandler := setupApi()
+			defer ts.Close()
+			defer storeStub.reset()
+			defer encoreHandler.reset()
+			api.wrapperMaxDepth = c.maxDepth
+			api.wrapperTimeout = 100 * time.Millisecond
+			adServerUrl, err := url.Parse(adServer.URL)
+			is.NoErr(err)
+			api.adServerUrl = *adServerUrl.JoinPath("wrapper")
+
+			re := regexp.MustCompile("[^a-zA-Z0-9]")
+			adKey := re.ReplaceAllString("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4", "")
+			_ = storeStub.Set(adKey, structure.TranscodeInfo{
+				Url:    "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8",
+				Status: "COMPLETED",
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "/vast", nil)
+			is.NoErr(err)
+			wrappers := structure.WrapperVast{
+				Ads: []structure.WrapperAd{
+					{
+						Id:       "WRAPPER_AD",
+						Sequence: 3,
+						Wrapper: &structure.Wrapper{
+							VastAdTagUri: adServer.URL + c.path,
+						},
+					},
+				},
+			}
+			vast := vmap.VAST{Ad: []vmap.Ad{{Id: "WRAPPER_AD", Sequence: 3}}}
+			api.resolveWrappers(req.Context(), req, &vast, &wrappers)
+			is.Equal(len(vast.Ad), c.expectedAds)
+			if c.expectedAds > 0 {
+				is.Equal(vast.Ad[0].Sequence, 3)
+				is.True(vast.Ad[0].InLine != nil)
+			}
+		})
+	}
+}
+
+func TestReplaceVastWithWrapper(t *testing.T) {
+	is := is.New(t)
+	adServer := setupWrapperAdServer(t)
+	defer adServer.Close()
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	api.wrapperMaxDepth = 5
+	api.wrapperTimeout = time.Second
+	adServerUrl, err := url.Parse(adServer.URL)
+	is.NoErr(err)
+	api.adServerUrl = *adServerUrl.JoinPath("double-wrapper")
+
+	re := regexp.MustCompile("[^a-zA-Z0-9]")
+	adKey := re.ReplaceAllString("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4", "")
+	_ = storeStub.Set(adKey, structure.TranscodeInfo{
+		Url:    "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8",
+		Status: "COMPLETED",
+	})
+
+	vastReq, err := http.NewRequest(http.MethodGet, "/vast", nil)
+	is.NoErr(err)
+	vastReq.Header.Set("accept", "application/xml")
+	recorder := httptest.NewRecorder()
+	api.HandleVast(recorder, vastReq)
+	is.Equal(recorder.Result().StatusCode, http.StatusOK)
+	defer recorder.Result().Body.Close()
+
+	responseBody, err := io.ReadAll(recorder.Result().Body)
+	is.NoErr(err)
+	vastRes, err := vmap.DecodeVast(responseBody)
+	is.NoErr(err)
+	is.Equal(len(vastRes.Ad), 1)
+	ad := vastRes.Ad[0]
+	is.Equal(ad.Id, "POD_AD-ID_001")
+	is.Equal(ad.Sequence, 3)
+	// One impression from the inline ad and one per wrapper
+	is.Equal(len(ad.InLine.Impression), 3)
+	is.Equal(ad.InLine.Error.Value, "https://wrapper.example.com/error")
+	linear := ad.InLine.Creatives[0].Linear
+	is.Equal(len(linear.TrackingEvents), 7)
+	is.True(strings.HasSuffix(linear.TrackingEvents[6].Text, "/start"))
+	is.Equal(linear.MediaFiles[0].Text, "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8")
+
+	is.Equal(storeStub.kpis.ServedAds, 1)
+	is.Equal(encoreHandler.calls, 0)
+	storeStub.reset()
+	encoreHandler.reset()
+}
@@ -0,0 +1,53 @@
+package signing
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestToken(t *testing.T) {
+	is := is.New(t)
+	signer := NewSigner("secret", time.Hour)
+	expires := time.Now().Add(time.Minute).Unix()
+	token := signer.Token(expires, "creative", "job")
+	is.True(signer.VerifyToken(token, expires, "creative", "job"))
+	is.True(!signer.VerifyToken(token, expires, "other-creative", "job"))
+	is.True(!signer.VerifyToken(token, expires, "creative", "other-job"))
+	is.True(!signer.VerifyToken(token, expires+3600, "creative", "job")) // expiry was extended
+	is.True(!signer.VerifyToken("", expires, "creative", "job"))
+	is.True(!signer.VerifyToken("not base64!", expires, "creative", "job"))
+	is.True(!NewSigner("other-secret", time.Hour).VerifyToken(token, expires, "creative", "job"))
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	is.True(!signer.VerifyToken(signer.Token(expired, "creative", "job"), expired, "creative", "job"))
+}
+
+func TestSignQuery(t *testing.T) {
+	is := is.New(t)
+	signer := NewSigner("secret", time.Hour)
+	query := url.Values{}
+	signer.SignQuery(query, "creative", "job")
+	expires, err := strconv.ParseInt(query.Get(EXPIRES_PARAM), 10, 64)
+	is.NoErr(err)
+	is.True(expires > time.Now().Add(59*time.Minute).Unix())
+	is.True(signer.VerifyQuery(query, "creative", "job"))
+	is.True(!signer.VerifyQuery(query, "creative", "other-job"))
+
+	query.Del(EXPIRES_PARAM)
+	is.True(!signer.VerifyQuery(query, "creative", "job"))
+}
+
+func TestSignature(t *testing.T) {
+	is := is.New(t)
+	signer := NewSigner("secret", time.Hour)
+	body := []byte(`{"jobId":"job"}`)
+	signature := signer.Signature(body)
+	is.True(signer.VerifySignature(body, signature))
+	is.True(!signer.VerifySignature([]byte(`{"jobId":"other-job"}`), signature))
+	is.True(!signer.VerifySignature(body, signature[len(signaturePrefix):])) // missing prefix
+	is.True(!signer.VerifySignature(body, signaturePrefix+"zz"))
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+const INVALIDATION_CHANNEL = "store_cache_invalidation"
+
+const creativeInvalidationPrefix = "creative:"
+const blacklistInvalidationPrefix = "blacklist:"
+
+// Invalidator is implemented by stores that can tell other replicas
+// to drop entries from their local caches.
+type Invalidator interface {
+	PublishInvalidation(message string) error
+	// Blocks, calling onMessage for each invalidation, until the context
+	// is cancelled or the subscription fails.
+	SubscribeInvalidations(ctx context.Context, onMessage func(message string)) error
+}
+
+// CachedStore is a read-through cache in front of another Store.
+// Only completed jobs are cached, since they essentially never change,
+// together with blacklist membership, which is cached no longer than the
+// blacklist entry lasts. Everything else goes straight
+// to the underlying store. Writes invalidate the local cache and, if the
+// underlying store is an Invalidator, the caches of other replicas.
+type CachedStore struct {
+	Store
+	creatives   *lruCache[structure.TranscodeInfo]
+	blacklist   *lruCache[bool]
+	invalidator Invalidator
+}
+
+func NewCachedStore(backing Store, size int, ttl time.Duration) *CachedStore {
+	invalidator, _ := backing.(Invalidator)
+	return &CachedStore{
+		Store:       backing,
+		creatives:   newLruCache[structure.TranscodeInfo](size, ttl),
+		blacklist:   newLruCache[bool](size, ttl),
+		invalidator: invalidator,
+	}
+}
+
+func (cs *CachedStore) Get(key string) (structure.TranscodeInfo, bool, error) {
+	if value, found := cs.creatives.get(key); found {
+		return value, true, nil
+	}
+	value, found, err := cs.Store.Get(key)
+	if err == nil && found && value.Status == structure.StatusCompleted {
+		cs.creatives.put(key, value)
+	}
+	return value, found, err
+}
+
+func (cs *CachedStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	results := make(map[string]structure.TranscodeInfo, len(keys))
+	uncached := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value, found := cs.creatives.get(key); found {
+			results[key] = value
+		} else {
+			uncached = append(uncached, key)
+		}
+	}
+	if len(uncached) == 0 {
+		return results, nil
+	}
+	fetched, err := cs.Store.GetMany(uncached)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range fetched {
+		if value.Status == structure.StatusCompleted {
+			cs.creatives.put(key, value)
+		}
+		results[key] = value
+	}
+	return results, nil
+}
+
+func (cs *CachedStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
+	defer cs.invalidateCreative(key)
+	return cs.Store.Set(key, value, ttl...)
+}
+
+func (cs *CachedStore) Claim(key string, value structure.TranscodeInfo, ttl int64) (bool, error) {
+	claimed, err := cs.Store.Claim(key, value, ttl)
+	if claimed {
+		cs.invalidateCreative(key)
+	}
+	return claimed, err
+}
+
+func (cs *CachedStore) Delete(key string) error {
+	defer cs.invalidateCreative(key)
+	return cs.Store.Delete(key)
+}
+
+func (cs *CachedStore) DeleteIfStale(key string, olderThan time.Time) (bool, error) {
+	deleted, err := cs.Store.DeleteIfStale(key, olderThan)
+	if deleted {
+		cs.invalidateCreative(key)
+	}
+	return deleted, err
+}
+
+func (cs *CachedStore) BlackList(entry structure.BlacklistEntry) error {
+	defer cs.invalidateBlackList(entry.MediaUrl)
+	return cs.Store.BlackList(entry)
+}
+
+func (cs *CachedStore) PruneBlackList() ([]string, error) {
+	pruned, err := cs.Store.PruneBlackList()
+	for _, value := range pruned {
+		cs.invalidateBlackList(value)
+	}
+	return pruned, err
+}
+
+func (cs *CachedStore) RemoveFromBlackList(value string) error {
+	defer cs.invalidateBlackList(value)
+	return cs.Store.RemoveFromBlackList(value)
+}
+
+func (cs *CachedStore) BlackListMany(entries []structure.BlacklistEntry) []error {
+	defer func() {
+		for _, entry := range entries {
+			cs.invalidateBlackList(entry.MediaUrl)
+		}
+	}()
+	return cs.Store.BlackListMany(entries)
+}
+
+func (cs *CachedStore) RemoveFromBlackListMany(values []string) []error {
+	defer func() {
+		for _, value := range values {
+			cs.invalidateBlackList(value)
+		}
+	}()
+	return cs.Store.RemoveFromBlackListMany(values)
+}
+
+func (cs *CachedStore) InBlackList(value string) (bool, error) {
+	if blacklisted, found := cs.blacklist.get(value); found {
+		return blacklisted, nil
+	}
+	blacklisted, err := cs.Store.InBlackList(value)
+	if err == nil {
+		cs.cacheBlackList(map[string]bool{value: blacklisted})
+	}
+	return blacklisted, err
+}
+
+func (cs *CachedStore) InBlackListMany(values []string) (map[string]bool, error) {
+	results := make(map[string]bool, len(values))
+	uncached := make([]string, 0, len(values))
+	for _, value := range values {
+		if blacklisted, found := cs.blacklist.get(value); found {
+			results[value] = blacklisted
+		} else {
+			uncached = append(uncached, value)
+		}
+	}
+	if len(uncached) == 0 {
+		return results, nil
+	}
+	fetched, err := cs.Store.InBlackListMany(uncached)
+	if err != nil {
+		return nil, err
+	}
+	cs.cacheBlackList(fetched)
+	for value, blacklisted := range fetched {
+		results[value] = blacklisted
+	}
+	return results, nil
+}
+
+// Caches the results of blacklist lookups. Entries that expire are only
+// cached until they expire, so their expiry is looked up first. If that
+// fails they are not cached at all.
+func (cs *CachedStore) cacheBlackList(fetched map[string]bool) {
+	blacklisted := make([]string, 0, len(fetched))
+	for value, inBlackList := range fetched {
+		if inBlackList {
+			blacklisted = append(blacklisted, value)
+		} else {
+			cs.blacklist.put(value, false)
+		}
+	}
+	if len(blacklisted) == 0 {
+		return
+	}
+	entries, err := cs.Store.GetBlackListEntries(blacklisted)
+	if err != nil {
+		logger.Warn("failed to get blacklist entries to cache", slog.String("error", err.Error()))
+		return
+	}
+	for _, value := range blacklisted {
+		until := time.Time{}
+		if expiresAt := entries[value].ExpiresAt; expiresAt > 0 {
+			until = time.Unix(expiresAt, 0)
+		}
+		cs.blacklist.putUntil(value, true, until)
+	}
+}
+
+// ListenForInvalidations drops entries invalidated by other replicas.
+// The subscription is re-established if it fails, and the whole cache is
+// cleared when that happens since invalidations may have been missed.
+// Blocks until the context is cancelled. Does nothing if the underlying
+// store cannot publish invalidations.
+func (cs *CachedStore) ListenForInvalidations(ctx context.Context) {
+	if cs.invalidator == nil {
+		return
+	}
+	for {
+		err := cs.invalidator.SubscribeInvalidations(ctx, cs.handleInvalidation)
+		if ctx.Err() != nil {
+			return
+		}
+		cs.creatives.clear()
+		cs.blacklist.clear()
+		if err != nil {
+			logger.Error("cache invalidation subscription failed, retrying", slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (cs *CachedStore) handleInvalidation(message string) {
+	if key, found := strings.CutPrefix(message, creativeInvalidationPrefix); found {
+		cs.creatives.remove(key)
+	} else if value, found := strings.CutPrefix(message, blacklistInvalidationPrefix); found {
+		cs.blacklist.remove(value)
+	} else {
+		logger.Warn("unknown cache invalidation message", slog.String("message", message))
+	}
+}
+
+func (cs *CachedStore) invalidateCreative(key string) {
+	cs.creatives.remove(key)
+	cs.publish(creativeInvalidationPrefix + key)
+}
+
+func (cs *CachedStore) invalidateBlackList(value string) {
+	cs.blacklist.remove(value)
+	cs.publish(blacklistInvalidationPrefix + value)
+}
+
+func (cs *CachedStore) publish(message string) {
+	if cs.invalidator == nil {
+		return
+	}
+	if err := cs.invalidator.PublishInvalidation(message); err != nil {
+		logger.Error("failed to publish cache invalidation",
+			slog.String("message", message),
+			slog.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestLruCache(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	cache := newLruCache[int](2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.put("a", 1)
+	cache.put("b", 2)
+	_, _ = cache.get("a") // a is now the most recently used
+	cache.put("c", 3)
+	is.Equal(cache.len(), 2)
+	_, found := cache.get("b")
+	is.True(!found) // Evicted
+	value, found := cache.get("a")
+	is.True(found)
+	is.Equal(value, 1)
+
+	now = now.Add(2 * time.Minute)
+	_, found = cache.get("c")
+	is.True(!found) // Expired
+
+	cache.putUntil("d", 4, now.Add(10*time.Second))
+	cache.putUntil("e", 5, now.Add(time.Hour)) // the TTL comes first
+	now = now.Add(11 * time.Second)
+	_, found = cache.get("d")
+	is.True(!found)
+	_, found = cache.get("e")
+	is.True(found)
+}
+
+func TestCachedStoreBlackListExpiry(t *testing.T) {
+	is := is.New(t)
+	memoryStore, now := newTestMemoryStore()
+	cachedStore := NewCachedStore(memoryStore, 10, time.Minute)
+	cachedStore.blacklist.now = func() time.Time { return *now }
+
+	is.NoErr(cachedStore.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "http://example.com/temporary.mp4",
+		ExpiresAt: now.Add(10 * time.Second).Unix(),
+	}))
+	is.NoErr(cachedStore.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/broken.mp4"}))
+	blacklisted, err := cachedStore.InBlackListMany([]string{"http://example.com/temporary.mp4", "http://example.com/broken.mp4"})
+	is.NoErr(err)
+	is.True(blacklisted["http://example.com/temporary.mp4"])
+	is.True(blacklisted["http://example.com/broken.mp4"])
+
+	// The cached result does not outlive the entry
+	*now = now.Add(11 * time.Second)
+	blacklisted, err = cachedStore.InBlackListMany([]string{"http://example.com/temporary.mp4", "http://example.com/broken.mp4"})
+	is.NoErr(err)
+	is.True(!blacklisted["http://example.com/temporary.mp4"])
+	is.True(blacklisted["http://example.com/broken.mp4"])
+	inBlackList, err := cachedStore.InBlackList("http://example.com/temporary.mp4")
+	is.NoErr(err)
+	is.True(!inBlackList)
+}
+
+func TestCachedStore(t *testing.T) {
+	is := is.New(t)
+	valkeyStore, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+	cachedStore := NewCachedStore(valkeyStore, 10, time.Minute)
+
+	is.NoErr(cachedStore.Set("completed", structure.TranscodeInfo{Url: "http://example.com/done.m3u8", Status: "COMPLETED"}))
+	is.NoErr(cachedStore.Set("queued", structure.TranscodeInfo{Url: "http://example.com/source.mp4", Status: "QUEUED"}))
+	is.NoErr(cachedStore.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/broken.mp4"}))
+	results, err := cachedStore.GetMany([]string{"completed", "queued"})
+	is.NoErr(err)
+	is.Equal(len(results), 2)
+	blacklisted, err := cachedStore.InBlackListMany([]string{"http://example.com/broken.mp4", "http://example.com/fine.mp4"})
+	is.NoErr(err)
+	is.True(blacklisted["http://example.com/broken.mp4"])
+
+	// Only completed jobs and blacklist lookups are served from the cache
+	minir.FlushAll()
+	info, found, err := cachedStore.Get("completed")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(info.Url, "http://example.com/done.m3u8")
+	_, found, err = cachedStore.Get("queued")
+	is.NoErr(err)
+	is.True(!found)
+	inBlackList, err := cachedStore.InBlackList("http://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(inBlackList)
+
+	// Writes go through and invalidate
+	is.NoErr(cachedStore.Delete("completed"))
+	_, found, err = cachedStore.Get("completed")
+	is.NoErr(err)
+	is.True(!found)
+	is.NoErr(cachedStore.RemoveFromBlackList("http://example.com/broken.mp4"))
+	inBlackList, err = cachedStore.InBlackList("http://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(!inBlackList)
+}
+
+func TestCacheInvalidationAcrossReplicas(t *testing.T) {
+	is := is.New(t)
+	valkeyStore, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+	replicaA := NewCachedStore(valkeyStore, 10, time.Minute)
+	replicaB := NewCachedStore(valkeyStore, 10, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go replicaB.ListenForInvalidations(ctx)
+	// Wait for the subscription to be set up
+	for minir.PubSubNumSub(INVALIDATION_CHANNEL)[INVALIDATION_CHANNEL] == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	is.NoErr(replicaA.Set("key", structure.TranscodeInfo{Url: "http://example.com/v1.m3u8", Status: "COMPLETED"}))
+	info, _, err := replicaB.Get("key")
+	is.NoErr(err)
+	is.Equal(info.Url, "http://example.com/v1.m3u8")
+
+	is.NoErr(replicaA.Set("key", structure.TranscodeInfo{Url: "http://example.com/v2.m3u8", Status: "COMPLETED"}))
+	deadline := time.Now().Add(2 * time.Second)
+	for replicaB.creatives.len() > 0 {
+		is.True(time.Now().Before(deadline))
+		time.Sleep(5 * time.Millisecond)
+	}
+	info, _, err = replicaB.Get("key")
+	is.NoErr(err)
+	is.Equal(info.Url, "http://example.com/v2.m3u8")
+}
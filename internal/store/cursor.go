@@ -0,0 +1,144 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a listing ordered by score, newest first,
+// with ties broken by member in reverse order. A page read from a cursor
+// never includes the entry at the cursor itself, so entries written while
+// paging do not shift the following pages.
+type Cursor struct {
+	Score  float64 `json:"s"`
+	Member string  `json:"m"`
+	// Read the entries before the cursor, towards the newest entries
+	Backward bool `json:"b,omitempty"`
+}
+
+// Page is a listing read from a cursor.
+type Page[T any] struct {
+	Items []T
+	// The keys of the items, in the same order
+	Keys []string
+	// Cursors to the neighbouring pages, nil if there are none
+	Next *Cursor
+	Prev *Cursor
+	// Number of entries in the whole listing, -1 if it is too costly to count
+	Total int64
+}
+
+// Encode returns the cursor as an opaque string, safe to use in URLs.
+func (c Cursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func DecodeCursor(encoded string) (Cursor, error) {
+	var cursor Cursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(raw, &cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+type scoredMember struct {
+	score  float64
+	member string
+}
+
+// Returns true if the entry comes after the cursor in the direction it is read.
+func (c Cursor) precedes(entry scoredMember) bool {
+	if c.Backward {
+		return entry.score > c.Score || (entry.score == c.Score && entry.member > c.Member)
+	}
+	return entry.score < c.Score || (entry.score == c.Score && entry.member < c.Member)
+}
+
+func (entry scoredMember) cursor(backward bool) *Cursor {
+	return &Cursor{Score: entry.score, Member: entry.member, Backward: backward}
+}
+
+// Builds a page from entries read in the cursor's direction. Read holds at
+// most size+1 entries, where the extra one only tells that there is more.
+func newPage[T any](items []T, read []scoredMember, cursor *Cursor, size int) Page[T] {
+	hasMore := len(read) > size
+	if hasMore {
+		items = items[:size]
+		read = read[:size]
+	}
+	backward := cursor != nil && cursor.Backward
+	if backward {
+		slices.Reverse(items)
+		slices.Reverse(read)
+	}
+	page := Page[T]{Items: items, Keys: make([]string, 0, len(read)), Total: -1}
+	for _, entry := range read {
+		page.Keys = append(page.Keys, entry.member)
+	}
+	if len(read) == 0 {
+		return page
+	}
+	first, last := read[0], read[len(read)-1]
+	if backward {
+		page.Next = last.cursor(false)
+		if hasMore {
+			page.Prev = first.cursor(true)
+		}
+	} else {
+		if hasMore {
+			page.Next = last.cursor(false)
+		}
+		if cursor != nil {
+			page.Prev = first.cursor(true)
+		}
+	}
+	return page
+}
+
+// Points the page's cursor in the direction it was read at the given entry,
+// for a page whose scan stopped there before the page was full. The entries
+// after it have not been looked at yet.
+func continueAt[T any](page *Page[T], stoppedAt scoredMember, cursor *Cursor) {
+	if cursor != nil && cursor.Backward {
+		page.Prev = stoppedAt.cursor(true)
+		if page.Next == nil {
+			page.Next = &Cursor{Score: cursor.Score, Member: cursor.Member}
+		}
+	} else {
+		page.Next = stoppedAt.cursor(false)
+	}
+}
+
+// Pages through entries already sorted newest first, for stores that keep
+// everything in memory.
+func pageSorted[T any](items []T, entries []scoredMember, cursor *Cursor, size int) Page[T] {
+	read := make([]scoredMember, 0, size+1)
+	readItems := make([]T, 0, size+1)
+	if cursor != nil && cursor.Backward {
+		for idx := len(entries) - 1; idx >= 0 && len(read) <= size; idx-- {
+			if cursor.precedes(entries[idx]) {
+				read = append(read, entries[idx])
+				readItems = append(readItems, items[idx])
+			}
+		}
+	} else {
+		for idx := 0; idx < len(entries) && len(read) <= size; idx++ {
+			if cursor == nil || cursor.precedes(entries[idx]) {
+				read = append(read, entries[idx])
+				readItems = append(readItems, items[idx])
+			}
+		}
+	}
+	page := newPage(readItems, read, cursor, size)
+	page.Total = int64(len(entries))
+	return page
+}
@@ -0,0 +1,18 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	is := is.New(t)
+	cursor := Cursor{Score: 1750000000123, Member: "creative/with?odd&chars", Backward: true}
+	decoded, err := DecodeCursor(cursor.Encode())
+	is.NoErr(err)
+	is.Equal(decoded, cursor)
+
+	_, err = DecodeCursor("not a cursor")
+	is.Equal(err, ErrInvalidCursor)
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+const STATUS_INDEX_PREFIX = "job_status_index:"
+
+func statusIndexKey(status structure.JobStatus) string {
+	return STATUS_INDEX_PREFIX + string(status)
+}
+
+// JobFilter narrows down the jobs returned by ListFiltered.
+// Zero values match everything.
+type JobFilter struct {
+	Status structure.JobStatus
+	// Substring of the source URL
+	Source string
+	// Last updated at or after Since, and at or before Until
+	Since time.Time
+	Until time.Time
+	// Prefix of the creative ID
+	Prefix string
+}
+
+// Returns the score range of the filter in the indexes, in unix milliseconds.
+func (f JobFilter) scoreRange() (float64, float64) {
+	minScore, maxScore := math.Inf(-1), math.Inf(1)
+	if !f.Since.IsZero() {
+		minScore = float64(f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		maxScore = float64(f.Until.UnixMilli())
+	}
+	return minScore, maxScore
+}
+
+// Returns true if the filter can only be applied by looking at
+// each candidate, rather than by the indexes alone.
+func (f JobFilter) needsScan() bool {
+	return f.Source != "" || f.Prefix != ""
+}
+
+func (f JobFilter) matchesKey(key string) bool {
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+func (f JobFilter) matches(key string, value structure.TranscodeInfo) bool {
+	if f.Status != "" && value.Status != f.Status {
+		return false
+	}
+	return f.matchesKey(key) && strings.Contains(value.Source, f.Source)
+}
+
+// AuditFilter narrows down the events returned by ListAudit.
+// Zero values match everything.
+type AuditFilter struct {
+	// Recorded at or after Since, and at or before Until
+	Since time.Time
+	Until time.Time
+	// Only events older than the one with this ID, to page through the log
+	Before string
+}
+
+// Returns the range of stream IDs matching the filter, as XREVRANGE
+// takes them. Events before the cursor were recorded before Until too.
+func (f AuditFilter) idRange() (string, string) {
+	start, end := "-", "+"
+	if !f.Since.IsZero() {
+		start = strconv.FormatInt(f.Since.UnixMilli(), 10)
+	}
+	if !f.Until.IsZero() {
+		end = strconv.FormatInt(f.Until.UnixMilli(), 10)
+	}
+	if f.Before != "" {
+		end = "(" + f.Before
+	}
+	return start, end
+}
+
+func (f AuditFilter) matches(id string) bool {
+	millis, seq, _ := parseAuditId(id)
+	if !f.Since.IsZero() && millis < f.Since.UnixMilli() {
+		return false
+	}
+	if !f.Until.IsZero() && millis > f.Until.UnixMilli() {
+		return false
+	}
+	if f.Before != "" {
+		beforeMillis, beforeSeq, _ := parseAuditId(f.Before)
+		return millis < beforeMillis || millis == beforeMillis && seq < beforeSeq
+	}
+	return true
+}
+
+// IsAuditId is true for IDs of the form assigned to audit events,
+// <unix milliseconds>-<sequence number>.
+func IsAuditId(id string) bool {
+	_, _, ok := parseAuditId(id)
+	return ok
+}
+
+func parseAuditId(id string) (int64, int64, bool) {
+	millisPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	millis, err := strconv.ParseInt(millisPart, 10, 64)
+	if err != nil || millis < 0 {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseInt(seqPart, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, 0, false
+	}
+	return millis, seq, true
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size bounded cache where entries also expire after a fixed TTL.
+// It is safe for concurrent use.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Most recently used at the front
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLruCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+		now:     time.Now,
+	}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	elem, found := c.entries[key]
+	if !found {
+		return zero, false
+	}
+	entry := elem.Value.(*lruEntry[V])
+	if c.now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) put(key string, value V) {
+	c.putUntil(key, value, time.Time{})
+}
+
+// putUntil is like put, but the entry expires at until if that is before
+// the TTL. A zero until is ignored.
+func (c *lruCache[V]) putUntil(key string, value V, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if !until.IsZero() && until.Before(expires) {
+		expires = until
+	}
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+func (c *lruCache[V]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *lruCache[V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
@@ -0,0 +1,466 @@
+package store
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+const MEMORY_URL = "memory://"
+
+// MemoryStore keeps everything in process memory. It behaves like the
+// ValkeyStore for a single instance, and is meant for demos and tests
+// where no Valkey is available. Nothing is shared between replicas
+// and nothing survives a restart.
+type MemoryStore struct {
+	mu            sync.Mutex
+	entries       map[string]memoryEntry
+	timeIndex     map[string]time.Time
+	blacklist     map[string]time.Time
+	blacklisted   map[string]structure.BlacklistEntry
+	rules         map[string]structure.BlacklistRule
+	packagingJobs map[string][]structure.PackagingQueueMessage
+	locks         map[string]memoryLock
+	history       map[string][]structure.StatusChange
+	failures      map[string]sourceFailures
+	audit         []structure.AuditEvent
+	auditSeq      int64
+	now           func() time.Time
+}
+
+type memoryEntry struct {
+	value   structure.TranscodeInfo
+	expires time.Time // Zero if the entry does not expire
+}
+
+type sourceFailures struct {
+	count   int64
+	reason  string
+	expires time.Time
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:       make(map[string]memoryEntry),
+		timeIndex:     make(map[string]time.Time),
+		blacklist:     make(map[string]time.Time),
+		blacklisted:   make(map[string]structure.BlacklistEntry),
+		rules:         make(map[string]structure.BlacklistRule),
+		packagingJobs: make(map[string][]structure.PackagingQueueMessage),
+		locks:         make(map[string]memoryLock),
+		history:       make(map[string][]structure.StatusChange),
+		failures:      make(map[string]sourceFailures),
+		now:           time.Now,
+	}
+}
+
+// Returns the entry if it exists and has not expired. Must hold the lock.
+func (ms *MemoryStore) get(key string) (structure.TranscodeInfo, bool) {
+	entry, found := ms.entries[key]
+	if !found {
+		return structure.TranscodeInfo{}, false
+	}
+	if !entry.expires.IsZero() && !ms.now().Before(entry.expires) {
+		// Like in Valkey, the time index keeps the key until it is deleted
+		delete(ms.entries, key)
+		return structure.TranscodeInfo{}, false
+	}
+	return entry.value, true
+}
+
+func (ms *MemoryStore) set(key string, value structure.TranscodeInfo, ttl ...int64) {
+	if previous, found := ms.get(key); !found || previous.Status != value.Status {
+		history := append(ms.history[key], structure.StatusChangeFromInfo(value))
+		ms.history[key] = history[max(0, len(history)-HISTORY_MAX_LENGTH):]
+	}
+	entry := memoryEntry{value: value}
+	if len(ttl) > 0 {
+		entry.expires = ms.now().Add(time.Duration(ttl[0]) * time.Second)
+	}
+	ms.entries[key] = entry
+	ms.timeIndex[key] = ms.now()
+}
+
+func (ms *MemoryStore) Get(key string) (structure.TranscodeInfo, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	value, found := ms.get(key)
+	return value, found, nil
+}
+
+func (ms *MemoryStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	results := make(map[string]structure.TranscodeInfo, len(keys))
+	for _, key := range keys {
+		if value, found := ms.get(key); found {
+			results[key] = value
+		}
+	}
+	return results, nil
+}
+
+func (ms *MemoryStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if previous, found := ms.get(key); found && !previous.Status.CanTransitionTo(value.Status) {
+		return &structure.IllegalTransitionError{From: previous.Status, To: value.Status}
+	}
+	ms.set(key, value, ttl...)
+	return nil
+}
+
+func (ms *MemoryStore) Claim(key string, value structure.TranscodeInfo, ttl int64) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, found := ms.get(key); found {
+		return false, nil
+	}
+	ms.set(key, value, ttl)
+	return true, nil
+}
+
+func (ms *MemoryStore) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, key)
+	delete(ms.timeIndex, key)
+	return nil
+}
+
+func (ms *MemoryStore) History(key string) ([]structure.StatusChange, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return slices.Clone(ms.history[key]), nil
+}
+
+func (ms *MemoryStore) Ttl(key string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, found := ms.get(key); !found {
+		return 0, errors.New("key does not exist")
+	}
+	expires := ms.entries[key].expires
+	if expires.IsZero() {
+		return -1, nil
+	}
+	return int64(math.Ceil(expires.Sub(ms.now()).Seconds())), nil
+}
+
+func (ms *MemoryStore) EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.packagingJobs[queueName] = append(ms.packagingJobs[queueName], packagingJob)
+	return nil
+}
+
+func (ms *MemoryStore) BlackList(entry structure.BlacklistEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.blacklist[entry.MediaUrl] = ms.now()
+	ms.blacklisted[entry.MediaUrl] = entry
+	return nil
+}
+
+func (ms *MemoryStore) BlackListMany(entries []structure.BlacklistEntry) []error {
+	errs := make([]error, len(entries))
+	for idx, entry := range entries {
+		errs[idx] = ms.BlackList(entry)
+	}
+	return errs
+}
+
+// Must hold the lock.
+func (ms *MemoryStore) inBlackList(value string) bool {
+	_, found := ms.blacklist[value]
+	return found && !ms.blacklisted[value].Expired(ms.now())
+}
+
+func (ms *MemoryStore) InBlackList(value string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.inBlackList(value), nil
+}
+
+func (ms *MemoryStore) InBlackListMany(values []string) (map[string]bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	results := make(map[string]bool, len(values))
+	for _, value := range values {
+		results[value] = ms.inBlackList(value)
+	}
+	return results, nil
+}
+
+func (ms *MemoryStore) RemoveFromBlackList(value string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.blacklist, value)
+	delete(ms.blacklisted, value)
+	return nil
+}
+
+func (ms *MemoryStore) RemoveFromBlackListMany(values []string) []error {
+	errs := make([]error, len(values))
+	for idx, value := range values {
+		errs[idx] = ms.RemoveFromBlackList(value)
+	}
+	return errs
+}
+
+func (ms *MemoryStore) GetBlackListEntries(values []string) (map[string]structure.BlacklistEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries := make(map[string]structure.BlacklistEntry, len(values))
+	for _, value := range values {
+		if entry, found := ms.blacklisted[value]; found {
+			entries[value] = entry
+		}
+	}
+	return entries, nil
+}
+
+func (ms *MemoryStore) PruneBlackList() ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	pruned := make([]string, 0)
+	for value, entry := range ms.blacklisted {
+		if entry.Expired(ms.now()) {
+			delete(ms.blacklist, value)
+			delete(ms.blacklisted, value)
+			pruned = append(pruned, value)
+		}
+	}
+	slices.Sort(pruned)
+	return pruned, nil
+}
+
+func (ms *MemoryStore) AddBlackListRule(rule structure.BlacklistRule) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.rules[rule.Id()] = rule
+	return nil
+}
+
+func (ms *MemoryStore) RemoveBlackListRule(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.rules, id)
+	return nil
+}
+
+func (ms *MemoryStore) GetBlackListRules() ([]structure.BlacklistRule, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rules := make([]structure.BlacklistRule, 0, len(ms.rules))
+	for _, rule := range ms.rules {
+		rules = append(rules, rule)
+	}
+	slices.SortFunc(rules, func(a, b structure.BlacklistRule) int {
+		return cmp.Compare(a.Id(), b.Id())
+	})
+	return rules, nil
+}
+
+func (ms *MemoryStore) AppendAudit(event structure.AuditEvent, maxLength int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	event.Timestamp = ms.now().UnixMilli()
+	// IDs like the ones of a Valkey stream
+	if len(ms.audit) > 0 && ms.audit[len(ms.audit)-1].Timestamp == event.Timestamp {
+		ms.auditSeq++
+	} else {
+		ms.auditSeq = 0
+	}
+	event.Id = strconv.FormatInt(event.Timestamp, 10) + "-" + strconv.FormatInt(ms.auditSeq, 10)
+	ms.audit = append(ms.audit, event)
+	if overflow := int64(len(ms.audit)) - maxLength; overflow > 0 {
+		ms.audit = slices.Clone(ms.audit[overflow:])
+	}
+	return nil
+}
+
+func (ms *MemoryStore) AppendAuditMany(events []structure.AuditEvent, maxLength int64) error {
+	for _, event := range events {
+		_ = ms.AppendAudit(event, maxLength)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ListAudit(filter AuditFilter, size int) ([]structure.AuditEvent, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	events := make([]structure.AuditEvent, 0, size)
+	for idx := len(ms.audit) - 1; idx >= 0 && len(events) < size; idx-- {
+		if filter.matches(ms.audit[idx].Id) {
+			events = append(events, ms.audit[idx])
+		}
+	}
+	return events, nil
+}
+
+func (ms *MemoryStore) RecordSourceFailure(source string, reason string, window int64) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	failures := ms.failures[source]
+	if !ms.now().Before(failures.expires) {
+		failures = sourceFailures{expires: ms.now().Add(time.Duration(window) * time.Second)}
+	}
+	failures.count++
+	failures.reason = reason
+	ms.failures[source] = failures
+	return failures.count, nil
+}
+
+func (ms *MemoryStore) ClearSourceFailures(source string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.failures, source)
+	return nil
+}
+
+func (ms *MemoryStore) GetBlackList(page int, size int) ([]string, int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	values := newestFirst(ms.blacklist)
+	return paginate(values, page, size), int64(len(values)), nil
+}
+
+func (ms *MemoryStore) GetBlackListPage(cursor *Cursor, size int) (Page[string], error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	values := newestFirst(ms.blacklist)
+	entries := make([]scoredMember, 0, len(values))
+	for _, value := range values {
+		entries = append(entries, scoredMember{score: float64(ms.blacklist[value].UnixMilli()), member: value})
+	}
+	return pageSorted(values, entries, cursor, size), nil
+}
+
+func (ms *MemoryStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := newestFirst(ms.timeIndex)
+	results := make([]structure.TranscodeInfo, 0, size)
+	for _, key := range paginate(keys, page, size) {
+		if value, found := ms.get(key); found {
+			results = append(results, value)
+		}
+	}
+	return results, int64(len(keys)), nil
+}
+
+func (ms *MemoryStore) ListFiltered(filter JobFilter, page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	matching, _ := ms.filter(filter)
+	return paginate(matching, page, size), int64(len(matching)), nil
+}
+
+func (ms *MemoryStore) ListPage(filter JobFilter, cursor *Cursor, size int) (Page[structure.TranscodeInfo], error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	matching, entries := ms.filter(filter)
+	return pageSorted(matching, entries, cursor, size), nil
+}
+
+// Returns the jobs matching the filter, newest first, along with their
+// positions in the time index. Must hold the lock.
+func (ms *MemoryStore) filter(filter JobFilter) ([]structure.TranscodeInfo, []scoredMember) {
+	minScore, maxScore := filter.scoreRange()
+	matching := make([]structure.TranscodeInfo, 0)
+	entries := make([]scoredMember, 0)
+	for _, key := range newestFirst(ms.timeIndex) {
+		score := float64(ms.timeIndex[key].UnixMilli())
+		if score < minScore || score > maxScore {
+			continue
+		}
+		if value, found := ms.get(key); found && filter.matches(key, value) {
+			matching = append(matching, value)
+			entries = append(entries, scoredMember{score: score, member: key})
+		}
+	}
+	return matching, entries
+}
+
+func (ms *MemoryStore) ListStale(olderThan time.Time, offset int64, count int64) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stale := make([]string, 0)
+	for key, updated := range ms.timeIndex {
+		if updated.Before(olderThan) {
+			stale = append(stale, key)
+		}
+	}
+	slices.SortFunc(stale, func(a, b string) int {
+		return cmp.Or(ms.timeIndex[a].Compare(ms.timeIndex[b]), cmp.Compare(a, b))
+	})
+	if offset >= int64(len(stale)) {
+		return []string{}, nil
+	}
+	return stale[offset:min(offset+count, int64(len(stale)))], nil
+}
+
+func (ms *MemoryStore) DeleteIfStale(key string, olderThan time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	updated, found := ms.timeIndex[key]
+	if !found || !updated.Before(olderThan) {
+		return false, nil
+	}
+	delete(ms.entries, key)
+	delete(ms.timeIndex, key)
+	return true, nil
+}
+
+func (ms *MemoryStore) TryLock(name string, owner string, ttl int64) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if lock, found := ms.locks[name]; found && ms.now().Before(lock.expires) {
+		return false, nil
+	}
+	ms.locks[name] = memoryLock{owner: owner, expires: ms.now().Add(time.Duration(ttl) * time.Second)}
+	return true, nil
+}
+
+func (ms *MemoryStore) RenewLock(name string, owner string, ttl int64) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if lock, found := ms.locks[name]; found && lock.owner != owner && ms.now().Before(lock.expires) {
+		return false, nil
+	}
+	ms.locks[name] = memoryLock{owner: owner, expires: ms.now().Add(time.Duration(ttl) * time.Second)}
+	return true, nil
+}
+
+// Returns the keys sorted by their timestamps, most recent first. Like in
+// Valkey, timestamps are compared in milliseconds with ties broken by key.
+func newestFirst(timestamps map[string]time.Time) []string {
+	keys := make([]string, 0, len(timestamps))
+	for key := range timestamps {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(timestamps[b].UnixMilli(), timestamps[a].UnixMilli()), cmp.Compare(b, a))
+	})
+	return keys
+}
+
+func paginate[T any](values []T, page int, size int) []T {
+	start := page * size
+	if start < 0 || size <= 0 || start >= len(values) {
+		return []T{}
+	}
+	return values[start:min(start+size, len(values))]
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func newTestMemoryStore() (*MemoryStore, *time.Time) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	return store, &now
+}
+
+func TestMemoryStore(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	testData := structure.TranscodeInfo{
+		Url:    "http://example.com/video/index.m3u8",
+		Status: "COMPLETED",
+	}
+	is.NoErr(store.Set("test-key", testData))
+	is.NoErr(store.Set("expiring-key", testData, 10))
+	retrieved, found, err := store.Get("test-key")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(retrieved.Url, testData.Url)
+
+	claimed, err := store.Claim("test-key", structure.TranscodeInfo{Status: "QUEUED"}, 10)
+	is.NoErr(err)
+	is.True(!claimed)
+
+	*now = now.Add(11 * time.Second)
+	results, err := store.GetMany([]string{"test-key", "expiring-key"})
+	is.NoErr(err)
+	is.Equal(len(results), 1)
+	claimed, err = store.Claim("expiring-key", structure.TranscodeInfo{Status: "QUEUED"}, 10)
+	is.NoErr(err)
+	is.True(claimed)
+
+	is.NoErr(store.Delete("test-key"))
+	_, found, err = store.Get("test-key")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestMemoryStoreList(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	for i := range 10 {
+		*now = now.Add(time.Second)
+		is.NoErr(store.Set(strconv.Itoa(i), structure.TranscodeInfo{Url: strconv.Itoa(i)}))
+	}
+	values, total, err := store.List(1, 3)
+	is.NoErr(err)
+	is.Equal(total, int64(10))
+	is.Equal(len(values), 3)
+	is.Equal(values[0].Url, "6") // Newest first
+	is.Equal(values[2].Url, "4")
+
+	values, _, err = store.List(4, 3)
+	is.NoErr(err)
+	is.Equal(len(values), 0)
+
+	stale, err := store.ListStale(now.Add(-5*time.Second), 0, 100)
+	is.NoErr(err)
+	is.Equal(stale, []string{"0", "1", "2", "3"}) // Oldest first
+	deleted, err := store.DeleteIfStale("0", now.Add(-5*time.Second))
+	is.NoErr(err)
+	is.True(deleted)
+	deleted, err = store.DeleteIfStale("9", now.Add(-5*time.Second))
+	is.NoErr(err)
+	is.True(!deleted)
+}
+
+func TestMemoryStoreBlackList(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	for _, url := range []string{"a", "b", "c"} {
+		*now = now.Add(time.Second)
+		is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: url}))
+	}
+	inBlackList, err := store.InBlackList("b")
+	is.NoErr(err)
+	is.True(inBlackList)
+	results, err := store.InBlackListMany([]string{"a", "d"})
+	is.NoErr(err)
+	is.True(results["a"])
+	is.True(!results["d"])
+
+	values, total, err := store.GetBlackList(0, 2)
+	is.NoErr(err)
+	is.Equal(total, int64(3))
+	is.Equal(values, []string{"c", "b"})
+
+	is.NoErr(store.RemoveFromBlackList("b"))
+	inBlackList, err = store.InBlackList("b")
+	is.NoErr(err)
+	is.True(!inBlackList)
+}
+
+func TestMemoryStoreBlackListExpiry(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	is.NoErr(store.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "a",
+		Reason:    "corrupt source",
+		Actor:     "ops",
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}))
+	is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "b"}))
+
+	entries, err := store.GetBlackListEntries([]string{"a", "c"})
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries["a"].Reason, "corrupt source")
+	pruned, err := store.PruneBlackList()
+	is.NoErr(err)
+	is.Equal(len(pruned), 0)
+
+	*now = now.Add(2 * time.Minute)
+	inBlackList, err := store.InBlackList("a")
+	is.NoErr(err)
+	is.True(!inBlackList)
+	pruned, err = store.PruneBlackList()
+	is.NoErr(err)
+	is.Equal(pruned, []string{"a"})
+	_, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(1))
+}
+
+func TestMemoryStoreBlackListRules(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore()
+	hostRule := structure.BlacklistRule{Type: structure.RuleHost, Pattern: "bad-cdn.example.com"}
+	globRule := structure.BlacklistRule{Type: structure.RuleGlob, Pattern: "*.mov"}
+	is.NoErr(store.AddBlackListRule(hostRule))
+	is.NoErr(store.AddBlackListRule(globRule))
+	rules, err := store.GetBlackListRules()
+	is.NoErr(err)
+	is.Equal(rules, []structure.BlacklistRule{globRule, hostRule})
+
+	is.NoErr(store.RemoveBlackListRule(globRule.Id()))
+	rules, err = store.GetBlackListRules()
+	is.NoErr(err)
+	is.Equal(rules, []structure.BlacklistRule{hostRule})
+}
+
+func TestMemoryStoreAuditLog(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	for _, target := range []string{"a", "b", "c", "d"} {
+		is.NoErr(store.AppendAudit(structure.AuditEvent{Actor: "ops", Action: "blacklist.add", Target: target}, 3))
+		if target == "b" {
+			*now = now.Add(time.Minute)
+		}
+	}
+	events, err := store.ListAudit(AuditFilter{}, 10)
+	is.NoErr(err)
+	is.Equal(len(events), 3) // Capped
+	is.Equal(events[0].Target, "d")
+	is.Equal(events[1].Id, strconv.FormatInt(now.UnixMilli(), 10)+"-0")
+	is.Equal(events[0].Id, strconv.FormatInt(now.UnixMilli(), 10)+"-1")
+
+	events, err = store.ListAudit(AuditFilter{Until: now.Add(-time.Second)}, 10)
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.Equal(events[0].Target, "b")
+	events, err = store.ListAudit(AuditFilter{Before: events[0].Id}, 10)
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+	events, err = store.ListAudit(AuditFilter{Since: *now}, 1)
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.Equal(events[0].Target, "d")
+}
+
+func TestMemoryStoreLocksAndQueue(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	locked, err := store.TryLock("lock", "instance-a", 10)
+	is.NoErr(err)
+	is.True(locked)
+	locked, err = store.TryLock("lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(!locked)
+	*now = now.Add(11 * time.Second)
+	locked, err = store.TryLock("lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(locked)
+	locked, err = store.RenewLock("lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(locked)
+	locked, err = store.RenewLock("lock", "instance-a", 10)
+	is.NoErr(err)
+	is.True(!locked)
+
+	is.NoErr(store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job-id"}))
+	is.Equal(len(store.packagingJobs["package"]), 1)
+}
+
+func TestMemoryStoreListFiltered(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	start := *now
+	for i, status := range []structure.JobStatus{"QUEUED", "FAILED", "FAILED", "COMPLETED"} {
+		*now = now.Add(time.Second)
+		is.NoErr(store.Set("ad"+strconv.Itoa(i), structure.TranscodeInfo{
+			Status: status,
+			Source: "https://example.com/" + strconv.Itoa(i) + ".mp4",
+		}))
+	}
+	values, total, err := store.ListFiltered(JobFilter{Status: "FAILED"}, 0, 1)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(values[0].Source, "https://example.com/2.mp4")
+
+	values, total, err = store.ListFiltered(JobFilter{Until: start.Add(2 * time.Second), Source: "example.com"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(values[1].Source, "https://example.com/0.mp4")
+}
+
+func TestMemoryStoreCursorPages(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore()
+	// All entries share a timestamp, so they are ordered by key
+	for i := range 5 {
+		is.NoErr(store.Set("job"+strconv.Itoa(i), structure.TranscodeInfo{Url: strconv.Itoa(i)}))
+		is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "url" + strconv.Itoa(i)}))
+	}
+	first, err := store.ListPage(JobFilter{}, nil, 2)
+	is.NoErr(err)
+	is.Equal(len(first.Items), 2)
+	is.Equal(first.Items[0].Url, "4")
+	second, err := store.ListPage(JobFilter{}, first.Next, 2)
+	is.NoErr(err)
+	is.Equal(second.Items[0].Url, "2")
+	is.Equal(second.Keys, []string{"job2", "job1"})
+	back, err := store.ListPage(JobFilter{}, second.Prev, 2)
+	is.NoErr(err)
+	is.Equal(back.Items, first.Items)
+	is.True(back.Prev == nil)
+
+	blacklist, err := store.GetBlackListPage(nil, 10)
+	is.NoErr(err)
+	is.Equal(blacklist.Items, []string{"url4", "url3", "url2", "url1", "url0"})
+	is.True(blacklist.Next == nil)
+}
+
+func TestMemoryStoreSourceFailures(t *testing.T) {
+	is := is.New(t)
+	store, now := newTestMemoryStore()
+	source := "http://example.com/broken.mp4"
+	for expected := range int64(3) {
+		count, err := store.RecordSourceFailure(source, "no audio", 60)
+		is.NoErr(err)
+		is.Equal(count, expected+1)
+	}
+	*now = now.Add(40 * time.Second)
+	count, _ := store.RecordSourceFailure(source, "no audio", 60)
+	is.Equal(count, int64(4))
+	// The window started at the first failure
+	*now = now.Add(21 * time.Second)
+	count, _ = store.RecordSourceFailure(source, "no audio", 60)
+	is.Equal(count, int64(1))
+	is.NoErr(store.ClearSourceFailures(source))
+	count, _ = store.RecordSourceFailure(source, "no audio", 60)
+	is.Equal(count, int64(1))
+}
+
+func TestMemoryStoreStatusTransitions(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore()
+	claimed, err := store.Claim("ad", structure.TranscodeInfo{Status: structure.StatusQueued}, 10)
+	is.NoErr(err)
+	is.True(claimed)
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 10}))
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 50}))
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusCompleted}))
+
+	var transitionErr *structure.IllegalTransitionError
+	err = store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 90})
+	is.True(errors.As(err, &transitionErr))
+	is.Equal(transitionErr.From, structure.StatusCompleted)
+	value, _, _ := store.Get("ad")
+	is.Equal(value.Status, structure.StatusCompleted)
+
+	// The history survives the job, and keeps growing when it is dispatched again
+	is.NoErr(store.Delete("ad"))
+	_, err = store.Claim("ad", structure.TranscodeInfo{Status: structure.StatusQueued}, 10)
+	is.NoErr(err)
+	history, err := store.History("ad")
+	is.NoErr(err)
+	statuses := []structure.JobStatus{}
+	for _, change := range history {
+		statuses = append(statuses, change.Status)
+	}
+	is.Equal(statuses, []structure.JobStatus{
+		structure.StatusQueued,
+		structure.StatusInProgress,
+		structure.StatusCompleted,
+		structure.StatusQueued,
+	})
+}
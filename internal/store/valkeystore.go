@@ -1,11 +1,15 @@
 package store
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
@@ -14,52 +18,328 @@ import (
 )
 
 const BLACKLIST_KEY = "blacklist"
+
+// Details of the blacklist entries, keyed by URL, and the expiry of the
+// entries that expire, as unix timestamps.
+const BLACKLIST_ENTRIES_KEY = "blacklist_entries"
+const BLACKLIST_EXPIRY_KEY = "blacklist_expiry"
+
+// Blacklist rules, keyed by rule id
+const BLACKLIST_RULES_KEY = "blacklist_rules"
+
+// Capped stream of audit events
+const AUDIT_LOG_KEY = "audit_log"
+
+// The number of entries sent in each pipeline by the bulk blacklist and
+// audit methods
+const BLACKLIST_BATCH_SIZE = 500
+
 const TIME_INDEX_KEY = "job_time_index"
 
+// All creative IDs with the same score, so that they are ordered
+// lexicographically and can be looked up by prefix
+const KEY_INDEX_KEY = "job_key_index"
+const HISTORY_KEY_PREFIX = "job_history:"
+const SOURCE_FAILURES_KEY_PREFIX = "source_failures:"
+
+// The number of status changes kept for each creative, and how long the
+// history is kept after the last change.
+const HISTORY_MAX_LENGTH = 100
+const HISTORY_TTL = 30 * 24 * time.Hour
+
+// Number of candidates read at a time when filtering jobs
+const filterBatchSize = 500
+
+// The source filter is matched against the job data, so at most this
+// many candidates are read for a single listing
+var filterScanLimit int64 = 10000
+
+// In cluster mode, the job indexes and the blacklist share this hash tag so
+// that they end up in the same slot, which the scripts updating several of
+// them at once rely on. Jobs and their history are tagged with the creative
+// ID instead, which spreads them over the cluster, and the remaining keys
+// are left untagged.
+const CLUSTER_HASH_TAG = "{ad-normalizer}:"
+
 type Store interface {
 	Get(key string) (structure.TranscodeInfo, bool, error)
+	GetMany(keys []string) (map[string]structure.TranscodeInfo, error)
 	Set(key string, value structure.TranscodeInfo, ttl ...int64) error
+	Claim(key string, value structure.TranscodeInfo, ttl int64) (bool, error)
 	Delete(key string) error
+	// Seconds until the key expires, or -1 if it does not expire
+	Ttl(key string) (int64, error)
 	EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error
-	BlackList(value string) error
+	BlackList(entry structure.BlacklistEntry) error
+	// Expired entries are not in the blacklist, even before they are pruned
 	InBlackList(value string) (bool, error)
+	InBlackListMany(values []string) (map[string]bool, error)
 	RemoveFromBlackList(value string) error
+	// Bulk versions of BlackList and RemoveFromBlackList. The returned
+	// errors line up with the input, and are nil where it succeeded.
+	BlackListMany(entries []structure.BlacklistEntry) []error
+	RemoveFromBlackListMany(values []string) []error
+	// Details of the given blacklisted URLs. URLs blacklisted without
+	// details are left out.
+	GetBlackListEntries(values []string) (map[string]structure.BlacklistEntry, error)
+	// Removes the expired entries from the blacklist, and returns their URLs
+	PruneBlackList() ([]string, error)
 	GetBlackList(page int, size int) ([]string, int64, error)
+	// Rules blacklisting every URL or creative matching a pattern. Adding
+	// a rule with the same id as an existing one replaces it.
+	AddBlackListRule(rule structure.BlacklistRule) error
+	RemoveBlackListRule(id string) error
+	GetBlackListRules() ([]structure.BlacklistRule, error)
 	List(page int, size int) ([]structure.TranscodeInfo, int64, error)
+	ListFiltered(filter JobFilter, page int, size int) ([]structure.TranscodeInfo, int64, error)
+	// Cursor based alternatives to List and GetBlackList. A nil cursor starts
+	// from the newest entry.
+	ListPage(filter JobFilter, cursor *Cursor, size int) (Page[structure.TranscodeInfo], error)
+	GetBlackListPage(cursor *Cursor, size int) (Page[string], error)
+	// Counts a failed job for the source along with the reason it failed,
+	// and returns the number of failures counted. The count is forgotten
+	// window seconds after the first failure.
+	RecordSourceFailure(source string, reason string, window int64) (int64, error)
+	ClearSourceFailures(source string) error
+	// Appends an event to the audit log, keeping roughly the last maxLength
+	// events. The event's ID and timestamp are assigned by the store.
+	AppendAudit(event structure.AuditEvent, maxLength int64) error
+	// Appends several events at once, in order
+	AppendAuditMany(events []structure.AuditEvent, maxLength int64) error
+	// Audit events matching the filter, newest first
+	ListAudit(filter AuditFilter, size int) ([]structure.AuditEvent, error)
+	ListStale(olderThan time.Time, offset int64, count int64) ([]string, error)
+	DeleteIfStale(key string, olderThan time.Time) (bool, error)
+	TryLock(name string, owner string, ttl int64) (bool, error)
+	// Like TryLock, but also succeeds and extends the lock if the owner
+	// already holds it. Used to elect a leader among the replicas.
+	RenewLock(name string, owner string, ttl int64) (bool, error)
+	// Status changes of the creative, oldest first. The history outlives
+	// the job, so that it covers earlier attempts at the same creative.
+	History(key string) ([]structure.StatusChange, error)
 }
 
+// Removes a job from the indexes only if it has not been updated since the
+// cutoff. KEYS[1] is the time index and the rest are the other indexes.
+// ARGV[1] is the job's member in the indexes and ARGV[2] the cutoff.
+var unindexIfStaleScript = valkey.NewLuaScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) < tonumber(ARGV[2]) then
+	for i = 1, #KEYS do
+		redis.call('ZREM', KEYS[i], ARGV[1])
+	end
+	return 1
+end
+return 0
+`)
+
+// Deletes a job only if it still has the value it was read with.
+// KEYS[1] is the job and ARGV[1] the value.
+var deleteIfUnchangedScript = valkey.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Removes the expired entries from the blacklist. Runs as a script so
+// that an entry renewed in between is not removed.
+// KEYS[1] is the blacklist, KEYS[2] the entries and KEYS[3] the expiry
+// index. ARGV[1] is the current time. Returns the removed URLs.
+var pruneBlackListScript = valkey.NewLuaScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+for _, member in ipairs(expired) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('HDEL', KEYS[2], member)
+	redis.call('ZREM', KEYS[3], member)
+end
+return expired
+`)
+
+// Stores the job unless it would make an illegal status transition, and
+// records the change in the job's history if the status changed.
+// KEYS[1] is the job and KEYS[2] its history. ARGV[1] is the job, ARGV[2]
+// its TTL in seconds or 0 for no expiry, ARGV[3] its status and ARGV[4] the
+// history entry. ARGV[5] and ARGV[6] are the length and TTL of the history,
+// and the rest are the statuses the job may not move from.
+// Returns whether the job was stored, and the status it had before.
+var setStatusScript = valkey.NewLuaScript(`
+local previous = ''
+local current = redis.call('GET', KEYS[1])
+if current then
+	local ok, decoded = pcall(cjson.decode, current)
+	if ok and type(decoded) == 'table' and type(decoded['status']) == 'string' then
+		previous = decoded['status']
+	end
+	for i = 7, #ARGV do
+		if ARGV[i] == previous then
+			return {0, previous}
+		end
+	end
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+if previous ~= ARGV[3] then
+	redis.call('RPUSH', KEYS[2], ARGV[4])
+	redis.call('LTRIM', KEYS[2], -tonumber(ARGV[5]), -1)
+	redis.call('EXPIRE', KEYS[2], ARGV[6])
+end
+return {1, previous}
+`)
+
+// Takes the lock if it is free, or extends it if the owner already holds it.
+// KEYS[1] is the lock, ARGV[1] the owner and ARGV[2] the TTL in seconds.
+var renewLockScript = valkey.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
 type ValkeyStore struct {
-	client valkey.Client
+	client  valkey.Client
+	hashTag string
 }
 
-func NewValkeyStore(valkeyUrl string) (*ValkeyStore, error) {
-	logger.Debug("Connecting to Valkey", slog.String("valkeyUrl", valkeyUrl))
-	options := valkey.MustParseURL(valkeyUrl)
+// NewValkeyStore connects to a single Valkey node, or to a cluster if
+// cluster is true. Additional cluster nodes can be given with the addr
+// query parameter, e.g. redis://node1:6379?addr=node2:6379
+func NewValkeyStore(valkeyUrl string, cluster bool) (*ValkeyStore, error) {
+	logger.Debug("Connecting to Valkey",
+		slog.String("valkeyUrl", valkeyUrl),
+		slog.Bool("cluster", cluster),
+	)
+	options, err := valkey.ParseURL(valkeyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Valkey URL: %w", err)
+	}
 	options.SendToReplicas = func(cmd valkey.Completed) bool {
 		return false // No read from replicas
 	}
 	options.DisableCache = true
+	// Without this the client guesses the mode from the server, which would
+	// silently drop the hash tags when talking to a cluster by mistake
+	options.ForceSingleClient = !cluster
+	options.ShuffleInit = cluster
 	client, err := valkey.NewClient(options)
 	if err != nil {
 		logger.Error("Failed to create Valkey client", slog.String("error", err.Error()))
 		return nil, err
 	}
-	return &ValkeyStore{
+	vs := &ValkeyStore{
 		client: client,
-	}, nil
+	}
+	if cluster {
+		vs.hashTag = CLUSTER_HASH_TAG
+	}
+	return vs, nil
+}
+
+// Returns the name an index or blacklist key is stored under in Valkey.
+func (vs *ValkeyStore) key(name string) string {
+	return vs.hashTag + name
+}
+
+// Returns the name the job is stored under in Valkey. In cluster mode the
+// creative ID is the hash tag, so that the job and its history share a slot.
+func (vs *ValkeyStore) jobKey(key string) string {
+	if vs.hashTag == "" {
+		return key
+	}
+	return "{" + key + "}"
+}
+
+func (vs *ValkeyStore) historyKey(key string) string {
+	return HISTORY_KEY_PREFIX + vs.jobKey(key)
+}
+
+// Fails if the store holds jobs indexed under the names of the other mode,
+// e.g. after REDIS_CLUSTER has been toggled. The keys are not migrated, so
+// the jobs would otherwise silently be missing.
+func (vs *ValkeyStore) CheckKeyLayout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	other := CLUSTER_HASH_TAG + TIME_INDEX_KEY
+	if vs.hashTag != "" {
+		other = TIME_INDEX_KEY
+	}
+	exists, err := vs.client.Do(ctx, vs.client.B().Exists().Key(other).Build()).AsInt64()
+	if err != nil {
+		return fmt.Errorf("failed to check key layout: %w", err)
+	}
+	if exists > 0 {
+		return fmt.Errorf("found jobs stored with REDIS_CLUSTER=%t, keys are not migrated when it is changed", vs.hashTag == "")
+	}
+	return nil
+}
+
+// Fetches the given keys, grouping them by slot when talking to a cluster.
+// The result is keyed by the names passed in, not the stored names.
+func (vs *ValkeyStore) mget(ctx context.Context, keys []string) (map[string]valkey.ValkeyMessage, error) {
+	storedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		storedKeys = append(storedKeys, vs.jobKey(key))
+	}
+	res, err := valkey.MGet(vs.client, ctx, storedKeys)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]valkey.ValkeyMessage, len(res))
+	for idx, key := range keys {
+		if msg, found := res[storedKeys[idx]]; found {
+			results[key] = msg
+		}
+	}
+	return results, nil
+}
+
+// Returns a page of a sorted set, highest score first, along with its size.
+// Both are read in the same round trip.
+func (vs *ValkeyStore) pageSortedSet(ctx context.Context, key string, page int, size int) ([]string, int64, error) {
+	start := int64(page * size)
+	end := int64(start + int64(size) - 1)
+	res := vs.client.DoMulti(
+		ctx,
+		vs.client.B().
+			Zrevrange().
+			Key(vs.key(key)).
+			Start(start).
+			Stop(end).
+			Build(),
+		vs.client.B().
+			Zcard().
+			Key(vs.key(key)).
+			Build(),
+	)
+	values, err := res[0].AsStrSlice()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get values from %s: %w", key, err)
+	}
+	cardinality, err := res[1].AsInt64()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get cardinality of %s: %w", key, err)
+	}
+	return values, cardinality, nil
 }
 
 func (vs *ValkeyStore) Delete(key string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := vs.client.Do(ctx, vs.client.B().Del().Key(key).Build()).Error()
+	err := vs.client.Do(ctx, vs.client.B().Del().Key(vs.jobKey(key)).Build()).Error()
 	if err != nil {
 		return fmt.Errorf("failed to delete key %s: %w", key, err)
 	}
-	err = deleteFromTimeIndex(vs, key)
+	err = vs.deleteFromIndexes(key)
 	if err != nil {
-		return fmt.Errorf("failed to delete key %s from time index: %w", key, err)
+		return fmt.Errorf("failed to delete key %s from indexes: %w", key, err)
 	}
 	return nil
 }
@@ -68,7 +348,7 @@ func (vs *ValkeyStore) Get(key string) (structure.TranscodeInfo, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	value := structure.TranscodeInfo{}
-	result, err := vs.client.Do(ctx, vs.client.B().Get().Key(key).Build()).AsBytes()
+	result, err := vs.client.Do(ctx, vs.client.B().Get().Key(vs.jobKey(key)).Build()).AsBytes()
 	if err != nil {
 		if errors.Is(err, valkey.Nil) {
 			return value, false, nil // Key does not exist
@@ -87,6 +367,38 @@ func (vs *ValkeyStore) Get(key string) (structure.TranscodeInfo, bool, error) {
 	return value, true, nil
 }
 
+// GetMany fetches several jobs in a single round trip.
+// Keys that do not exist are left out of the result.
+func (vs *ValkeyStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	results := make(map[string]structure.TranscodeInfo, len(keys))
+	if len(keys) == 0 {
+		return results, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	mGetRes, err := vs.mget(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %d keys: %w", len(keys), err)
+	}
+	for key, data := range mGetRes {
+		if data.IsNil() {
+			continue // Key does not exist
+		}
+		bytesData, err := data.AsBytes()
+		if err != nil || len(bytesData) == 0 {
+			logger.Error("Failed to read value from Valkey", slog.String("key", key))
+			continue
+		}
+		var value structure.TranscodeInfo
+		if err = json.Unmarshal(bytesData, &value); err != nil {
+			logger.Error("Failed to unmarshal value from Valkey", slog.String("key", key))
+			continue
+		}
+		results[key] = value
+	}
+	return results, nil
+}
+
 func (vs *ValkeyStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -95,58 +407,136 @@ func (vs *ValkeyStore) Set(key string, value structure.TranscodeInfo, ttl ...int
 	if err != nil {
 		return fmt.Errorf("failed to marshal value for key %s: %w", key, err)
 	}
+	change, err := json.Marshal(structure.StatusChangeFromInfo(value))
+	if err != nil {
+		return fmt.Errorf("failed to marshal status change for key %s: %w", key, err)
+	}
+	var ttlValue int64 // No expiry
+	if len(ttl) > 0 {
+		ttlValue = ttl[0]
+	}
+	args := []string{
+		string(valueBytes),
+		strconv.FormatInt(ttlValue, 10),
+		string(value.Status),
+		string(change),
+		strconv.Itoa(HISTORY_MAX_LENGTH),
+		strconv.FormatInt(int64(HISTORY_TTL.Seconds()), 10),
+	}
+	for _, status := range structure.JobStatuses {
+		if !status.CanTransitionTo(value.Status) {
+			args = append(args, string(status))
+		}
+	}
+	result, err := setStatusScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.jobKey(key), vs.historyKey(key)},
+		args,
+	).ToArray()
+	if err != nil {
+		return fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	if len(result) != 2 {
+		return fmt.Errorf("failed to set key %s: unexpected script result", key)
+	}
+	if stored, _ := result[0].AsInt64(); stored == 0 {
+		previous, _ := result[1].ToString()
+		return &structure.IllegalTransitionError{From: structure.JobStatus(previous), To: value.Status}
+	}
+	logger.Debug("Set key in Valkey",
+		slog.String("key", key),
+		slog.String("url", value.Url),
+		slog.String("status", string(value.Status)),
+		slog.Int64("ttl", ttlValue),
+	)
+	err = vs.updateIndexes(key, value.Status)
+	if err != nil {
+		return fmt.Errorf("failed to update indexes for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Claim stores the value only if the key does not already exist, with a TTL
+// so that a claim left behind by a crashed instance eventually expires.
+// Returns true if this caller got the claim, which makes it responsible
+// for dispatching the job for the key.
+func (vs *ValkeyStore) Claim(key string, value structure.TranscodeInfo, ttl int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal value for key %s: %w", key, err)
+	}
 	err = vs.client.Do(
 		ctx,
 		vs.client.B().Set().
-			Key(key).
+			Key(vs.jobKey(key)).
 			Value(string(valueBytes)).
+			Nx().
+			ExSeconds(ttl).
 			Build()).
 		Error()
 	if err != nil {
-		return fmt.Errorf("failed to set key %s: %w", key, err)
+		if errors.Is(err, valkey.Nil) {
+			return false, nil // Already claimed
+		}
+		return false, fmt.Errorf("failed to claim key %s: %w", key, err)
 	}
-	if len(ttl) > 0 {
-		ttlValue := ttl[0]
+	err = vs.updateIndexes(key, value.Status)
+	if err != nil {
+		return true, fmt.Errorf("failed to update indexes for key %s: %w", key, err)
+	}
+	err = vs.appendHistory(ctx, key, structure.StatusChangeFromInfo(value))
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
 
-		err = vs.client.Do(
-			ctx,
-			vs.client.B().Expire().
-				Key(key).
-				Seconds(int64(ttlValue)).
-				Build()).
-			Error()
-		if err != nil {
-			return fmt.Errorf("failed to set TTL for key %s: %w", key, err)
-		}
-	} else {
-		// make sure the key does not expire
-		err = vs.client.Do(
-			ctx,
-			vs.client.B().Persist().
-				Key(key).
-				Build()).
-			Error()
-		if err != nil {
-			return fmt.Errorf("failed to persist key %s: %w", key, err)
+func (vs *ValkeyStore) appendHistory(ctx context.Context, key string, change structure.StatusChange) error {
+	changeBytes, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status change for key %s: %w", key, err)
+	}
+	storedKey := vs.historyKey(key)
+	for _, res := range vs.client.DoMulti(
+		ctx,
+		vs.client.B().Rpush().Key(storedKey).Element(string(changeBytes)).Build(),
+		vs.client.B().Ltrim().Key(storedKey).Start(-HISTORY_MAX_LENGTH).Stop(-1).Build(),
+		vs.client.B().Expire().Key(storedKey).Seconds(int64(HISTORY_TTL.Seconds())).Build(),
+	) {
+		if err := res.Error(); err != nil {
+			return fmt.Errorf("failed to append to history of key %s: %w", key, err)
 		}
-		logger.Debug("Persisted key in Valkey", slog.String("key", key))
-		logger.Debug("Set key in Valkey",
-			slog.String("key", key),
-			slog.String("url", value.Url),
-			slog.String("status", value.Status),
-		)
 	}
-	err = vs.updateTimeIndex(key)
+	return nil
+}
+
+// History returns the status changes of the creative, oldest first.
+func (vs *ValkeyStore) History(key string) ([]structure.StatusChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	entries, err := vs.client.Do(ctx, vs.client.B().Lrange().Key(vs.historyKey(key)).Start(0).Stop(-1).Build()).AsStrSlice()
 	if err != nil {
-		return fmt.Errorf("failed to update time index for key %s: %w", key, err)
+		return nil, fmt.Errorf("failed to get history of key %s: %w", key, err)
 	}
-	return nil
+	history := make([]structure.StatusChange, 0, len(entries))
+	for _, entry := range entries {
+		change := structure.StatusChange{}
+		if err := json.Unmarshal([]byte(entry), &change); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal history of key %s: %w", key, err)
+		}
+		history = append(history, change)
+	}
+	return history, nil
 }
 
 func (vs *ValkeyStore) Ttl(key string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
-	result, err := vs.client.Do(ctx, vs.client.B().Ttl().Key(key).Build()).AsInt64()
+	result, err := vs.client.Do(ctx, vs.client.B().Ttl().Key(vs.jobKey(key)).Build()).AsInt64()
 	if err != nil {
 		logger.Warn("Could not get TTL from valkey", slog.String("key", key), slog.String("err", err.Error()))
 		return 0, err
@@ -183,161 +573,1001 @@ func (vs *ValkeyStore) EnqueuePackagingJob(queueName string, packagingJob struct
 	return nil
 }
 
-func (vs *ValkeyStore) BlackList(value string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	err := vs.client.Do(
-		ctx,
+func (vs *ValkeyStore) BlackList(entry structure.BlacklistEntry) error {
+	if err := vs.BlackListMany([]structure.BlacklistEntry{entry})[0]; err != nil {
+		return err
+	}
+	logger.Info("Added URL to blacklist", slog.String("key", entry.MediaUrl))
+	return nil
+}
+
+// BlackListMany adds the entries in pipelined batches. The returned errors
+// line up with the entries, and are nil for the entries that were added.
+func (vs *ValkeyStore) BlackListMany(entries []structure.BlacklistEntry) []error {
+	errs := make([]error, len(entries))
+	for start := 0; start < len(entries); start += BLACKLIST_BATCH_SIZE {
+		batch := entries[start:min(start+BLACKLIST_BATCH_SIZE, len(entries))]
+		cmds := make(valkey.Commands, 0, 3*len(batch))
+		// The index of the entry each command belongs to
+		owners := make([]int, 0, 3*len(batch))
+		score := float64(time.Now().UnixMilli())
+		for idx, entry := range batch {
+			entryCmds, err := vs.blackListCommands(entry, score)
+			if err != nil {
+				errs[start+idx] = err
+				continue
+			}
+			for range entryCmds {
+				owners = append(owners, start+idx)
+			}
+			cmds = append(cmds, entryCmds...)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for idx, res := range vs.client.DoMulti(ctx, cmds...) {
+			owner := owners[idx]
+			if err := res.Error(); err != nil && errs[owner] == nil {
+				errs[owner] = fmt.Errorf("failed to add key %s to blacklist: %w", entries[owner].MediaUrl, err)
+			}
+		}
+		cancel()
+	}
+	return errs
+}
+
+func (vs *ValkeyStore) blackListCommands(entry structure.BlacklistEntry, score float64) (valkey.Commands, error) {
+	value := entry.MediaUrl
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal blacklist entry for %s: %w", value, err)
+	}
+	cmds := valkey.Commands{
 		vs.client.B().
 			Zadd().
-			Key(BLACKLIST_KEY).
+			Key(vs.key(BLACKLIST_KEY)).
 			ScoreMember().
-			ScoreMember(float64(time.Now().UnixMilli()), value).
-			Build()).
-		Error()
+			ScoreMember(score, value).
+			Build(),
+		vs.client.B().
+			Hset().
+			Key(vs.key(BLACKLIST_ENTRIES_KEY)).
+			FieldValue().
+			FieldValue(value, string(serialized)).
+			Build(),
+	}
+	if entry.ExpiresAt > 0 {
+		cmds = append(cmds, vs.client.B().
+			Zadd().
+			Key(vs.key(BLACKLIST_EXPIRY_KEY)).
+			ScoreMember().
+			ScoreMember(float64(entry.ExpiresAt), value).
+			Build())
+	} else {
+		// The entry may have been temporary before
+		cmds = append(cmds, vs.client.B().Zrem().Key(vs.key(BLACKLIST_EXPIRY_KEY)).Member(value).Build())
+	}
+	return cmds, nil
+}
+
+func (vs *ValkeyStore) InBlackList(value string) (bool, error) {
+	results, err := vs.InBlackListMany([]string{value})
 	if err != nil {
-		return fmt.Errorf("failed to add key %s to blacklist: %w", value, err)
+		return false, err
+	}
+	return results[value], nil
+}
+
+// InBlackListMany checks several values against the blacklist, pipelining
+// the lookups so that they only cost a single round trip.
+func (vs *ValkeyStore) InBlackListMany(values []string) (map[string]bool, error) {
+	results := make(map[string]bool, len(values))
+	if len(values) == 0 {
+		return results, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cmds := make(valkey.Commands, 0, 2*len(values))
+	for _, value := range values {
+		cmds = append(cmds,
+			vs.client.B().Zscore().Key(vs.key(BLACKLIST_KEY)).Member(value).Build(),
+			vs.client.B().Zscore().Key(vs.key(BLACKLIST_EXPIRY_KEY)).Member(value).Build(),
+		)
+	}
+	now := time.Now().Unix()
+	res := vs.client.DoMulti(ctx, cmds...)
+	for idx, value := range values {
+		_, err := res[2*idx].AsFloat64()
+		if err != nil && !errors.Is(err, valkey.Nil) {
+			return nil, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+		}
+		blacklisted := err == nil
+		expiresAt, err := res[2*idx+1].AsFloat64()
+		if err != nil && !errors.Is(err, valkey.Nil) {
+			return nil, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+		}
+		if err == nil && int64(expiresAt) <= now {
+			blacklisted = false // Expired, but not pruned yet
+		}
+		results[value] = blacklisted
 	}
-	logger.Info("Added URL to blacklist", slog.String("key", value))
+	return results, nil
+}
+
+func (vs *ValkeyStore) RemoveFromBlackList(value string) error {
+	if err := vs.RemoveFromBlackListMany([]string{value})[0]; err != nil {
+		return err
+	}
+	logger.Info("Removed URL from blacklist", slog.String("key", value))
 	return nil
 }
 
-func (vs *ValkeyStore) InBlackList(value string) (bool, error) {
+// RemoveFromBlackListMany removes the values in pipelined batches. The
+// returned errors line up with the values. Removing a value that is not
+// blacklisted is not an error.
+func (vs *ValkeyStore) RemoveFromBlackListMany(values []string) []error {
+	errs := make([]error, len(values))
+	for start := 0; start < len(values); start += BLACKLIST_BATCH_SIZE {
+		batch := values[start:min(start+BLACKLIST_BATCH_SIZE, len(values))]
+		cmds := make(valkey.Commands, 0, 3*len(batch))
+		for _, value := range batch {
+			cmds = append(cmds,
+				vs.client.B().Zrem().Key(vs.key(BLACKLIST_KEY)).Member(value).Build(),
+				vs.client.B().Hdel().Key(vs.key(BLACKLIST_ENTRIES_KEY)).Field(value).Build(),
+				vs.client.B().Zrem().Key(vs.key(BLACKLIST_EXPIRY_KEY)).Member(value).Build(),
+			)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for idx, res := range vs.client.DoMulti(ctx, cmds...) {
+			owner := start + idx/3
+			if err := res.Error(); err != nil && errs[owner] == nil {
+				errs[owner] = fmt.Errorf("failed to remove key %s from blacklist: %w", values[owner], err)
+			}
+		}
+		cancel()
+	}
+	return errs
+}
+
+func (vs *ValkeyStore) GetBlackListEntries(values []string) (map[string]structure.BlacklistEntry, error) {
+	entries := make(map[string]structure.BlacklistEntry, len(values))
+	if len(values) == 0 {
+		return entries, nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := vs.client.Do(ctx, vs.client.B().Zscore().Key(BLACKLIST_KEY).Member(value).Build()).AsFloat64()
+	serialized, err := vs.client.Do(
+		ctx,
+		vs.client.B().Hmget().Key(vs.key(BLACKLIST_ENTRIES_KEY)).Field(values...).Build(),
+	).ToArray()
 	if err != nil {
-		if errors.Is(err, valkey.Nil) {
-			return false, nil // Key is not in blacklist
+		return nil, fmt.Errorf("failed to get blacklist entries: %w", err)
+	}
+	for idx, res := range serialized {
+		raw, err := res.ToString()
+		if err != nil {
+			continue // Blacklisted without details
 		}
-		return false, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+		entry := structure.BlacklistEntry{}
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal blacklist entry for %s: %w", values[idx], err)
+		}
+		entries[values[idx]] = entry
 	}
-	return true, nil // If score is >= 0, the key is in the blacklist
+	return entries, nil
 }
 
-func (vs *ValkeyStore) RemoveFromBlackList(value string) error {
+func (vs *ValkeyStore) PruneBlackList() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pruned, err := pruneBlackListScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.key(BLACKLIST_KEY), vs.key(BLACKLIST_ENTRIES_KEY), vs.key(BLACKLIST_EXPIRY_KEY)},
+		[]string{strconv.FormatInt(time.Now().Unix(), 10)},
+	).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune blacklist: %w", err)
+	}
+	return pruned, nil
+}
+
+func (vs *ValkeyStore) AddBlackListRule(rule structure.BlacklistRule) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := vs.client.Do(
+	serialized, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blacklist rule %s: %w", rule.Id(), err)
+	}
+	err = vs.client.Do(
 		ctx,
-		vs.client.B().
-			Zrem().
-			Key(BLACKLIST_KEY).
-			Member(value).
-			Build()).
-		Error()
+		vs.client.B().Hset().Key(BLACKLIST_RULES_KEY).FieldValue().FieldValue(rule.Id(), string(serialized)).Build(),
+	).Error()
+	if err != nil {
+		return fmt.Errorf("failed to add blacklist rule %s: %w", rule.Id(), err)
+	}
+	logger.Info("Added blacklist rule", slog.String("rule", rule.Id()))
+	return nil
+}
 
+func (vs *ValkeyStore) RemoveBlackListRule(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := vs.client.Do(ctx, vs.client.B().Hdel().Key(BLACKLIST_RULES_KEY).Field(id).Build()).Error()
 	if err != nil {
-		return fmt.Errorf("failed to remove key %s from blacklist: %w", value, err)
+		return fmt.Errorf("failed to remove blacklist rule %s: %w", id, err)
+	}
+	logger.Info("Removed blacklist rule", slog.String("rule", id))
+	return nil
+}
+
+func (vs *ValkeyStore) GetBlackListRules() ([]structure.BlacklistRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	serialized, err := vs.client.Do(ctx, vs.client.B().Hvals().Key(BLACKLIST_RULES_KEY).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blacklist rules: %w", err)
+	}
+	rules := make([]structure.BlacklistRule, 0, len(serialized))
+	for _, raw := range serialized {
+		rule := structure.BlacklistRule{}
+		if err := json.Unmarshal([]byte(raw), &rule); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal blacklist rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	// Hash order is arbitrary
+	slices.SortFunc(rules, func(a, b structure.BlacklistRule) int {
+		return cmp.Compare(a.Id(), b.Id())
+	})
+	return rules, nil
+}
+
+func (vs *ValkeyStore) AppendAudit(event structure.AuditEvent, maxLength int64) error {
+	return vs.AppendAuditMany([]structure.AuditEvent{event}, maxLength)
+}
+
+// AppendAuditMany appends the events in pipelined batches. Returns the first
+// failure, the other events are still appended.
+func (vs *ValkeyStore) AppendAuditMany(events []structure.AuditEvent, maxLength int64) error {
+	var firstErr error
+	for start := 0; start < len(events); start += BLACKLIST_BATCH_SIZE {
+		batch := events[start:min(start+BLACKLIST_BATCH_SIZE, len(events))]
+		cmds := make(valkey.Commands, 0, len(batch))
+		actions := make([]string, 0, len(batch))
+		for _, event := range batch {
+			cmd, err := vs.auditCommand(event, maxLength)
+			if err != nil {
+				firstErr = cmp.Or(firstErr, err)
+				continue
+			}
+			cmds = append(cmds, cmd)
+			actions = append(actions, event.Action)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for idx, res := range vs.client.DoMulti(ctx, cmds...) {
+			if err := res.Error(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to append audit event %s: %w", actions[idx], err)
+			}
+		}
+		cancel()
+	}
+	return firstErr
+}
+
+func (vs *ValkeyStore) auditCommand(event structure.AuditEvent, maxLength int64) (valkey.Completed, error) {
+	fields := vs.client.B().
+		Xadd().
+		Key(AUDIT_LOG_KEY).
+		Maxlen().
+		Almost().
+		Threshold(strconv.FormatInt(maxLength, 10)).
+		Id("*").
+		FieldValue().
+		FieldValue("actor", event.Actor).
+		FieldValue("action", event.Action).
+		FieldValue("target", event.Target)
+	if len(event.Details) > 0 {
+		details, err := json.Marshal(event.Details)
+		if err != nil {
+			return valkey.Completed{}, fmt.Errorf("failed to marshal audit details: %w", err)
+		}
+		fields = fields.FieldValue("details", string(details))
+	}
+	return fields.Build(), nil
+}
+
+func (vs *ValkeyStore) ListAudit(filter AuditFilter, size int) ([]structure.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start, end := filter.idRange()
+	entries, err := vs.client.Do(
+		ctx,
+		vs.client.B().Xrevrange().Key(AUDIT_LOG_KEY).End(end).Start(start).Count(int64(size)).Build(),
+	).AsXRange()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	events := make([]structure.AuditEvent, 0, len(entries))
+	for _, entry := range entries {
+		// The stream ID is the time the event was added
+		millis, _, _ := parseAuditId(entry.ID)
+		event := structure.AuditEvent{
+			Id:        entry.ID,
+			Timestamp: millis,
+			Actor:     entry.FieldValues["actor"],
+			Action:    entry.FieldValues["action"],
+			Target:    entry.FieldValues["target"],
+		}
+		if details, found := entry.FieldValues["details"]; found {
+			if err := json.Unmarshal([]byte(details), &event.Details); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal details of audit event %s: %w", entry.ID, err)
+			}
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (vs *ValkeyStore) RecordSourceFailure(source string, reason string, window int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	key := SOURCE_FAILURES_KEY_PREFIX + source
+	results := vs.client.DoMulti(ctx,
+		vs.client.B().Hincrby().Key(key).Field("count").Increment(1).Build(),
+		vs.client.B().Hset().Key(key).FieldValue().FieldValue("reason", reason).Build(),
+		// The window starts at the first failure
+		vs.client.B().Expire().Key(key).Seconds(window).Nx().Build(),
+	)
+	for _, res := range results {
+		if err := res.Error(); err != nil {
+			return 0, fmt.Errorf("failed to record failure for source %s: %w", source, err)
+		}
+	}
+	return results[0].AsInt64()
+}
+
+func (vs *ValkeyStore) ClearSourceFailures(source string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := vs.client.Do(ctx, vs.client.B().Del().Key(SOURCE_FAILURES_KEY_PREFIX+source).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("failed to clear failures for source %s: %w", source, err)
 	}
-	logger.Info("Removed URL from blacklist", slog.String("key", value))
 	return nil
 }
 
 func (vs *ValkeyStore) GetBlackList(page int, size int) ([]string, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	start := int64(page * size)
-	end := int64(start + int64(size) - 1)
-	values, err := vs.client.Do(
-		ctx,
+	return vs.pageSortedSet(ctx, BLACKLIST_KEY, page, size)
+}
+
+// Moves the key to the front of the time index, and into the index
+// for its status and the key index. All indexes are updated in a single
+// round trip.
+func (vs *ValkeyStore) updateIndexes(key string, status structure.JobStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	score := float64(time.Now().UnixMilli())
+	cmds := make(valkey.Commands, 0, len(structure.JobStatuses)+3)
+	cmds = append(cmds,
 		vs.client.B().
-			Zrevrange().
-			Key(BLACKLIST_KEY).
-			Start(start).
-			Stop(end).
-			Build()).AsStrSlice()
+			Zadd().
+			Key(vs.key(KEY_INDEX_KEY)).
+			ScoreMember().
+			ScoreMember(0, key).
+			Build(),
+		vs.client.B().
+			Zadd().
+			Key(vs.key(TIME_INDEX_KEY)).
+			ScoreMember().
+			ScoreMember(score, key).
+			Build(),
+		vs.client.B().
+			Zadd().
+			Key(vs.key(statusIndexKey(status))).
+			ScoreMember().
+			ScoreMember(score, key).
+			Build(),
+	)
+	for _, other := range structure.JobStatuses {
+		if other == status {
+			continue
+		}
+		cmds = append(cmds, vs.client.B().Zrem().Key(vs.key(statusIndexKey(other))).Member(key).Build())
+	}
+	for _, res := range vs.client.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return fmt.Errorf("failed to update indexes for key %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (vs *ValkeyStore) deleteFromIndexes(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cmds := make(valkey.Commands, 0, len(structure.JobStatuses)+2)
+	for _, index := range vs.indexKeys() {
+		cmds = append(cmds, vs.client.B().Zrem().Key(index).Member(key).Build())
+	}
+	for _, res := range vs.client.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return fmt.Errorf("failed to delete key %s from indexes: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Returns the stored names of the time index followed by all status indexes
+// and the key index.
+func (vs *ValkeyStore) indexKeys() []string {
+	keys := make([]string, 0, len(structure.JobStatuses)+2)
+	keys = append(keys, vs.key(TIME_INDEX_KEY))
+	for _, status := range structure.JobStatuses {
+		keys = append(keys, vs.key(statusIndexKey(status)))
+	}
+	return append(keys, vs.key(KEY_INDEX_KEY))
+}
+
+// Adds the jobs in the time index to the key index, for the jobs stored by
+// versions that did not maintain it. Safe to run any number of times.
+func (vs *ValkeyStore) BuildKeyIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for offset := int64(0); ; offset += BLACKLIST_BATCH_SIZE {
+		keys, err := vs.client.Do(
+			ctx,
+			vs.client.B().
+				Zrange().
+				Key(vs.key(TIME_INDEX_KEY)).
+				Min(strconv.FormatInt(offset, 10)).
+				Max(strconv.FormatInt(offset+BLACKLIST_BATCH_SIZE-1, 10)).
+				Build()).AsStrSlice()
+		if err != nil {
+			return fmt.Errorf("failed to read time index: %w", err)
+		}
+		if len(keys) > 0 {
+			cmd := vs.client.B().Zadd().Key(vs.key(KEY_INDEX_KEY)).ScoreMember()
+			for _, key := range keys {
+				cmd = cmd.ScoreMember(0, key)
+			}
+			if err = vs.client.Do(ctx, cmd.Build()).Error(); err != nil {
+				return fmt.Errorf("failed to build key index: %w", err)
+			}
+		}
+		if len(keys) < BLACKLIST_BATCH_SIZE {
+			return nil
+		}
+	}
+}
+
+// Returns the members of the index with a creative ID starting with the
+// prefix and a score within the range, newest first. The candidates are
+// looked up in the key index, so only the jobs with the prefix are read.
+func (vs *ValkeyStore) prefixMembers(
+	ctx context.Context,
+	index string,
+	prefix string,
+	minScore float64,
+	maxScore float64,
+) ([]scoredMember, error) {
+	members := []scoredMember{}
+	for offset := int64(0); ; offset += filterBatchSize {
+		keys, err := vs.client.Do(
+			ctx,
+			vs.client.B().
+				Zrangebylex().
+				Key(vs.key(KEY_INDEX_KEY)).
+				Min("["+prefix).
+				// No UTF-8 text contains 0xff, so this is after every key with the prefix
+				Max("("+prefix+"\xff").
+				Limit(offset, filterBatchSize).
+				Build()).AsStrSlice()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keys with prefix %s: %w", prefix, err)
+		}
+		if len(keys) > 0 {
+			scores, err := vs.client.Do(ctx, vs.client.B().Zmscore().Key(vs.key(index)).Member(keys...).Build()).ToArray()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get scores from %s: %w", index, err)
+			}
+			for idx, result := range scores {
+				score, err := result.AsFloat64()
+				if err != nil {
+					continue // Not in the index, e.g. with another status
+				}
+				if score >= minScore && score <= maxScore {
+					members = append(members, scoredMember{score: score, member: keys[idx]})
+				}
+			}
+		}
+		if len(keys) < filterBatchSize {
+			break
+		}
+	}
+	slices.SortFunc(members, func(a, b scoredMember) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(b.member, a.member))
+	})
+	return members, nil
+}
+
+// Returns the jobs of the members in order, leaving out the ones that have
+// expired or don't match the filter, until limit jobs are found. Kept holds
+// the members of the jobs returned.
+func (vs *ValkeyStore) loadMembers(
+	members []scoredMember,
+	filter JobFilter,
+	limit int,
+) ([]structure.TranscodeInfo, []scoredMember, error) {
+	items := make([]structure.TranscodeInfo, 0, min(limit, len(members)))
+	kept := make([]scoredMember, 0, min(limit, len(members)))
+	for start := 0; start < len(members) && len(items) < limit; start += filterBatchSize {
+		batch := members[start:min(start+filterBatchSize, len(members))]
+		keys := make([]string, 0, len(batch))
+		for _, entry := range batch {
+			keys = append(keys, entry.member)
+		}
+		values, err := vs.GetMany(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range batch {
+			value, found := values[entry.member]
+			if found && filter.matches(entry.member, value) && len(items) < limit {
+				items = append(items, value)
+				kept = append(kept, entry)
+			}
+		}
+	}
+	return items, kept, nil
+}
+
+func (vs *ValkeyStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, cardinality, err := vs.pageSortedSet(ctx, TIME_INDEX_KEY, page, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	values, err := vs.GetMany(keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	results := make([]structure.TranscodeInfo, 0, len(keys))
+	for _, key := range keys {
+		if value, found := values[key]; found {
+			results = append(results, value)
+		}
+	}
+	return results, cardinality, nil
+}
+
+// ListFiltered returns the jobs matching the filter, most recently updated
+// first. Status, time range and prefix are looked up in the indexes. The
+// source filter is applied to the remaining candidates in batches. Without
+// a prefix, only the filterScanLimit most recent candidates are read, and
+// the total is -1 if there were more.
+func (vs *ValkeyStore) ListFiltered(filter JobFilter, page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index := TIME_INDEX_KEY
+	if filter.Status != "" {
+		index = statusIndexKey(filter.Status)
+	}
+	minValue, maxValue := filter.scoreRange()
+	minScore, maxScore := formatScore(minValue), formatScore(maxValue)
+	rangeByScore := func(offset int64, count int64) ([]string, error) {
+		keys, err := vs.client.Do(
+			ctx,
+			vs.client.B().
+				Zrevrangebyscore().
+				Key(vs.key(index)).
+				Max(maxScore).
+				Min(minScore).
+				Limit(offset, count).
+				Build()).AsStrSlice()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keys from %s: %w", index, err)
+		}
+		return keys, nil
+	}
+
+	if !filter.needsScan() {
+		keys, err := rangeByScore(int64(page*size), int64(size))
+		if err != nil {
+			return nil, 0, err
+		}
+		total, err := vs.client.Do(
+			ctx,
+			vs.client.B().
+				Zcount().
+				Key(vs.key(index)).
+				Min(minScore).
+				Max(maxScore).
+				Build()).AsInt64()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to count keys in %s: %w", index, err)
+		}
+		values, err := vs.GetMany(keys)
+		if err != nil {
+			return nil, 0, err
+		}
+		results := make([]structure.TranscodeInfo, 0, len(keys))
+		for _, key := range keys {
+			if value, found := values[key]; found {
+				results = append(results, value)
+			}
+		}
+		return results, total, nil
+	}
+
+	skip := page * size
+	if filter.Prefix != "" {
+		members, err := vs.prefixMembers(ctx, index, filter.Prefix, minValue, maxValue)
+		if err != nil {
+			return nil, 0, err
+		}
+		if filter.Source == "" {
+			results, _, err := vs.loadMembers(members[min(skip, len(members)):], filter, size)
+			return results, int64(len(members)), err
+		}
+		// Every job with the prefix is matched against the source to count them
+		results, _, err := vs.loadMembers(members, filter, len(members))
+		if err != nil {
+			return nil, 0, err
+		}
+		return results[min(skip, len(results)):min(skip+size, len(results))], int64(len(results)), nil
+	}
+
+	results := make([]structure.TranscodeInfo, 0, size)
+	total := int64(0)
+	capped := true
+	for offset := int64(0); offset < filterScanLimit; offset += filterBatchSize {
+		keys, err := rangeByScore(offset, filterBatchSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		values, err := vs.GetMany(keys)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, key := range keys {
+			value, found := values[key]
+			if !found || !filter.matches(key, value) {
+				continue
+			}
+			total++
+			if skip > 0 {
+				skip--
+			} else if len(results) < size {
+				results = append(results, value)
+			}
+		}
+		if len(keys) < filterBatchSize {
+			capped = false
+			break
+		}
+	}
+	if capped {
+		total = -1 // The matches past the limit are not counted
+	}
+	return results, total, nil
+}
+
+// ListPage returns a page of the jobs matching the filter. Without a prefix,
+// the source filter reads at most filterScanLimit candidates per page. A
+// page that stops there can be short, or even empty, and its cursor
+// continues from the last candidate read.
+func (vs *ValkeyStore) ListPage(filter JobFilter, cursor *Cursor, size int) (Page[structure.TranscodeInfo], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index := TIME_INDEX_KEY
+	if filter.Status != "" {
+		index = statusIndexKey(filter.Status)
+	}
+	minScore, maxScore := filter.scoreRange()
+	if filter.Prefix != "" {
+		members, err := vs.prefixMembers(ctx, index, filter.Prefix, minScore, maxScore)
+		if err != nil {
+			return Page[structure.TranscodeInfo]{}, err
+		}
+		remaining := make([]scoredMember, 0, len(members))
+		for _, entry := range members {
+			if cursor == nil || cursor.precedes(entry) {
+				remaining = append(remaining, entry)
+			}
+		}
+		if cursor != nil && cursor.Backward {
+			slices.Reverse(remaining)
+		}
+		items, read, err := vs.loadMembers(remaining, filter, size+1)
+		if err != nil {
+			return Page[structure.TranscodeInfo]{}, err
+		}
+		page := newPage(items, read, cursor, size)
+		if filter.Source == "" {
+			page.Total = int64(len(members))
+		}
+		return page, nil
+	}
+	// Without filters that need the job data, most of what is read is kept
+	batchSize, limit := int64(size+1), int64(0)
+	if filter.needsScan() {
+		batchSize, limit = filterBatchSize, filterScanLimit
+	}
+	items, read, stoppedAt, err := scanSortedSet(ctx, vs, index, minScore, maxScore, cursor, size, batchSize, limit,
+		func(batch []scoredMember) ([]structure.TranscodeInfo, []scoredMember, error) {
+			keys := make([]string, 0, len(batch))
+			for _, entry := range batch {
+				keys = append(keys, entry.member)
+			}
+			values, err := vs.GetMany(keys)
+			if err != nil {
+				return nil, nil, err
+			}
+			items := make([]structure.TranscodeInfo, 0, len(batch))
+			kept := make([]scoredMember, 0, len(batch))
+			for _, entry := range batch {
+				value, found := values[entry.member]
+				if found && filter.matches(entry.member, value) {
+					items = append(items, value)
+					kept = append(kept, entry)
+				}
+			}
+			return items, kept, nil
+		},
+	)
+	if err != nil {
+		return Page[structure.TranscodeInfo]{}, err
+	}
+	page := newPage(items, read, cursor, size)
+	if stoppedAt != nil {
+		continueAt(&page, *stoppedAt, cursor)
+	}
+	if !filter.needsScan() {
+		page.Total, err = vs.client.Do(
+			ctx,
+			vs.client.B().
+				Zcount().
+				Key(vs.key(index)).
+				Min(formatScore(minScore)).
+				Max(formatScore(maxScore)).
+				Build()).AsInt64()
+		if err != nil {
+			return page, fmt.Errorf("failed to count keys in %s: %w", index, err)
+		}
+	}
+	return page, nil
+}
+
+func (vs *ValkeyStore) GetBlackListPage(cursor *Cursor, size int) (Page[string], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	items, read, _, err := scanSortedSet(ctx, vs, BLACKLIST_KEY, math.Inf(-1), math.Inf(1), cursor, size, int64(size+1), 0,
+		func(batch []scoredMember) ([]string, []scoredMember, error) {
+			items := make([]string, 0, len(batch))
+			for _, entry := range batch {
+				items = append(items, entry.member)
+			}
+			return items, batch, nil
+		},
+	)
+	if err != nil {
+		return Page[string]{}, err
+	}
+	page := newPage(items, read, cursor, size)
+	page.Total, err = vs.client.Do(ctx, vs.client.B().Zcard().Key(vs.key(BLACKLIST_KEY)).Build()).AsInt64()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get values from blacklist: %w", err)
+		return page, fmt.Errorf("failed to get cardinality of blacklist: %w", err)
+	}
+	return page, nil
+}
+
+// Reads entries from a sorted set within the score range, starting after the
+// cursor and going in its direction, until size+1 entries are kept. Load turns
+// a batch of entries into items, leaving out the ones that should be skipped.
+func scanSortedSet[T any](
+	ctx context.Context,
+	vs *ValkeyStore,
+	key string,
+	minScore float64,
+	maxScore float64,
+	cursor *Cursor,
+	size int,
+	batchSize int64,
+	limit int64,
+	load func(batch []scoredMember) ([]T, []scoredMember, error),
+) ([]T, []scoredMember, *scoredMember, error) {
+	backward := cursor != nil && cursor.Backward
+	if cursor != nil {
+		// Inclusive, since entries sharing the cursor's score may come after it
+		if backward {
+			minScore = max(minScore, cursor.Score)
+		} else {
+			maxScore = min(maxScore, cursor.Score)
+		}
+	}
+	items := make([]T, 0, size+1)
+	read := make([]scoredMember, 0, size+1)
+	for offset := int64(0); len(read) <= size; offset += batchSize {
+		var cmd valkey.Completed
+		if backward {
+			cmd = vs.client.B().
+				Zrangebyscore().
+				Key(vs.key(key)).
+				Min(formatScore(minScore)).
+				Max(formatScore(maxScore)).
+				Withscores().
+				Limit(offset, batchSize).
+				Build()
+		} else {
+			cmd = vs.client.B().
+				Zrevrangebyscore().
+				Key(vs.key(key)).
+				Max(formatScore(maxScore)).
+				Min(formatScore(minScore)).
+				Withscores().
+				Limit(offset, batchSize).
+				Build()
+		}
+		scores, err := vs.client.Do(ctx, cmd).AsZScores()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read from %s: %w", key, err)
+		}
+		batch := make([]scoredMember, 0, len(scores))
+		for _, score := range scores {
+			entry := scoredMember{score: score.Score, member: score.Member}
+			if cursor == nil || cursor.precedes(entry) {
+				batch = append(batch, entry)
+			}
+		}
+		batchItems, kept, err := load(batch)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		remaining := size + 1 - len(read)
+		items = append(items, batchItems[:min(remaining, len(batchItems))]...)
+		read = append(read, kept[:min(remaining, len(kept))]...)
+		if int64(len(scores)) < batchSize {
+			break
+		}
+		if limit > 0 && offset+batchSize >= limit && len(read) <= size {
+			last := scoredMember{score: scores[len(scores)-1].Score, member: scores[len(scores)-1].Member}
+			return items, read, &last, nil
+		}
+	}
+	return items, read, nil, nil
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, -1):
+		return "-inf"
+	case math.IsInf(score, 1):
+		return "+inf"
+	default:
+		return strconv.FormatFloat(score, 'f', -1, 64)
 	}
-	cardinality, err := vs.client.Do(
+}
+
+// Returns keys from the time index that have not been updated since olderThan,
+// oldest first.
+func (vs *ValkeyStore) ListStale(olderThan time.Time, offset int64, count int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := vs.client.Do(
 		ctx,
 		vs.client.B().
-			Zcard().
-			Key(BLACKLIST_KEY).
-			Build()).AsInt64()
+			Zrangebyscore().
+			Key(vs.key(TIME_INDEX_KEY)).
+			Min("-inf").
+			Max("("+strconv.FormatInt(olderThan.UnixMilli(), 10)).
+			Limit(offset, count).
+			Build()).AsStrSlice()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get cardinality of blacklist: %w", err)
+		return nil, fmt.Errorf("failed to get stale keys from time index: %w", err)
 	}
-	return values, cardinality, nil
+	return keys, nil
 }
 
-func (vs *ValkeyStore) updateTimeIndex(key string) error {
+// Deletes a job only if it has not been updated since the cutoff. In cluster
+// mode the job and the indexes live on different nodes, so the job is read
+// first and only deleted if it is unchanged once it has been taken out of
+// the indexes. A callback updating the job in between is then not lost, and
+// indexes the job again.
+func (vs *ValkeyStore) DeleteIfStale(key string, olderThan time.Time) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := vs.client.Do(
+	current, err := vs.client.Do(ctx, vs.client.B().Get().Key(vs.jobKey(key)).Build()).ToString()
+	missing := errors.Is(err, valkey.Nil)
+	if err != nil && !missing {
+		return false, fmt.Errorf("failed to get stale key %s: %w", key, err)
+	}
+	unindexed, err := unindexIfStaleScript.Exec(
 		ctx,
-		vs.client.B().
-			Zadd().
-			Key(TIME_INDEX_KEY).
-			ScoreMember().
-			ScoreMember(float64(time.Now().UnixMilli()), key).
-			Build()).
-		Error()
+		vs.client,
+		vs.indexKeys(),
+		[]string{key, strconv.FormatInt(olderThan.UnixMilli(), 10)},
+	).AsInt64()
 	if err != nil {
-		return fmt.Errorf("failed to update time index for key %s: %w", key, err)
+		return false, fmt.Errorf("failed to delete stale key %s from indexes: %w", key, err)
+	}
+	if unindexed == 0 || missing {
+		return unindexed == 1, nil
 	}
-	return err
+	deleted, err := deleteIfUnchangedScript.Exec(ctx, vs.client, []string{vs.jobKey(key)}, []string{current}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete stale key %s: %w", key, err)
+	}
+	return deleted == 1, nil
 }
 
-func deleteFromTimeIndex(vs *ValkeyStore, key string) error {
+// Acquires a named lock for ttl seconds if no one else holds it.
+// The lock is not released explicitly, it is meant to expire.
+func (vs *ValkeyStore) TryLock(name string, owner string, ttl int64) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := vs.client.Do(
 		ctx,
 		vs.client.B().
-			Zrem().
-			Key(TIME_INDEX_KEY).
-			Member(key).
+			Set().
+			Key(name).
+			Value(owner).
+			Nx().
+			ExSeconds(ttl).
 			Build()).
 		Error()
 	if err != nil {
-		return fmt.Errorf("failed to delete key %s from time index: %w", key, err)
+		if errors.Is(err, valkey.Nil) {
+			return false, nil // Someone else holds the lock
+		}
+		return false, fmt.Errorf("failed to acquire lock %s: %w", name, err)
 	}
-	return err
+	return true, nil
 }
 
-func (vs *ValkeyStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (vs *ValkeyStore) RenewLock(name string, owner string, ttl int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	start := int64(page * size)
-	end := int64(start + int64(size) - 1)
-	keys, err := vs.client.Do(
+	locked, err := renewLockScript.Exec(
 		ctx,
-		vs.client.B().
-			Zrevrange().
-			Key(TIME_INDEX_KEY).
-			Start(start).
-			Stop(end).
-			Build()).AsStrSlice()
+		vs.client,
+		[]string{name},
+		[]string{owner, strconv.FormatInt(ttl, 10)},
+	).AsInt64()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get keys from time index: %w", err)
+		return false, fmt.Errorf("failed to renew lock %s: %w", name, err)
 	}
-	cardinality, err := vs.client.Do(
+	return locked == 1, nil
+}
+
+func (vs *ValkeyStore) PublishInvalidation(message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := vs.client.Do(
 		ctx,
 		vs.client.B().
-			Zcard().
-			Key(TIME_INDEX_KEY).
-			Build()).AsInt64()
+			Publish().
+			Channel(INVALIDATION_CHANNEL).
+			Message(message).
+			Build()).
+		Error()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get cardinality of time index: %w", err)
-	}
-	results := make([]structure.TranscodeInfo, 0, len(keys))
-	mGetRes, err := valkey.MGet(vs.client, ctx, keys)
-	for _, key := range keys {
-		data, ok := mGetRes[key]
-		if !ok {
-			continue // Key does not exist
-		}
-		// TODO: Error handling
-		bytesData, _ := data.AsBytes()
-		var value structure.TranscodeInfo
-		err = json.Unmarshal(bytesData, &value)
-		if err != nil {
-			logger.Error("Failed to unmarshal value from Valkey", slog.String("key", key))
-			continue
-		}
-		results = append(results, value)
+		return fmt.Errorf("failed to publish invalidation %s: %w", message, err)
 	}
-	return results, cardinality, err
+	return nil
+}
+
+func (vs *ValkeyStore) SubscribeInvalidations(ctx context.Context, onMessage func(message string)) error {
+	// Subscribe on a dedicated connection, since servers speaking RESP2
+	// do not allow other commands on a subscribed connection
+	return vs.client.Dedicated(func(client valkey.DedicatedClient) error {
+		return client.Receive(
+			ctx,
+			client.B().Subscribe().Channel(INVALIDATION_CHANNEL).Build(),
+			func(msg valkey.PubSubMessage) {
+				onMessage(msg.Message)
+			},
+		)
+	})
 }
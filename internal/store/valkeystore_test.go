@@ -1,9 +1,13 @@
 package store
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,7 +34,7 @@ func TestMain(m *testing.M) {
 
 func TestValkeyStore(t *testing.T) {
 	is := is.New(t)
-	store, err := NewValkeyStore("redis://" + redisAdress)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
 	is.NoErr(err)
 	testData := structure.TranscodeInfo{
 		Url:         "http://example.com/video/index.m3u8",
@@ -57,7 +61,7 @@ func TestValkeyStore(t *testing.T) {
 
 func TestValkeyStoreTtl(t *testing.T) {
 	is := is.New(t)
-	store, err := NewValkeyStore("redis://" + redisAdress)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
 	is.NoErr(err)
 	testData := structure.TranscodeInfo{
 		Url:         "http://example.com/video/index.m3u8",
@@ -87,7 +91,7 @@ func TestValkeyStoreTtl(t *testing.T) {
 
 func TestQueuePackagingJob(t *testing.T) {
 	is := is.New(t)
-	store, err := NewValkeyStore("redis://" + redisAdress)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
 	is.NoErr(err)
 
 	packagingJob := structure.PackagingQueueMessage{
@@ -101,10 +105,10 @@ func TestQueuePackagingJob(t *testing.T) {
 
 func TestBlackList(t *testing.T) {
 	is := is.New(t)
-	store, err := NewValkeyStore("redis://" + redisAdress)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
 	is.NoErr(err)
 
-	err = store.BlackList("test-key")
+	err = store.BlackList(structure.BlacklistEntry{MediaUrl: "test-key"})
 	is.NoErr(err)
 
 	inBlackList, err := store.InBlackList("test-key")
@@ -125,9 +129,222 @@ func TestBlackList(t *testing.T) {
 
 }
 
+func TestBlackListEntries(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	now := time.Now()
+	is.NoErr(store.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "http://example.com/broken.mp4",
+		Reason:    "corrupt source",
+		Actor:     "ops",
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}))
+	is.NoErr(store.BlackList(structure.BlacklistEntry{
+		MediaUrl:  "http://example.com/expired.mp4",
+		ExpiresAt: now.Add(-time.Minute).Unix(),
+	}))
+	is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/forever.mp4"}))
+
+	results, err := store.InBlackListMany([]string{
+		"http://example.com/broken.mp4",
+		"http://example.com/expired.mp4",
+		"http://example.com/forever.mp4",
+	})
+	is.NoErr(err)
+	is.True(results["http://example.com/broken.mp4"])
+	is.True(!results["http://example.com/expired.mp4"]) // Expired, even before pruning
+	is.True(results["http://example.com/forever.mp4"])
+
+	entries, err := store.GetBlackListEntries([]string{"http://example.com/broken.mp4", "http://example.com/unknown.mp4"})
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries["http://example.com/broken.mp4"].Reason, "corrupt source")
+	is.Equal(entries["http://example.com/broken.mp4"].Actor, "ops")
+	is.Equal(entries["http://example.com/broken.mp4"].ExpiresAt, now.Add(time.Hour).Unix())
+
+	pruned, err := store.PruneBlackList()
+	is.NoErr(err)
+	is.Equal(pruned, []string{"http://example.com/expired.mp4"})
+	_, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	entries, err = store.GetBlackListEntries([]string{"http://example.com/expired.mp4"})
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+
+	// Blacklisting again without an expiry makes the entry permanent
+	is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/broken.mp4"}))
+	pruned, err = store.PruneBlackList()
+	is.NoErr(err)
+	is.Equal(len(pruned), 0)
+	inBlackList, err := store.InBlackList("http://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(inBlackList)
+}
+
+func TestBlackListRules(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	hostRule := structure.BlacklistRule{Type: structure.RuleHost, Pattern: "bad-cdn.example.com", Reason: "broken CDN"}
+	keyRule := structure.BlacklistRule{Type: structure.RuleCreativeKey, Pattern: "badcreative"}
+	is.NoErr(store.AddBlackListRule(hostRule))
+	is.NoErr(store.AddBlackListRule(keyRule))
+	hostRule.Reason = "still broken"
+	is.NoErr(store.AddBlackListRule(hostRule)) // Replaces the first rule
+
+	rules, err := store.GetBlackListRules()
+	is.NoErr(err)
+	is.Equal(rules, []structure.BlacklistRule{keyRule, hostRule})
+
+	is.NoErr(store.RemoveBlackListRule(keyRule.Id()))
+	rules, err = store.GetBlackListRules()
+	is.NoErr(err)
+	is.Equal(rules, []structure.BlacklistRule{hostRule})
+}
+
+func TestBlackListMany(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	// More than one pipeline
+	entries := make([]structure.BlacklistEntry, 0, BLACKLIST_BATCH_SIZE+10)
+	values := make([]string, 0, cap(entries))
+	for idx := range cap(entries) {
+		value := "http://example.com/" + strconv.Itoa(idx) + ".mp4"
+		entries = append(entries, structure.BlacklistEntry{MediaUrl: value, Reason: "bulk"})
+		values = append(values, value)
+	}
+	entries[3].ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	for _, err := range store.BlackListMany(entries) {
+		is.NoErr(err)
+	}
+	_, total, err := store.GetBlackList(0, 1)
+	is.NoErr(err)
+	is.Equal(total, int64(len(entries)))
+	blacklisted, err := store.InBlackListMany(values[:5])
+	is.NoErr(err)
+	is.True(blacklisted[values[0]])
+	is.True(!blacklisted[values[3]]) // Expired
+	stored, err := store.GetBlackListEntries([]string{values[len(values)-1]})
+	is.NoErr(err)
+	is.Equal(stored[values[len(values)-1]].Reason, "bulk")
+
+	for _, err := range store.RemoveFromBlackListMany(append(values[1:], "http://example.com/unknown.mp4")) {
+		is.NoErr(err)
+	}
+	fullBlacklist, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(1))
+	is.Equal(fullBlacklist, []string{values[0]})
+	pruned, err := store.PruneBlackList()
+	is.NoErr(err)
+	is.Equal(len(pruned), 0) // The expiry went with the entry
+}
+
+func TestAuditLog(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	start := time.Now().Add(-time.Second)
+	for _, target := range []string{"a", "b", "c"} {
+		is.NoErr(store.AppendAudit(structure.AuditEvent{
+			Actor:   "ops",
+			Action:  "blacklist.add",
+			Target:  target,
+			Details: map[string]string{"reason": "broken " + target},
+		}, 100))
+	}
+	is.NoErr(store.AppendAudit(structure.AuditEvent{Actor: "ops", Action: "job.delete", Target: "d"}, 100))
+
+	events, err := store.ListAudit(AuditFilter{}, 3)
+	is.NoErr(err)
+	is.Equal(len(events), 3)
+	is.Equal(events[0].Target, "d") // Newest first
+	is.Equal(len(events[0].Details), 0)
+	is.Equal(events[1].Details["reason"], "broken c")
+	is.Equal(events[2].Actor, "ops")
+	is.True(events[2].Timestamp >= start.UnixMilli())
+	is.True(IsAuditId(events[2].Id))
+
+	events, err = store.ListAudit(AuditFilter{Before: events[2].Id}, 3)
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.Equal(events[0].Target, "a")
+
+	events, err = store.ListAudit(AuditFilter{Since: time.Now().Add(time.Hour)}, 10)
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+	events, err = store.ListAudit(AuditFilter{Since: start, Until: time.Now().Add(time.Second)}, 10)
+	is.NoErr(err)
+	is.Equal(len(events), 4)
+
+	is.NoErr(store.AppendAuditMany([]structure.AuditEvent{
+		{Actor: "ops", Action: "blacklist.remove", Target: "e"},
+		{Actor: "ops", Action: "blacklist.remove", Target: "f"},
+	}, 100))
+	events, err = store.ListAudit(AuditFilter{}, 2)
+	is.NoErr(err)
+	is.Equal(events[0].Target, "f") // Appended in order
+	is.Equal(events[1].Target, "e")
+}
+
+func TestGetMany(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	for i := range 3 {
+		err = store.Set("many-key-"+strconv.Itoa(i), structure.TranscodeInfo{
+			Url:    "http://example.com/video/" + strconv.Itoa(i) + "/index.m3u8",
+			Status: "COMPLETED",
+		})
+		is.NoErr(err)
+	}
+	results, err := store.GetMany([]string{"many-key-0", "many-key-2", "missing-key"})
+	is.NoErr(err)
+	is.Equal(len(results), 2)
+	is.Equal(results["many-key-0"].Url, "http://example.com/video/0/index.m3u8")
+	is.Equal(results["many-key-2"].Url, "http://example.com/video/2/index.m3u8")
+	_, found := results["missing-key"]
+	is.True(!found)
+
+	results, err = store.GetMany(nil)
+	is.NoErr(err)
+	is.Equal(len(results), 0)
+}
+
+func TestInBlackListMany(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/broken.mp4"}))
+	results, err := store.InBlackListMany([]string{
+		"http://example.com/broken.mp4",
+		"http://example.com/fine.mp4",
+	})
+	is.NoErr(err)
+	is.Equal(len(results), 2)
+	is.True(results["http://example.com/broken.mp4"])
+	is.True(!results["http://example.com/fine.mp4"])
+}
+
 func TestList(t *testing.T) {
 	is := is.New(t)
-	store, err := NewValkeyStore("redis://" + redisAdress)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
 	is.NoErr(err)
 
 	// Add some test data
@@ -166,3 +383,490 @@ func TestList(t *testing.T) {
 	is.Equal(len(results), 0)
 	is.Equal(cardinality, int64(0))
 }
+
+func TestStaleJobs(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	for i := range 3 {
+		err = store.Set("stale-key-"+strconv.Itoa(i), structure.TranscodeInfo{Status: "QUEUED"})
+		is.NoErr(err)
+	}
+	stale, err := store.ListStale(time.Now().Add(-time.Hour), 0, 10)
+	is.NoErr(err)
+	is.Equal(len(stale), 0)
+
+	cutoff := time.Now().Add(time.Second)
+	stale, err = store.ListStale(cutoff, 0, 2)
+	is.NoErr(err)
+	is.Equal(stale, []string{"stale-key-0", "stale-key-1"})
+	stale, err = store.ListStale(cutoff, 2, 2)
+	is.NoErr(err)
+	is.Equal(stale, []string{"stale-key-2"})
+
+	deleted, err := store.DeleteIfStale("stale-key-0", time.Now().Add(-time.Hour))
+	is.NoErr(err)
+	is.True(!deleted) // Updated after the cutoff
+	deleted, err = store.DeleteIfStale("stale-key-0", cutoff)
+	is.NoErr(err)
+	is.True(deleted)
+	_, found, err := store.Get("stale-key-0")
+	is.NoErr(err)
+	is.True(!found)
+
+	for i := 1; i < 3; i++ {
+		is.NoErr(store.Delete("stale-key-" + strconv.Itoa(i)))
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	locked, err := store.TryLock("test-lock", "instance-a", 10)
+	is.NoErr(err)
+	is.True(locked)
+	locked, err = store.TryLock("test-lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(!locked) // Held by instance-a
+	minir.FastForward(11 * time.Second)
+	locked, err = store.TryLock("test-lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(locked)
+}
+
+func TestRenewLock(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	locked, err := store.RenewLock("leader-lock", "instance-a", 10)
+	is.NoErr(err)
+	is.True(locked)
+	minir.FastForward(6 * time.Second)
+	locked, err = store.RenewLock("leader-lock", "instance-a", 10)
+	is.NoErr(err)
+	is.True(locked) // Renewed by the holder
+	locked, err = store.RenewLock("leader-lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(!locked) // Held by instance-a
+	minir.FastForward(6 * time.Second)
+	locked, err = store.TryLock("leader-lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(!locked) // Still held, since it was renewed
+	minir.FastForward(5 * time.Second)
+	locked, err = store.RenewLock("leader-lock", "instance-b", 10)
+	is.NoErr(err)
+	is.True(locked)
+}
+
+func TestClaim(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	claimed, err := store.Claim("claim-key", structure.TranscodeInfo{Status: "QUEUED"}, 10)
+	is.NoErr(err)
+	is.True(claimed)
+	claimed, err = store.Claim("claim-key", structure.TranscodeInfo{Status: "QUEUED"}, 10)
+	is.NoErr(err)
+	is.True(!claimed) // Already claimed
+	ttl, err := store.Ttl("claim-key")
+	is.NoErr(err)
+	is.True(ttl > 0)
+
+	minir.FastForward(11 * time.Second) // The claim expires if never followed up
+	claimed, err = store.Claim("claim-key", structure.TranscodeInfo{Status: "QUEUED"}, 10)
+	is.NoErr(err)
+	is.True(claimed)
+	is.NoErr(store.Delete("claim-key"))
+}
+
+func TestSourceFailures(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+	source := "http://example.com/broken.mp4"
+	for expected := range int64(3) {
+		count, err := store.RecordSourceFailure(source, "no audio", 60)
+		is.NoErr(err)
+		is.Equal(count, expected+1)
+	}
+	is.Equal(minir.HGet(SOURCE_FAILURES_KEY_PREFIX+source, "reason"), "no audio")
+
+	// Failures are forgotten once the window since the first one has passed,
+	// even if there were more in between
+	minir.FastForward(40 * time.Second)
+	count, err := store.RecordSourceFailure(source, "no audio", 60)
+	is.NoErr(err)
+	is.Equal(count, int64(4))
+	minir.FastForward(21 * time.Second)
+	count, err = store.RecordSourceFailure(source, "no audio", 60)
+	is.NoErr(err)
+	is.Equal(count, int64(1))
+
+	is.NoErr(store.ClearSourceFailures(source))
+	count, err = store.RecordSourceFailure(source, "no audio", 60)
+	is.NoErr(err)
+	is.Equal(count, int64(1))
+}
+
+func TestStatusTransitions(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	claimed, err := store.Claim("ad", structure.TranscodeInfo{Status: structure.StatusQueued, LastUpdate: 1}, 10)
+	is.NoErr(err)
+	is.True(claimed)
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 10, LastUpdate: 2}))
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 50, LastUpdate: 3}))
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusPackaging, LastUpdate: 4}))
+	is.NoErr(store.Set("ad", structure.TranscodeInfo{Status: structure.StatusCompleted, LastUpdate: 5}))
+
+	var transitionErr *structure.IllegalTransitionError
+	err = store.Set("ad", structure.TranscodeInfo{Status: structure.StatusInProgress, Progress: 90})
+	is.True(errors.As(err, &transitionErr))
+	is.Equal(transitionErr.From, structure.StatusCompleted)
+	is.Equal(transitionErr.To, structure.StatusInProgress)
+	value, _, err := store.Get("ad")
+	is.NoErr(err)
+	is.Equal(value.Status, structure.StatusCompleted)
+	ttl, err := store.Ttl("ad")
+	is.NoErr(err)
+	is.Equal(ttl, int64(-1)) // The claim TTL is gone once the job is stored
+
+	// Entries stored by earlier versions, without a known status, can be replaced
+	is.NoErr(minir.Set("legacy", `{"url":"http://example.com/index.m3u8"}`))
+	is.NoErr(store.Set("legacy", structure.TranscodeInfo{Status: structure.StatusQueued}, 10))
+	ttl, err = store.Ttl("legacy")
+	is.NoErr(err)
+	is.Equal(ttl, int64(10))
+
+	// Progress updates don't add to the history, and the history outlives the job
+	is.NoErr(store.Delete("ad"))
+	history, err := store.History("ad")
+	is.NoErr(err)
+	is.Equal(len(history), 4)
+	is.Equal(history[0], structure.StatusChange{Status: structure.StatusQueued, Time: 1})
+	is.Equal(history[1].Time, int64(2))
+	is.Equal(history[3].Status, structure.StatusCompleted)
+	is.True(minir.TTL(HISTORY_KEY_PREFIX+"ad") > 0)
+
+	history, err = store.History("missing")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+}
+
+// Miniredis answers CLUSTER SLOTS as a single node cluster owning every slot,
+// which is enough to make the client run in cluster mode.
+func TestClusterMode(t *testing.T) {
+	is := is.New(t)
+	mr, err := miniredis.Run()
+	is.NoErr(err)
+	defer mr.Close()
+	store, err := NewValkeyStore("redis://"+mr.Addr(), true)
+	is.NoErr(err)
+
+	for i := range 5 {
+		is.NoErr(store.Set("cluster-key-"+strconv.Itoa(i), structure.TranscodeInfo{
+			Url:    "http://example.com/" + strconv.Itoa(i) + ".m3u8",
+			Status: "COMPLETED",
+		}))
+	}
+	claimed, err := store.Claim("cluster-claim", structure.TranscodeInfo{Status: "QUEUED"}, 60)
+	is.NoErr(err)
+	is.True(claimed)
+	is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "http://example.com/broken.mp4"}))
+	locked, err := store.TryLock("cluster-lock", "instance", 60)
+	is.NoErr(err)
+	is.True(locked)
+	is.NoErr(store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job-id"}))
+
+	// Jobs are spread over the cluster, the indexes and the blacklist share a slot
+	keys := mr.Keys()
+	is.True(slices.Contains(keys, "{cluster-key-0}"))
+	is.True(slices.Contains(keys, HISTORY_KEY_PREFIX+"{cluster-key-0}"))
+	is.True(slices.Contains(keys, "{cluster-claim}"))
+	is.True(slices.Contains(keys, CLUSTER_HASH_TAG+TIME_INDEX_KEY))
+	is.True(slices.Contains(keys, CLUSTER_HASH_TAG+BLACKLIST_KEY))
+	is.True(slices.Contains(keys, "cluster-lock"))
+	is.True(slices.Contains(keys, "package"))
+	for _, key := range keys {
+		if strings.HasPrefix(key, CLUSTER_HASH_TAG) {
+			is.True(strings.HasPrefix(key, CLUSTER_HASH_TAG+"job_") || strings.HasPrefix(key, CLUSTER_HASH_TAG+"blacklist")) // only indexes and the blacklist share the tag
+		}
+	}
+	is.NoErr(store.CheckKeyLayout())
+
+	values, total, err := store.List(0, 3)
+	is.NoErr(err)
+	is.Equal(total, int64(6))
+	is.Equal(len(values), 3)
+	results, err := store.GetMany([]string{"cluster-key-0", "cluster-key-4"})
+	is.NoErr(err)
+	is.Equal(len(results), 2)
+	blacklist, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(1))
+	is.Equal(blacklist[0], "http://example.com/broken.mp4")
+
+	deleted, err := store.DeleteIfStale("cluster-key-0", time.Now().Add(time.Second))
+	is.NoErr(err)
+	is.True(deleted)
+	_, found, err := store.Get("cluster-key-0")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestCheckKeyLayout(t *testing.T) {
+	is := is.New(t)
+	mr, err := miniredis.Run()
+	is.NoErr(err)
+	defer mr.Close()
+	standalone, err := NewValkeyStore("redis://"+mr.Addr(), false)
+	is.NoErr(err)
+	cluster, err := NewValkeyStore("redis://"+mr.Addr(), true)
+	is.NoErr(err)
+	is.NoErr(standalone.CheckKeyLayout())
+	is.NoErr(cluster.CheckKeyLayout())
+
+	is.NoErr(standalone.Set("key", structure.TranscodeInfo{Status: "QUEUED"}))
+	is.NoErr(standalone.CheckKeyLayout())
+	is.True(cluster.CheckKeyLayout() != nil) // stored without hash tags
+
+	is.NoErr(standalone.Delete("key"))
+	is.NoErr(cluster.Set("key", structure.TranscodeInfo{Status: "QUEUED"}))
+	is.True(standalone.CheckKeyLayout() != nil) // stored with hash tags
+}
+
+func TestListFiltered(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	set := func(key string, status structure.JobStatus, source string) {
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Status: status, Source: source}))
+		time.Sleep(2 * time.Millisecond) // Keep the time index scores apart
+	}
+	set("adA1", "QUEUED", "https://ads.example.com/a1.mp4")
+	set("adA2", "FAILED", "https://ads.example.com/a2.mp4")
+	set("adB1", "FAILED", "https://other.example.com/b1.mp4")
+	middle := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	set("adB2", "QUEUED", "https://other.example.com/b2.mp4")
+	set("adA1", "COMPLETED", "https://ads.example.com/a1.mp4")
+
+	cases := []struct {
+		name     string
+		filter   JobFilter
+		page     int
+		size     int
+		expected []string
+		total    int64
+	}{
+		{name: "status", filter: JobFilter{Status: "FAILED"}, size: 10, expected: []string{"b1", "a2"}, total: 2},
+		{name: "moved status", filter: JobFilter{Status: "QUEUED"}, size: 10, expected: []string{"b2"}, total: 1},
+		{name: "status page", filter: JobFilter{Status: "FAILED"}, page: 1, size: 1, expected: []string{"a2"}, total: 2},
+		{name: "since", filter: JobFilter{Since: middle}, size: 10, expected: []string{"a1", "b2"}, total: 2},
+		{name: "until", filter: JobFilter{Until: middle}, size: 10, expected: []string{"b1", "a2"}, total: 2},
+		{name: "prefix", filter: JobFilter{Prefix: "adB"}, size: 10, expected: []string{"b2", "b1"}, total: 2},
+		{name: "source", filter: JobFilter{Source: "ads.example.com"}, size: 10, expected: []string{"a1", "a2"}, total: 2},
+		{name: "source page", filter: JobFilter{Source: "example.com"}, page: 1, size: 3, expected: []string{"a2"}, total: 4},
+		{name: "combined", filter: JobFilter{Status: "FAILED", Prefix: "adA"}, size: 10, expected: []string{"a2"}, total: 1},
+		{name: "no match", filter: JobFilter{Status: "PACKAGING"}, size: 10, expected: []string{}, total: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			values, total, err := store.ListFiltered(c.filter, c.page, c.size)
+			is.NoErr(err)
+			is.Equal(total, c.total)
+			sources := make([]string, 0, len(values))
+			for _, value := range values {
+				sources = append(sources, strings.TrimSuffix(value.Source[strings.LastIndex(value.Source, "/")+1:], ".mp4"))
+			}
+			is.Equal(sources, c.expected)
+		})
+	}
+
+	// Removed jobs leave the status indexes too
+	is.NoErr(store.Delete("adA2"))
+	deleted, err := store.DeleteIfStale("adB1", time.Now().Add(time.Second))
+	is.NoErr(err)
+	is.True(deleted)
+	_, total, err := store.ListFiltered(JobFilter{Status: "FAILED"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(0))
+}
+
+func TestCursorPages(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+
+	for i := range 7 {
+		is.NoErr(store.Set("job"+strconv.Itoa(i), structure.TranscodeInfo{Url: strconv.Itoa(i), Status: "COMPLETED"}))
+		is.NoErr(store.BlackList(structure.BlacklistEntry{MediaUrl: "url" + strconv.Itoa(i)}))
+	}
+	// Make some entries share a score, ordered by member among themselves
+	for i := range 7 {
+		score := float64(1000 + i/2)
+		_, _ = minir.ZAdd(TIME_INDEX_KEY, score, "job"+strconv.Itoa(i))
+		_, _ = minir.ZAdd(BLACKLIST_KEY, score, "url"+strconv.Itoa(i))
+	}
+	urls := func(jobs []structure.TranscodeInfo) []string {
+		res := make([]string, 0, len(jobs))
+		for _, job := range jobs {
+			res = append(res, job.Url)
+		}
+		return res
+	}
+
+	first, err := store.ListPage(JobFilter{}, nil, 3)
+	is.NoErr(err)
+	is.Equal(urls(first.Items), []string{"6", "5", "4"})
+	is.Equal(first.Keys, []string{"job6", "job5", "job4"})
+	is.Equal(first.Total, int64(7))
+	is.True(first.Prev == nil)
+
+	// New jobs do not shift the following pages
+	is.NoErr(store.Set("job7", structure.TranscodeInfo{Url: "7", Status: "COMPLETED"}))
+	second, err := store.ListPage(JobFilter{}, first.Next, 3)
+	is.NoErr(err)
+	is.Equal(urls(second.Items), []string{"3", "2", "1"})
+	last, err := store.ListPage(JobFilter{}, second.Next, 3)
+	is.NoErr(err)
+	is.Equal(urls(last.Items), []string{"0"})
+	is.True(last.Next == nil)
+
+	back, err := store.ListPage(JobFilter{}, last.Prev, 3)
+	is.NoErr(err)
+	is.Equal(urls(back.Items), []string{"3", "2", "1"})
+	back, err = store.ListPage(JobFilter{}, back.Prev, 3)
+	is.NoErr(err)
+	is.Equal(urls(back.Items), []string{"6", "5", "4"})
+	is.True(back.Prev != nil) // job7 was added in front
+
+	filtered, err := store.ListPage(JobFilter{Prefix: "job1"}, nil, 3)
+	is.NoErr(err)
+	is.Equal(urls(filtered.Items), []string{"1"})
+	is.Equal(filtered.Keys, []string{"job1"})
+	is.Equal(filtered.Total, int64(1))
+
+	blacklist, err := store.GetBlackListPage(nil, 4)
+	is.NoErr(err)
+	is.Equal(blacklist.Items, []string{"url6", "url5", "url4", "url3"})
+	blacklist, err = store.GetBlackListPage(blacklist.Next, 4)
+	is.NoErr(err)
+	is.Equal(blacklist.Items, []string{"url2", "url1", "url0"})
+	is.True(blacklist.Next == nil)
+	is.Equal(blacklist.Total, int64(7))
+}
+
+func TestFilterScanLimit(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+	defer func(limit int64) { filterScanLimit = limit }(filterScanLimit)
+	filterScanLimit = filterBatchSize
+
+	// Only the oldest job matches, behind a full scan of others
+	add := func(key string, score float64, source string) {
+		serialized, _ := json.Marshal(structure.TranscodeInfo{Url: key, Source: source, Status: "COMPLETED"})
+		is.NoErr(minir.Set(key, string(serialized)))
+		_, _ = minir.ZAdd(TIME_INDEX_KEY, score, key)
+	}
+	add("rare", 1000, "https://rare.example.com/rare.mp4")
+	for i := range filterBatchSize {
+		add("job"+strconv.Itoa(i), float64(2000+i), "https://ads.example.com/"+strconv.Itoa(i)+".mp4")
+	}
+	filter := JobFilter{Source: "rare.example.com"}
+
+	_, total, err := store.ListFiltered(filter, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(-1)) // not counted past the candidates read
+
+	first, err := store.ListPage(filter, nil, 10)
+	is.NoErr(err)
+	is.Equal(len(first.Items), 0)
+	is.True(first.Next != nil) // the scan stopped, there is more to read
+	second, err := store.ListPage(filter, first.Next, 10)
+	is.NoErr(err)
+	is.Equal(second.Keys, []string{"rare"})
+	is.True(second.Next == nil)
+	back, err := store.ListPage(filter, second.Prev, 10)
+	is.NoErr(err)
+	is.Equal(len(back.Items), 0)
+	is.True(back.Next != nil)
+}
+
+func TestPrefixIndex(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, false)
+	is.NoErr(err)
+	defer minir.FlushAll()
+	defer func(limit int64) { filterScanLimit = limit }(filterScanLimit)
+	filterScanLimit = filterBatchSize
+
+	// The oldest jobs match, behind more than the scan limit of others
+	add := func(key string, score float64, status structure.JobStatus) {
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Url: key, Source: "https://ads.example.com/" + key + ".mp4", Status: status}))
+		_, _ = minir.ZAdd(TIME_INDEX_KEY, score, key)
+		_, _ = minir.ZAdd(statusIndexKey(status), score, key)
+	}
+	add("rare1", 1000, "FAILED")
+	add("rare2", 1001, "COMPLETED")
+	add("rare3", 1002, "FAILED")
+	for i := range filterBatchSize + 1 {
+		add("job"+strconv.Itoa(i), float64(2000+i), "FAILED")
+	}
+
+	values, total, err := store.ListFiltered(JobFilter{Prefix: "rare"}, 0, 2)
+	is.NoErr(err)
+	is.Equal(total, int64(3))
+	is.Equal(values[0].Url, "rare3")
+	is.Equal(values[1].Url, "rare2")
+	values, total, err = store.ListFiltered(JobFilter{Prefix: "rare", Status: "FAILED"}, 1, 1)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(values[0].Url, "rare1")
+	values, total, err = store.ListFiltered(JobFilter{Prefix: "rare", Source: "rare2"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(1))
+	is.Equal(values[0].Url, "rare2")
+
+	first, err := store.ListPage(JobFilter{Prefix: "rare"}, nil, 2)
+	is.NoErr(err)
+	is.Equal(first.Keys, []string{"rare3", "rare2"})
+	is.Equal(first.Total, int64(3))
+	second, err := store.ListPage(JobFilter{Prefix: "rare"}, first.Next, 2)
+	is.NoErr(err)
+	is.Equal(second.Keys, []string{"rare1"})
+	is.True(second.Next == nil)
+	back, err := store.ListPage(JobFilter{Prefix: "rare"}, second.Prev, 2)
+	is.NoErr(err)
+	is.Equal(back.Keys, []string{"rare3", "rare2"})
+
+	// Removed jobs leave the key index
+	is.NoErr(store.Delete("rare2"))
+	_, total, err = store.ListFiltered(JobFilter{Prefix: "rare"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+
+	// Jobs indexed before the key index existed are added to it
+	_, _ = minir.ZAdd(TIME_INDEX_KEY, 3000, "rare4")
+	serialized, _ := json.Marshal(structure.TranscodeInfo{Url: "rare4", Status: "COMPLETED"})
+	is.NoErr(minir.Set("rare4", string(serialized)))
+	_, total, err = store.ListFiltered(JobFilter{Prefix: "rare"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.NoErr(store.BuildKeyIndex())
+	values, total, err = store.ListFiltered(JobFilter{Prefix: "rare"}, 0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(3))
+	is.Equal(values[0].Url, "rare4")
+}
@@ -0,0 +1,15 @@
+package structure
+
+// AuditEvent records a change made through the API or a callback.
+type AuditEvent struct {
+	// Assigned by the store, orders the events
+	Id string `json:"id,omitempty"`
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// Who made the change, e.g. the name of an API key
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	// What was changed, e.g. a media URL or a creative ID
+	Target  string            `json:"target,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
@@ -0,0 +1,58 @@
+package structure
+
+import "time"
+
+// BlacklistEntry is a blacklisted media URL, along with why and by whom it
+// was blacklisted.
+type BlacklistEntry struct {
+	MediaUrl string `json:"mediaUrl"`
+	Reason   string `json:"reason,omitempty"`
+	// Who added the entry, e.g. the name of an API key
+	Actor string `json:"actor,omitempty"`
+	// Unix timestamps, ExpiresAt is 0 for entries that do not expire
+	CreatedAt int64 `json:"createdAt,omitempty"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+func (be BlacklistEntry) Expired(now time.Time) bool {
+	return be.ExpiresAt > 0 && be.ExpiresAt <= now.Unix()
+}
+
+// BlacklistRuleType is how the pattern of a blacklist rule is matched.
+type BlacklistRuleType string
+
+const (
+	// The host of the media URL, or any of its subdomains
+	RuleHost BlacklistRuleType = "host"
+	// The media URL without its query string starts with the pattern
+	RulePathPrefix BlacklistRuleType = "pathPrefix"
+	// The media URL matches the pattern, where * matches any characters
+	// and ? matches a single character
+	RuleGlob BlacklistRuleType = "glob"
+	// The media URL matches the regular expression (RE2 syntax)
+	RuleRegex BlacklistRuleType = "regex"
+	// The creative key, as extracted from the ad, equals the pattern
+	RuleCreativeKey BlacklistRuleType = "creativeKey"
+)
+
+var BlacklistRuleTypes = []BlacklistRuleType{RuleHost, RulePathPrefix, RuleGlob, RuleRegex, RuleCreativeKey}
+
+// BlacklistRule blacklists every media URL or creative matching a pattern,
+// rather than a single media URL.
+type BlacklistRule struct {
+	Type      BlacklistRuleType `json:"type"`
+	Pattern   string            `json:"pattern"`
+	Reason    string            `json:"reason,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
+	CreatedAt int64             `json:"createdAt,omitempty"`
+	ExpiresAt int64             `json:"expiresAt,omitempty"`
+}
+
+// Id identifies the rule, so that adding the same rule twice replaces it.
+func (br BlacklistRule) Id() string {
+	return string(br.Type) + ":" + br.Pattern
+}
+
+func (br BlacklistRule) Expired(now time.Time) bool {
+	return br.ExpiresAt > 0 && br.ExpiresAt <= now.Unix()
+}
@@ -1,6 +1,9 @@
 package structure
 
-import "slices"
+import (
+	"net/url"
+	"slices"
+)
 
 type EncoreJob struct {
 	Id                  string         `json:"id,omitempty"`
@@ -9,10 +12,13 @@ type EncoreJob struct {
 	OutputFolder        string         `json:"outputFolder"`
 	BaseName            string         `json:"baseName"`
 	Status              string         `json:"status,omitempty"`
+	Progress            int            `json:"progress,omitempty"`
 	Inputs              []EncoreInput  `json:"inputs,omitempty"`
 	Outputs             []EncoreOutput `json:"output,omitempty"`
 	ProgressCallbackUri string         `json:"progressCallbackUri,omitempty"`
 	Message             string         `json:"message,omitempty"`
+	// Base URL of the Encore instance running the job, not part of the Encore API
+	EncoreUrl string `json:"-"`
 }
 
 func (ep *EncoreJob) GetFrameRates() []float64 {
@@ -40,6 +46,41 @@ func (ep *EncoreJob) HasAudioOutput() bool {
 	return false
 }
 
+// TranscodeJob converts the Encore job to the backend neutral job.
+func (ep *EncoreJob) TranscodeJob() TranscodeJob {
+	job := TranscodeJob{
+		Id:           ep.Id,
+		CreativeId:   ep.ExternalId,
+		Profile:      ep.Profile,
+		Status:       TranscodeStatus(ep.Status),
+		Progress:     ep.Progress,
+		Message:      ep.Message,
+		Location:     ep.EncoreUrl,
+		OutputFolder: ep.OutputFolder,
+		BaseName:     ep.BaseName,
+		HasAudio:     ep.HasAudioOutput(),
+	}
+	if ep.Status == "NEW" {
+		job.Status = TranscodeQueued
+	}
+	if len(ep.Inputs) > 0 {
+		job.Source = ep.Inputs[0].Uri
+	}
+	if ep.EncoreUrl != "" && ep.Id != "" {
+		job.JobUrl, _ = url.JoinPath(ep.EncoreUrl, "encoreJobs", ep.Id)
+	}
+	for _, o := range ep.Outputs {
+		for _, vs := range o.VideoStreams {
+			job.Video = append(job.Video, VideoRendition{
+				Width:     vs.Width,
+				Height:    vs.Height,
+				FrameRate: ParseFrameRate(vs.FrameRate),
+			})
+		}
+	}
+	return job
+}
+
 type EncoreInput struct {
 	Uri       string  `json:"uri"`
 	SeekTo    float64 `json:"seekTo,omitempty"`
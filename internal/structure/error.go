@@ -10,3 +10,19 @@ type AdServerError struct {
 func (e AdServerError) Error() string {
 	return "error " + strconv.Itoa(e.StatusCode) + ": " + e.Message
 }
+
+// Returned when Encore rejects or fails to respond to a request.
+// StatusCode is 0 if no response was received at all.
+type EncoreError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e EncoreError) Error() string {
+	return "encore error " + strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+// Transient errors are worth retrying, since Encore might recover.
+func (e EncoreError) Transient() bool {
+	return e.StatusCode == 0 || e.StatusCode >= 500
+}
@@ -12,6 +12,7 @@ type PackagingFailureBody struct {
 
 type FailMessage struct {
 	JobId string `json:"jobId"`
+	Url   string `json:"url"`
 }
 
 type PackagingQueueMessage struct {
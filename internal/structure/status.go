@@ -0,0 +1,122 @@
+package structure
+
+import (
+	"fmt"
+	"slices"
+)
+
+// JobStatus is the stage a transcoding job is in.
+type JobStatus string
+
+const (
+	StatusQueued     JobStatus = "QUEUED"
+	StatusInProgress JobStatus = "IN_PROGRESS"
+	StatusPackaging  JobStatus = "PACKAGING"
+	StatusCompleted  JobStatus = "COMPLETED"
+	StatusFailed     JobStatus = "FAILED"
+	// The job was stopped because the creative was blacklisted or deleted
+	StatusCancelled JobStatus = "CANCELLED"
+	// The Encore job could not be created, the entry expires when it is time to try again
+	StatusDispatchFailed JobStatus = "DISPATCH_FAILED"
+	// Encore reported a status the normalizer does not know about
+	StatusUnknown JobStatus = "UNKNOWN"
+)
+
+// All statuses a job can be stored with.
+var JobStatuses = []JobStatus{
+	StatusQueued,
+	StatusInProgress,
+	StatusPackaging,
+	StatusCompleted,
+	StatusFailed,
+	StatusCancelled,
+	StatusDispatchFailed,
+	StatusUnknown,
+}
+
+// The statuses a job may move to from each status. Staying in the same
+// status is always allowed, and a job that is not stored may start anywhere,
+// since its earlier stages may have expired or been removed.
+var statusTransitions = map[JobStatus][]JobStatus{
+	StatusQueued: {
+		StatusInProgress,
+		StatusPackaging,
+		StatusCompleted,
+		StatusFailed,
+		StatusCancelled,
+		StatusDispatchFailed,
+		StatusUnknown,
+	},
+	StatusInProgress: {
+		StatusPackaging,
+		StatusCompleted,
+		StatusFailed,
+		StatusCancelled,
+		StatusUnknown,
+	},
+	StatusPackaging: {
+		StatusCompleted,
+		StatusFailed,
+		StatusCancelled,
+	},
+	StatusUnknown: {
+		StatusInProgress,
+		StatusPackaging,
+		StatusCompleted,
+		StatusFailed,
+		StatusCancelled,
+	},
+}
+
+func (s JobStatus) Valid() bool {
+	return slices.Contains(JobStatuses, s)
+}
+
+func (s JobStatus) Terminal() bool {
+	return len(statusTransitions[s]) == 0
+}
+
+// CanTransitionTo returns true if a job in this status may be updated to next.
+func (s JobStatus) CanTransitionTo(next JobStatus) bool {
+	return s == next || slices.Contains(statusTransitions[s], next)
+}
+
+// PreviousStatuses returns the statuses a job may be in before moving to s.
+func (s JobStatus) PreviousStatuses() []JobStatus {
+	previous := []JobStatus{}
+	for _, status := range JobStatuses {
+		if status.CanTransitionTo(s) {
+			previous = append(previous, status)
+		}
+	}
+	return previous
+}
+
+// IllegalTransitionError is returned by the store when an update would move
+// a job backwards, e.g. a late progress callback for a completed job.
+type IllegalTransitionError struct {
+	From JobStatus
+	To   JobStatus
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal status transition from %s to %s", e.From, e.To)
+}
+
+// StatusChange is an entry in the status history of a creative.
+type StatusChange struct {
+	Status JobStatus `json:"status"`
+	// Unix timestamp of the change
+	Time        int64  `json:"time"`
+	EncoreJobId string `json:"encoreJobId,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func StatusChangeFromInfo(info TranscodeInfo) StatusChange {
+	return StatusChange{
+		Status:      info.Status,
+		Time:        info.LastUpdate,
+		EncoreJobId: info.EncoreJobId,
+		Error:       info.Error,
+	}
+}
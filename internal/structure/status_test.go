@@ -0,0 +1,41 @@
+package structure
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	is := is.New(t)
+	cases := []struct {
+		from, to JobStatus
+		allowed  bool
+	}{
+		{from: StatusQueued, to: StatusQueued, allowed: true},
+		{from: StatusQueued, to: StatusInProgress, allowed: true},
+		{from: StatusQueued, to: StatusDispatchFailed, allowed: true},
+		{from: StatusInProgress, to: StatusPackaging, allowed: true},
+		{from: StatusInProgress, to: StatusCompleted, allowed: true},
+		{from: StatusPackaging, to: StatusCompleted, allowed: true},
+		{from: StatusPackaging, to: StatusFailed, allowed: true},
+		{from: StatusInProgress, to: StatusQueued, allowed: false},
+		{from: StatusPackaging, to: StatusInProgress, allowed: false},
+		{from: StatusCompleted, to: StatusInProgress, allowed: false},
+		{from: StatusCompleted, to: StatusPackaging, allowed: false},
+		{from: StatusFailed, to: StatusCompleted, allowed: false},
+		{from: StatusDispatchFailed, to: StatusQueued, allowed: false},
+		{from: StatusInProgress, to: StatusCancelled, allowed: true},
+		{from: StatusPackaging, to: StatusCancelled, allowed: true},
+		{from: StatusCancelled, to: StatusCompleted, allowed: false},
+		{from: StatusCompleted, to: StatusCancelled, allowed: false},
+	}
+	for _, c := range cases {
+		is.Equal(c.from.CanTransitionTo(c.to), c.allowed) // c.from -> c.to
+	}
+	is.True(StatusCompleted.Terminal())
+	is.True(StatusCancelled.Terminal())
+	is.True(!StatusPackaging.Terminal())
+	is.Equal(StatusPackaging.PreviousStatuses(), []JobStatus{StatusQueued, StatusInProgress, StatusPackaging, StatusUnknown})
+	is.True(!JobStatus("DONE").Valid())
+}
@@ -1,12 +1,11 @@
 package structure
 
 import (
-	"fmt"
+	"cmp"
 	"math"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type ManifestAsset struct {
@@ -27,48 +26,38 @@ type TranscodeInfo struct {
 	Url         string    `json:"url"`
 	AspectRatio string    `json:"aspectRatio"`
 	FrameRates  []float64 `json:"frameRates"`
-	Status      string    `json:"status"`
+	Status      JobStatus `json:"status"`
 	Source      string    `json:"source,omitempty"`
 	LastUpdate  int64     `json:"lastUpdate,omitempty"`
 	Error       string    `json:"error,omitempty"`
+	EncoreJobId string    `json:"encoreJobId,omitempty"`
+	// Base URL of the Encore instance running the job
+	EncoreUrl string `json:"encoreUrl,omitempty"`
+	// Transcoding progress in percent, as reported by Encore
+	Progress int    `json:"progress,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	// Unix timestamps for when each stage was reached
+	CreatedAt    int64 `json:"createdAt,omitempty"`
+	TranscodedAt int64 `json:"transcodedAt,omitempty"`
+	PackagedAt   int64 `json:"packagedAt,omitempty"`
 }
 
-func TranscodeInfoFromEncoreJob(job *EncoreJob, jitPackaging bool, assetServerUrl url.URL) (TranscodeInfo, error) {
-	jobStatus := job.GetTranscodeStatus(jitPackaging)
-	if len(job.Outputs) == 0 {
-		return TranscodeInfo{}, fmt.Errorf("no outputs found for job %s", job.Id)
-	}
-	firstVideoStream := job.Outputs[0].VideoStreams[0]
-	width := 1920
-	height := 1080
-	if firstVideoStream.Width != 0 {
-		width = firstVideoStream.Width
-	}
-	if firstVideoStream.Height != 0 {
-		height = firstVideoStream.Height
-	}
-	aspectRatio := calculateAspectRatio(width, height)
-	var vidUrl string
-	if jitPackaging {
-		packageUrl := CreatePackageUrl(
-			assetServerUrl,
-			job.OutputFolder,
-			job.BaseName,
-		)
-		vidUrl = packageUrl.String()
-	}
-	tc := TranscodeInfo{
-		Url:         vidUrl,
-		AspectRatio: aspectRatio,
-		FrameRates:  job.GetFrameRates(),
-		Status:      jobStatus,
-		Source:      job.Inputs[0].Uri,
-		LastUpdate:  time.Now().Unix(),
-	}
-	if job.Message != "" {
-		tc.Error = job.Message
+// KeepHistory copies what is known about the earlier stages of the job from
+// the previously stored info, for when the info is rebuilt from the Encore job.
+func (tc *TranscodeInfo) KeepHistory(previous TranscodeInfo) {
+	if tc.EncoreJobId != previous.EncoreJobId && tc.EncoreJobId != "" && previous.EncoreJobId != "" {
+		return // A different job, nothing to keep
 	}
-	return tc, nil
+	tc.CreatedAt = cmp.Or(tc.CreatedAt, previous.CreatedAt)
+	tc.TranscodedAt = cmp.Or(tc.TranscodedAt, previous.TranscodedAt)
+	tc.PackagedAt = cmp.Or(tc.PackagedAt, previous.PackagedAt)
+	tc.Profile = cmp.Or(tc.Profile, previous.Profile)
+	tc.EncoreUrl = cmp.Or(tc.EncoreUrl, previous.EncoreUrl)
+}
+
+func TranscodeInfoFromEncoreJob(job *EncoreJob, jitPackaging bool, assetServerUrl url.URL) (TranscodeInfo, error) {
+	transcodeJob := job.TranscodeJob()
+	return TranscodeInfoFromJob(&transcodeJob, jitPackaging, assetServerUrl)
 }
 
 type EncoreJobProgress struct {
@@ -78,23 +67,9 @@ type EncoreJobProgress struct {
 	Status     string `json:"status"`
 }
 
-func (ep *EncoreJob) GetTranscodeStatus(jitPackage bool) string {
-	var res string
-	switch ep.Status {
-	case "SUCCESSFUL":
-		if jitPackage {
-			res = "COMPLETED"
-		} else {
-			res = "PACKAGING"
-		}
-	case "FAILED", "CANCELLED":
-		res = "FAILED"
-	case "IN_PROGRESS", "QUEUED", "NEW":
-		res = "IN_PROGRESS"
-	default:
-		res = "UNKNOWN"
-	}
-	return res
+func (ep *EncoreJob) GetTranscodeStatus(jitPackage bool) JobStatus {
+	transcodeJob := ep.TranscodeJob()
+	return transcodeJob.InfoStatus(jitPackage)
 }
 
 func calculateAspectRatio(width, height int) string {
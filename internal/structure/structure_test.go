@@ -50,7 +50,7 @@ func TestTranscodeInfoFromEncoreJob(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(res.AspectRatio, "16:9")
 	is.Equal(res.FrameRates, []float64{25.0})
-	is.Equal(res.Status, "COMPLETED")
+	is.Equal(res.Status, StatusCompleted)
 	is.Equal(res.Url, "http://cdn.osaas.io/assets/1234567890abcdef/test-asset.m3u8")
 }
 
@@ -60,7 +60,7 @@ func TestGetTranscodeStatus(t *testing.T) {
 		name       string
 		job        EncoreJob
 		jitPackage bool
-		expected   string
+		expected   JobStatus
 	}{
 		{
 			name: "Successful Transcode no JIT package",
@@ -94,6 +94,14 @@ func TestGetTranscodeStatus(t *testing.T) {
 			jitPackage: false,
 			expected:   "FAILED",
 		},
+		{
+			name: "Cancelled in Encore",
+			job: EncoreJob{
+				Status: "CANCELLED",
+			},
+			jitPackage: false,
+			expected:   "CANCELLED",
+		},
 		{
 			name: "In progress Transcode",
 			job: EncoreJob{
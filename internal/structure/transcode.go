@@ -0,0 +1,118 @@
+package structure
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// TranscodeStatus is the status of a job in the transcoder backend.
+type TranscodeStatus string
+
+const (
+	TranscodeQueued     TranscodeStatus = "QUEUED"
+	TranscodeInProgress TranscodeStatus = "IN_PROGRESS"
+	TranscodeSuccessful TranscodeStatus = "SUCCESSFUL"
+	TranscodeFailed     TranscodeStatus = "FAILED"
+	TranscodeCancelled  TranscodeStatus = "CANCELLED"
+)
+
+// TranscodeJob is a transcoding job, independent of the backend running it.
+type TranscodeJob struct {
+	Id         string
+	CreativeId string
+	Profile    string
+	Status     TranscodeStatus
+	// Progress in percent
+	Progress int
+	// Why the job failed
+	Message string
+	// URL of the source media
+	Source string
+	// Where the job runs, e.g. the base URL of the Encore instance.
+	// Passed back to the transcoder when looking up the job.
+	Location string
+	// URL the packager fetches the job from
+	JobUrl string
+	// Where the transcoded files are written
+	OutputFolder string
+	BaseName     string
+	Video        []VideoRendition
+	HasAudio     bool
+	// Set by backends that produce a playable HLS playlist themselves,
+	// in which case no packaging is needed
+	PlaylistUrl string
+}
+
+type VideoRendition struct {
+	Width     int
+	Height    int
+	FrameRate float64
+}
+
+func (tj *TranscodeJob) FrameRates() []float64 {
+	frameRates := make([]float64, 0, len(tj.Video))
+	for _, v := range tj.Video {
+		if v.FrameRate != 0 {
+			frameRates = append(frameRates, v.FrameRate)
+		}
+	}
+	// Sorting the slices allows us to use slices.Compact to remove duplicates
+	slices.Sort(frameRates)
+	return slices.Compact(frameRates)
+}
+
+// InfoStatus returns the status the creative is stored with for the job.
+func (tj *TranscodeJob) InfoStatus(jitPackage bool) JobStatus {
+	switch tj.Status {
+	case TranscodeSuccessful:
+		if jitPackage || tj.PlaylistUrl != "" {
+			return StatusCompleted
+		}
+		return StatusPackaging
+	case TranscodeFailed:
+		return StatusFailed
+	case TranscodeCancelled:
+		return StatusCancelled
+	case TranscodeQueued, TranscodeInProgress:
+		return StatusInProgress
+	default:
+		return StatusUnknown
+	}
+}
+
+func TranscodeInfoFromJob(job *TranscodeJob, jitPackaging bool, assetServerUrl url.URL) (TranscodeInfo, error) {
+	if len(job.Video) == 0 {
+		return TranscodeInfo{}, fmt.Errorf("no outputs found for job %s", job.Id)
+	}
+	width := 1920
+	height := 1080
+	if job.Video[0].Width != 0 {
+		width = job.Video[0].Width
+	}
+	if job.Video[0].Height != 0 {
+		height = job.Video[0].Height
+	}
+	vidUrl := job.PlaylistUrl
+	if vidUrl == "" && jitPackaging {
+		packageUrl := CreatePackageUrl(
+			assetServerUrl,
+			job.OutputFolder,
+			job.BaseName,
+		)
+		vidUrl = packageUrl.String()
+	}
+	return TranscodeInfo{
+		Url:         vidUrl,
+		AspectRatio: calculateAspectRatio(width, height),
+		FrameRates:  job.FrameRates(),
+		Status:      job.InfoStatus(jitPackaging),
+		Source:      job.Source,
+		LastUpdate:  time.Now().Unix(),
+		EncoreJobId: job.Id,
+		EncoreUrl:   job.Location,
+		Profile:     job.Profile,
+		Error:       job.Message,
+	}, nil
+}
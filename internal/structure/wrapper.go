@@ -0,0 +1,33 @@
+package structure
+
+import "github.com/Eyevinn/VMAP/vmap"
+
+// The VMAP library only decodes InLine ads, so wrapper ads are read
+// separately from the raw document using these minimal types.
+// Ads are kept in document order so they can be matched by index
+// against the ads decoded by the VMAP library.
+type WrapperVast struct {
+	Ads []WrapperAd `xml:"Ad"`
+}
+
+type WrapperAd struct {
+	Id       string   `xml:"id,attr"`
+	Sequence int      `xml:"sequence,attr"`
+	Wrapper  *Wrapper `xml:"Wrapper"`
+}
+
+type Wrapper struct {
+	VastAdTagUri   string               `xml:"VASTAdTagURI"`
+	Impressions    []vmap.Impression    `xml:"Impression"`
+	Errors         []vmap.Error         `xml:"Error"`
+	TrackingEvents []vmap.TrackingEvent `xml:"Creatives>Creative>Linear>TrackingEvents>Tracking"`
+	ClickTracking  []vmap.ClickTracking `xml:"Creatives>Creative>Linear>VideoClicks>ClickTracking"`
+}
+
+type WrapperVmap struct {
+	AdBreaks []WrapperAdBreak `xml:"AdBreak"`
+}
+
+type WrapperAdBreak struct {
+	Vast *WrapperVast `xml:"AdSource>VASTAdData>VAST"`
+}
@@ -0,0 +1,28 @@
+package transcoder
+
+import "github.com/Eyevinn/ad-normalizer/internal/structure"
+
+// Transcoder runs the transcoding jobs for the creatives, e.g. SVT Encore
+// or a local ffmpeg.
+type Transcoder interface {
+	// Submit starts transcoding the creative.
+	Submit(creative *structure.ManifestAsset) (structure.TranscodeJob, error)
+	// GetJob returns the current state of a job. location is the location
+	// of the job as returned by Submit, or empty if it is not known.
+	GetJob(location string, jobId string) (structure.TranscodeJob, error)
+	// Cancel stops a job that has not finished yet.
+	Cancel(location string, jobId string) error
+}
+
+// Notifier is implemented by transcoders that report job updates
+// in-process, instead of through a callback URL.
+type Notifier interface {
+	Notify(onUpdate func(structure.TranscodeJob))
+}
+
+// Starter is implemented by transcoders whose jobs only run once they are
+// started, so that the caller can record a submitted job before any update
+// about it is reported.
+type Starter interface {
+	Start(jobId string)
+}
@@ -1,11 +1,14 @@
 package util
 
 import (
+	"cmp"
 	"log/slog"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Eyevinn/VMAP/vmap"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
@@ -34,6 +37,9 @@ func GetCreatives(
 ) map[string]structure.ManifestAsset {
 	creatives := make(map[string]structure.ManifestAsset, len(vast.Ad))
 	for _, ad := range vast.Ad {
+		if ad.InLine == nil {
+			continue // Unresolved wrapper, nothing to transcode
+		}
 		mediaFile := GetBestMediaFileFromVastAd(&ad)
 		adId := getKey(keyField, keyRegex, &ad, mediaFile)
 		creatives[adId] = structure.ManifestAsset{
@@ -157,6 +163,9 @@ func ReplaceMediaFiles(
 ) error {
 	newAds := make([]vmap.Ad, 0, len(vast.Ad))
 	for _, ad := range vast.Ad {
+		if ad.InLine == nil {
+			continue
+		}
 		mediaFile := GetBestMediaFileFromVastAd(&ad)
 		adId := getKey(keyField, keyRegex, &ad, mediaFile)
 		if asset, found := assets[adId]; found {
@@ -174,6 +183,65 @@ func ReplaceMediaFiles(
 	return nil
 }
 
+// FitToBreakDuration drops ads from the VAST until the total ad duration fits
+// within the break. Ads are kept in Sequence order, with unsequenced ads last,
+// and an ad is skipped if it would overflow the break or has no known duration.
+// The ads that are kept are numbered 1..n in that order. If a filler ad is
+// present, it is moved to the end to top up what is left of the break. A
+// filler with a known duration is removed if it doesn't fit, and one without
+// is kept as long as there is time left. Its duration is never changed, since
+// that would not change the length of its media.
+func FitToBreakDuration(vast *vmap.VAST, breakDuration time.Duration) {
+	var filler *vmap.Ad
+	ads := make([]vmap.Ad, 0, len(vast.Ad))
+	for _, ad := range vast.Ad {
+		if ad.Id == fillerId {
+			filler = &ad
+			continue
+		}
+		ads = append(ads, ad)
+	}
+	slices.SortStableFunc(ads, func(a, b vmap.Ad) int {
+		// Sequence 0 means the ad is not part of the pod
+		if a.Sequence == 0 || b.Sequence == 0 {
+			return cmp.Compare(b.Sequence, a.Sequence)
+		}
+		return cmp.Compare(a.Sequence, b.Sequence)
+	})
+
+	var total time.Duration
+	fitted := make([]vmap.Ad, 0, len(ads)+1)
+	for _, ad := range ads {
+		duration := getAdDuration(ad).Duration
+		if duration <= 0 || total+duration > breakDuration {
+			logger.Debug("ad does not fit in break, dropping",
+				slog.String("adId", ad.Id),
+				slog.Duration("adDuration", duration),
+				slog.Duration("remaining", breakDuration-total),
+			)
+			continue
+		}
+		total += duration
+		fitted = append(fitted, ad)
+	}
+
+	if filler != nil {
+		duration := getAdDuration(*filler).Duration
+		if total < breakDuration && total+duration <= breakDuration {
+			fitted = append(fitted, *filler)
+		} else {
+			logger.Debug("filler does not fit in break, dropping",
+				slog.Duration("fillerDuration", duration),
+				slog.Duration("remaining", breakDuration-total),
+			)
+		}
+	}
+	for i := range fitted {
+		fitted[i].Sequence = i + 1
+	}
+	vast.Ad = fitted
+}
+
 func CreateOutputUrl(bucket url.URL, folder string) string {
 	newPath := bucket.JoinPath(folder, uuid.New().String(), "/")
 	return newPath.String()
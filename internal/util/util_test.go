@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Eyevinn/VMAP/vmap"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
@@ -103,6 +104,136 @@ func TestCreateFillerAd(t *testing.T) {
 
 }
 
+func TestFitToBreakDuration(t *testing.T) {
+	durationAd := func(id string, sequence int, duration time.Duration) vmap.Ad {
+		ad := defaultAd()
+		ad.Id = id
+		ad.Sequence = sequence
+		ad.InLine.Creatives[0].Linear.Duration = vmap.Duration{Duration: duration}
+		return ad
+	}
+	cases := []struct {
+		name             string
+		ads              []vmap.Ad
+		breakDuration    time.Duration
+		expectedIds      []string
+		expectedFillDur  time.Duration
+		expectFillerLast bool
+	}{
+		{
+			name: "all ads fit",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 10*time.Second),
+				durationAd("b", 2, 15*time.Second),
+			},
+			breakDuration: 30 * time.Second,
+			expectedIds:   []string{"a", "b"},
+		},
+		{
+			name: "reorders by sequence and drops overflowing ads",
+			ads: []vmap.Ad{
+				durationAd("standalone", 0, 5*time.Second),
+				durationAd("b", 2, 15*time.Second),
+				durationAd("a", 1, 10*time.Second),
+				durationAd("c", 3, 10*time.Second),
+			},
+			breakDuration: 20 * time.Second,
+			expectedIds:   []string{"a", "c"},
+		},
+		{
+			name: "ads without duration are dropped",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 0),
+				durationAd("b", 2, 10*time.Second),
+			},
+			breakDuration: 10 * time.Second,
+			expectedIds:   []string{"b"},
+		},
+		{
+			name: "filler fits in the remainder",
+			ads: []vmap.Ad{
+				durationAd(fillerId, 1, 8*time.Second),
+				durationAd("a", 2, 10*time.Second),
+				durationAd("b", 3, 15*time.Second),
+			},
+			breakDuration:    20 * time.Second,
+			expectedIds:      []string{"a", fillerId},
+			expectedFillDur:  8 * time.Second, // the duration of its media is kept
+			expectFillerLast: true,
+		},
+		{
+			name: "filler numbered after the ads that are kept",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 10*time.Second),
+				durationAd("b", 2, 15*time.Second),
+				durationAd("c", 3, 5*time.Second),
+				durationAd(fillerId, 4, 5*time.Second),
+			},
+			breakDuration:    20 * time.Second,
+			expectedIds:      []string{"a", "c", fillerId},
+			expectedFillDur:  5 * time.Second,
+			expectFillerLast: true,
+		},
+		{
+			name: "filler longer than the remainder leaves a gap",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 10*time.Second),
+				durationAd(fillerId, 2, 15*time.Second),
+			},
+			breakDuration: 20 * time.Second,
+			expectedIds:   []string{"a"},
+		},
+		{
+			name: "filler without duration tops up the remainder",
+			ads: []vmap.Ad{
+				CreateFillerAd("http://example.com/filler.mp4", 3),
+				durationAd("a", 1, 10*time.Second),
+				durationAd("b", 2, 15*time.Second),
+			},
+			breakDuration:    20 * time.Second,
+			expectedIds:      []string{"a", fillerId},
+			expectFillerLast: true,
+		},
+		{
+			name: "filler without duration removed when break is full",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 10*time.Second),
+				CreateFillerAd("http://example.com/filler.mp4", 2),
+			},
+			breakDuration: 10 * time.Second,
+			expectedIds:   []string{"a"},
+		},
+		{
+			name: "filler removed when break is full",
+			ads: []vmap.Ad{
+				durationAd("a", 1, 10*time.Second),
+				durationAd(fillerId, 2, 5*time.Second),
+			},
+			breakDuration: 10 * time.Second,
+			expectedIds:   []string{"a"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			is := is.New(t)
+			vast := &vmap.VAST{Ad: c.ads}
+			FitToBreakDuration(vast, c.breakDuration)
+			ids := make([]string, 0, len(vast.Ad))
+			for _, ad := range vast.Ad {
+				ids = append(ids, ad.Id)
+			}
+			is.Equal(ids, c.expectedIds)
+			for i, ad := range vast.Ad {
+				is.Equal(ad.Sequence, i+1) // renumbered without gaps or duplicates
+			}
+			if c.expectFillerLast {
+				filler := vast.Ad[len(vast.Ad)-1]
+				is.Equal(filler.InLine.Creatives[0].Linear.Duration.Duration, c.expectedFillDur)
+			}
+		})
+	}
+}
+
 func TestCreateOutputUrl(t *testing.T) {
 	is := is.New(t)
 	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")